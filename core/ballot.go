@@ -39,6 +39,7 @@ func (bx *BallotBox) Init(opt BallotBoxOptions) {
 	utils.RequireFalse(opt.Waiter == nil || opt.ClosureQueue == nil, "waiter or closureQueue is nil.")
 	bx.waiter = opt.Waiter
 	bx.closureQueue = opt.ClosureQueue
+	bx.pendingMetaQueue = utils.NewSegmentList()
 }
 
 func (bx *BallotBox) ClearPendingTasks() {
@@ -116,7 +117,7 @@ func (bx *BallotBox) SetLastCommittedIndex(lastCommittedIndex int64) (bool, erro
 // [firstLogIndex, lastLogIndex] commit to stable at peer
 func (bx *BallotBox) CommitAt(firstLogIndex, lastLogIndex int64, peer entity.PeerId) bool {
 	r := bx.innerCommitAt(firstLogIndex, lastLogIndex, peer)
-	bx.waiter.OnCommitted(bx.lastCommittedIndex)
+	bx.waiter.OnCommitted(bx.GetLastCommittedIndex())
 	return r
 }
 
@@ -131,7 +132,7 @@ func (bx *BallotBox) innerCommitAt(firstLogIndex, lastLogIndex int64, peer entit
 	if lastLogIndex < bx.pendingIndex {
 		return true
 	}
-	if lastLogIndex > bx.pendingIndex+int64(bx.pendingMetaQueue.Size()) {
+	if lastLogIndex >= bx.pendingIndex+int64(bx.pendingMetaQueue.Size()) {
 		panic(utils.ErrArrayOutOfBound)
 	}
 
@@ -0,0 +1,297 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/rpc"
+	"github.com/pole-group/lraft/utils"
+)
+
+//cliRequestHandlers CliService 发出的运维命令与处理函数的对应关系，和 raftRequestHandlers 一样由节点自己或者 NodeManager 注册
+var cliRequestHandlers = map[string]raftRequestHandler{
+	rpc.CliAddPeerRequest:        (*raftRpcHandler).handleAddPeerRequest,
+	rpc.CliRemovePeerRequest:     (*raftRpcHandler).handleRemovePeerRequest,
+	rpc.CliChangePeersRequest:    (*raftRpcHandler).handleChangePeersRequest,
+	rpc.CliResetPeersRequest:     (*raftRpcHandler).handleResetPeersRequest,
+	rpc.CliAddLearnerRequest:     (*raftRpcHandler).handleAddLearnersRequest,
+	rpc.CliRemoveLearnersRequest: (*raftRpcHandler).handleRemoveLearnersRequest,
+	rpc.CliResetLearnersRequest:  (*raftRpcHandler).handleResetLearnersRequest,
+	rpc.CliGetLeaderRequest:      (*raftRpcHandler).handleGetLeaderRequest,
+	rpc.CliGetPeersRequest:       (*raftRpcHandler).handleGetPeersRequest,
+	rpc.CliTransferLeaderRequest: (*raftRpcHandler).handleTransferLeaderRequest,
+	rpc.CliSnapshotRequest:       (*raftRpcHandler).handleSnapshotRequest,
+}
+
+//cliResponseClosure 节点执行完运维命令之后回复请求方，成功时回复 resp，失败时回复对应的错误码
+type cliResponseClosure struct {
+	done    *RpcRequestClosure
+	command string
+	resp    proto.Message
+}
+
+func (crc *cliResponseClosure) Run(status entity.Status) {
+	if !status.IsOK() {
+		crc.done.Run(status)
+		return
+	}
+	crc.done.SendProtoResponse(crc.command, crc.resp)
+}
+
+//handleCliRequest 节点关闭了 Cli 服务或者请求不是发给当前节点的时候直接回复错误，否则交给 handler 处理
+func (rrh *raftRpcHandler) handleCliRequest(handler raftRequestHandler, ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	node := rrh.node
+	if node.options.DisableCli {
+		rpcCtx.Send(rpc.NewErrorServerResponse(entity.EPERM, fmt.Sprintf("Cli service of node %s is disabled.",
+			node.nodeID.GetDesc())))
+		return
+	}
+	if groupID, peerID, ok := requestTarget(req); ok {
+		peer := entity.PeerId{}
+		if groupID != node.groupID || (peerID != "" && (!peer.Parse(peerID) || !peer.Equal(node.serverID))) {
+			rpcCtx.Send(rpc.NewErrorServerResponse(entity.ENOENT, fmt.Sprintf("Peer %s not found in group %s.",
+				peerID, groupID)))
+			return
+		}
+	}
+	handler(rrh, ctx, req, rpcCtx)
+}
+
+//leaderConf 修改配置的运维命令只能由 Leader 处理，其他节点回复 EPERM，CliService 收到之后重新查找 Leader
+func (rrh *raftRpcHandler) leaderConf() (*entity.Configuration, entity.Status) {
+	peers, err := rrh.node.ListPeers()
+	if err != nil {
+		return nil, entity.NewStatus(entity.EPERM, err.Error())
+	}
+	learners, err := rrh.node.ListLearners()
+	if err != nil {
+		return nil, entity.NewStatus(entity.EPERM, err.Error())
+	}
+	return entity.NewConfiguration(peers, learners), entity.StatusOK()
+}
+
+//handleAddPeerRequest 向集群中加入节点，成员变更完成之后回复变更前后的 peers
+func (rrh *raftRpcHandler) handleAddPeerRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	addReq := req.(*raft.AddPeerRequest)
+	done := NewRpcRequestClosure(rpcCtx)
+	peer := entity.PeerId{}
+	if !peer.Parse(addReq.GetPeerID()) {
+		done.Run(entity.NewStatus(entity.EINVAL, fmt.Sprintf("Fail to parse peer %s.", addReq.GetPeerID())))
+		return
+	}
+	oldConf, st := rrh.leaderConf()
+	if !st.IsOK() {
+		done.Run(st)
+		return
+	}
+	newConf := oldConf.Copy()
+	newConf.AddPeer(peer)
+	utils.RaftLog.Info("Node %s receive add peer request, peer=%s.", rrh.node.nodeID.GetDesc(), peer.GetDesc())
+	rrh.node.AddPeer(peer, &cliResponseClosure{
+		done:    done,
+		command: rpc.CliAddPeerRequest,
+		resp: &raft.AddPeerResponse{
+			OldPeers: encodePeerIds(oldConf.ListPeers()),
+			NewPeers: encodePeerIds(newConf.ListPeers()),
+		},
+	})
+}
+
+//handleRemovePeerRequest 从集群中移除节点，成员变更完成之后回复变更前后的 peers
+func (rrh *raftRpcHandler) handleRemovePeerRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	removeReq := req.(*raft.RemovePeerRequest)
+	done := NewRpcRequestClosure(rpcCtx)
+	peer := entity.PeerId{}
+	if !peer.Parse(removeReq.GetPeerID()) {
+		done.Run(entity.NewStatus(entity.EINVAL, fmt.Sprintf("Fail to parse peer %s.", removeReq.GetPeerID())))
+		return
+	}
+	oldConf, st := rrh.leaderConf()
+	if !st.IsOK() {
+		done.Run(st)
+		return
+	}
+	newConf := oldConf.Copy()
+	newConf.RemovePeer(&peer)
+	utils.RaftLog.Info("Node %s receive remove peer request, peer=%s.", rrh.node.nodeID.GetDesc(), peer.GetDesc())
+	rrh.node.RemovePeer(peer, &cliResponseClosure{
+		done:    done,
+		command: rpc.CliRemovePeerRequest,
+		resp: &raft.RemovePeerResponse{
+			OldPeers: encodePeerIds(oldConf.ListPeers()),
+			NewPeers: encodePeerIds(newConf.ListPeers()),
+		},
+	})
+}
+
+//handleChangePeersRequest 将集群的 peers 变更为 newPeers，Learner 保持不变
+func (rrh *raftRpcHandler) handleChangePeersRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	changeReq := req.(*raft.ChangePeersRequest)
+	done := NewRpcRequestClosure(rpcCtx)
+	peers, st := decodePeerIds(changeReq.GetNewPeers())
+	if !st.IsOK() {
+		done.Run(st)
+		return
+	}
+	oldConf, st := rrh.leaderConf()
+	if !st.IsOK() {
+		done.Run(st)
+		return
+	}
+	newConf := oldConf.Copy()
+	newConf.SetPeers(peers)
+	utils.RaftLog.Info("Node %s receive change peers request, new peers=%v.", rrh.node.nodeID.GetDesc(), peers)
+	rrh.node.ChangePeers(newConf, &cliResponseClosure{
+		done:    done,
+		command: rpc.CliChangePeersRequest,
+		resp: &raft.ChangePeersResponse{
+			OldPeers: encodePeerIds(oldConf.ListPeers()),
+			NewPeers: encodePeerIds(newConf.ListPeers()),
+		},
+	})
+}
+
+//handleResetPeersRequest 强制覆盖节点的配置，见 Node.ResetPeers
+func (rrh *raftRpcHandler) handleResetPeersRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	resetReq := req.(*raft.ResetPeerRequest)
+	done := NewRpcRequestClosure(rpcCtx)
+	peers, st := decodePeerIds(resetReq.GetNewPeers())
+	if !st.IsOK() {
+		done.Run(st)
+		return
+	}
+	utils.RaftLog.Warn("Node %s receive reset peers request, new peers=%v.", rrh.node.nodeID.GetDesc(), peers)
+	done.Run(rrh.node.ResetPeers(entity.NewConfiguration(peers, nil)))
+}
+
+//handleAddLearnersRequest 向集群中加入 Learner，成员变更完成之后回复变更前后的 learners
+func (rrh *raftRpcHandler) handleAddLearnersRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	addReq := req.(*raft.AddLearnersRequest)
+	rrh.changeLearners(rpc.CliAddLearnerRequest, addReq.GetLearners(), NewRpcRequestClosure(rpcCtx),
+		func(conf *entity.Configuration, learners []entity.PeerId) {
+			conf.AddLearners(learners)
+		}, rrh.node.AddLearners)
+}
+
+//handleRemoveLearnersRequest 从集群中移除 Learner，成员变更完成之后回复变更前后的 learners
+func (rrh *raftRpcHandler) handleRemoveLearnersRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	removeReq := req.(*raft.RemoveLearnersRequest)
+	rrh.changeLearners(rpc.CliRemoveLearnersRequest, removeReq.GetLearners(), NewRpcRequestClosure(rpcCtx),
+		func(conf *entity.Configuration, learners []entity.PeerId) {
+			for i := range learners {
+				conf.RemoveLearners(&learners[i])
+			}
+		}, rrh.node.RemoveLearners)
+}
+
+//handleResetLearnersRequest 将集群的 Learner 替换为请求中的 learners
+func (rrh *raftRpcHandler) handleResetLearnersRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	resetReq := req.(*raft.ResetLearnersRequest)
+	rrh.changeLearners(rpc.CliResetLearnersRequest, resetReq.GetLearners(), NewRpcRequestClosure(rpcCtx),
+		func(conf *entity.Configuration, learners []entity.PeerId) {
+			conf.SetLearners(learners)
+		}, rrh.node.ResetLearners)
+}
+
+//changeLearners 三种 Learner 变更的公共部分，update 根据 learners 修改配置得到变更之后的 learners，change 发起变更
+func (rrh *raftRpcHandler) changeLearners(command string, learners []string, done *RpcRequestClosure,
+	update func(conf *entity.Configuration, learners []entity.PeerId),
+	change func(learners []entity.PeerId, done Closure)) {
+	peers, st := decodePeerIds(learners)
+	if !st.IsOK() {
+		done.Run(st)
+		return
+	}
+	oldConf, st := rrh.leaderConf()
+	if !st.IsOK() {
+		done.Run(st)
+		return
+	}
+	utils.RaftLog.Info("Node %s receive %s, learners=%v.", rrh.node.nodeID.GetDesc(), command, peers)
+	newConf := oldConf.Copy()
+	update(newConf, peers)
+	change(peers, &cliResponseClosure{
+		done:    done,
+		command: command,
+		resp: &raft.LearnersOpResponse{
+			OldLearners: encodePeerIds(oldConf.ListLearners()),
+			NewLearners: encodePeerIds(newConf.ListLearners()),
+		},
+	})
+}
+
+//handleGetLeaderRequest 回复节点所知道的 Leader，还不知道 Leader 时回复 EAGAIN
+func (rrh *raftRpcHandler) handleGetLeaderRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	done := NewRpcRequestClosure(rpcCtx)
+	leaderID := rrh.node.GetLeaderID()
+	if leaderID.IsEmpty() {
+		done.Run(entity.NewStatus(entity.EAGAIN, "Unknown leader."))
+		return
+	}
+	done.SendProtoResponse(rpc.CliGetLeaderRequest, &raft.GetLeaderResponse{LeaderID: leaderID.GetDesc()})
+}
+
+//handleGetPeersRequest Leader 回复集群当前的 peers 以及 learners，onlyAlive 时只回复最近一个租约内响应过 Leader 的节点
+func (rrh *raftRpcHandler) handleGetPeersRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	getReq := req.(*raft.GetPeersRequest)
+	done := NewRpcRequestClosure(rpcCtx)
+	listPeers, listLearners := rrh.node.ListPeers, rrh.node.ListLearners
+	if getReq.GetOnlyAlive() {
+		listPeers, listLearners = rrh.node.ListAlivePeers, rrh.node.ListAliveLearners
+	}
+	peers, err := listPeers()
+	if err != nil {
+		done.Run(entity.NewStatus(entity.EPERM, err.Error()))
+		return
+	}
+	learners, err := listLearners()
+	if err != nil {
+		done.Run(entity.NewStatus(entity.EPERM, err.Error()))
+		return
+	}
+	done.SendProtoResponse(rpc.CliGetPeersRequest, &raft.GetPeersResponse{
+		Peers:    encodePeerIds(peers),
+		Learners: encodePeerIds(learners),
+	})
+}
+
+//handleTransferLeaderRequest Leader 把领导权转移给请求中的节点
+func (rrh *raftRpcHandler) handleTransferLeaderRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	transferReq := req.(*raft.TransferLeaderRequest)
+	done := NewRpcRequestClosure(rpcCtx)
+	peer := entity.PeerId{}
+	if !peer.Parse(transferReq.GetPeerID()) {
+		done.Run(entity.NewStatus(entity.EINVAL, fmt.Sprintf("Fail to parse peer %s.", transferReq.GetPeerID())))
+		return
+	}
+	utils.RaftLog.Info("Node %s receive transfer leader request, peer=%s.", rrh.node.nodeID.GetDesc(),
+		peer.GetDesc())
+	done.Run(rrh.node.TransferLeadershipTo(peer))
+}
+
+//handleSnapshotRequest 节点立即生成一次快照，快照完成之后回复
+func (rrh *raftRpcHandler) handleSnapshotRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	utils.RaftLog.Info("Node %s receive snapshot request.", rrh.node.nodeID.GetDesc())
+	rrh.node.Snapshot(NewRpcRequestClosure(rpcCtx))
+}
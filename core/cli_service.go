@@ -5,73 +5,432 @@
 package core
 
 import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	polerpc "github.com/pole-group/pole-rpc"
+
 	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
 	"github.com/pole-group/lraft/rpc"
+	"github.com/pole-group/lraft/utils"
 )
 
+//CliService 运维客户端，通过 Cli* 命令对 raft 组进行成员变更、转移领导权等操作
 type CliService struct {
 	timeoutMs int32
 	maxRetry  int32
-	rpcClient *rpc.RaftClient
+	rpcClient rpc.ClientTransport
+}
+
+//NewCliService 创建运维客户端，CliOptions 中没有指定传输层时创建基于 RSocket 的实现
+func NewCliService(opts CliOptions) (*CliService, error) {
+	if opts.TimeoutMs <= 0 {
+		return nil, fmt.Errorf("invalid timeoutMs %d", opts.TimeoutMs)
+	}
+	if opts.MaxRetry < 0 {
+		return nil, fmt.Errorf("invalid maxRetry %d", opts.MaxRetry)
+	}
+	client := opts.ClientTransport
+	if client == nil {
+		raftClient, err := rpc.NewRaftClient(false)
+		if err != nil {
+			return nil, err
+		}
+		client = raftClient
+	}
+	return &CliService{
+		timeoutMs: opts.TimeoutMs,
+		maxRetry:  opts.MaxRetry,
+		rpcClient: client,
+	}, nil
 }
 
+//AddPeer 向 raft 组中加入 peerId，conf 是 raft 组当前的配置，用来查找 Leader。成员变更完成之后才会返回，timeoutMs 需要
+//足够新节点追上 Leader 的日志
 func (cli *CliService) AddPeer(groupId string, peerId *entity.PeerId, conf *entity.Configuration) entity.Status {
-	return entity.Status{}
+	if peerId == nil || peerId.IsEmpty() {
+		return entity.NewStatus(entity.EINVAL, "Empty peer id.")
+	}
+	resp, st := cli.invokeLeader(groupId, conf, rpc.CliAddPeerRequest, func(leader entity.PeerId) proto.Message {
+		return &raft.AddPeerRequest{
+			GroupID:  groupId,
+			LeaderID: leader.GetDesc(),
+			PeerID:   peerId.GetDesc(),
+		}
+	})
+	if st.IsOK() {
+		addResp := resp.(*raft.AddPeerResponse)
+		cli.logConfChanged(groupId, addResp.GetOldPeers(), addResp.GetNewPeers())
+	}
+	return st
 }
 
+//RemovePeer 从 raft 组中移除 peerId，conf 是 raft 组当前的配置，用来查找 Leader
 func (cli *CliService) RemovePeer(groupId string, peerId *entity.PeerId, conf *entity.Configuration) entity.Status {
-	return entity.Status{}
+	if peerId == nil || peerId.IsEmpty() {
+		return entity.NewStatus(entity.EINVAL, "Empty peer id.")
+	}
+	resp, st := cli.invokeLeader(groupId, conf, rpc.CliRemovePeerRequest, func(leader entity.PeerId) proto.Message {
+		return &raft.RemovePeerRequest{
+			GroupID:  groupId,
+			LeaderID: leader.GetDesc(),
+			PeerID:   peerId.GetDesc(),
+		}
+	})
+	if st.IsOK() {
+		removeResp := resp.(*raft.RemovePeerResponse)
+		cli.logConfChanged(groupId, removeResp.GetOldPeers(), removeResp.GetNewPeers())
+	}
+	return st
 }
 
+//ChangePeer 将 raft 组的 peers 变更为 newConf 中的 peers，Learner 保持不变，oldConf 用来查找 Leader
 func (cli *CliService) ChangePeer(groupId string, oldConf, newConf *entity.Configuration) entity.Status {
-	return entity.Status{}
+	if newConf == nil || newConf.IsEmpty() {
+		return entity.NewStatus(entity.EINVAL, "Empty new configuration.")
+	}
+	resp, st := cli.invokeLeader(groupId, oldConf, rpc.CliChangePeersRequest, func(leader entity.PeerId) proto.Message {
+		return &raft.ChangePeersRequest{
+			GroupID:  groupId,
+			LeaderID: leader.GetDesc(),
+			NewPeers: encodePeerIds(newConf.ListPeers()),
+		}
+	})
+	if st.IsOK() {
+		changeResp := resp.(*raft.ChangePeersResponse)
+		cli.logConfChanged(groupId, changeResp.GetOldPeers(), changeResp.GetNewPeers())
+	}
+	return st
 }
 
-func (cli *CliService) ResetPeer(groupId string, peerId *entity.PeerId, conf *entity.Configuration) entity.Status {
-	return entity.Status{}
+//ResetPeer 强制把 peerId 上的节点的配置覆盖为 newConf，不经过多数派确认，只能在多数派永久丢失时用于灾难恢复，
+//需要在每一个存活的节点上分别执行，见 Node.ResetPeers
+func (cli *CliService) ResetPeer(groupId string, peerId *entity.PeerId, newConf *entity.Configuration) entity.Status {
+	if peerId == nil || peerId.IsEmpty() {
+		return entity.NewStatus(entity.EINVAL, "Empty peer id.")
+	}
+	if newConf == nil || newConf.IsEmpty() {
+		return entity.NewStatus(entity.EINVAL, "Empty new configuration.")
+	}
+	req := &raft.ResetPeerRequest{
+		GroupID:  groupId,
+		PeerID:   peerId.GetDesc(),
+		NewPeers: encodePeerIds(newConf.ListPeers()),
+	}
+	_, st := cli.invoke(peerId.GetEndpoint(), rpc.CliResetPeersRequest, req)
+	return st
 }
 
-func (cli *CliService) AddLearners(groupId string, learners []*entity.PeerId, conf *entity.Configuration) entity.Status {
-	return entity.Status{}
+//AddLearners 向 raft 组中加入 Learner，conf 是 raft 组当前的配置，用来查找 Leader
+func (cli *CliService) AddLearners(groupId string, learners []entity.PeerId, conf *entity.Configuration) entity.Status {
+	return cli.changeLearners(groupId, conf, rpc.CliAddLearnerRequest, learners,
+		func(leader entity.PeerId, learners []string) proto.Message {
+			return &raft.AddLearnersRequest{GroupID: groupId, LeaderID: leader.GetDesc(), Learners: learners}
+		})
 }
 
-func (cli *CliService) RemoveLearners(groupId string, learners []*entity.PeerId, conf *entity.Configuration) entity.Status {
-	return entity.Status{}
+//RemoveLearners 从 raft 组中移除 Learner，conf 是 raft 组当前的配置，用来查找 Leader
+func (cli *CliService) RemoveLearners(groupId string, learners []entity.PeerId,
+	conf *entity.Configuration) entity.Status {
+	return cli.changeLearners(groupId, conf, rpc.CliRemoveLearnersRequest, learners,
+		func(leader entity.PeerId, learners []string) proto.Message {
+			return &raft.RemoveLearnersRequest{GroupID: groupId, LeaderID: leader.GetDesc(), Learners: learners}
+		})
 }
 
-func (cli *CliService) ResetLearners(groupId string, learners []*entity.PeerId,
+//ResetLearners 将 raft 组的 Learner 替换为 learners，conf 是 raft 组当前的配置，用来查找 Leader
+func (cli *CliService) ResetLearners(groupId string, learners []entity.PeerId,
 	conf *entity.Configuration) entity.Status {
-	return entity.Status{}
+	return cli.changeLearners(groupId, conf, rpc.CliResetLearnersRequest, learners,
+		func(leader entity.PeerId, learners []string) proto.Message {
+			return &raft.ResetLearnersRequest{GroupID: groupId, LeaderID: leader.GetDesc(), Learners: learners}
+		})
+}
+
+//changeLearners 三种 Learner 变更的公共部分，newRequest 根据 Leader 以及编码之后的 learners 构造请求
+func (cli *CliService) changeLearners(groupId string, conf *entity.Configuration, command string,
+	learners []entity.PeerId, newRequest func(leader entity.PeerId, learners []string) proto.Message) entity.Status {
+	if len(learners) == 0 {
+		return entity.NewStatus(entity.EINVAL, "Empty learners.")
+	}
+	encoded := encodePeerIds(learners)
+	resp, st := cli.invokeLeader(groupId, conf, command, func(leader entity.PeerId) proto.Message {
+		return newRequest(leader, encoded)
+	})
+	if st.IsOK() {
+		learnersResp := resp.(*raft.LearnersOpResponse)
+		utils.RaftLog.Info("Learners of replication group %s changed from %v to %v.", groupId,
+			learnersResp.GetOldLearners(), learnersResp.GetNewLearners())
+	}
+	return st
 }
 
+//TransferLeader 将 raft 组的领导权转移给 peerId，conf 是 raft 组当前的配置，用来查找 Leader
 func (cli *CliService) TransferLeader(groupId string, peerId *entity.PeerId, conf *entity.Configuration) entity.Status {
-	return entity.Status{}
+	if peerId == nil || peerId.IsEmpty() {
+		return entity.NewStatus(entity.EINVAL, "Empty peer id.")
+	}
+	_, st := cli.invokeLeader(groupId, conf, rpc.CliTransferLeaderRequest, func(leader entity.PeerId) proto.Message {
+		return &raft.TransferLeaderRequest{
+			GroupID:  groupId,
+			LeaderID: leader.GetDesc(),
+			PeerID:   peerId.GetDesc(),
+		}
+	})
+	return st
 }
 
+//Snapshot 让 peerId 上的节点立即生成一次快照
 func (cli *CliService) Snapshot(groupId string, peerId *entity.PeerId) entity.Status {
-	return entity.Status{}
+	if peerId == nil || peerId.IsEmpty() {
+		return entity.NewStatus(entity.EINVAL, "Empty peer id.")
+	}
+	_, st := cli.invoke(peerId.GetEndpoint(), rpc.CliSnapshotRequest, &raft.SnapshotRequest{
+		GroupID: groupId,
+		PeerID:  peerId.GetDesc(),
+	})
+	return st
 }
 
+//GetLeader 依次询问 conf 中的节点，把第一个知道 Leader 的节点回复的 Leader 写入 leaderId，所有节点都不知道 Leader 时
+//返回 EAGAIN
 func (cli *CliService) GetLeader(groupId string, leaderId *entity.PeerId, conf *entity.Configuration) entity.Status {
-	return entity.Status{}
+	if leaderId == nil {
+		return entity.NewStatus(entity.EINVAL, "Nil leader id.")
+	}
+	if conf == nil || conf.IsEmpty() {
+		return entity.NewStatus(entity.EINVAL, "Empty group configuration.")
+	}
+	errs := make([]string, 0, conf.Size())
+	for _, peer := range conf.ListPeers() {
+		resp, st := cli.invoke(peer.GetEndpoint(), rpc.CliGetLeaderRequest, &raft.GetLeaderRequest{
+			GroupID: groupId,
+			PeerID:  peer.GetDesc(),
+		})
+		if !st.IsOK() {
+			errs = append(errs, fmt.Sprintf("%s : %s", peer.GetDesc(), st.GetMsg()))
+			continue
+		}
+		leader := resp.(*raft.GetLeaderResponse).GetLeaderID()
+		if leaderId.Parse(leader) {
+			return entity.StatusOK()
+		}
+		errs = append(errs, fmt.Sprintf("%s : fail to parse leader %s", peer.GetDesc(), leader))
+	}
+	return entity.NewStatus(entity.EAGAIN, fmt.Sprintf("Fail to get leader of group %s, %v.", groupId, errs))
+}
+
+//GetPeers raft 组当前配置中的 peers，conf 用来查找 Leader
+func (cli *CliService) GetPeers(groupId string, conf *entity.Configuration) ([]entity.PeerId, entity.Status) {
+	return cli.getPeers(groupId, conf, false, false)
+}
+
+//GetAlivePeers 最近一个租约内响应过 Leader 的 peers，包括 Leader 自己
+func (cli *CliService) GetAlivePeers(groupId string, conf *entity.Configuration) ([]entity.PeerId, entity.Status) {
+	return cli.getPeers(groupId, conf, true, false)
+}
+
+//GetLearners raft 组当前配置中的 learners，conf 用来查找 Leader
+func (cli *CliService) GetLearners(groupId string, conf *entity.Configuration) ([]entity.PeerId, entity.Status) {
+	return cli.getPeers(groupId, conf, false, true)
+}
+
+//GetAliveLearners 最近一个租约内响应过 Leader 的 learners
+func (cli *CliService) GetAliveLearners(groupId string, conf *entity.Configuration) ([]entity.PeerId, entity.Status) {
+	return cli.getPeers(groupId, conf, true, true)
+}
+
+func (cli *CliService) getPeers(groupId string, conf *entity.Configuration, onlyAlive,
+	learners bool) ([]entity.PeerId, entity.Status) {
+	resp, st := cli.invokeLeader(groupId, conf, rpc.CliGetPeersRequest, func(leader entity.PeerId) proto.Message {
+		return &raft.GetPeersRequest{
+			GroupID:   groupId,
+			LeaderID:  leader.GetDesc(),
+			OnlyAlive: onlyAlive,
+		}
+	})
+	if !st.IsOK() {
+		return nil, st
+	}
+	peersResp := resp.(*raft.GetPeersResponse)
+	if learners {
+		return decodePeerIds(peersResp.GetLearners())
+	}
+	return decodePeerIds(peersResp.GetPeers())
+}
+
+//ReBalance 平衡 groupIds 中各个 raft 组的 Leader，使得 conf 中每个节点上的 Leader 数量不超过平均值。Leader 超过平均值时，
+//把领导权转移给存活的并且 Leader 数量低于平均值的节点，之后重新检查这个 raft 组。balancedLeaderIds 不为空时记录每个
+//raft 组最终的 Leader，领导权转移失败时立即返回
+func (cli *CliService) ReBalance(groupIds []string, conf *entity.Configuration,
+	balancedLeaderIds map[string]entity.PeerId) entity.Status {
+	if len(groupIds) == 0 {
+		return entity.NewStatus(entity.EINVAL, "Empty balance group ids.")
+	}
+	if conf == nil || conf.IsEmpty() {
+		return entity.NewStatus(entity.EINVAL, "Empty group configuration.")
+	}
+	utils.RaftLog.Info("Rebalance start with raft groups=%v.", groupIds)
+	expectedAverage := (len(groupIds) + conf.Size() - 1) / conf.Size()
+	leaderCounter := make(map[string]int)
+	queue := append(make([]string, 0, len(groupIds)), groupIds...)
+	transfers := 0
+	st := entity.StatusOK()
+	for len(queue) != 0 && st.IsOK() {
+		groupId := queue[0]
+		queue = queue[1:]
+		leaderId := entity.PeerId{}
+		if st = cli.GetLeader(groupId, &leaderId, conf); !st.IsOK() {
+			break
+		}
+		if balancedLeaderIds != nil {
+			balancedLeaderIds[groupId] = leaderId
+		}
+		leaderCounter[leaderId.GetDesc()]++
+		if leaderCounter[leaderId.GetDesc()] <= expectedAverage {
+			continue
+		}
+		target := cli.findTargetPeer(groupId, leaderId, conf, leaderCounter, expectedAverage)
+		if target.IsEmpty() {
+			continue
+		}
+		transfers++
+		// 领导权转移失败通常是因为节点正忙，稍后再重新平衡
+		if st = cli.TransferLeader(groupId, &target, conf); !st.IsOK() {
+			break
+		}
+		if st = cli.waitNewLeader(groupId, leaderId, conf); !st.IsOK() {
+			break
+		}
+		utils.RaftLog.Info("Group %s transfer leader to %s.", groupId, target.GetDesc())
+		leaderCounter[leaderId.GetDesc()]--
+		// 立即重新检查这个 raft 组，新的 Leader 计入之后其他 raft 组才不会选中同一个节点
+		queue = append([]string{groupId}, queue...)
+	}
+	utils.RaftLog.Info("Rebalanced raft groups=%v, status=%s, number of transfers=%d.", groupIds, st.GetMsg(),
+		transfers)
+	return st
+}
+
+//waitNewLeader 领导权转移是异步的，等待 groupId 选举出 oldLeader 之外的 Leader，目标节点没有在 maxRetry+1 个 timeoutMs
+//之内当选时返回 ETIMEDOUT
+func (cli *CliService) waitNewLeader(groupId string, oldLeader entity.PeerId, conf *entity.Configuration) entity.Status {
+	deadline := time.Now().Add(time.Duration(cli.timeoutMs*(cli.maxRetry+1)) * time.Millisecond)
+	for {
+		leader := entity.PeerId{}
+		if st := cli.GetLeader(groupId, &leader, conf); st.IsOK() && !leader.Equal(oldLeader) {
+			return st
+		}
+		if time.Now().After(deadline) {
+			return entity.NewStatus(entity.ETIMEDOUT, fmt.Sprintf("Group %s fail to elect a new leader.", groupId))
+		}
+		time.Sleep(time.Duration(cli.timeoutMs/10) * time.Millisecond)
+	}
+}
+
+//findTargetPeer 在 groupId 存活的节点中找一个 Leader 数量低于平均值的节点，找不到时返回空的节点
+func (cli *CliService) findTargetPeer(groupId string, leaderId entity.PeerId, conf *entity.Configuration,
+	leaderCounter map[string]int, expectedAverage int) entity.PeerId {
+	peers, st := cli.GetAlivePeers(groupId, conf)
+	if !st.IsOK() {
+		utils.RaftLog.Warn("Fail to get alive peers of group %s : %s", groupId, st.GetMsg())
+		return entity.EmptyPeer
+	}
+	for _, peer := range peers {
+		if peer.Equal(leaderId) || !conf.Contains(peer) || leaderCounter[peer.GetDesc()] >= expectedAverage {
+			continue
+		}
+		return peer
+	}
+	return entity.EmptyPeer
 }
 
-func (cli *CliService) GetPeers(groupId string, peerId *entity.PeerId, conf *entity.Configuration) []*entity.PeerId {
-	return nil
+//invokeLeader 先通过 GetLeader 找到 Leader 再发送请求。Leader 回复 EPERM 说明领导权已经转移，找不到 Leader 或者 Leader
+//不可达时可能正在选举，Leader 回复 EBUSY 说明配置日志还没有提交，这些情况都等待 timeoutMs 之后重新查找 Leader，最多重试
+//maxRetry 次
+func (cli *CliService) invokeLeader(groupId string, conf *entity.Configuration, command string,
+	newRequest func(leader entity.PeerId) proto.Message) (proto.Message, entity.Status) {
+	st := entity.StatusOK()
+	for i := int32(0); i <= cli.maxRetry; i++ {
+		if i != 0 {
+			utils.RaftLog.Debug("Retry %s of group %s after %s.", command, groupId, st.GetMsg())
+			time.Sleep(time.Duration(cli.timeoutMs) * time.Millisecond)
+		}
+		leader := entity.PeerId{}
+		if st = cli.GetLeader(groupId, &leader, conf); !st.IsOK() {
+			continue
+		}
+		var resp proto.Message
+		if resp, st = cli.invoke(leader.GetEndpoint(), command, newRequest(leader)); st.IsOK() {
+			return resp, st
+		}
+		if code := st.GetCode(); code != entity.EPERM && code != entity.EAGAIN && code != entity.EHostDown &&
+			code != entity.EBUSY {
+			return nil, st
+		}
+	}
+	return nil, st
 }
 
-func (cli *CliService) GetAlivePeers(groupId string, peerId *entity.PeerId, conf *entity.Configuration) []*entity.PeerId {
-	return nil
+func (cli *CliService) logConfChanged(groupId string, oldPeers, newPeers []string) {
+	utils.RaftLog.Info("Configuration of replication group %s changed from %v to %v.", groupId, oldPeers, newPeers)
 }
 
-func (cli *CliService) GetLearners(groupId string, peerId *entity.PeerId, conf *entity.Configuration) []*entity.PeerId {
-	return nil
+//invoke 发送请求并且等待响应，timeoutMs 之内没有收到响应时返回 ETIMEDOUT
+func (cli *CliService) invoke(endpoint entity.Endpoint, command string, req proto.Message) (proto.Message,
+	entity.Status) {
+	body, err := ptypes.MarshalAny(req)
+	if err != nil {
+		return nil, entity.NewStatus(entity.EInternal, err.Error())
+	}
+	type result struct {
+		resp *polerpc.ServerResponse
+		err  error
+	}
+	resultC := make(chan result, 1)
+	polerpc.Go(context.Background(), func(ctx context.Context) {
+		resp, err := cli.rpcClient.SendRequest(endpoint, &polerpc.ServerRequest{
+			FunName: command,
+			Body:    body,
+		})
+		resultC <- result{resp: resp, err: err}
+	})
+	timer := time.NewTimer(time.Duration(cli.timeoutMs) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case r := <-resultC:
+		if r.err != nil {
+			return nil, entity.NewStatus(entity.EHostDown, r.err.Error())
+		}
+		return rpc.GlobalProtoRegistry.DecodeResponse(command, r.resp)
+	case <-timer.C:
+		return nil, entity.NewStatus(entity.ETIMEDOUT, fmt.Sprintf("%s to %s timeout", command,
+			endpoint.GetDesc()))
+	}
 }
 
-func (cli *CliService) GetAliveLearners(groupId string, peerId *entity.PeerId, conf *entity.Configuration) []*entity.PeerId {
-	return nil
+//encodePeerIds Cli* 命令中的节点以字符串的形式传输
+func encodePeerIds(peers []entity.PeerId) []string {
+	result := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		result = append(result, peer.GetDesc())
+	}
+	return result
 }
 
-func (cli *CliService) ReBalance(groupIds []string, balanceLeaderIds map[string]*entity.PeerId, conf *entity.Configuration) []*entity.PeerId {
-	return nil
+//decodePeerIds 任何一个节点解析失败时返回 EINVAL
+func decodePeerIds(peers []string) ([]entity.PeerId, entity.Status) {
+	result := make([]entity.PeerId, 0, len(peers))
+	for _, s := range peers {
+		peer := entity.PeerId{}
+		if !peer.Parse(s) {
+			return nil, entity.NewStatus(entity.EINVAL, fmt.Sprintf("Fail to parse peer %s.", s))
+		}
+		result = append(result, peer)
+	}
+	return result, entity.StatusOK()
 }
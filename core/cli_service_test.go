@@ -0,0 +1,219 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/rpc"
+)
+
+//newTestCliService 以一个不属于任何节点的地址接入 network 的运维客户端
+func newTestCliService(t *testing.T, network *rpc.FaultNetwork) *CliService {
+	cli, err := NewCliService(CliOptions{
+		TimeoutMs:       testElectionTimeoutMs,
+		MaxRetry:        3,
+		ClientTransport: network.NewClient(entity.NewEndpoint("127.0.0.1", 9000)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+func TestCliService(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peers := newTestPeers(5)
+	nodes := make([]*nodeImpl, 0, len(peers))
+	for _, peer := range peers[:3] {
+		nodes = append(nodes, startTestNode(t, network, peer, peers[:3]))
+	}
+	for _, peer := range peers[3:] {
+		startTestNode(t, network, peer, nil)
+	}
+	leader := waitSingleLeader(t, nodes...)
+	cli := newTestCliService(t, network)
+	conf := entity.NewConfiguration(peers[:3], nil)
+	checkPeers := func(what string, get func(string, *entity.Configuration) ([]entity.PeerId, entity.Status),
+		expect []entity.PeerId) {
+		t.Helper()
+		result, st := get(testGroupID, conf)
+		if !st.IsOK() {
+			t.Fatalf("%s, status %d %s", what, st.GetCode(), st.GetMsg())
+		}
+		if !entity.NewConfiguration(result, nil).Equal(entity.NewConfiguration(expect, nil)) {
+			t.Fatalf("%s : %v, expect %v", what, result, expect)
+		}
+	}
+
+	leaderId := entity.PeerId{}
+	if st := cli.GetLeader(testGroupID, &leaderId, conf); !st.IsOK() || !leaderId.Equal(leader.serverID) {
+		t.Fatalf("get leader %s, status %d %s", leaderId.GetDesc(), st.GetCode(), st.GetMsg())
+	}
+	checkPeers("get peers", cli.GetPeers, peers[:3])
+	waitUntil(t, "all peers to be alive", func() bool {
+		alive, st := cli.GetAlivePeers(testGroupID, conf)
+		return st.IsOK() && len(alive) == 3
+	})
+
+	// Follower 拒绝修改配置的命令，CliService 收到 EPERM 之后重新查找 Leader
+	for _, node := range nodes {
+		if node == leader {
+			continue
+		}
+		_, st := cli.invoke(node.serverID.GetEndpoint(), rpc.CliGetPeersRequest, &raft.GetPeersRequest{
+			GroupID:  testGroupID,
+			LeaderID: node.serverID.GetDesc(),
+		})
+		if st.GetCode() != entity.EPERM {
+			t.Fatalf("get peers from follower, status %d %s", st.GetCode(), st.GetMsg())
+		}
+		break
+	}
+
+	if st := cli.AddPeer(testGroupID, &peers[3], conf); !st.IsOK() {
+		t.Fatalf("add peer, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	checkPeers("peers after adding", cli.GetPeers, peers[:4])
+	if st := cli.AddPeer(testGroupID, &peers[3], conf); st.GetCode() != entity.EINVAL {
+		t.Fatalf("add an existing peer, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if st := cli.RemovePeer(testGroupID, &peers[3], conf); !st.IsOK() {
+		t.Fatalf("remove peer, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	checkPeers("peers after removing", cli.GetPeers, peers[:3])
+
+	if st := cli.AddLearners(testGroupID, peers[4:], conf); !st.IsOK() {
+		t.Fatalf("add learners, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	checkPeers("learners after adding", cli.GetLearners, peers[4:])
+	if st := cli.ResetLearners(testGroupID, peers[3:4], conf); !st.IsOK() {
+		t.Fatalf("reset learners, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	checkPeers("learners after resetting", cli.GetLearners, peers[3:4])
+	waitUntil(t, "learner to be alive", func() bool {
+		alive, st := cli.GetAliveLearners(testGroupID, conf)
+		return st.IsOK() && len(alive) == 1 && alive[0].Equal(peers[3])
+	})
+
+	// ChangePeer 只修改 peers，Learner 保持不变
+	newConf := entity.NewConfiguration(append([]entity.PeerId{peers[4]}, peers[:3]...), nil)
+	if st := cli.ChangePeer(testGroupID, conf, newConf); !st.IsOK() {
+		t.Fatalf("change peers, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	checkPeers("peers after changing", cli.GetPeers, newConf.ListPeers())
+	checkPeers("learners after changing", cli.GetLearners, peers[3:4])
+	if st := cli.RemoveLearners(testGroupID, peers[3:4], conf); !st.IsOK() {
+		t.Fatalf("remove learners, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	checkPeers("learners after removing", cli.GetLearners, nil)
+
+	if st := cli.Snapshot(testGroupID, &leader.serverID); !st.IsOK() {
+		t.Fatalf("snapshot, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	balanced := make(map[string]entity.PeerId)
+	if st := cli.ReBalance([]string{testGroupID}, conf, balanced); !st.IsOK() {
+		t.Fatalf("rebalance, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if leaderId := balanced[testGroupID]; !leaderId.Equal(leader.serverID) {
+		t.Fatalf("balanced leader %s, expect %s", leaderId.GetDesc(), leader.serverID.GetDesc())
+	}
+}
+
+func TestCliServiceDisabled(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peer := newTestPeers(1)[0]
+	opts := newSingleNodeOptions(t, network, peer)
+	opts.DisableCli = true
+	node, err := NewNode(testGroupID, peer, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		node.Shutdown(nil)
+		node.Join()
+	})
+	waitUntil(t, "single node to become leader", node.IsLeader)
+
+	cli := newTestCliService(t, network)
+	if st := cli.Snapshot(testGroupID, &peer); st.GetCode() != entity.EPERM {
+		t.Fatalf("snapshot with cli disabled, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	leaderId := entity.PeerId{}
+	if st := cli.GetLeader(testGroupID, &leaderId, entity.NewConfiguration([]entity.PeerId{peer}, nil)); st.IsOK() {
+		t.Fatalf("get leader with cli disabled, leader %s", leaderId.GetDesc())
+	}
+}
+
+func TestCliServiceWithNodeManager(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peers := newTestPeers(3)
+	groups := []string{"group-a", "group-b"}
+	managers := newTestNodeManagers(t, network, peers, groups)
+	cli := newTestCliService(t, network)
+	conf := entity.NewConfiguration(peers, nil)
+	for _, groupID := range groups {
+		waitUntil(t, groupID+" to elect a leader", func() bool {
+			return len(groupLeaders(managers, groupID)) == 1
+		})
+		leader := groupLeaders(managers, groupID)[0]
+		leaderId := entity.PeerId{}
+		if st := cli.GetLeader(groupID, &leaderId, conf); !st.IsOK() || !leaderId.Equal(leader.GetLeaderID()) {
+			t.Fatalf("leader of %s is %s, status %d %s", groupID, leaderId.GetDesc(), st.GetCode(), st.GetMsg())
+		}
+		// 发给 Leader 的命令按照 LeaderID 而不是被操作的 PeerID 分发
+		if st := cli.AddPeer(groupID, &peers[0], conf); st.GetCode() != entity.EINVAL {
+			t.Fatalf("add an existing peer to %s, status %d %s", groupID, st.GetCode(), st.GetMsg())
+		}
+		result, st := cli.GetPeers(groupID, conf)
+		if !st.IsOK() || !entity.NewConfiguration(result, nil).Equal(conf) {
+			t.Fatalf("peers of %s : %v, status %d %s", groupID, result, st.GetCode(), st.GetMsg())
+		}
+	}
+	if st := cli.GetLeader("unknown", &entity.PeerId{}, conf); st.GetCode() != entity.EAGAIN {
+		t.Fatalf("leader of unknown group, status %d %s", st.GetCode(), st.GetMsg())
+	}
+}
+
+//TestCliServiceReBalance 所有 raft 组的 Leader 都转移到同一个节点上，ReBalance 之后每个节点上各有一个 Leader
+func TestCliServiceReBalance(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peers := newTestPeers(3)
+	groups := []string{"group-0", "group-1", "group-2"}
+	managers := newTestNodeManagers(t, network, peers, groups)
+	cli := newTestCliService(t, network)
+	conf := entity.NewConfiguration(peers, nil)
+	for _, groupID := range groups {
+		target := managers[0].GetNode(groupID, peers[0])
+		waitUntil(t, groupID+" to transfer leader to "+peers[0].GetDesc(), func() bool {
+			if target.IsLeader() {
+				return true
+			}
+			if len(groupLeaders(managers, groupID)) == 1 {
+				cli.TransferLeader(groupID, &peers[0], conf)
+			}
+			return false
+		})
+	}
+
+	balanced := make(map[string]entity.PeerId)
+	if st := cli.ReBalance(groups, conf, balanced); !st.IsOK() {
+		t.Fatalf("rebalance, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	leaderCounter := make(map[string]int)
+	for _, groupID := range groups {
+		expect := balanced[groupID]
+		waitUntil(t, groupID+" leader to be "+expect.GetDesc(), func() bool {
+			leaders := groupLeaders(managers, groupID)
+			return len(leaders) == 1 && leaders[0].GetLeaderID().Equal(expect)
+		})
+		leaderCounter[expect.GetDesc()]++
+	}
+	if len(leaderCounter) != len(peers) {
+		t.Fatalf("leaders after rebalance %v", balanced)
+	}
+}
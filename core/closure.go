@@ -41,17 +41,19 @@ func (cq *ClosureQueue) GetQueue() list.List {
 
 func (cq *ClosureQueue) Clear() {
 	cq.lock.Lock()
-	t := cq.queue
-	cq.queue = list.List{}
+	closures := make([]Closure, 0, cq.queue.Len())
+	for e := cq.queue.Front(); e != nil; e = e.Next() {
+		closures = append(closures, e.Value.(Closure))
+	}
+	cq.queue.Init()
 	cq.firstIndex = 0
 	cq.lock.Unlock()
 
 	status := entity.NewStatus(entity.EPERM, "Leader stepped down")
-
-	e := t.Front()
-	for e != nil {
-		done := e.Value.(Closure)
-		done.Run(status)
+	for _, done := range closures {
+		if done != nil {
+			done.Run(status)
+		}
 	}
 }
 
@@ -77,39 +79,36 @@ func (cq *ClosureQueue) AppendPendingClosure(closure Closure) {
 	cq.queue.PushBack(closure)
 }
 
-func (cq *ClosureQueue) PopClosureUntil(endIndex int64, closures []Closure, tasks []TaskClosure) int64 {
-	closures = make([]Closure, 0)
-	if len(tasks) != 0 {
-		tasks = make([]TaskClosure, 0)
-	}
+//PopClosureUntil 取出 endIndex 以及之前日志的回调，同时返回第一个回调对应的日志索引；队列中没有这些日志的回调时返回
+//endIndex + 1，endIndex 超出了队列的范围时返回 -1
+func (cq *ClosureQueue) PopClosureUntil(endIndex int64) ([]Closure, []TaskClosure, int64) {
+	closures := make([]Closure, 0)
+	tasks := make([]TaskClosure, 0)
 
 	defer cq.lock.Unlock()
 	cq.lock.Lock()
 
 	qSize := int64(cq.queue.Len())
 	if qSize == 0 || endIndex < cq.firstIndex {
-		return endIndex + 1
+		return closures, tasks, endIndex + 1
 	}
 	if endIndex > cq.firstIndex+qSize-1 {
-		// TODO Log
-		return -1
+		utils.RaftLog.Error("invalid endIndex=%d, firstIndex=%d, closureQueueSize=%d", endIndex, cq.firstIndex,
+			qSize)
+		return closures, tasks, -1
 	}
 	outFirstIndex := cq.firstIndex
 	for i := outFirstIndex; i <= endIndex; i++ {
 		e := cq.queue.Front()
 		cq.queue.Remove(e)
-		switch t := e.Value.(type) {
-		case TaskClosure:
-			if tasks != nil {
-				tasks = append(tasks, t)
-			}
-		case Closure:
-			// do nothing
+		if t, ok := e.Value.(TaskClosure); ok {
+			tasks = append(tasks, t)
 		}
-		closures = append(closures, e.Value.(Closure))
+		closure, _ := e.Value.(Closure)
+		closures = append(closures, closure)
 	}
 	cq.firstIndex = endIndex + 1
-	return outFirstIndex
+	return closures, tasks, outFirstIndex
 }
 
 type SynchronizedClosure struct {
@@ -239,9 +238,10 @@ func (rc *ReadIndexClosure) Run(status entity.Status) {
 	rc.runUserCallback(status)
 }
 
+//CatchUpClosure 等待 Replicator 追上 Leader 的日志，和 Leader 的差距不超过 maxMargin 时以成功回调，timer 触发时以 ETIMEDOUT 回调
 type CatchUpClosure struct {
 	maxMargin   int64
-	future      utils.Future
+	timer       utils.Timer
 	errorWasSet bool
 	status      entity.Status
 	F           func(status entity.Status)
@@ -259,8 +259,8 @@ func (cuc *CatchUpClosure) SetMaxMargin(maxMargin int64) {
 	cuc.maxMargin = maxMargin
 }
 
-func (cuc *CatchUpClosure) GetFuture() utils.Future {
-	return cuc.future
+func (cuc *CatchUpClosure) GetTimer() utils.Timer {
+	return cuc.timer
 }
 
 func (cuc *CatchUpClosure) IsErrorWasSet() bool {
@@ -271,22 +271,55 @@ func (cuc *CatchUpClosure) SetErrorWasSet(errorWasSet bool) {
 	cuc.errorWasSet = errorWasSet
 }
 
-type StableClosure struct {
+//StableClosure 日志落盘后的回调，LogManager 在回调之前会设置好本批日志的 FirstLogIndex 以及 Entries
+type StableClosure interface {
+	Closure
+
+	GetFirstLogIndex() int64
+
+	SetFirstLogIndex(firstLogIndex int64)
+
+	GetEntries() []*entity.LogEntry
+
+	SetEntries(entries []*entity.LogEntry)
+}
+
+type BaseStableClosure struct {
 	FirstLogIndex int64
 	Entries       []*entity.LogEntry
 	NEntries      int32
 	f             func(status entity.Status)
 }
 
-func NewStableClosure(entries []*entity.LogEntry, f func(status entity.Status)) *StableClosure {
-	return &StableClosure{
-		Entries: entries,
-		f:       f,
+func NewStableClosure(entries []*entity.LogEntry, f func(status entity.Status)) *BaseStableClosure {
+	return &BaseStableClosure{
+		Entries:  entries,
+		NEntries: int32(len(entries)),
+		f:        f,
 	}
 }
 
-func (sc *StableClosure) Run(status entity.Status) {
-	sc.f(status)
+func (sc *BaseStableClosure) GetFirstLogIndex() int64 {
+	return sc.FirstLogIndex
+}
+
+func (sc *BaseStableClosure) SetFirstLogIndex(firstLogIndex int64) {
+	sc.FirstLogIndex = firstLogIndex
+}
+
+func (sc *BaseStableClosure) GetEntries() []*entity.LogEntry {
+	return sc.Entries
+}
+
+func (sc *BaseStableClosure) SetEntries(entries []*entity.LogEntry) {
+	sc.Entries = entries
+	sc.NEntries = int32(len(entries))
+}
+
+func (sc *BaseStableClosure) Run(status entity.Status) {
+	if sc.f != nil {
+		sc.f(status)
+	}
 }
 
 type OnErrorClosure struct {
@@ -314,12 +347,12 @@ func (rrc *RpcResponseClosure) Run(status entity.Status) {
 
 type RpcRequestClosure struct {
 	state       int32
-	rpcCtx      *rpc.RpcContext
+	rpcCtx      polerpc.RpcServerContext
 	defaultResp *polerpc.ServerResponse
 	F           func(status entity.Status)
 }
 
-func NewRpcRequestClosure(rpcCtx *rpc.RpcContext) *RpcRequestClosure {
+func NewRpcRequestClosure(rpcCtx polerpc.RpcServerContext) *RpcRequestClosure {
 	return &RpcRequestClosure{
 		state:       RpcPending,
 		rpcCtx:      rpcCtx,
@@ -327,7 +360,7 @@ func NewRpcRequestClosure(rpcCtx *rpc.RpcContext) *RpcRequestClosure {
 	}
 }
 
-func NewRpcRequestClosureWithDefaultResp(rpcCtx *rpc.RpcContext, defaultResp *polerpc.ServerResponse) *RpcRequestClosure {
+func NewRpcRequestClosureWithDefaultResp(rpcCtx polerpc.RpcServerContext, defaultResp *polerpc.ServerResponse) *RpcRequestClosure {
 	return &RpcRequestClosure{
 		state:       RpcPending,
 		rpcCtx:      rpcCtx,
@@ -335,34 +368,34 @@ func NewRpcRequestClosureWithDefaultResp(rpcCtx *rpc.RpcContext, defaultResp *po
 	}
 }
 
-func (rrc *RpcRequestClosure) GetRpcCtx() *rpc.RpcContext {
+func (rrc *RpcRequestClosure) GetRpcCtx() polerpc.RpcServerContext {
 	return rrc.rpcCtx
 }
 
 func (rrc *RpcRequestClosure) SendResponse(msg *polerpc.ServerResponse) {
 	if atomic.CompareAndSwapInt32(&rrc.state, RpcPending, RpcRespond) {
-		rrc.rpcCtx.SendMsg(msg)
+		rrc.rpcCtx.Send(msg)
 	}
 }
 
-func (rrc *RpcRequestClosure) Run(status entity.Status) {
-
-	errResp := &proto2.ErrorResponse{
-		ErrorCode: int32(status.GetCode()),
-		ErrorMsg:  status.GetMsg(),
-	}
-
-	a, err := ptypes.MarshalAny(errResp)
+//SendProtoResponse 将 proto 格式的响应序列化之后回复给请求方，只有第一次回复会生效
+func (rrc *RpcRequestClosure) SendProtoResponse(funName string, msg proto.Message) {
+	body, err := ptypes.MarshalAny(msg)
 	if err != nil {
-		panic(err)
+		utils.RaftLog.Error("Fail to marshal %s response : %s", funName, err)
+		rrc.Run(entity.NewStatus(entity.EInternal, err.Error()))
+		return
 	}
-
 	rrc.SendResponse(&polerpc.ServerResponse{
-		FunName: rpc.CommonRpcErrorCommand,
-		Body:    a,
+		FunName: funName,
+		Body:    body,
 	})
 }
 
+func (rrc *RpcRequestClosure) Run(status entity.Status) {
+	rrc.SendResponse(rpc.NewErrorServerResponse(status.GetCode(), status.GetMsg()))
+}
+
 type OnPreVoteRpcDone struct {
 	RpcResponseClosure
 	PeerId    entity.PeerId
@@ -395,3 +428,7 @@ type InstallSnapshotResponseClosure struct {
 type TimeoutNowResponseClosure struct {
 	RpcResponseClosure
 }
+
+type GetFileResponseClosure struct {
+	RpcResponseClosure
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/rpc"
+	"github.com/pole-group/lraft/utils"
+)
+
+const testElectionTimeoutMs = 1000
+
+//testCluster 运行在 rpc.FaultNetwork 上的 raft 集群，默认不启动选举的定时任务，由测试用例调用 preVote、electSelf
+//来驱动选举，这样每一次选举的发起者都是确定的；调用 enableElection 之后由节点自己发起选举
+type testCluster struct {
+	t       *testing.T
+	network *rpc.FaultNetwork
+	clock   utils.Clock
+	peers   []entity.PeerId
+	nodes   []*nodeImpl
+}
+
+func newTestCluster(t *testing.T, size int, seed int64) *testCluster {
+	return newTestClusterWithClock(t, size, seed, utils.SystemClock)
+}
+
+func newTestClusterWithClock(t *testing.T, size int, seed int64, clock utils.Clock) *testCluster {
+	c := &testCluster{
+		t:       t,
+		network: rpc.NewFaultNetwork(seed),
+		clock:   clock,
+		peers:   make([]entity.PeerId, 0, size),
+		nodes:   make([]*nodeImpl, 0, size),
+	}
+	for i := 0; i < size; i++ {
+		peer := entity.PeerId{}
+		peer.Parse(fmt.Sprintf("127.0.0.1:%d", 8081+i))
+		c.peers = append(c.peers, peer)
+	}
+	for _, peer := range c.peers {
+		c.nodes = append(c.nodes, c.newNode(peer))
+	}
+	t.Cleanup(c.stop)
+	return c
+}
+
+//newNode 通过 NewNode 在 FaultNetwork 上创建节点，之后关闭选举的定时任务，由测试用例决定谁来发起选举
+func (c *testCluster) newNode(self entity.PeerId) *nodeImpl {
+	server, err := c.network.NewServer(self.GetEndpoint())
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	opts := NewDefaultNodeOptions()
+	opts.ElectionTimeoutMs = testElectionTimeoutMs
+	opts.Clock = c.clock
+	opts.Fsm = &kvStateMachine{}
+	opts.LogURI = "mem://"
+	opts.RaftMetaURI = c.t.TempDir()
+	opts.InitialConf = entity.NewConfiguration(c.peers, nil)
+	opts.ServerTransport = server
+	opts.ClientTransport = c.network.NewClient(self.GetEndpoint())
+	opts.RaftOptions.ReadOnlyOpt = ReadOnlySafe
+	n, err := NewNode(testGroupID, self, opts)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	node := n.(*nodeImpl)
+	node.lock.Lock()
+	node.raftNodeJobMgn.stopJob(JobForElection)
+	node.raftNodeJobMgn.electionJob = nil
+	node.lock.Unlock()
+	return node
+}
+
+func (c *testCluster) stop() {
+	for _, node := range c.nodes {
+		node.Shutdown(nil)
+	}
+	for _, node := range c.nodes {
+		node.Join()
+		node.rpcServer.Close()
+	}
+}
+
+func (c *testCluster) endpoints(nodes ...*nodeImpl) []entity.Endpoint {
+	endpoints := make([]entity.Endpoint, 0, len(nodes))
+	for _, node := range nodes {
+		endpoints = append(endpoints, node.serverID.GetEndpoint())
+	}
+	return endpoints
+}
+
+//others 除了 node 之外的其他节点
+func (c *testCluster) others(node *nodeImpl) []*nodeImpl {
+	others := make([]*nodeImpl, 0, len(c.nodes)-1)
+	for _, n := range c.nodes {
+		if n != node {
+			others = append(others, n)
+		}
+	}
+	return others
+}
+
+//partition 把节点划分为互相隔离的分组
+func (c *testCluster) partition(groups ...[]*nodeImpl) {
+	endpoints := make([][]entity.Endpoint, 0, len(groups))
+	for _, group := range groups {
+		endpoints = append(endpoints, c.endpoints(group...))
+	}
+	c.network.Partition(endpoints...)
+}
+
+//preVote 模拟选举超时，node 放弃当前的 Leader 并且发起预投票
+func (c *testCluster) preVote(node *nodeImpl) {
+	node.lock.Lock()
+	node.resetLeaderId(entity.EmptyPeer, entity.NewStatus(entity.ERaftTimedOut, "election timeout in test"))
+	doPreVote(node)
+}
+
+//electSelf 跳过预投票直接发起投票
+func (c *testCluster) electSelf(node *nodeImpl) {
+	node.lock.Lock()
+	electSelf(node)
+}
+
+func (c *testCluster) status(node *nodeImpl) (NodeState, int64, entity.PeerId) {
+	defer node.lock.RUnlock()
+	node.lock.RLock()
+	return node.state, node.currTerm, node.leaderID.Copy()
+}
+
+//waitLeader 等待 leader 成为 Leader，并且 followers 都认可它
+func (c *testCluster) waitLeader(leader *nodeImpl, followers ...*nodeImpl) int64 {
+	c.t.Helper()
+	var term int64
+	waitUntil(c.t, "leader "+leader.serverID.GetDesc(), func() bool {
+		var state NodeState
+		state, term, _ = c.status(leader)
+		if state != StateLeader {
+			return false
+		}
+		for _, follower := range followers {
+			state, followerTerm, leaderID := c.status(follower)
+			if state != StateFollower || followerTerm != term || !leaderID.Equal(leader.serverID) {
+				return false
+			}
+		}
+		return true
+	})
+	return term
+}
+
+//enableElection 启动所有节点的选举定时任务，之后由节点自己发起选举
+func (c *testCluster) enableElection() {
+	for _, node := range c.nodes {
+		node.lock.Lock()
+		node.options.ElectionMaxDelayMs = testElectionTimeoutMs
+		node.raftNodeJobMgn.electionJob = newElector(node, node.raftNodeJobMgn)
+		node.raftNodeJobMgn.startJob(JobForElection)
+		node.lock.Unlock()
+	}
+}
+
+//apply 和 Leader 处理 Task 的流程一致，以 Leader 当前的任期追加 count 条日志，返回最后一条日志的 index
+func (c *testCluster) apply(leader *nodeImpl, count int) int64 {
+	c.t.Helper()
+	data := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		data = append(data, []byte(fmt.Sprintf("%s-%d", leader.serverID.GetDesc(), i)))
+	}
+	lastIndex, ok := c.appendData(leader, data...)
+	if !ok {
+		c.t.Fatalf("node %s is not leader", leader.serverID.GetDesc())
+	}
+	return lastIndex
+}
+
+//appendData 以 Leader 当前的任期追加日志，node 不是 Leader 时返回 false
+func (c *testCluster) appendData(node *nodeImpl, data ...[]byte) (int64, bool) {
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	if node.state != StateLeader {
+		return 0, false
+	}
+	entries := make([]*entity.LogEntry, 0, len(data))
+	for _, d := range data {
+		entry := entity.NewLogEntry(raft.EntryType_EntryTypeData)
+		entry.LogID = entity.NewLogID(0, node.currTerm)
+		entry.Data = d
+		node.ballotBox.AppendPendingTask(node.conf.GetConf(), nil, NewStableClosure(nil,
+			func(status entity.Status) {}))
+		entries = append(entries, entry)
+	}
+	node.logManager.AppendEntries(entries, &LeaderStableClosure{
+		BaseStableClosure: BaseStableClosure{NEntries: int32(len(entries))},
+		node:              node,
+	})
+	return entries[len(entries)-1].LogID.GetIndex(), true
+}
+
+//waitCommitted 等待 nodes 的 committedIndex 都推进到 index
+func (c *testCluster) waitCommitted(index int64, nodes ...*nodeImpl) {
+	c.t.Helper()
+	waitUntil(c.t, fmt.Sprintf("commit index %d", index), func() bool {
+		for _, node := range nodes {
+			if node.ballotBox.GetLastCommittedIndex() < index {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+//readIndex 在 node 上执行一次 ReadIndex 请求，返回 node 回复给请求方的结果
+func (c *testCluster) readIndex(node *nodeImpl) (*raft.ReadIndexResponse, entity.Status) {
+	c.t.Helper()
+	resp, st := c.tryReadIndex(node)
+	if st.GetCode() == entity.ETIMEDOUT {
+		c.t.Fatalf("read index on %s timeout", node.serverID.GetDesc())
+	}
+	return resp, st
+}
+
+//tryReadIndex 和 readIndex 相同，但是超时的时候返回 ETIMEDOUT 而不是让测试失败，可以在其他协程中调用
+func (c *testCluster) tryReadIndex(node *nodeImpl) (*raft.ReadIndexResponse, entity.Status) {
+	req := &raft.ReadIndexRequest{
+		GroupID:  testGroupID,
+		ServerID: node.serverID.GetDesc(),
+		PeerID:   node.serverID.GetDesc(),
+		Entries:  [][]byte{[]byte("read")},
+	}
+	rpcCtx := newTestRpcContext()
+	node.handleReadIndexRequest(req, NewRpcRequestClosure(rpcCtx))
+	select {
+	case resp := <-rpcCtx.respC:
+		msg, st := rpc.GlobalProtoRegistry.DecodeResponse(rpc.CoreReadIndexRequest, resp)
+		if !st.IsOK() {
+			return nil, st
+		}
+		readResp := msg.(*raft.ReadIndexResponse)
+		if errResp := readResp.ErrorResponse; errResp != nil && errResp.ErrorCode != int32(entity.SUCCESS) {
+			return nil, entity.NewStatus(entity.RaftErrorCode(errResp.ErrorCode), errResp.ErrorMsg)
+		}
+		return readResp, entity.StatusOK()
+	case <-time.After(testWaitTimeout):
+		return nil, entity.NewStatus(entity.ETIMEDOUT, "read index timeout")
+	}
+}
+
+//checkLogs 检查 nodes 在 [1, lastIndex] 范围内的日志完全一致
+func (c *testCluster) checkLogs(lastIndex int64, nodes ...*nodeImpl) {
+	c.t.Helper()
+	expect := nodes[0]
+	for _, node := range nodes[1:] {
+		for index := int64(1); index <= lastIndex; index++ {
+			a, b := expect.logManager.GetEntry(index), node.logManager.GetEntry(index)
+			if a == nil || b == nil || a.LogID.GetTerm() != b.LogID.GetTerm() || string(a.Data) != string(b.Data) {
+				c.t.Fatalf("log %d on %s and %s is different", index, expect.serverID.GetDesc(),
+					node.serverID.GetDesc())
+			}
+		}
+	}
+}
+
@@ -0,0 +1,210 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/utils"
+)
+
+//FileReader 按照 offset 以及 count 读取某个目录下的文件，返回读取到的数据以及是否已经读到了文件末尾
+type FileReader interface {
+	GetPath() string
+
+	ReadFile(fileName string, offset, maxCount int64) ([]byte, bool, error)
+}
+
+//LocalDirReader 读取本地目录下的文件，不允许访问目录之外的文件
+type LocalDirReader struct {
+	path string
+}
+
+func NewLocalDirReader(path string) *LocalDirReader {
+	return &LocalDirReader{
+		path: path,
+	}
+}
+
+func (ldr *LocalDirReader) GetPath() string {
+	return ldr.path
+}
+
+func (ldr *LocalDirReader) ReadFile(fileName string, offset, maxCount int64) ([]byte, bool, error) {
+	return ldr.readLocalFile(fileName, offset, maxCount)
+}
+
+func (ldr *LocalDirReader) readLocalFile(fileName string, offset, maxCount int64) ([]byte, bool, error) {
+	cleanName := filepath.Clean(fileName)
+	if filepath.IsAbs(cleanName) || cleanName == ".." || strings.HasPrefix(cleanName, ".."+string(filepath.Separator)) {
+		return nil, false, fmt.Errorf("invalid file name %s", fileName)
+	}
+	f, err := os.Open(filepath.Join(ldr.path, cleanName))
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	buf := make([]byte, maxCount)
+	n, err := f.ReadAt(buf, offset)
+	if err == io.EOF {
+		return buf[:n], true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	// 恰好读满 maxCount 时需要确认是否已经到了文件末尾，避免 follower 再多发一次请求
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	return buf[:n], offset+int64(n) >= info.Size(), nil
+}
+
+//SnapshotFileReader 读取快照目录下的文件，元数据文件直接由内存中的 localSnapshotMetaTable 生成，
+// 并且只允许读取元数据中登记过的文件
+type SnapshotFileReader struct {
+	LocalDirReader
+	metaTable        *localSnapshotMetaTable
+	snapshotThrottle SnapshotThrottle
+}
+
+func NewSnapshotFileReader(path string, metaTable *localSnapshotMetaTable, throttle SnapshotThrottle) *SnapshotFileReader {
+	return &SnapshotFileReader{
+		LocalDirReader: LocalDirReader{
+			path: path,
+		},
+		metaTable:        metaTable,
+		snapshotThrottle: throttle,
+	}
+}
+
+func (sfr *SnapshotFileReader) ReadFile(fileName string, offset, maxCount int64) ([]byte, bool, error) {
+	if fileName == raftSnapshotMetaFile {
+		b, err := sfr.metaTable.saveToBytes()
+		if err != nil {
+			return nil, false, err
+		}
+		if offset >= int64(len(b)) {
+			return []byte{}, true, nil
+		}
+		end := offset + maxCount
+		if end >= int64(len(b)) {
+			return b[offset:], true, nil
+		}
+		return b[offset:end], false, nil
+	}
+	if sfr.metaTable.getFileMeta(fileName) == nil {
+		return nil, false, &os.PathError{Op: "read", Path: fileName, Err: os.ErrNotExist}
+	}
+	// 元数据文件很小，只对快照中的数据文件限流
+	if sfr.snapshotThrottle == nil {
+		return sfr.readLocalFile(fileName, offset, maxCount)
+	}
+	startUs := monotonicUs()
+	acquired := sfr.snapshotThrottle.ThrottledByThroughput(maxCount)
+	if acquired <= 0 {
+		return nil, false, ErrSnapshotThrottled
+	}
+	data, eof, err := sfr.readLocalFile(fileName, offset, acquired)
+	// 读取失败或者读到了文件末尾时实际读取的字节数少于获取的额度，多余的额度需要归还
+	sfr.snapshotThrottle.ReturnUnusedThroughput(acquired, int64(len(data)), monotonicUs()-startUs)
+	return data, eof, err
+}
+
+var fileService = newFileService()
+
+//FileService leader 对外提供文件下载的服务，每一个 FileReader 注册之后会分配一个 readerID，
+//follower 通过 CoreGetFileRequest 携带 readerID 分块读取文件
+type FileService struct {
+	lock    sync.RWMutex
+	nextID  int64
+	readers map[int64]FileReader
+}
+
+func newFileService() *FileService {
+	// readerID 从一个随机值开始，避免节点重启之后 follower 使用旧的 readerID 读到了新的快照
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return &FileService{
+		nextID:  r.Int63n(1<<31) + 1,
+		readers: make(map[int64]FileReader),
+	}
+}
+
+func GetFileService() *FileService {
+	return fileService
+}
+
+func (fs *FileService) AddReader(reader FileReader) int64 {
+	defer fs.lock.Unlock()
+	fs.lock.Lock()
+	readerID := fs.nextID
+	fs.nextID++
+	fs.readers[readerID] = reader
+	return readerID
+}
+
+func (fs *FileService) RemoveReader(readerID int64) bool {
+	defer fs.lock.Unlock()
+	fs.lock.Lock()
+	if _, ok := fs.readers[readerID]; !ok {
+		return false
+	}
+	delete(fs.readers, readerID)
+	return true
+}
+
+func (fs *FileService) getReader(readerID int64) FileReader {
+	defer fs.lock.RUnlock()
+	fs.lock.RLock()
+	return fs.readers[readerID]
+}
+
+//HandleGetFile 处理 follower 的 GetFileRequest，每次最多读取 count 个字节
+func (fs *FileService) HandleGetFile(req *raft.GetFileRequest) *raft.GetFileResponse {
+	if req.GetCount() <= 0 || req.GetOffset() < 0 {
+		return &raft.GetFileResponse{
+			ErrorResponse: entity.NewErrorResponse(entity.EINVAL, "Invalid GetFileRequest, count=%d, offset=%d",
+				req.GetCount(), req.GetOffset()),
+		}
+	}
+	reader := fs.getReader(req.GetReaderID())
+	if reader == nil {
+		return &raft.GetFileResponse{
+			ErrorResponse: entity.NewErrorResponse(entity.ENOENT, "Fail to find reader=%d", req.GetReaderID()),
+		}
+	}
+	data, eof, err := reader.ReadFile(req.GetFilename(), req.GetOffset(), req.GetCount())
+	if err == ErrSnapshotThrottled {
+		return &raft.GetFileResponse{
+			ErrorResponse: entity.NewErrorResponse(entity.EAGAIN, "Read %s throttled by throughput, try again later",
+				req.GetFilename()),
+		}
+	}
+	if err != nil {
+		utils.RaftLog.Error("Fail to read %s from path %s : %s", req.GetFilename(), reader.GetPath(), err)
+		code := entity.EIO
+		if os.IsNotExist(err) {
+			code = entity.ENOENT
+		}
+		return &raft.GetFileResponse{
+			ErrorResponse: entity.NewErrorResponse(code, "Fail to read from path=%s filename=%s : %s",
+				reader.GetPath(), req.GetFilename(), err),
+		}
+	}
+	return &raft.GetFileResponse{
+		Eof:      eof,
+		Data:     data,
+		ReadSize: int64(len(data)),
+	}
+}
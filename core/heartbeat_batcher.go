@@ -0,0 +1,210 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jjeffcaii/reactor-go/mono"
+	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/rpc"
+	"github.com/pole-group/lraft/utils"
+)
+
+//heartbeatBatch 在同一个时间窗口内等待发往同一个 Endpoint 的心跳
+type heartbeatBatch struct {
+	endpoint    entity.Endpoint
+	clock       utils.Clock
+	entries     []*raft.HeartbeatRequestEntry
+	replicators []*Replicator
+}
+
+func (batch *heartbeatBatch) append(r *Replicator, entry *raft.HeartbeatRequestEntry) {
+	batch.entries = append(batch.entries, entry)
+	batch.replicators = append(batch.replicators, r)
+}
+
+//heartbeatBatcher 将同一个 NodeManager 上所有 Leader 发往同一个 Endpoint 的心跳合并为一个 BatchHeartbeatRequest，
+//第一个心跳到达时开启时间窗口，窗口结束时整批发送。发送时还会带上发往该 Endpoint、仍在等待定时器的其他 Replicator 的心跳，
+//同一批心跳的响应返回之后这些 Replicator 从相同的发送时间开始计算下一次心跳，因此之后的心跳总是落在同一个窗口内
+type heartbeatBatcher struct {
+	lock       sync.Mutex
+	client     rpc.ClientTransport
+	window     time.Duration
+	batches    map[string]*heartbeatBatch          // <endpoint, batch>
+	waiting    map[string]map[*Replicator]struct{} // <endpoint, 等待下一次心跳的 Replicator>
+	isShutdown bool
+}
+
+func newHeartbeatBatcher(client rpc.ClientTransport, windowMs int32) *heartbeatBatcher {
+	return &heartbeatBatcher{
+		client:  client,
+		window:  time.Duration(windowMs) * time.Millisecond,
+		batches: make(map[string]*heartbeatBatch),
+		waiting: make(map[string]map[*Replicator]struct{}),
+	}
+}
+
+//wait Replicator 开启了下一次心跳的定时器，调用时持有 Replicator 的锁
+func (hb *heartbeatBatcher) wait(r *Replicator) {
+	defer hb.lock.Unlock()
+	hb.lock.Lock()
+	if hb.isShutdown {
+		return
+	}
+	key := r.options.peerId.GetEndpoint().GetDesc()
+	waiters, exist := hb.waiting[key]
+	if !exist {
+		waiters = make(map[*Replicator]struct{})
+		hb.waiting[key] = waiters
+	}
+	waiters[r] = struct{}{}
+}
+
+//cancelWait Replicator 停止之后不再参与合并
+func (hb *heartbeatBatcher) cancelWait(r *Replicator) {
+	defer hb.lock.Unlock()
+	hb.lock.Lock()
+	key := r.options.peerId.GetEndpoint().GetDesc()
+	delete(hb.waiting[key], r)
+}
+
+//add 加入 Replicator 定时器触发的心跳，窗口的定时任务使用 Replicator 的 clock；关闭之后直接以 EShutdown 回调
+func (hb *heartbeatBatcher) add(r *Replicator, entry *raft.HeartbeatRequestEntry) {
+	endpoint := r.options.peerId.GetEndpoint()
+	hb.lock.Lock()
+	if hb.isShutdown {
+		hb.lock.Unlock()
+		r.onBatchedHeartbeatReturn(nil, entity.NewStatus(entity.EShutdown, "node manager is shutdown"),
+			r.options.clock.NowMs())
+		return
+	}
+	key := endpoint.GetDesc()
+	delete(hb.waiting[key], r)
+	batch, exist := hb.batches[key]
+	if !exist {
+		batch = &heartbeatBatch{
+			endpoint: endpoint,
+			clock:    r.options.clock,
+		}
+		hb.batches[key] = batch
+		r.options.clock.AfterFunc(hb.window, func() {
+			hb.flush(key)
+		})
+	}
+	batch.append(r, entry)
+	hb.lock.Unlock()
+}
+
+//flush 发送 endpoint 当前窗口内的所有心跳，响应按照请求中的顺序分发给每一个 Replicator
+func (hb *heartbeatBatcher) flush(key string) {
+	hb.lock.Lock()
+	batch, exist := hb.batches[key]
+	delete(hb.batches, key)
+	waiters := hb.waiting[key]
+	delete(hb.waiting, key)
+	hb.lock.Unlock()
+	if !exist {
+		return
+	}
+	// 获取 Replicator 的锁时不能持有 hb.lock，Replicator 持有自己的锁时会调用 wait
+	for r := range waiters {
+		if entry := r.pullHeartbeat(); entry != nil {
+			batch.append(r, entry)
+		}
+	}
+
+	sendTime := batch.clock.NowMs()
+	req := &raft.BatchHeartbeatRequest{
+		Entries: batch.entries,
+	}
+	done := &RpcResponseClosure{}
+	done.F = func(resp proto.Message, status entity.Status) {
+		var batchResp *raft.BatchHeartbeatResponse
+		if status.IsOK() {
+			batchResp, status = parseBatchHeartbeatResponse(resp, len(batch.entries))
+		}
+		for i, r := range batch.replicators {
+			if !status.IsOK() {
+				r.onBatchedHeartbeatReturn(nil, status, sendTime)
+				continue
+			}
+			entryResp, entry := batchResp.Entries[i], batch.entries[i]
+			if entryResp.GroupID != entry.GroupID || entryResp.PeerID != entry.PeerID {
+				r.onBatchedHeartbeatReturn(nil, entity.NewStatus(entity.ERequest, fmt.Sprintf("heartbeat response "+
+					"of %s:%s is mismatched with request %s:%s", entryResp.GroupID, entryResp.PeerID, entry.GroupID,
+					entry.PeerID)), sendTime)
+				continue
+			}
+			r.onBatchedHeartbeatReturn(entryResp, entity.StatusOK(), sendTime)
+		}
+	}
+	sendAsync(done, func() mono.Mono {
+		return invokeWithClosure(batch.endpoint, hb.client, rpc.CoreBatchHeartbeatRequest, req, done)
+	})
+	utils.RaftLog.Debug("send BatchHeartbeatRequest with %d groups to %s", len(batch.entries),
+		batch.endpoint.GetDesc())
+}
+
+//shutdown 之后不再接收新的心跳，窗口中还没有发送的心跳以 EShutdown 回调
+func (hb *heartbeatBatcher) shutdown() {
+	hb.lock.Lock()
+	hb.isShutdown = true
+	batches := hb.batches
+	hb.batches = make(map[string]*heartbeatBatch)
+	hb.waiting = make(map[string]map[*Replicator]struct{})
+	hb.lock.Unlock()
+	st := entity.NewStatus(entity.EShutdown, "node manager is shutdown")
+	for _, batch := range batches {
+		for _, r := range batch.replicators {
+			r.onBatchedHeartbeatReturn(nil, st, batch.clock.NowMs())
+		}
+	}
+}
+
+func parseBatchHeartbeatResponse(resp proto.Message, expectEntries int) (*raft.BatchHeartbeatResponse,
+	entity.Status) {
+	batchResp, ok := resp.(*raft.BatchHeartbeatResponse)
+	if !ok || batchResp == nil {
+		return nil, entity.NewStatus(entity.ERequest, "invalid BatchHeartbeatResponse")
+	}
+	if errResp := batchResp.ErrorResponse; errResp != nil && errResp.ErrorCode != int32(entity.SUCCESS) {
+		return nil, entity.NewStatus(entity.RaftErrorCode(errResp.ErrorCode), errResp.ErrorMsg)
+	}
+	if len(batchResp.Entries) != expectEntries {
+		return nil, entity.NewStatus(entity.ERequest, fmt.Sprintf("BatchHeartbeatResponse has %d entries, "+
+			"expect %d", len(batchResp.Entries), expectEntries))
+	}
+	return batchResp, entity.StatusOK()
+}
+
+//handleBatchHeartbeatRequest Follower 所在的 NodeManager 将每一项心跳分发给对应的节点，找不到节点的一项单独回复错误
+func (nm *NodeManager) handleBatchHeartbeatRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	batchReq := req.(*raft.BatchHeartbeatRequest)
+	resp := &raft.BatchHeartbeatResponse{
+		Entries: make([]*raft.HeartbeatResponseEntry, 0, len(batchReq.Entries)),
+	}
+	for _, entry := range batchReq.Entries {
+		node, st := nm.findNode(entry.GroupID, entry.PeerID)
+		if !st.IsOK() {
+			resp.Entries = append(resp.Entries, &raft.HeartbeatResponseEntry{
+				GroupID:       entry.GroupID,
+				PeerID:        entry.PeerID,
+				ErrorResponse: entity.NewErrorResponse(st.GetCode(), "%s", st.GetMsg()),
+			})
+			continue
+		}
+		resp.Entries = append(resp.Entries, node.handleHeartbeatRequest(entry))
+	}
+	NewRpcRequestClosure(rpcCtx).SendProtoResponse(rpc.CoreBatchHeartbeatRequest, resp)
+}
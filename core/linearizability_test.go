@@ -0,0 +1,284 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pole-group/lraft/entity"
+	"github.com/pole-group/lraft/rpc"
+	"github.com/pole-group/lraft/utils"
+)
+
+const (
+	kvEntryPrefix = "kv:"
+	// 客户端等待写入被状态机 apply 或者读请求返回的最长时间，超过之后写请求的结果视为未知
+	kvClientTimeout = 2 * time.Second
+)
+
+//kvHistory 记录客户端的每一次操作以及调用、返回的时间
+type kvHistory struct {
+	lock  sync.Mutex
+	start time.Time
+	ops   []utils.Operation
+}
+
+func newKvHistory() *kvHistory {
+	return &kvHistory{start: time.Now()}
+}
+
+func (h *kvHistory) now() int64 {
+	return int64(time.Since(h.start))
+}
+
+func (h *kvHistory) add(op utils.Operation) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.ops = append(h.ops, op)
+}
+
+func (h *kvHistory) operations() []utils.Operation {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	ops := make([]utils.Operation, len(h.ops))
+	copy(ops, h.ops)
+	return ops
+}
+
+//kvStateMachine 将 kvEntryPrefix 开头的日志作为对 key 的写入 apply 到内存中，其他日志直接跳过，每一条日志都会回调 Done
+type kvStateMachine struct {
+	recordStateMachine
+	lock sync.RWMutex
+	kv   map[string]string
+}
+
+func (fsm *kvStateMachine) OnApply(iterator Iterator) {
+	for iterator.HasNext() {
+		done := iterator.Done()
+		data := string(iterator.Next())
+		if strings.HasPrefix(data, kvEntryPrefix) {
+			kv := strings.SplitN(strings.TrimPrefix(data, kvEntryPrefix), "=", 2)
+			fsm.lock.Lock()
+			if fsm.kv == nil {
+				fsm.kv = make(map[string]string)
+			}
+			fsm.kv[kv[0]] = kv[1]
+			fsm.lock.Unlock()
+		}
+		if done != nil {
+			done.Run(entity.StatusOK())
+		}
+	}
+}
+
+func (fsm *kvStateMachine) get(key string) string {
+	defer fsm.lock.RUnlock()
+	fsm.lock.RLock()
+	return fsm.kv[key]
+}
+
+//putKv 通过 node 的 Apply 写入 key，node 不是 Leader 时不发起请求，不需要记录；Apply 失败或者没有在超时时间内提交的
+//请求可能已经写入了日志，结果是未知的，返回时间记为无穷大
+func (c *testCluster) putKv(h *kvHistory, client int, node *nodeImpl, key, value string) {
+	if !node.IsLeader() {
+		return
+	}
+	call := h.now()
+	done := make(statusClosure, 1)
+	if err := node.Apply(&Task{Data: []byte(kvEntryPrefix + key + "=" + value), Done: done}); err != nil {
+		return
+	}
+	ret := int64(math.MaxInt64)
+	select {
+	case st := <-done:
+		if st.IsOK() {
+			ret = h.now()
+		}
+	case <-time.After(kvClientTimeout):
+	}
+	h.add(utils.Operation{
+		ClientID: client,
+		Input:    utils.KvInput{Op: utils.KvPut, Key: key, Value: value},
+		Call:     call,
+		Return:   ret,
+	})
+}
+
+//readKv 通过 node 的 ReadIndex 读取 key，状态机 apply 到 readIndex 之后从 node 的状态机中读取，失败的读请求不会产生
+//任何影响，不需要记录
+func (c *testCluster) readKv(h *kvHistory, client int, node *nodeImpl, key string) {
+	fsm := node.options.Fsm.(*kvStateMachine)
+	call := h.now()
+	result := make(chan string, 1)
+	if err := node.ReadIndex(nil, NewReadIndexClosure(func(status entity.Status, index int64, reqCtx []byte) {
+		if status.IsOK() {
+			result <- fsm.get(key)
+		}
+		close(result)
+	}, kvClientTimeout)); err != nil {
+		return
+	}
+	value, ok := <-result
+	if !ok {
+		return
+	}
+	h.add(utils.Operation{
+		ClientID: client,
+		Input:    utils.KvInput{Op: utils.KvGet, Key: key},
+		Call:     call,
+		Output:   utils.KvOutput{Value: value},
+		Return:   h.now(),
+	})
+}
+
+//runKvClients 启动 clients 个客户端，在 duration 内随机的向各个节点发起读写请求，同时 nemesis 随机的隔离节点
+func (c *testCluster) runKvClients(seed int64, clients int, duration time.Duration) *kvHistory {
+	h := newKvHistory()
+	end := time.Now().Add(duration)
+	keys := []string{"x", "y"}
+	wg := sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(seed + int64(client)))
+			for seq := 0; time.Now().Before(end); seq++ {
+				node := c.nodes[random.Intn(len(c.nodes))]
+				key := keys[random.Intn(len(keys))]
+				if random.Intn(2) == 0 {
+					c.putKv(h, client, node, key, fmt.Sprintf("%d-%d", client, seq))
+				} else {
+					c.readKv(h, client, node, key)
+				}
+				time.Sleep(time.Duration(random.Intn(20)) * time.Millisecond)
+			}
+		}(i)
+	}
+
+	random := rand.New(rand.NewSource(seed))
+	for time.Now().Before(end) {
+		time.Sleep(time.Duration(testElectionTimeoutMs+random.Intn(testElectionTimeoutMs)) * time.Millisecond)
+		// 每一轮先恢复网络，再制造新的故障，保证总有多数派可以选出 Leader
+		c.network.HealPartition()
+		switch random.Intn(3) {
+		case 0:
+			c.network.Isolate(c.nodes[random.Intn(len(c.nodes))].serverID.GetEndpoint())
+		case 1:
+			// 隔离当前的 Leader，少数派中的旧 Leader 在降级之前仍然会收到读请求
+			for _, node := range c.nodes {
+				if state, _, _ := c.status(node); state == StateLeader {
+					c.network.Isolate(node.serverID.GetEndpoint())
+					break
+				}
+			}
+		}
+	}
+	c.network.HealPartition()
+	wg.Wait()
+	return h
+}
+
+func checkLinearizable(t *testing.T, readOnlyOpt ReadOnlyOption, seed int64) {
+	c := newTestCluster(t, 3, seed)
+	for _, node := range c.nodes {
+		node.raftOptions.ReadOnlyOpt = readOnlyOpt
+	}
+	c.network.SetDefaultFault(rpc.LinkFault{Latency: time.Millisecond, Jitter: 5 * time.Millisecond,
+		DropRate: 0.02})
+	c.enableElection()
+	// 缩小选举的随机延迟，让新 Leader 尽可能早的选出来，和旧 Leader 租约失效之后、降级之前的窗口重叠
+	for _, node := range c.nodes {
+		node.lock.Lock()
+		node.options.ElectionMaxDelayMs = testElectionTimeoutMs / 10
+		node.lock.Unlock()
+	}
+
+	h := c.runKvClients(seed, 4, 10*testElectionTimeoutMs*time.Millisecond)
+	ops := h.operations()
+	reads, writes := 0, 0
+	for _, op := range ops {
+		if op.Input.(utils.KvInput).Op == utils.KvGet {
+			reads++
+		} else {
+			writes++
+		}
+	}
+	if reads == 0 || writes == 0 {
+		t.Fatalf("history is too short to check, %d reads and %d writes", reads, writes)
+	}
+	if !utils.CheckOperations(utils.KvModel, ops) {
+		t.Fatalf("history with seed %d is not linearizable :\n%s", seed,
+			strings.Join(utils.DescribeOperations(utils.KvModel, ops), "\n"))
+	}
+	t.Logf("%d reads and %d writes are linearizable", reads, writes)
+}
+
+//TestLinearizableReadOnlySafe 网络分区以及丢包的情况下，ReadOnlySafe 模式的读写历史满足线性一致性
+func TestLinearizableReadOnlySafe(t *testing.T) {
+	checkLinearizable(t, ReadOnlySafe, 5)
+}
+
+//TestLinearizableReadOnlyLeaseBased 网络分区以及丢包的情况下，ReadOnlyLeaseBased 模式的读写历史满足线性一致性，
+//租约失效时读请求需要退化为 ReadOnlySafe
+func TestLinearizableReadOnlyLeaseBased(t *testing.T) {
+	checkLinearizable(t, ReadOnlyLeaseBased, 6)
+}
+
+//checkStaleLeaderRead 暂停旧 Leader 的 StepDownJob 并且隔离它，模拟定时任务被延迟的旧 Leader 在新 Leader 写入之后仍然
+//收到读请求，租约失效时 ReadOnlyLeaseBased 必须退化为 ReadOnlySafe，而 ReadOnlySafe 必须得到多数派的确认
+func checkStaleLeaderRead(t *testing.T, readOnlyOpt ReadOnlyOption, seed int64) {
+	c := newTestCluster(t, 3, seed)
+	n1, n2, n3 := c.nodes[0], c.nodes[1], c.nodes[2]
+	for _, node := range c.nodes {
+		node.raftOptions.ReadOnlyOpt = readOnlyOpt
+	}
+	c.electSelf(n1)
+	c.waitLeader(n1, n2, n3)
+	c.waitCommitted(c.apply(n1, 1), n1, n2, n3)
+
+	h := newKvHistory()
+	c.putKv(h, 0, n1, "x", "1")
+	// 写入在 n1、n3 组成的多数派上提交时 n2 可能还没有收到，n2 的日志落后时 n3 不会投票给它
+	c.waitCommitted(n1.logManager.GetLastLogIndex(), n1, n2, n3)
+	n1.lock.Lock()
+	n1.raftNodeJobMgn.stopJob(JobForStepDown)
+	n1.lock.Unlock()
+	c.network.Isolate(n1.serverID.GetEndpoint())
+	c.campaign(n2)
+	c.waitLeader(n2, n3)
+	c.putKv(h, 1, n2, "x", "2")
+	c.readKv(h, 2, n1, "x")
+	c.readKv(h, 2, n2, "x")
+
+	if state, _, _ := c.status(n1); state != StateLeader {
+		t.Fatalf("isolated node %s is %s, expect a stale leader", n1.serverID.GetDesc(), state.GetName())
+	}
+	ops := h.operations()
+	for _, op := range ops {
+		if op.Return == math.MaxInt64 {
+			t.Fatalf("put %v is not committed", op.Input)
+		}
+	}
+	if !utils.CheckOperations(utils.KvModel, ops) {
+		t.Fatalf("stale leader serves a stale read :\n%s",
+			strings.Join(utils.DescribeOperations(utils.KvModel, ops), "\n"))
+	}
+}
+
+//TestLinearizableStaleLeaderRead 少数派中还没有降级的旧 Leader 不能读到新 Leader 写入之前的值
+func TestLinearizableStaleLeaderRead(t *testing.T) {
+	t.Run("ReadOnlySafe", func(t *testing.T) {
+		checkStaleLeaderRead(t, ReadOnlySafe, 7)
+	})
+	t.Run("ReadOnlyLeaseBased", func(t *testing.T) {
+		checkStaleLeaderRead(t, ReadOnlyLeaseBased, 8)
+	})
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pole-group/lraft/entity"
+	"github.com/pole-group/lraft/utils"
+)
+
+type diskEventType int32
+
+const (
+	diskEventAppend diskEventType = iota
+	diskEventTruncatePrefix
+	diskEventTruncateSuffix
+	diskEventReset
+	diskEventLastLogID
+	diskEventFlush
+	diskEventShutdown
+)
+
+//StableClosureEvent LogManager 投递给磁盘写线程的事件，除了追加日志之外，截断以及重置日志也需要经过磁盘写线程，
+//保证对 LogStorage 的修改和日志追加的顺序一致
+type StableClosureEvent struct {
+	eType  diskEventType
+	done   StableClosure
+	index  int64
+	term   int64
+	result chan *entity.LogId
+}
+
+func (sce *StableClosureEvent) Name() string {
+	return "StableClosureEvent"
+}
+
+func (sce *StableClosureEvent) Sequence() int64 {
+	return 0
+}
+
+//logDiskWriter 磁盘写线程，将多次 AppendEntries 的日志合并成一批写入 LogStorage，一批日志只做一次 fsync，
+//落盘完成之后依次回调每一个 StableClosure
+type logDiskWriter struct {
+	lm            *LogManagerImpl
+	logStorage    LogStorage
+	batchSize     int
+	flushInterval time.Duration
+	clock         utils.Clock
+	closures      []StableClosure
+	entries       []*entity.LogEntry
+	timerArmed    int32
+}
+
+func newLogDiskWriter(lm *LogManagerImpl, raftOpts RaftOptions, clock utils.Clock) *logDiskWriter {
+	batchSize := int(raftOpts.MaxAppendBatchSize)
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	return &logDiskWriter{
+		lm:            lm,
+		logStorage:    lm.logStorage,
+		batchSize:     batchSize,
+		flushInterval: time.Duration(raftOpts.AppendFlushIntervalMs) * time.Millisecond,
+		clock:         clock,
+		closures:      make([]StableClosure, 0, batchSize),
+		entries:       make([]*entity.LogEntry, 0, batchSize),
+	}
+}
+
+func (ldw *logDiskWriter) OnEvent(event utils.Event, endOfBatch bool) {
+	e := event.(*StableClosureEvent)
+	switch e.eType {
+	case diskEventAppend:
+		ldw.closures = append(ldw.closures, e.done)
+		ldw.entries = append(ldw.entries, e.done.GetEntries()...)
+		if len(ldw.entries) >= ldw.batchSize || len(ldw.closures) >= ldw.batchSize {
+			ldw.flush()
+		}
+	case diskEventFlush:
+		ldw.flush()
+	default:
+		ldw.flush()
+		ldw.handleStorageEvent(e)
+	}
+	if endOfBatch {
+		ldw.endBatch()
+	}
+}
+
+func (ldw *logDiskWriter) endBatch() {
+	if len(ldw.closures) == 0 {
+		return
+	}
+	if ldw.flushInterval <= 0 {
+		ldw.flush()
+		return
+	}
+	ldw.armFlushTimer()
+}
+
+func (ldw *logDiskWriter) SubscribeType() utils.Event {
+	return &StableClosureEvent{}
+}
+
+func (ldw *logDiskWriter) IgnoreExpireEvent() bool {
+	return false
+}
+
+//armFlushTimer 当前批次没有攒满时，最多再等待 flushInterval 的时间，期间到达的日志会合并到同一批次中。定时器来自节点的
+//Clock，模拟测试中攒批的时机也由虚拟时间决定
+func (ldw *logDiskWriter) armFlushTimer() {
+	if !atomic.CompareAndSwapInt32(&ldw.timerArmed, 0, 1) {
+		return
+	}
+	ldw.clock.AfterFunc(ldw.flushInterval, func() {
+		atomic.StoreInt32(&ldw.timerArmed, 0)
+		// 定时器不持有 LogManager 的锁，flush 事件和其他事件之间也没有顺序要求，可以直接投递。EventBus 关闭时磁盘写线程
+		// 已经把剩余的日志落盘，这里的 flush 事件可以丢弃
+		if err := ldw.lm.eventBus.PublishEvent(&StableClosureEvent{eType: diskEventFlush}); err != nil {
+			utils.RaftLog.Warn("fail to publish disk flush event : %s", err)
+		}
+	})
+}
+
+func (ldw *logDiskWriter) flush() {
+	if len(ldw.closures) == 0 {
+		return
+	}
+	st := entity.StatusOK()
+	if len(ldw.entries) != 0 {
+		n := ldw.logStorage.AppendEntries(ldw.entries)
+		if n != len(ldw.entries) {
+			utils.RaftLog.Error("fail to append entries to log storage, expect %d, written %d", len(ldw.entries), n)
+			ldw.lm.reportError(entity.EIO, "Fail to append log entries")
+			st = entity.NewStatus(entity.EIO, "Fail to append log entries")
+		} else {
+			last := ldw.entries[len(ldw.entries)-1].LogID
+			ldw.lm.setDiskID(entity.NewLogID(last.GetIndex(), last.GetTerm()))
+		}
+	}
+	closures := ldw.closures
+	ldw.closures = make([]StableClosure, 0, ldw.batchSize)
+	ldw.entries = make([]*entity.LogEntry, 0, ldw.batchSize)
+	for _, done := range closures {
+		ldw.runClosure(done, st)
+	}
+}
+
+func (ldw *logDiskWriter) runClosure(done StableClosure, st entity.Status) {
+	defer func() {
+		if err := recover(); err != nil {
+			utils.RaftLog.Error("run stable closure occur panic error : %s", err)
+		}
+	}()
+	done.Run(st)
+}
+
+func (ldw *logDiskWriter) handleStorageEvent(e *StableClosureEvent) {
+	switch e.eType {
+	case diskEventTruncatePrefix:
+		if !ldw.logStorage.TruncatePrefix(e.index) {
+			ldw.lm.reportError(entity.EIO, "Fail to truncate log prefix, firstIndexKept=%d", e.index)
+		}
+	case diskEventTruncateSuffix:
+		if !ldw.logStorage.TruncateSuffix(e.index) {
+			ldw.lm.reportError(entity.EIO, "Fail to truncate log suffix, lastIndexKept=%d", e.index)
+			return
+		}
+		ldw.lm.resetDiskID(entity.NewLogID(e.index, e.term))
+	case diskEventReset:
+		// Rest 会保留 nextLogIndex 对应的日志，这里需要将其一并清除，保证 LogStorage 和 LogManager 的视图一致
+		if !ldw.logStorage.Rest(e.index) || !ldw.logStorage.TruncateSuffix(e.index-1) {
+			ldw.lm.reportError(entity.EIO, "Fail to reset log storage, nextLogIndex=%d", e.index)
+			return
+		}
+		ldw.lm.resetDiskID(entity.NewLogID(e.index-1, e.term))
+	case diskEventLastLogID:
+		ldw.lm.lock.RLock()
+		id := entity.NewLogID(ldw.lm.diskID.GetIndex(), ldw.lm.diskID.GetTerm())
+		ldw.lm.lock.RUnlock()
+		e.result <- id
+	case diskEventShutdown:
+		ldw.lm.eventBus.DeregisterSubscriber(ldw)
+		ldw.logStorage.Shutdown()
+		ldw.lm.shutdownLatch.Done()
+	}
+}
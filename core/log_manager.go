@@ -0,0 +1,693 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/utils"
+)
+
+type waitMeta struct {
+	onNewLog NewLogCallback
+	arg      interface{}
+	errCode  int32
+}
+
+//LogManagerImpl 负责管理 raft 日志，在 LogStorage 之上维护了一份尚未被状态机 apply 的日志缓存、配置变更记录以及日志等待者
+type LogManagerImpl struct {
+	lock                  sync.RWMutex
+	logStorage            LogStorage
+	confMgn               *entity.ConfigurationManager
+	fsmCaller             FSMCaller
+	raftOpts              RaftOptions
+	logsInMemory          []*entity.LogEntry
+	firstLogIndex         int64
+	lastLogIndex          int64
+	diskID                *entity.LogId
+	appliedID             *entity.LogId
+	lastSnapshotID        *entity.LogId
+	waitMap               map[int64]*waitMeta
+	nextWaitID            int64
+	stopped               bool
+	hasError              int32
+	lastLogIndexListeners []LastLogIndexListener
+	listenerLock          sync.RWMutex
+	diskWriter            *logDiskWriter
+	eventBus              *utils.EventBus
+	ownEventBus           bool
+	shutdownLatch         sync.WaitGroup
+	// 持有 lock 时产生的磁盘事件先按顺序放入 pendingEvents，释放 lock 之后再由 publishLock 串行地投递给磁盘写线程。
+	// 磁盘写线程落盘之后需要获取 lock，如果持有 lock 时阻塞在已满的队列上会导致双方互相等待
+	pendingEvents []*StableClosureEvent
+	publishLock   sync.Mutex
+}
+
+func NewLogManager() *LogManagerImpl {
+	return &LogManagerImpl{
+		logsInMemory:          make([]*entity.LogEntry, 0),
+		diskID:                entity.NewEmptyLogID(),
+		appliedID:             entity.NewEmptyLogID(),
+		lastSnapshotID:        entity.NewEmptyLogID(),
+		waitMap:               make(map[int64]*waitMeta),
+		nextWaitID:            1,
+		lastLogIndexListeners: make([]LastLogIndexListener, 0),
+	}
+}
+
+func (lm *LogManagerImpl) Init(opts LogManagerOptions) bool {
+	defer lm.lock.Unlock()
+	lm.lock.Lock()
+
+	if opts.LogStorage == nil {
+		utils.RaftLog.Error("fail to init log manager, log storage is nil")
+		return false
+	}
+	lm.logStorage = opts.LogStorage
+	lm.confMgn = opts.ConfMgn
+	lm.fsmCaller = opts.FsmCaller
+	lm.raftOpts = opts.RaftOpts
+
+	if !lm.logStorage.Init(LogStorageOptions{ConfMgn: lm.confMgn}) {
+		utils.RaftLog.Error("fail to init log storage")
+		return false
+	}
+	lm.firstLogIndex = lm.logStorage.GetFirstLogIndex()
+	lm.lastLogIndex = lm.logStorage.GetLastLogIndex()
+	lm.diskID = entity.NewLogID(lm.lastLogIndex, lm.logStorage.GetTerm(lm.lastLogIndex))
+
+	clock := opts.Clock
+	if clock == nil {
+		clock = utils.SystemClock
+	}
+	lm.diskWriter = newLogDiskWriter(lm, opts.RaftOpts, clock)
+	lm.eventBus = opts.EventBus
+	if lm.eventBus == nil {
+		lm.eventBus = utils.NewEventBus()
+		lm.ownEventBus = true
+	}
+	if err := lm.eventBus.RegisterPublisher(&StableClosureEvent{}, opts.RaftOpts.DiskRingBufferSize); err != nil {
+		utils.RaftLog.Error("fail to register log disk publisher : %s", err)
+		return false
+	}
+	if err := lm.eventBus.RegisterSubscriber(lm.diskWriter); err != nil {
+		utils.RaftLog.Error("fail to register log disk writer : %s", err)
+		return false
+	}
+	lm.shutdownLatch.Add(1)
+	return true
+}
+
+func (lm *LogManagerImpl) Shutdown() {
+	lm.lock.Lock()
+	if lm.stopped {
+		lm.lock.Unlock()
+		return
+	}
+	lm.stopped = true
+	lm.wakeupAllWaiter()
+	lm.unsafePublishDiskEvent(&StableClosureEvent{eType: diskEventShutdown})
+	lm.lock.Unlock()
+	lm.flushDiskEvents()
+}
+
+//Join 等待磁盘写线程将 Shutdown 之前提交的日志全部落盘并关闭 LogStorage
+func (lm *LogManagerImpl) Join() {
+	lm.shutdownLatch.Wait()
+	if lm.ownEventBus {
+		lm.eventBus.Shutdown()
+	}
+}
+
+func (lm *LogManagerImpl) AddLastLogIndexListener(listener LastLogIndexListener) {
+	defer lm.listenerLock.Unlock()
+	lm.listenerLock.Lock()
+	lm.lastLogIndexListeners = append(lm.lastLogIndexListeners, listener)
+}
+
+func (lm *LogManagerImpl) RemoveLogIndexListener(listener LastLogIndexListener) {
+	defer lm.listenerLock.Unlock()
+	lm.listenerLock.Lock()
+	for i, l := range lm.lastLogIndexListeners {
+		if l == listener {
+			lm.lastLogIndexListeners = append(lm.lastLogIndexListeners[:i], lm.lastLogIndexListeners[i+1:]...)
+			return
+		}
+	}
+}
+
+func (lm *LogManagerImpl) notifyLastLogIndexListeners(lastLogIndex int64) {
+	lm.listenerLock.RLock()
+	listeners := make([]LastLogIndexListener, len(lm.lastLogIndexListeners))
+	copy(listeners, lm.lastLogIndexListeners)
+	lm.listenerLock.RUnlock()
+
+	for _, listener := range listeners {
+		listener.OnLastLogIndexChanged(lastLogIndex)
+	}
+}
+
+//AppendEntries 追加日志，Leader 传入的日志 index 为 0，由这里统一分配；Follower 传入的日志带有 Leader 分配的 index，
+//需要先和本地日志做冲突检测。日志先放入内存，再投递给磁盘写线程批量落盘，落盘之后回调 done
+func (lm *LogManagerImpl) AppendEntries(entries []*entity.LogEntry, done StableClosure) {
+	lm.lock.Lock()
+	if atomic.LoadInt32(&lm.hasError) == 1 {
+		lm.lock.Unlock()
+		done.Run(entity.NewStatus(entity.EIO, "Corrupted LogStorage"))
+		return
+	}
+	if lm.stopped {
+		lm.lock.Unlock()
+		done.Run(entity.NewStatus(entity.EStop, "Log manager is stopped"))
+		return
+	}
+	if len(entries) != 0 {
+		var ok bool
+		if entries, ok = lm.checkAndResolveConflict(entries, done); !ok {
+			lm.flushDiskEvents()
+			return
+		}
+	}
+	for _, entry := range entries {
+		if entry.LogType == raft.EntryType_EntryTypeConfiguration {
+			confEntry := entity.NewConfigurationEntry(entity.NewLogID(entry.LogID.GetIndex(), entry.LogID.GetTerm()),
+				entity.NewConfiguration(entry.Peers, entry.Learners), nil)
+			if len(entry.OldPeers) != 0 {
+				confEntry.SetOldConf(entity.NewConfiguration(entry.OldPeers, entry.OldLearners))
+			}
+			lm.confMgn.Add(confEntry)
+		}
+	}
+	if len(entries) != 0 {
+		done.SetFirstLogIndex(entries[0].LogID.GetIndex())
+		lm.logsInMemory = append(lm.logsInMemory, entries...)
+	}
+	done.SetEntries(entries)
+	lastLogIndex := lm.lastLogIndex
+	lm.wakeupAllWaiter()
+	lm.unsafePublishDiskEvent(&StableClosureEvent{eType: diskEventAppend, done: done})
+	lm.lock.Unlock()
+	lm.flushDiskEvents()
+
+	lm.notifyLastLogIndexListeners(lastLogIndex)
+}
+
+//unsafePublishDiskEvent 调用者持有 lock，事件按照产生的顺序暂存，释放 lock 之后需要调用 flushDiskEvents 真正投递
+func (lm *LogManagerImpl) unsafePublishDiskEvent(event *StableClosureEvent) {
+	lm.pendingEvents = append(lm.pendingEvents, event)
+}
+
+//flushDiskEvents 不能持有 lock 调用，磁盘写线程的队列已满时在这里阻塞。多个协程同时调用时由 publishLock 保证
+//事件按照放入 pendingEvents 的顺序投递，返回时当前协程之前暂存的事件都已经投递
+func (lm *LogManagerImpl) flushDiskEvents() {
+	defer lm.publishLock.Unlock()
+	lm.publishLock.Lock()
+	lm.lock.Lock()
+	events := lm.pendingEvents
+	lm.pendingEvents = nil
+	lm.lock.Unlock()
+	for _, event := range events {
+		if err := lm.eventBus.PublishEvent(event); err != nil {
+			lm.failDiskEvent(event, err)
+		}
+	}
+}
+
+//failDiskEvent 事件没有投递给磁盘写线程，需要通知等待该事件的调用方，否则对应的 closure 永远不会被回调
+func (lm *LogManagerImpl) failDiskEvent(event *StableClosureEvent, err error) {
+	utils.RaftLog.Error("fail to publish disk event %d : %s", event.eType, err)
+	switch event.eType {
+	case diskEventAppend:
+		st := entity.NewEmptyStatus()
+		st.SetError(entity.EStop, "Fail to publish disk event : %s", err)
+		event.done.Run(st)
+	case diskEventLastLogID:
+		event.result <- nil
+	case diskEventShutdown:
+		lm.logStorage.Shutdown()
+		lm.shutdownLatch.Done()
+	}
+}
+
+//setDiskID 由磁盘写线程在日志落盘之后调用
+func (lm *LogManagerImpl) setDiskID(id *entity.LogId) {
+	lm.lock.Lock()
+	if id.Compare(lm.diskID) < 0 {
+		lm.lock.Unlock()
+		return
+	}
+	lm.diskID = id
+	clearID := lm.unsafeGetClearID()
+	lm.lock.Unlock()
+	lm.clearMemoryLogs(clearID)
+}
+
+//checkAndResolveConflict 返回去掉重复部分之后需要真正追加的日志，返回 false 时 done 已经被回调并且锁已经释放
+func (lm *LogManagerImpl) checkAndResolveConflict(entries []*entity.LogEntry, done StableClosure) ([]*entity.LogEntry, bool) {
+	first := entries[0]
+	if first.LogID.GetIndex() == 0 {
+		for _, entry := range entries {
+			lm.lastLogIndex++
+			entry.LogID.SetIndex(lm.lastLogIndex)
+		}
+		return entries, true
+	}
+
+	if first.LogID.GetIndex() > lm.lastLogIndex+1 {
+		lm.lock.Unlock()
+		st := entity.NewEmptyStatus()
+		st.SetError(entity.EINVAL, "There's gap between first_index=%d and last_log_index=%d",
+			first.LogID.GetIndex(), lm.lastLogIndex)
+		done.Run(st)
+		return nil, false
+	}
+	last := entries[len(entries)-1]
+	if last.LogID.GetIndex() <= lm.appliedID.GetIndex() {
+		utils.RaftLog.Warn("Received entries of which the lastLog=%d is not greater than appliedIndex=%d, return immediately with nothing changed.",
+			last.LogID.GetIndex(), lm.appliedID.GetIndex())
+		lm.lock.Unlock()
+		done.Run(entity.StatusOK())
+		return nil, false
+	}
+	if first.LogID.GetIndex() == lm.lastLogIndex+1 {
+		lm.lastLogIndex = last.LogID.GetIndex()
+		return entries, true
+	}
+
+	// 追加的日志和本地的日志存在重叠，找到第一条 term 不一致的日志，将本地从该位置开始的日志全部截断
+	conflictingIndex := 0
+	for ; conflictingIndex < len(entries); conflictingIndex++ {
+		entry := entries[conflictingIndex]
+		if lm.unsafeGetTerm(entry.LogID.GetIndex()) != entry.LogID.GetTerm() {
+			break
+		}
+	}
+	if conflictingIndex != len(entries) {
+		if entries[conflictingIndex].LogID.GetIndex() <= lm.lastLogIndex {
+			lm.unsafeTruncateSuffix(entries[conflictingIndex].LogID.GetIndex() - 1)
+		}
+		lm.lastLogIndex = last.LogID.GetIndex()
+	}
+	return entries[conflictingIndex:], true
+}
+
+//unsafeGetClearID 已经落盘并且被 apply 的日志才可以从内存中清除
+func (lm *LogManagerImpl) unsafeGetClearID() *entity.LogId {
+	if lm.diskID.Compare(lm.appliedID) <= 0 {
+		return lm.diskID
+	}
+	return lm.appliedID
+}
+
+//resetDiskID 日志被截断或者重置之后，已经落盘的位置需要跟着回退
+func (lm *LogManagerImpl) resetDiskID(id *entity.LogId) {
+	defer lm.lock.Unlock()
+	lm.lock.Lock()
+	if lm.diskID.GetIndex() > id.GetIndex() || id.Compare(lm.diskID) > 0 {
+		lm.diskID = id
+	}
+}
+
+//SetAppliedID 状态机 apply 之后调用，已经落盘并且被 apply 的日志不再需要保存在内存中
+func (lm *LogManagerImpl) SetAppliedID(appliedID *entity.LogId) {
+	lm.lock.Lock()
+	if appliedID.Compare(lm.appliedID) < 0 {
+		lm.lock.Unlock()
+		return
+	}
+	lm.appliedID = entity.NewLogID(appliedID.GetIndex(), appliedID.GetTerm())
+	clearID := lm.unsafeGetClearID()
+	lm.lock.Unlock()
+	lm.clearMemoryLogs(clearID)
+}
+
+func (lm *LogManagerImpl) clearMemoryLogs(id *entity.LogId) {
+	defer lm.lock.Unlock()
+	lm.lock.Lock()
+
+	index := 0
+	for ; index < len(lm.logsInMemory); index++ {
+		entry := lm.logsInMemory[index]
+		if entry.LogID.Compare(id) > 0 {
+			break
+		}
+	}
+	if index > 0 {
+		lm.logsInMemory = append(make([]*entity.LogEntry, 0, len(lm.logsInMemory)-index), lm.logsInMemory[index:]...)
+	}
+}
+
+//SetSnapshot 快照完成（本地生成或者从 Leader 安装）之后调用，更新配置信息并丢弃快照已经包含的日志
+func (lm *LogManagerImpl) SetSnapshot(meta *raft.SnapshotMeta) {
+	lm.lock.Lock()
+
+	if meta.GetLastIncludedIndex() <= lm.lastSnapshotID.GetIndex() {
+		lm.lock.Unlock()
+		return
+	}
+	conf, err := parseConfiguration(meta.GetPeers(), meta.GetLearners())
+	if err != nil {
+		lm.lock.Unlock()
+		utils.RaftLog.Error("fail to parse configuration from snapshot meta : %s", err)
+		return
+	}
+	oldConf, err := parseConfiguration(meta.GetOldPeers(), meta.GetOldLearners())
+	if err != nil {
+		lm.lock.Unlock()
+		utils.RaftLog.Error("fail to parse old configuration from snapshot meta : %s", err)
+		return
+	}
+	lm.confMgn.SetSnapshot(entity.NewConfigurationEntry(entity.NewLogID(meta.GetLastIncludedIndex(), meta.GetLastIncludedTerm()),
+		conf, oldConf))
+
+	term := lm.unsafeGetTerm(meta.GetLastIncludedIndex())
+	savedLastSnapshotIndex := lm.lastSnapshotID.GetIndex()
+	lm.lastSnapshotID = entity.NewLogID(meta.GetLastIncludedIndex(), meta.GetLastIncludedTerm())
+	if lm.lastSnapshotID.Compare(lm.appliedID) > 0 {
+		lm.appliedID = entity.NewLogID(meta.GetLastIncludedIndex(), meta.GetLastIncludedTerm())
+	}
+
+	if term == 0 {
+		// 快照的 lastIncludedIndex 已经超过了本地的最后一条日志
+		lm.unsafeTruncatePrefix(meta.GetLastIncludedIndex() + 1)
+	} else if term == meta.GetLastIncludedTerm() {
+		// 暂时保留快照之前的日志，方便落后不多的 Follower 直接通过日志追赶，等到下一次快照再删除
+		if savedLastSnapshotIndex > 0 {
+			lm.unsafeTruncatePrefix(savedLastSnapshotIndex + 1)
+		}
+	} else {
+		if !lm.unsafeReset(meta.GetLastIncludedIndex() + 1) {
+			utils.RaftLog.Warn("Reset log manager failed, nextLogIndex=%d.", meta.GetLastIncludedIndex()+1)
+		}
+	}
+	lastLogIndex := lm.lastLogIndex
+	lm.lock.Unlock()
+	lm.flushDiskEvents()
+
+	lm.notifyLastLogIndexListeners(lastLogIndex)
+}
+
+func (lm *LogManagerImpl) ClearBufferedLogs() {
+	lm.lock.Lock()
+	if lm.lastSnapshotID.GetIndex() != 0 {
+		lm.unsafeTruncatePrefix(lm.lastSnapshotID.GetIndex() + 1)
+	}
+	lm.lock.Unlock()
+	lm.flushDiskEvents()
+}
+
+func (lm *LogManagerImpl) unsafeTruncatePrefix(firstIndexKept int64) {
+	if firstIndexKept <= lm.firstLogIndex {
+		return
+	}
+	index := 0
+	for ; index < len(lm.logsInMemory); index++ {
+		if lm.logsInMemory[index].LogID.GetIndex() >= firstIndexKept {
+			break
+		}
+	}
+	lm.logsInMemory = append(make([]*entity.LogEntry, 0, len(lm.logsInMemory)-index), lm.logsInMemory[index:]...)
+	lm.firstLogIndex = firstIndexKept
+	if firstIndexKept > lm.lastLogIndex {
+		// 日志已经全部被快照覆盖，[first, last] 变为空区间
+		lm.lastLogIndex = firstIndexKept - 1
+	}
+	lm.confMgn.TruncatePrefix(firstIndexKept)
+	lm.unsafePublishDiskEvent(&StableClosureEvent{eType: diskEventTruncatePrefix, index: firstIndexKept})
+}
+
+func (lm *LogManagerImpl) unsafeTruncateSuffix(lastIndexKept int64) {
+	if lastIndexKept < lm.appliedID.GetIndex() {
+		utils.RaftLog.Error("FATAL ERROR: Can't truncate logs before appliedId=%d, lastIndexKept=%d",
+			lm.appliedID.GetIndex(), lastIndexKept)
+		return
+	}
+	for len(lm.logsInMemory) != 0 && lm.logsInMemory[len(lm.logsInMemory)-1].LogID.GetIndex() > lastIndexKept {
+		lm.logsInMemory = lm.logsInMemory[:len(lm.logsInMemory)-1]
+	}
+	lm.lastLogIndex = lastIndexKept
+	lastTermKept := lm.unsafeGetTerm(lastIndexKept)
+	lm.confMgn.TruncateSuffix(lastIndexKept)
+	lm.unsafePublishDiskEvent(&StableClosureEvent{eType: diskEventTruncateSuffix, index: lastIndexKept, term: lastTermKept})
+}
+
+func (lm *LogManagerImpl) unsafeReset(nextLogIndex int64) bool {
+	lm.logsInMemory = make([]*entity.LogEntry, 0)
+	lm.firstLogIndex = nextLogIndex
+	lm.lastLogIndex = nextLogIndex - 1
+	lm.confMgn.TruncatePrefix(lm.firstLogIndex)
+	lm.confMgn.TruncateSuffix(lm.lastLogIndex)
+	lm.unsafePublishDiskEvent(&StableClosureEvent{eType: diskEventReset, index: nextLogIndex,
+		term: lm.lastSnapshotID.GetTerm()})
+	return true
+}
+
+func (lm *LogManagerImpl) GetEntry(index int64) *entity.LogEntry {
+	lm.lock.RLock()
+	if index > lm.lastLogIndex || index < lm.firstLogIndex {
+		lm.lock.RUnlock()
+		return nil
+	}
+	if entry := lm.getEntryFromMemory(index); entry != nil {
+		lm.lock.RUnlock()
+		return entry
+	}
+	lm.lock.RUnlock()
+
+	entry := lm.logStorage.GetEntry(index)
+	if entry == nil {
+		lm.reportError(entity.EIO, "Corrupted entry at index=%d, not found", index)
+		return nil
+	}
+	if entry.IsCorrupted() {
+		lm.reportError(entity.EIO, "Corrupted entry at index=%d, term=%d", index, entry.LogID.GetTerm())
+		return nil
+	}
+	return entry
+}
+
+func (lm *LogManagerImpl) getEntryFromMemory(index int64) *entity.LogEntry {
+	if len(lm.logsInMemory) == 0 {
+		return nil
+	}
+	pos := index - lm.logsInMemory[0].LogID.GetIndex()
+	if pos < 0 || pos >= int64(len(lm.logsInMemory)) {
+		return nil
+	}
+	return lm.logsInMemory[pos]
+}
+
+func (lm *LogManagerImpl) GetTerm(index int64) int64 {
+	if index == 0 {
+		return 0
+	}
+	lm.lock.RLock()
+	if lm.lastSnapshotID.GetIndex() == index {
+		lm.lock.RUnlock()
+		return lm.lastSnapshotID.GetTerm()
+	}
+	if index > lm.lastLogIndex || index < lm.firstLogIndex {
+		lm.lock.RUnlock()
+		return 0
+	}
+	if entry := lm.getEntryFromMemory(index); entry != nil {
+		lm.lock.RUnlock()
+		return entry.LogID.GetTerm()
+	}
+	lm.lock.RUnlock()
+	return lm.logStorage.GetTerm(index)
+}
+
+func (lm *LogManagerImpl) unsafeGetTerm(index int64) int64 {
+	if index == 0 {
+		return 0
+	}
+	if lm.lastSnapshotID.GetIndex() == index {
+		return lm.lastSnapshotID.GetTerm()
+	}
+	if index > lm.lastLogIndex || index < lm.firstLogIndex {
+		return 0
+	}
+	if entry := lm.getEntryFromMemory(index); entry != nil {
+		return entry.LogID.GetTerm()
+	}
+	return lm.logStorage.GetTerm(index)
+}
+
+func (lm *LogManagerImpl) GetFirstLogIndex() int64 {
+	defer lm.lock.RUnlock()
+	lm.lock.RLock()
+	return lm.firstLogIndex
+}
+
+func (lm *LogManagerImpl) GetLastLogIndex() int64 {
+	defer lm.lock.RUnlock()
+	lm.lock.RLock()
+	return lm.lastLogIndex
+}
+
+//GetLastLogID 获取最后一条日志的 LogId，isFlush 为 true 时会等待之前提交的日志全部落盘，返回已经落盘的最后一条日志
+func (lm *LogManagerImpl) GetLastLogID(isFlush bool) *entity.LogId {
+	lm.lock.Lock()
+	if !isFlush || lm.stopped {
+		defer lm.lock.Unlock()
+		if lm.lastLogIndex == lm.lastSnapshotID.GetIndex() {
+			return entity.NewLogID(lm.lastSnapshotID.GetIndex(), lm.lastSnapshotID.GetTerm())
+		}
+		return entity.NewLogID(lm.lastLogIndex, lm.unsafeGetTerm(lm.lastLogIndex))
+	}
+	if lm.lastLogIndex == lm.lastSnapshotID.GetIndex() {
+		defer lm.lock.Unlock()
+		return entity.NewLogID(lm.lastSnapshotID.GetIndex(), lm.lastSnapshotID.GetTerm())
+	}
+	result := make(chan *entity.LogId, 1)
+	lm.unsafePublishDiskEvent(&StableClosureEvent{eType: diskEventLastLogID, result: result})
+	lm.lock.Unlock()
+	lm.flushDiskEvents()
+	if id := <-result; id != nil {
+		return id
+	}
+	// 磁盘写线程已经停止，只能返回内存中的 lastLogId
+	return lm.GetLastLogID(false)
+}
+
+func (lm *LogManagerImpl) GetConfiguration(index int64) *entity.ConfigurationEntry {
+	defer lm.lock.RUnlock()
+	lm.lock.RLock()
+	return lm.confMgn.Get(index)
+}
+
+//CheckAndSetConfiguration 如果 LogManager 中存在比 current 更新的配置，则用最新的配置覆盖 current
+func (lm *LogManagerImpl) CheckAndSetConfiguration(current *entity.ConfigurationEntry) {
+	if current == nil {
+		return
+	}
+	defer lm.lock.RUnlock()
+	lm.lock.RLock()
+
+	lastConf := lm.confMgn.GetLastConfiguration()
+	if lastConf != nil && !lastConf.IsEmpty() && lastConf.GetID().GetIndex() > current.GetID().GetIndex() {
+		current.SetConf(lastConf.GetConf().Copy())
+		current.SetID(entity.NewLogID(lastConf.GetID().GetIndex(), lastConf.GetID().GetTerm()))
+		if lastConf.GetOldConf() != nil {
+			current.SetOldConf(lastConf.GetOldConf().Copy())
+		} else {
+			current.SetOldConf(nil)
+		}
+	}
+}
+
+//Wait 等待 lastLogIndex 超过 expectedLastLogIndex，有新日志或者 LogManager 停止时回调 cb，返回值为等待 ID，
+//为 0 表示 cb 已经被触发
+func (lm *LogManagerImpl) Wait(expectedLastLogIndex int64, cb NewLogCallback, arg interface{}) int64 {
+	wm := &waitMeta{
+		onNewLog: cb,
+		arg:      arg,
+	}
+	defer lm.lock.Unlock()
+	lm.lock.Lock()
+
+	if expectedLastLogIndex != lm.lastLogIndex || lm.stopped {
+		if lm.stopped {
+			wm.errCode = int32(entity.EStop)
+		}
+		runOnNewLog(wm)
+		return 0
+	}
+	waitID := lm.nextWaitID
+	lm.nextWaitID++
+	lm.waitMap[waitID] = wm
+	return waitID
+}
+
+func (lm *LogManagerImpl) RemoveWaiter(id int64) bool {
+	defer lm.lock.Unlock()
+	lm.lock.Lock()
+
+	_, ok := lm.waitMap[id]
+	delete(lm.waitMap, id)
+	return ok
+}
+
+func (lm *LogManagerImpl) wakeupAllWaiter() {
+	if len(lm.waitMap) == 0 {
+		return
+	}
+	waiters := lm.waitMap
+	lm.waitMap = make(map[int64]*waitMeta)
+	for _, wm := range waiters {
+		if lm.stopped {
+			wm.errCode = int32(entity.EStop)
+		}
+		runOnNewLog(wm)
+	}
+}
+
+func runOnNewLog(wm *waitMeta) {
+	polerpc.Go(context.Background(), func(ctx context.Context) {
+		wm.onNewLog.OnNewLog(wm.arg, wm.errCode)
+	})
+}
+
+//CheckConsistency 检查快照和日志之间是否存在空洞
+func (lm *LogManagerImpl) CheckConsistency() entity.Status {
+	defer lm.lock.RUnlock()
+	lm.lock.RLock()
+
+	if lm.firstLogIndex == 1 && lm.lastSnapshotID.GetIndex() == 0 {
+		return entity.StatusOK()
+	}
+	if lm.lastSnapshotID.GetIndex() == 0 {
+		st := entity.NewEmptyStatus()
+		st.SetError(entity.EIO, "Missing logs in (0, %d)", lm.firstLogIndex)
+		return st
+	}
+	if lm.lastSnapshotID.GetIndex() >= lm.firstLogIndex-1 && lm.lastSnapshotID.GetIndex() <= lm.lastLogIndex {
+		return entity.StatusOK()
+	}
+	st := entity.NewEmptyStatus()
+	st.SetError(entity.EIO, "There's a gap between snapshot={%d, %d} and log=[%d, %d] ", lm.lastSnapshotID.GetIndex(),
+		lm.lastSnapshotID.GetTerm(), lm.firstLogIndex, lm.lastLogIndex)
+	return st
+}
+
+func (lm *LogManagerImpl) reportError(code entity.RaftErrorCode, format string, args ...interface{}) {
+	atomic.StoreInt32(&lm.hasError, 1)
+	if lm.fsmCaller == nil {
+		return
+	}
+	st := entity.NewEmptyStatus()
+	st.SetError(code, format, args...)
+	lm.fsmCaller.OnError(entity.RaftError{
+		ErrType: raft.ErrorType_ErrorTypeLog,
+		Status:  st,
+	})
+}
+
+//parseConfiguration 将快照元数据中的字符串形式的 peers 以及 learners 转换为 Configuration
+func parseConfiguration(peers, learners []string) (*entity.Configuration, error) {
+	conf := entity.NewEmptyConfiguration()
+	for _, s := range peers {
+		peer := entity.PeerId{}
+		if err := utils.RequireTrue(peer.Parse(s), "Parse peer %s failed", s); err != nil {
+			return nil, err
+		}
+		conf.AddPeers([]entity.PeerId{peer})
+	}
+	for _, s := range learners {
+		learner := entity.PeerId{}
+		if err := utils.RequireTrue(learner.Parse(s), "Parse learner %s failed", s); err != nil {
+			return nil, err
+		}
+		conf.AddLearners([]entity.PeerId{learner})
+	}
+	return conf, nil
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/utils"
+)
+
+//slowLogStorage 每次落盘都要等待 delay，用来让磁盘写线程的队列堆积
+type slowLogStorage struct {
+	*MemoryLogStorage
+	delay time.Duration
+}
+
+func (sls *slowLogStorage) AppendEntries(entries []*entity.LogEntry) int {
+	time.Sleep(sls.delay)
+	return sls.MemoryLogStorage.AppendEntries(entries)
+}
+
+func newTestLogManager(t *testing.T, storage LogStorage, raftOpts RaftOptions) *LogManagerImpl {
+	return newTestLogManagerWithClock(t, storage, raftOpts, nil)
+}
+
+func newTestLogManagerWithClock(t *testing.T, storage LogStorage, raftOpts RaftOptions,
+	clock utils.Clock) *LogManagerImpl {
+	lm := NewLogManager()
+	if !lm.Init(LogManagerOptions{
+		LogStorage: storage,
+		ConfMgn:    entity.NewConfigurationManager(),
+		RaftOpts:   raftOpts,
+		Clock:      clock,
+	}) {
+		t.Fatal("fail to init log manager")
+	}
+	t.Cleanup(func() {
+		lm.Shutdown()
+		lm.Join()
+	})
+	return lm
+}
+
+//appendAndWait 追加日志并等待落盘，返回回调的 closure 以及落盘的结果
+func appendAndWait(t *testing.T, lm *LogManagerImpl, entries ...*entity.LogEntry) (*BaseStableClosure, entity.Status) {
+	t.Helper()
+	result := make(chan entity.Status, 1)
+	done := NewStableClosure(entries, func(status entity.Status) {
+		result <- status
+	})
+	lm.AppendEntries(entries, done)
+	select {
+	case st := <-result:
+		return done, st
+	case <-time.After(10 * time.Second):
+		t.Fatal("append entries not stable in time")
+	}
+	return nil, entity.Status{}
+}
+
+//newTestLogEntries 生成 [first, last] 的日志，first 为 0 时由 LogManager 分配 index
+func newTestLogEntries(first, last, term int64) []*entity.LogEntry {
+	entries := make([]*entity.LogEntry, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		entries = append(entries, newTestLogEntry(i, term))
+	}
+	return entries
+}
+
+func newTestConfEntry(index, term int64, peers []entity.PeerId) *entity.LogEntry {
+	entry := entity.NewLogEntry(raft.EntryType_EntryTypeConfiguration)
+	entry.LogID = entity.NewLogID(index, term)
+	entry.Peers = peers
+	return entry
+}
+
+func TestLogManagerFollowerOverwritesConflicts(t *testing.T) {
+	storage := NewMemoryLogStorage()
+	lm := newTestLogManager(t, storage, NewDefaultRaftOptions())
+	if _, st := appendAndWait(t, lm, newTestLogEntries(1, 10, 1)...); !st.IsOK() {
+		t.Fatalf("append entries, status %d %s", st.GetCode(), st.GetMsg())
+	}
+
+	// 新 Leader 从 6 开始覆盖，本地 [6, 10] 的日志被截断
+	done, st := appendAndWait(t, lm, newTestLogEntries(6, 8, 2)...)
+	if !st.IsOK() || done.GetFirstLogIndex() != 6 || len(done.GetEntries()) != 3 {
+		t.Fatalf("overwrite entries, first %d, %d entries, status %d %s", done.GetFirstLogIndex(),
+			len(done.GetEntries()), st.GetCode(), st.GetMsg())
+	}
+	if id := lm.GetLastLogID(true); id.GetIndex() != 8 || id.GetTerm() != 2 {
+		t.Fatalf("last log id %d/%d, expect 8/2", id.GetIndex(), id.GetTerm())
+	}
+	for i := int64(1); i <= 8; i++ {
+		expect := int64(1)
+		if i >= 6 {
+			expect = 2
+		}
+		if lm.GetTerm(i) != expect || storage.GetTerm(i) != expect {
+			t.Fatalf("term at %d, log manager %d, storage %d, expect %d", i, lm.GetTerm(i), storage.GetTerm(i),
+				expect)
+		}
+	}
+	if storage.GetLastLogIndex() != 8 || lm.GetEntry(9) != nil {
+		t.Fatalf("conflicting entries are kept, last log index in storage %d", storage.GetLastLogIndex())
+	}
+
+	// 中间有空洞的日志直接拒绝
+	if _, st := appendAndWait(t, lm, newTestLogEntries(20, 21, 2)...); st.GetCode() != entity.EINVAL {
+		t.Fatalf("append entries with a gap, status %d %s", st.GetCode(), st.GetMsg())
+	}
+}
+
+func TestLogManagerSkipsDuplicateEntries(t *testing.T) {
+	storage := NewMemoryLogStorage()
+	lm := newTestLogManager(t, storage, NewDefaultRaftOptions())
+	appendAndWait(t, lm, newTestLogEntries(1, 10, 1)...)
+
+	// Leader 重发的日志已经全部存在，不会重复写入
+	done, st := appendAndWait(t, lm, newTestLogEntries(3, 7, 1)...)
+	if !st.IsOK() || len(done.GetEntries()) != 0 {
+		t.Fatalf("append duplicate entries, %d entries written, status %d %s", len(done.GetEntries()),
+			st.GetCode(), st.GetMsg())
+	}
+	// 部分重复时只追加新的部分
+	done, st = appendAndWait(t, lm, newTestLogEntries(8, 12, 1)...)
+	if !st.IsOK() || done.GetFirstLogIndex() != 11 || len(done.GetEntries()) != 2 {
+		t.Fatalf("append overlapping entries, first %d, %d entries, status %d %s", done.GetFirstLogIndex(),
+			len(done.GetEntries()), st.GetCode(), st.GetMsg())
+	}
+	if lm.GetLastLogIndex() != 12 || storage.GetLastLogIndex() != 12 {
+		t.Fatalf("last log index %d, in storage %d, expect 12", lm.GetLastLogIndex(), storage.GetLastLogIndex())
+	}
+	if id := lm.GetLastLogID(true); id.GetIndex() != 12 || id.GetTerm() != 1 {
+		t.Fatalf("last log id %d/%d, expect 12/1", id.GetIndex(), id.GetTerm())
+	}
+}
+
+func TestLogManagerConfigurationRollback(t *testing.T) {
+	lm := newTestLogManager(t, NewMemoryLogStorage(), NewDefaultRaftOptions())
+	peers := newTestPeers(4)
+	entries := newTestLogEntries(1, 6, 1)
+	entries[2] = newTestConfEntry(3, 1, peers[:3])
+	entries[4] = newTestConfEntry(5, 1, peers[:4])
+	appendAndWait(t, lm, entries...)
+	if conf := lm.GetConfiguration(6); conf.GetID().GetIndex() != 5 {
+		t.Fatalf("configuration at 6 from index %d, expect 5", conf.GetID().GetIndex())
+	}
+
+	// 截断之后 index 5 的配置不再生效，回退到 index 3 的配置
+	appendAndWait(t, lm, newTestLogEntries(5, 6, 2)...)
+	conf := lm.GetConfiguration(6)
+	if conf.GetID().GetIndex() != 3 || !conf.GetConf().Equal(entity.NewConfiguration(peers[:3], nil)) {
+		t.Fatalf("configuration at 6 from index %d : %v, expect %v", conf.GetID().GetIndex(),
+			conf.GetConf().ListPeers(), peers[:3])
+	}
+	current := entity.NewConfigurationEntry(entity.NewLogID(0, 0), entity.NewEmptyConfiguration(), nil)
+	lm.CheckAndSetConfiguration(current)
+	if current.GetID().GetIndex() != 3 {
+		t.Fatalf("last configuration from index %d, expect 3", current.GetID().GetIndex())
+	}
+
+	// 覆盖的日志中带有新的配置时，新的配置生效
+	appendAndWait(t, lm, newTestConfEntry(6, 3, peers[1:4]))
+	if conf := lm.GetConfiguration(6); conf.GetID().GetIndex() != 6 ||
+		!conf.GetConf().Equal(entity.NewConfiguration(peers[1:4], nil)) {
+		t.Fatalf("configuration at 6 from index %d : %v", conf.GetID().GetIndex(), conf.GetConf().ListPeers())
+	}
+}
+
+//newTestPeers 127.0.0.1:8081 开始的 n 个节点
+func newTestPeers(n int) []entity.PeerId {
+	peers := make([]entity.PeerId, 0, n)
+	for i := 0; i < n; i++ {
+		peer := entity.PeerId{}
+		peer.Parse(fmt.Sprintf("127.0.0.1:%d", 8081+i))
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func TestLogManagerAppendNotBlockedByFullDiskRing(t *testing.T) {
+	raftOpts := NewDefaultRaftOptions()
+	// RegisterPublisher 会把过小的队列放大到 128，这里只需要远小于追加的日志数
+	raftOpts.DiskRingBufferSize = 1
+	raftOpts.MaxAppendBatchSize = 4
+	lm := newTestLogManager(t, &slowLogStorage{
+		MemoryLogStorage: NewMemoryLogStorage(),
+		delay:            time.Millisecond,
+	}, raftOpts)
+
+	const appenders, appendsPerAppender = 4, 256
+	var stable sync.WaitGroup
+	stable.Add(appenders * appendsPerAppender)
+	finished := make(chan struct{})
+	go func() {
+		var appending sync.WaitGroup
+		for i := 0; i < appenders; i++ {
+			appending.Add(1)
+			go func(i int) {
+				defer appending.Done()
+				for j := 0; j < appendsPerAppender; j++ {
+					entries := []*entity.LogEntry{newTestLogEntry(0, 1)}
+					lm.AppendEntries(entries, NewStableClosure(entries, func(status entity.Status) {
+						if !status.IsOK() {
+							t.Errorf("append entries, status %d %s", status.GetCode(), status.GetMsg())
+						}
+						stable.Done()
+					}))
+					if j%64 == 0 {
+						lm.GetLastLogID(true)
+					}
+				}
+			}(i)
+		}
+		appending.Wait()
+		stable.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(30 * time.Second):
+		t.Fatal("append entries hang on a full disk ring buffer")
+	}
+	if id := lm.GetLastLogID(true); id.GetIndex() != appenders*appendsPerAppender {
+		t.Fatalf("last stable log index %d, expect %d", id.GetIndex(), appenders*appendsPerAppender)
+	}
+}
+
+func TestLogManagerFlushTimerFollowsClock(t *testing.T) {
+	raftOpts := NewDefaultRaftOptions()
+	raftOpts.AppendFlushIntervalMs = 10
+	clock := utils.NewSimulationClock(1)
+	lm := newTestLogManagerWithClock(t, NewMemoryLogStorage(), raftOpts, clock)
+
+	result := make(chan entity.Status, 1)
+	entries := []*entity.LogEntry{newTestLogEntry(0, 1)}
+	lm.AppendEntries(entries, NewStableClosure(entries, func(status entity.Status) {
+		result <- status
+	}))
+	waitUntil(t, "flush timer to be armed", func() bool {
+		return clock.Pending() == 1
+	})
+	clock.Advance(9 * time.Millisecond)
+	select {
+	case <-result:
+		t.Fatal("entries flushed before the flush interval elapsed on the clock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case st := <-result:
+		if !st.IsOK() {
+			t.Fatalf("append entries, status %d %s", st.GetCode(), st.GetMsg())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("entries not flushed after the flush interval elapsed on the clock")
+	}
+}
+
+func TestLogManagerFailsEventsAfterEventBusShutdown(t *testing.T) {
+	bus := utils.NewEventBus()
+	lm := NewLogManager()
+	if !lm.Init(LogManagerOptions{
+		LogStorage: NewMemoryLogStorage(),
+		ConfMgn:    entity.NewConfigurationManager(),
+		RaftOpts:   NewDefaultRaftOptions(),
+		EventBus:   bus,
+	}) {
+		t.Fatal("fail to init log manager")
+	}
+	bus.Shutdown()
+
+	// 磁盘写线程已经停止，追加日志的 closure 以及等待落盘位置的调用方都不能一直阻塞
+	_, st := appendAndWait(t, lm, newTestLogEntries(1, 3, 1)...)
+	if st.GetCode() != entity.EStop {
+		t.Fatalf("append entries after event bus shutdown, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	lastLogID := make(chan *entity.LogId, 1)
+	go func() {
+		lastLogID <- lm.GetLastLogID(true)
+	}()
+	select {
+	case id := <-lastLogID:
+		if id.GetIndex() != 3 {
+			t.Fatalf("last log id %d, expect 3", id.GetIndex())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("GetLastLogID is blocked after event bus shutdown")
+	}
+	joined := make(chan struct{})
+	go func() {
+		lm.Shutdown()
+		lm.Join()
+		close(joined)
+	}()
+	select {
+	case <-joined:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Join is blocked after event bus shutdown")
+	}
+}
@@ -0,0 +1,739 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/utils"
+)
+
+const (
+	logMetaFile           = "log_meta"
+	logSegmentPrefix      = "segment_"
+	logSegmentDataSuffix  = ".log"
+	logSegmentIndexSuffix = ".idx"
+	// 每一条记录的头部: 4 字节的数据长度 + 8 字节的 crc64 校验和
+	logRecordHeaderSize = 12
+	// 索引文件中每一条记录: 8 字节的数据文件偏移量 + 1 字节的 LogEntry 类型
+	logIndexRecordSize = 9
+	checksumSize       = 8
+)
+
+//logSegment 一个固定大小的日志段，由数据文件以及索引文件组成，数据文件中存放的是 entity.LogEntry.Encode() 之后的数据
+type logSegment struct {
+	firstIndex int64
+	offsets    []int64
+	types      []raft.EntryType
+	size       int64
+	dataFile   *os.File
+	indexFile  *os.File
+}
+
+func (ls *logSegment) lastIndex() int64 {
+	return ls.firstIndex + int64(len(ls.offsets)) - 1
+}
+
+func (ls *logSegment) isEmpty() bool {
+	return len(ls.offsets) == 0
+}
+
+func (ls *logSegment) contains(index int64) bool {
+	return index >= ls.firstIndex && index <= ls.lastIndex()
+}
+
+func (ls *logSegment) close() {
+	if ls.dataFile != nil {
+		_ = ls.dataFile.Close()
+	}
+	if ls.indexFile != nil {
+		_ = ls.indexFile.Close()
+	}
+}
+
+func (ls *logSegment) read(index int64) ([]byte, error) {
+	pos := index - ls.firstIndex
+	offset := ls.offsets[pos]
+	end := ls.size
+	if pos+1 < int64(len(ls.offsets)) {
+		end = ls.offsets[pos+1]
+	}
+	buf := make([]byte, end-offset)
+	if _, err := ls.dataFile.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	dataLen := binary.BigEndian.Uint32(buf[0:4])
+	checksum := binary.BigEndian.Uint64(buf[4:logRecordHeaderSize])
+	data := buf[logRecordHeaderSize:]
+	if int64(dataLen) != int64(len(data)) || utils.Checksum(data) != checksum {
+		return nil, fmt.Errorf("corrupted log record at index=%d, file=%s", index, ls.dataFile.Name())
+	}
+	return data, nil
+}
+
+//FileLogStorage 基于本地文件的 LogStorage 实现，日志按照固定大小切分成多个 segment 文件顺序追加写入，每个 segment 额外维护一个索引文件
+//记录每一条日志在数据文件中的偏移量；崩溃重启时只需要对最后一个 segment 做扫描以及校验和检查即可恢复出 firstLogIndex 和 lastLogIndex
+type FileLogStorage struct {
+	lock           sync.RWMutex
+	path           string
+	raftOpts       RaftOptions
+	firstLogIndex  int64
+	segments       []*logSegment
+	hasLoadedFirst bool
+}
+
+func NewFileLogStorage(path string, raftOpts RaftOptions) *FileLogStorage {
+	return &FileLogStorage{
+		path:          path,
+		raftOpts:      raftOpts,
+		firstLogIndex: 1,
+	}
+}
+
+func (fls *FileLogStorage) Init(opts LogStorageOptions) bool {
+	defer fls.lock.Unlock()
+	fls.lock.Lock()
+
+	if err := os.MkdirAll(fls.path, os.ModePerm); err != nil {
+		utils.RaftLog.Error("fail to create log storage dir %s : %s", fls.path, err)
+		return false
+	}
+	if err := fls.loadMeta(); err != nil {
+		utils.RaftLog.Error("fail to load log storage meta from %s : %s", fls.path, err)
+		return false
+	}
+	if err := fls.loadSegments(); err != nil {
+		utils.RaftLog.Error("fail to load log segments from %s : %s", fls.path, err)
+		return false
+	}
+	if opts.ConfMgn != nil {
+		fls.loadConfiguration(opts.ConfMgn)
+	}
+	utils.RaftLog.Info("FileLogStorage init success, path=%s, firstLogIndex=%d, lastLogIndex=%d", fls.path,
+		fls.getFirstLogIndex(), fls.getLastLogIndex())
+	return true
+}
+
+func (fls *FileLogStorage) Shutdown() {
+	defer fls.lock.Unlock()
+	fls.lock.Lock()
+	for _, segment := range fls.segments {
+		segment.close()
+	}
+	fls.segments = nil
+}
+
+func (fls *FileLogStorage) GetFirstLogIndex() int64 {
+	defer fls.lock.RUnlock()
+	fls.lock.RLock()
+	return fls.getFirstLogIndex()
+}
+
+func (fls *FileLogStorage) getFirstLogIndex() int64 {
+	return fls.firstLogIndex
+}
+
+func (fls *FileLogStorage) GetLastLogIndex() int64 {
+	defer fls.lock.RUnlock()
+	fls.lock.RLock()
+	return fls.getLastLogIndex()
+}
+
+func (fls *FileLogStorage) getLastLogIndex() int64 {
+	if len(fls.segments) == 0 {
+		return fls.firstLogIndex - 1
+	}
+	return fls.segments[len(fls.segments)-1].lastIndex()
+}
+
+func (fls *FileLogStorage) GetEntry(index int64) *entity.LogEntry {
+	defer fls.lock.RUnlock()
+	fls.lock.RLock()
+	return fls.getEntry(index)
+}
+
+func (fls *FileLogStorage) getEntry(index int64) *entity.LogEntry {
+	if index < fls.firstLogIndex || index > fls.getLastLogIndex() {
+		return nil
+	}
+	segment := fls.findSegment(index)
+	if segment == nil {
+		return nil
+	}
+	data, err := segment.read(index)
+	if err != nil {
+		utils.RaftLog.Error("fail to read log entry at index=%d : %s", index, err)
+		return nil
+	}
+	entry := &entity.LogEntry{}
+	if err := entry.Decode(data); err != nil {
+		utils.RaftLog.Error("fail to decode log entry at index=%d : %s", index, err)
+		return nil
+	}
+	if entry.IsCorrupted() {
+		utils.RaftLog.Error("corrupted log entry at index=%d, checksum mismatch", index)
+		return nil
+	}
+	return entry
+}
+
+func (fls *FileLogStorage) GetTerm(index int64) int64 {
+	entry := fls.GetEntry(index)
+	if entry == nil {
+		return 0
+	}
+	return entry.LogID.GetTerm()
+}
+
+func (fls *FileLogStorage) AppendEntry(entry *entity.LogEntry) bool {
+	return fls.AppendEntries([]*entity.LogEntry{entry}) == 1
+}
+
+//AppendEntries 批量写入日志，一个批次只会做一次 fsync 操作，返回成功写入的日志条数
+func (fls *FileLogStorage) AppendEntries(entries []*entity.LogEntry) int {
+	if len(entries) == 0 {
+		return 0
+	}
+	defer fls.lock.Unlock()
+	fls.lock.Lock()
+
+	// 记录追加之前的状态，fsync 失败时回滚到该状态，不能让没有落盘的日志被读到
+	firstLogIndex, segmentCnt := fls.firstLogIndex, len(fls.segments)
+	tailEntries, tailSize := 0, int64(0)
+	if segmentCnt != 0 {
+		tail := fls.segments[segmentCnt-1]
+		tailEntries, tailSize = len(tail.offsets), tail.size
+	}
+	dirty := make(map[*logSegment]struct{})
+	cnt := 0
+	for _, entry := range entries {
+		if err := fls.appendLocked(entry, dirty); err != nil {
+			utils.RaftLog.Error("fail to append log entry index=%d : %s", entry.LogID.GetIndex(), err)
+			break
+		}
+		cnt++
+	}
+	if err := fls.syncSegments(dirty); err != nil {
+		utils.RaftLog.Error("fail to sync log segments : %s", err)
+		fls.rollbackLocked(firstLogIndex, segmentCnt, tailEntries, tailSize)
+		return 0
+	}
+	return cnt
+}
+
+//rollbackLocked 删除本次追加时新建的 segment，并将原来最后一个 segment 截断回追加之前的状态
+func (fls *FileLogStorage) rollbackLocked(firstLogIndex int64, segmentCnt, tailEntries int, tailSize int64) {
+	for len(fls.segments) > segmentCnt {
+		fls.destroySegment(fls.segments[len(fls.segments)-1])
+		fls.segments = fls.segments[:len(fls.segments)-1]
+	}
+	if segmentCnt != 0 {
+		tail := fls.segments[segmentCnt-1]
+		tail.offsets = tail.offsets[:tailEntries]
+		tail.types = tail.types[:tailEntries]
+		tail.size = tailSize
+		if err := tail.dataFile.Truncate(tailSize); err != nil {
+			utils.RaftLog.Error("fail to truncate log segment %s when rollback : %s", tail.dataFile.Name(), err)
+		}
+		if err := tail.indexFile.Truncate(int64(tailEntries) * logIndexRecordSize); err != nil {
+			utils.RaftLog.Error("fail to truncate log index %s when rollback : %s", tail.indexFile.Name(), err)
+		}
+	}
+	if fls.firstLogIndex != firstLogIndex {
+		fls.firstLogIndex = firstLogIndex
+		if err := fls.saveMeta(); err != nil {
+			utils.RaftLog.Error("fail to save log meta when rollback : %s", err)
+		}
+	}
+}
+
+//syncSegments 开启了 RaftOptions.Sync 时对本次写入过的 segment 做 fsync
+func (fls *FileLogStorage) syncSegments(dirty map[*logSegment]struct{}) error {
+	if !fls.raftOpts.Sync {
+		return nil
+	}
+	for segment := range dirty {
+		if err := segment.dataFile.Sync(); err != nil {
+			return fmt.Errorf("sync %s : %s", segment.dataFile.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (fls *FileLogStorage) appendLocked(entry *entity.LogEntry, dirty map[*logSegment]struct{}) error {
+	index := entry.LogID.GetIndex()
+	lastLogIndex := fls.getLastLogIndex()
+	if len(fls.segments) == 0 {
+		// 空的 LogStorage，第一条写入的日志决定了 firstLogIndex
+		if index != fls.firstLogIndex {
+			fls.firstLogIndex = index
+			if err := fls.saveMeta(); err != nil {
+				return err
+			}
+		}
+	} else if index != lastLogIndex+1 {
+		return fmt.Errorf("log index gap, expect=%d, actual=%d", lastLogIndex+1, index)
+	}
+
+	data := entry.Encode()
+	segment, err := fls.tailSegmentFor(index, int64(len(data)+logRecordHeaderSize), dirty)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, logRecordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint64(record[4:logRecordHeaderSize], utils.Checksum(data))
+	copy(record[logRecordHeaderSize:], data)
+	if _, err := segment.dataFile.WriteAt(record, segment.size); err != nil {
+		return err
+	}
+	idx := make([]byte, logIndexRecordSize)
+	binary.BigEndian.PutUint64(idx[0:8], uint64(segment.size))
+	idx[8] = byte(entry.LogType)
+	if _, err := segment.indexFile.WriteAt(idx, int64(len(segment.offsets))*logIndexRecordSize); err != nil {
+		return err
+	}
+	segment.offsets = append(segment.offsets, segment.size)
+	segment.types = append(segment.types, entry.LogType)
+	segment.size += int64(len(record))
+	dirty[segment] = struct{}{}
+	return nil
+}
+
+//tailSegmentFor 获取可以继续写入的 segment，如果当前最后一个 segment 已经写满则将其封存并新建一个 segment
+func (fls *FileLogStorage) tailSegmentFor(index, recordSize int64, dirty map[*logSegment]struct{}) (*logSegment, error) {
+	if len(fls.segments) != 0 {
+		tail := fls.segments[len(fls.segments)-1]
+		if tail.isEmpty() || tail.size+recordSize <= fls.raftOpts.MaxSegmentFileSize {
+			return tail, nil
+		}
+		if err := fls.sealSegment(tail); err != nil {
+			return nil, err
+		}
+		delete(dirty, tail)
+	}
+	segment, err := fls.createSegment(index)
+	if err != nil {
+		return nil, err
+	}
+	fls.segments = append(fls.segments, segment)
+	return segment, nil
+}
+
+func (fls *FileLogStorage) sealSegment(segment *logSegment) error {
+	if err := segment.dataFile.Sync(); err != nil {
+		return err
+	}
+	return segment.indexFile.Sync()
+}
+
+func (fls *FileLogStorage) createSegment(firstIndex int64) (*logSegment, error) {
+	dataFile, err := os.OpenFile(fls.segmentPath(firstIndex, logSegmentDataSuffix), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	indexFile, err := os.OpenFile(fls.segmentPath(firstIndex, logSegmentIndexSuffix), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		_ = dataFile.Close()
+		return nil, err
+	}
+	if err := utils.SyncDir(fls.path); err != nil {
+		_ = dataFile.Close()
+		_ = indexFile.Close()
+		return nil, err
+	}
+	return &logSegment{
+		firstIndex: firstIndex,
+		dataFile:   dataFile,
+		indexFile:  indexFile,
+	}, nil
+}
+
+//TruncatePrefix 删除 firstIndexKept 之前的日志，先持久化新的 firstLogIndex，然后删除已经完全无用的 segment 文件
+func (fls *FileLogStorage) TruncatePrefix(firstIndexKept int64) bool {
+	defer fls.lock.Unlock()
+	fls.lock.Lock()
+
+	if firstIndexKept <= fls.firstLogIndex {
+		return true
+	}
+	// 新的 firstLogIndex 没有落盘时恢复原来的值，保证内存和磁盘上的视图一致
+	oldFirstLogIndex := fls.firstLogIndex
+	fls.firstLogIndex = firstIndexKept
+	if err := fls.saveMeta(); err != nil {
+		utils.RaftLog.Error("fail to save log meta when truncate prefix to %d : %s", firstIndexKept, err)
+		fls.firstLogIndex = oldFirstLogIndex
+		return false
+	}
+	kept := make([]*logSegment, 0, len(fls.segments))
+	for i, segment := range fls.segments {
+		// 最后一个 segment 即使已经全部过期也需要保留, 由 firstLogIndex 来屏蔽掉其中的数据
+		if segment.lastIndex() < firstIndexKept && i != len(fls.segments)-1 {
+			fls.destroySegment(segment)
+			continue
+		}
+		kept = append(kept, segment)
+	}
+	fls.segments = kept
+	if len(fls.segments) == 1 && fls.segments[0].lastIndex() < firstIndexKept {
+		fls.destroySegment(fls.segments[0])
+		fls.segments = nil
+	}
+	return true
+}
+
+//TruncateSuffix 删除 lastIndexKept 之后的日志
+func (fls *FileLogStorage) TruncateSuffix(lastIndexKept int64) bool {
+	defer fls.lock.Unlock()
+	fls.lock.Lock()
+
+	if lastIndexKept >= fls.getLastLogIndex() {
+		return true
+	}
+	for len(fls.segments) != 0 {
+		tail := fls.segments[len(fls.segments)-1]
+		if tail.firstIndex <= lastIndexKept {
+			break
+		}
+		fls.destroySegment(tail)
+		fls.segments = fls.segments[:len(fls.segments)-1]
+	}
+	if len(fls.segments) == 0 {
+		return true
+	}
+	tail := fls.segments[len(fls.segments)-1]
+	keep := lastIndexKept - tail.firstIndex + 1
+	newSize := tail.size
+	if keep < int64(len(tail.offsets)) {
+		newSize = tail.offsets[keep]
+	}
+	if err := tail.dataFile.Truncate(newSize); err != nil {
+		utils.RaftLog.Error("fail to truncate log segment %s : %s", tail.dataFile.Name(), err)
+		return false
+	}
+	if err := tail.indexFile.Truncate(keep * logIndexRecordSize); err != nil {
+		utils.RaftLog.Error("fail to truncate log index %s : %s", tail.indexFile.Name(), err)
+		return false
+	}
+	tail.offsets = tail.offsets[:keep]
+	tail.types = tail.types[:keep]
+	tail.size = newSize
+	if err := fls.sealSegment(tail); err != nil {
+		utils.RaftLog.Error("fail to sync log segment %s : %s", tail.dataFile.Name(), err)
+		return false
+	}
+	return true
+}
+
+//Rest 清空所有的日志，并将 nextLogIndex 作为下一条日志的起始位置，如果 nextLogIndex 对应的日志存在则保留该日志
+func (fls *FileLogStorage) Rest(nextLogIndex int64) bool {
+	if nextLogIndex <= 0 {
+		utils.RaftLog.Error("invalid next log index %d", nextLogIndex)
+		return false
+	}
+	defer fls.lock.Unlock()
+	fls.lock.Lock()
+
+	// 清空以及写入占位日志在同一次加锁中完成，避免其他协程看到中间状态或者在两者之间写入日志
+	entry := fls.getEntry(nextLogIndex)
+	for _, segment := range fls.segments {
+		fls.destroySegment(segment)
+	}
+	fls.segments = nil
+	fls.firstLogIndex = nextLogIndex
+	if err := fls.saveMeta(); err != nil {
+		utils.RaftLog.Error("fail to save log meta when reset to %d : %s", nextLogIndex, err)
+		return false
+	}
+
+	if entry == nil {
+		entry = entity.NewLogEntry(raft.EntryType_EntryTypeNoOp)
+		entry.LogID = entity.NewLogID(nextLogIndex, 0)
+		utils.RaftLog.Warn("entry not found for nextLogIndex %d when reset", nextLogIndex)
+	}
+	dirty := make(map[*logSegment]struct{})
+	if err := fls.appendLocked(entry, dirty); err != nil {
+		utils.RaftLog.Error("fail to append log entry index=%d when reset : %s", nextLogIndex, err)
+		return false
+	}
+	if err := fls.syncSegments(dirty); err != nil {
+		utils.RaftLog.Error("fail to sync log segments when reset to %d : %s", nextLogIndex, err)
+		return false
+	}
+	return true
+}
+
+func (fls *FileLogStorage) destroySegment(segment *logSegment) {
+	segment.close()
+	if err := os.Remove(fls.segmentPath(segment.firstIndex, logSegmentDataSuffix)); err != nil && !os.IsNotExist(err) {
+		utils.RaftLog.Error("fail to remove log segment %d : %s", segment.firstIndex, err)
+	}
+	if err := os.Remove(fls.segmentPath(segment.firstIndex, logSegmentIndexSuffix)); err != nil && !os.IsNotExist(err) {
+		utils.RaftLog.Error("fail to remove log index %d : %s", segment.firstIndex, err)
+	}
+}
+
+func (fls *FileLogStorage) findSegment(index int64) *logSegment {
+	i := sort.Search(len(fls.segments), func(i int) bool {
+		return fls.segments[i].lastIndex() >= index
+	})
+	if i < len(fls.segments) && fls.segments[i].contains(index) {
+		return fls.segments[i]
+	}
+	return nil
+}
+
+func (fls *FileLogStorage) segmentPath(firstIndex int64, suffix string) string {
+	return filepath.Join(fls.path, fmt.Sprintf("%s%020d%s", logSegmentPrefix, firstIndex, suffix))
+}
+
+func (fls *FileLogStorage) saveMeta() error {
+	b, err := proto.Marshal(&raft.LogPBMeta{FirstLogIndex: fls.firstLogIndex})
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, checksumSize+len(b))
+	binary.BigEndian.PutUint64(buf[0:checksumSize], utils.Checksum(b))
+	copy(buf[checksumSize:], b)
+	return utils.AtomicWriteFile(filepath.Join(fls.path, logMetaFile), buf, 0644)
+}
+
+func (fls *FileLogStorage) loadMeta() error {
+	buf, err := ioutil.ReadFile(filepath.Join(fls.path, logMetaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(buf) < checksumSize || binary.BigEndian.Uint64(buf[0:checksumSize]) != utils.Checksum(buf[checksumSize:]) {
+		return fmt.Errorf("log meta checksum mismatch")
+	}
+	meta := &raft.LogPBMeta{}
+	if err := proto.Unmarshal(buf[checksumSize:], meta); err != nil {
+		return err
+	}
+	if meta.FirstLogIndex > 0 {
+		fls.firstLogIndex = meta.FirstLogIndex
+		fls.hasLoadedFirst = true
+	}
+	return nil
+}
+
+//loadSegments 加载所有的 segment，对于已经封存的 segment 直接信任其索引文件，而最后一个 segment 则需要重新扫描并且校验每一条记录，
+//遇到不完整或者校验失败的记录时，从该位置开始截断
+func (fls *FileLogStorage) loadSegments() error {
+	files, err := ioutil.ReadDir(fls.path)
+	if err != nil {
+		return err
+	}
+	firstIndexes := make([]int64, 0)
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, logSegmentPrefix) || !strings.HasSuffix(name, logSegmentDataSuffix) {
+			continue
+		}
+		firstIndex, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, logSegmentPrefix),
+			logSegmentDataSuffix), 10, 64)
+		if err != nil {
+			utils.RaftLog.Warn("ignore unknown file %s in log storage dir", name)
+			continue
+		}
+		firstIndexes = append(firstIndexes, firstIndex)
+	}
+	sort.Slice(firstIndexes, func(i, j int) bool {
+		return firstIndexes[i] < firstIndexes[j]
+	})
+
+	for i, firstIndex := range firstIndexes {
+		isTail := i == len(firstIndexes)-1
+		segment, err := fls.openSegment(firstIndex, isTail)
+		if err != nil {
+			return err
+		}
+		if n := len(fls.segments); n != 0 && fls.segments[n-1].lastIndex()+1 != segment.firstIndex {
+			segment.close()
+			return fmt.Errorf("log segments are not continuous, prev last index=%d, next first index=%d",
+				fls.segments[n-1].lastIndex(), segment.firstIndex)
+		}
+		fls.segments = append(fls.segments, segment)
+	}
+
+	// 删除掉那些已经完全位于 firstLogIndex 之前的 segment, 这是由于 TruncatePrefix 时持久化 meta 之后宕机导致的
+	for len(fls.segments) > 1 && fls.segments[0].lastIndex() < fls.firstLogIndex {
+		fls.destroySegment(fls.segments[0])
+		fls.segments = fls.segments[1:]
+	}
+	if len(fls.segments) != 0 {
+		head := fls.segments[0]
+		if !fls.hasLoadedFirst || head.firstIndex > fls.firstLogIndex {
+			fls.firstLogIndex = head.firstIndex
+		}
+		tail := fls.segments[len(fls.segments)-1]
+		if tail.isEmpty() || tail.lastIndex() < fls.firstLogIndex {
+			fls.destroySegment(tail)
+			fls.segments = fls.segments[:len(fls.segments)-1]
+		}
+	}
+	return nil
+}
+
+func (fls *FileLogStorage) openSegment(firstIndex int64, isTail bool) (*logSegment, error) {
+	dataFile, err := os.OpenFile(fls.segmentPath(firstIndex, logSegmentDataSuffix), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	indexFile, err := os.OpenFile(fls.segmentPath(firstIndex, logSegmentIndexSuffix), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		_ = dataFile.Close()
+		return nil, err
+	}
+	segment := &logSegment{
+		firstIndex: firstIndex,
+		dataFile:   dataFile,
+		indexFile:  indexFile,
+	}
+	if !isTail {
+		if err := fls.loadSegmentIndex(segment); err == nil {
+			return segment, nil
+		}
+		utils.RaftLog.Warn("log index of segment %d is broken, rebuild it by scanning data file", firstIndex)
+	}
+	if err := fls.recoverSegment(segment); err != nil {
+		segment.close()
+		return nil, err
+	}
+	return segment, nil
+}
+
+func (fls *FileLogStorage) loadSegmentIndex(segment *logSegment) error {
+	stat, err := segment.dataFile.Stat()
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadAll(io.NewSectionReader(segment.indexFile, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+	if len(buf) == 0 || len(buf)%logIndexRecordSize != 0 {
+		return fmt.Errorf("invalid log index size %d", len(buf))
+	}
+	cnt := len(buf) / logIndexRecordSize
+	offsets := make([]int64, cnt)
+	types := make([]raft.EntryType, cnt)
+	for i := 0; i < cnt; i++ {
+		record := buf[i*logIndexRecordSize : (i+1)*logIndexRecordSize]
+		offsets[i] = int64(binary.BigEndian.Uint64(record[0:8]))
+		types[i] = raft.EntryType(record[8])
+		if offsets[i] >= stat.Size() || (i > 0 && offsets[i] <= offsets[i-1]) {
+			return fmt.Errorf("invalid log index offset %d", offsets[i])
+		}
+	}
+	segment.offsets = offsets
+	segment.types = types
+	segment.size = stat.Size()
+	return nil
+}
+
+//recoverSegment 顺序扫描数据文件并校验每一条记录，重建索引文件
+func (fls *FileLogStorage) recoverSegment(segment *logSegment) error {
+	reader := bufio.NewReader(io.NewSectionReader(segment.dataFile, 0, 1<<62))
+	offset := int64(0)
+	header := make([]byte, logRecordHeaderSize)
+	offsets := make([]int64, 0)
+	types := make([]raft.EntryType, 0)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		dataLen := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint64(header[4:logRecordHeaderSize])
+		data := make([]byte, dataLen)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			utils.RaftLog.Warn("incomplete log record at offset %d of segment %d", offset, segment.firstIndex)
+			break
+		}
+		if utils.Checksum(data) != checksum {
+			utils.RaftLog.Warn("checksum mismatch at offset %d of segment %d", offset, segment.firstIndex)
+			break
+		}
+		entry := &entity.LogEntry{}
+		if err := entry.Decode(data); err != nil || entry.LogID.GetIndex() != segment.firstIndex+int64(len(offsets)) {
+			utils.RaftLog.Warn("bad log record at offset %d of segment %d", offset, segment.firstIndex)
+			break
+		}
+		offsets = append(offsets, offset)
+		types = append(types, entry.LogType)
+		offset += int64(logRecordHeaderSize) + int64(dataLen)
+	}
+
+	stat, err := segment.dataFile.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() != offset {
+		utils.RaftLog.Warn("truncate segment %d from %d to %d bytes", segment.firstIndex, stat.Size(), offset)
+		if err := segment.dataFile.Truncate(offset); err != nil {
+			return err
+		}
+		if err := segment.dataFile.Sync(); err != nil {
+			return err
+		}
+	}
+	idx := make([]byte, len(offsets)*logIndexRecordSize)
+	for i := range offsets {
+		binary.BigEndian.PutUint64(idx[i*logIndexRecordSize:i*logIndexRecordSize+8], uint64(offsets[i]))
+		idx[i*logIndexRecordSize+8] = byte(types[i])
+	}
+	if err := segment.indexFile.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := segment.indexFile.WriteAt(idx, 0); err != nil {
+		return err
+	}
+	if err := segment.indexFile.Sync(); err != nil {
+		return err
+	}
+	segment.offsets = offsets
+	segment.types = types
+	segment.size = offset
+	return nil
+}
+
+//loadConfiguration 将 firstLogIndex 之后的所有配置变更日志加载到 ConfigurationManager 中
+func (fls *FileLogStorage) loadConfiguration(confMgn *entity.ConfigurationManager) {
+	for _, segment := range fls.segments {
+		for i, t := range segment.types {
+			index := segment.firstIndex + int64(i)
+			if t != raft.EntryType_EntryTypeConfiguration || index < fls.firstLogIndex {
+				continue
+			}
+			entry := fls.getEntry(index)
+			if entry == nil {
+				continue
+			}
+			confEntry := entity.NewConfigurationEntry(entity.NewLogID(index, entry.LogID.GetTerm()),
+				entity.NewConfiguration(entry.Peers, entry.Learners), nil)
+			if len(entry.OldPeers) != 0 {
+				confEntry.SetOldConf(entity.NewConfiguration(entry.OldPeers, entry.OldLearners))
+			}
+			confMgn.Add(confEntry)
+		}
+	}
+}
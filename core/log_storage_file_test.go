@@ -0,0 +1,237 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+)
+
+func newTestLogEntry(index, term int64) *entity.LogEntry {
+	entry := entity.NewLogEntry(raft.EntryType_EntryTypeData)
+	entry.LogID = entity.NewLogID(index, term)
+	entry.Data = []byte("data")
+	return entry
+}
+
+//openTestFileLogStorage 打开 dir 下的 FileLogStorage，segmentSize 很小时少量日志就会切分出多个 segment
+func openTestFileLogStorage(t *testing.T, dir string, segmentSize int64) *FileLogStorage {
+	t.Helper()
+	raftOpts := NewDefaultRaftOptions()
+	raftOpts.MaxSegmentFileSize = segmentSize
+	storage := NewFileLogStorage(dir, raftOpts)
+	if !storage.Init(LogStorageOptions{}) {
+		t.Fatalf("fail to init file log storage %s", dir)
+	}
+	t.Cleanup(storage.Shutdown)
+	return storage
+}
+
+//appendTestLogs 追加 [first, last] 的日志，第 i 条日志的 term 为 i/10 + 1
+func appendTestLogs(t *testing.T, storage LogStorage, first, last int64) {
+	t.Helper()
+	entries := make([]*entity.LogEntry, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		entries = append(entries, newTestLogEntry(i, i/10+1))
+	}
+	if n := storage.AppendEntries(entries); n != len(entries) {
+		t.Fatalf("append %d entries, written %d", len(entries), n)
+	}
+}
+
+func checkLogRange(t *testing.T, storage LogStorage, first, last int64) {
+	t.Helper()
+	if storage.GetFirstLogIndex() != first || storage.GetLastLogIndex() != last {
+		t.Fatalf("log range [%d, %d], expect [%d, %d]", storage.GetFirstLogIndex(), storage.GetLastLogIndex(),
+			first, last)
+	}
+	for i := first; i <= last; i++ {
+		if entry := storage.GetEntry(i); entry == nil || entry.LogID.GetTerm() != i/10+1 {
+			t.Fatalf("entry at %d : %v", i, entry)
+		}
+	}
+	if storage.GetEntry(first-1) != nil || storage.GetEntry(last+1) != nil {
+		t.Fatalf("entries out of [%d, %d] are still readable", first, last)
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, logSegmentPrefix+"*"+logSegmentDataSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestFileLogStorageRecoverTornTail(t *testing.T) {
+	dir := t.TempDir()
+	storage := openTestFileLogStorage(t, dir, 1<<20)
+	appendTestLogs(t, storage, 1, 20)
+	storage.Shutdown()
+
+	// 宕机时最后一条记录只写了一部分：头部声明的长度比实际写入的数据长
+	files := segmentFiles(t, dir)
+	tail, err := os.OpenFile(files[len(files)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tail.Write([]byte{0, 0, 0, 100, 1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	tail.Close()
+
+	storage = openTestFileLogStorage(t, dir, 1<<20)
+	checkLogRange(t, storage, 1, 20)
+	appendTestLogs(t, storage, 21, 21)
+	storage.Shutdown()
+
+	// 最后一条记录完整写入但是内容损坏，校验失败之后从这条记录开始截断
+	buf, err := ioutil.ReadFile(files[len(files)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)-1] ^= 0xff
+	if err := ioutil.WriteFile(files[len(files)-1], buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	storage = openTestFileLogStorage(t, dir, 1<<20)
+	checkLogRange(t, storage, 1, 20)
+}
+
+func TestFileLogStorageCorruptMeta(t *testing.T) {
+	dir := t.TempDir()
+	storage := openTestFileLogStorage(t, dir, 1<<20)
+	appendTestLogs(t, storage, 1, 20)
+	if !storage.TruncatePrefix(5) {
+		t.Fatal("fail to truncate prefix")
+	}
+	storage.Shutdown()
+
+	metaPath := filepath.Join(dir, logMetaFile)
+	buf, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)-1] ^= 0xff
+	if err := ioutil.WriteFile(metaPath, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// firstLogIndex 无法确认时不能继续使用，否则已经被截断的日志会重新出现
+	raftOpts := NewDefaultRaftOptions()
+	if NewFileLogStorage(dir, raftOpts).Init(LogStorageOptions{}) {
+		t.Fatal("log storage with a corrupt meta must fail to init")
+	}
+}
+
+func TestFileLogStorageTruncatePrefixSaveMetaFails(t *testing.T) {
+	dir := t.TempDir()
+	storage := openTestFileLogStorage(t, dir, 1<<20)
+	appendTestLogs(t, storage, 1, 20)
+	// 临时文件的位置被目录占用，log meta 无法写入
+	if err := os.Mkdir(filepath.Join(dir, logMetaFile+".tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if storage.TruncatePrefix(5) {
+		t.Fatal("truncate prefix should fail when log meta can not be saved")
+	}
+	checkLogRange(t, storage, 1, 20)
+}
+
+func TestFileLogStorageTruncateAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	storage := openTestFileLogStorage(t, dir, 256)
+	appendTestLogs(t, storage, 1, 100)
+	segments := len(segmentFiles(t, dir))
+	if segments < 4 {
+		t.Fatalf("expect logs to span several segments, actual %d", segments)
+	}
+
+	if !storage.TruncatePrefix(45) {
+		t.Fatal("fail to truncate prefix")
+	}
+	checkLogRange(t, storage, 45, 100)
+	afterPrefix := len(segmentFiles(t, dir))
+	if afterPrefix >= segments {
+		t.Fatalf("segments before firstIndexKept are not removed, %d -> %d", segments, afterPrefix)
+	}
+
+	if !storage.TruncateSuffix(60) {
+		t.Fatal("fail to truncate suffix")
+	}
+	checkLogRange(t, storage, 45, 60)
+	if afterSuffix := len(segmentFiles(t, dir)); afterSuffix >= afterPrefix {
+		t.Fatalf("segments after lastIndexKept are not removed, %d -> %d", afterPrefix, afterSuffix)
+	}
+	// 截断之后可以继续追加，重新打开之后两次截断的结果都还在
+	appendTestLogs(t, storage, 61, 70)
+	storage.Shutdown()
+
+	storage = openTestFileLogStorage(t, dir, 256)
+	checkLogRange(t, storage, 45, 70)
+}
+
+func TestFileLogStorageRollbackWhenSyncFails(t *testing.T) {
+	dir := t.TempDir()
+	storage := openTestFileLogStorage(t, dir, 1024*1024)
+	appendTestLogs(t, storage, 1, 5)
+
+	// /dev/null 可以写入但是不支持 fsync，用来模拟数据文件 fsync 失败
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	tail := storage.segments[len(storage.segments)-1]
+	dataFile := tail.dataFile
+	tail.dataFile = devNull
+	entries := []*entity.LogEntry{newTestLogEntry(6, 1), newTestLogEntry(7, 1)}
+	if n := storage.AppendEntries(entries); n != 0 {
+		t.Fatalf("append entries when sync fails, written %d", n)
+	}
+	tail.dataFile = dataFile
+	// 没有落盘的日志被回滚，之后可以从原来的位置继续写入
+	checkLogRange(t, storage, 1, 5)
+	appendTestLogs(t, storage, 6, 8)
+	storage.Shutdown()
+
+	storage = openTestFileLogStorage(t, dir, 1024*1024)
+	checkLogRange(t, storage, 1, 8)
+}
+
+func TestFileLogStorageResetAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	storage := openTestFileLogStorage(t, dir, 256)
+	appendTestLogs(t, storage, 1, 50)
+
+	// nextLogIndex 对应的日志存在时保留这条日志
+	if !storage.Rest(30) {
+		t.Fatal("fail to reset")
+	}
+	checkLogRange(t, storage, 30, 30)
+	appendTestLogs(t, storage, 31, 35)
+	storage.Shutdown()
+
+	storage = openTestFileLogStorage(t, dir, 256)
+	checkLogRange(t, storage, 30, 35)
+
+	// nextLogIndex 超过了最后一条日志，只留下一条 term 为 0 的占位日志
+	if !storage.Rest(100) {
+		t.Fatal("fail to reset")
+	}
+	storage.Shutdown()
+	storage = openTestFileLogStorage(t, dir, 256)
+	if storage.GetFirstLogIndex() != 100 || storage.GetLastLogIndex() != 100 || storage.GetTerm(100) != 0 {
+		t.Fatalf("log range [%d, %d] after reset to 100", storage.GetFirstLogIndex(), storage.GetLastLogIndex())
+	}
+	if storage.GetEntry(35) != nil {
+		t.Fatal("entries before reset are still readable")
+	}
+}
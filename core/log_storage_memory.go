@@ -0,0 +1,158 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"sync"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/utils"
+)
+
+//MemoryLogStorage 纯内存的 LogStorage 实现，进程退出后数据即丢失，主要用于测试以及对持久化没有要求的场景
+type MemoryLogStorage struct {
+	lock          sync.RWMutex
+	firstLogIndex int64
+	entries       []*entity.LogEntry
+}
+
+func NewMemoryLogStorage() *MemoryLogStorage {
+	return &MemoryLogStorage{
+		firstLogIndex: 1,
+		entries:       make([]*entity.LogEntry, 0),
+	}
+}
+
+func (mls *MemoryLogStorage) Init(opts LogStorageOptions) bool {
+	defer mls.lock.RUnlock()
+	mls.lock.RLock()
+
+	if opts.ConfMgn == nil {
+		return true
+	}
+	for _, entry := range mls.entries {
+		if entry.LogType != raft.EntryType_EntryTypeConfiguration {
+			continue
+		}
+		confEntry := entity.NewConfigurationEntry(entity.NewLogID(entry.LogID.GetIndex(), entry.LogID.GetTerm()),
+			entity.NewConfiguration(entry.Peers, entry.Learners), nil)
+		if len(entry.OldPeers) != 0 {
+			confEntry.SetOldConf(entity.NewConfiguration(entry.OldPeers, entry.OldLearners))
+		}
+		opts.ConfMgn.Add(confEntry)
+	}
+	return true
+}
+
+func (mls *MemoryLogStorage) Shutdown() {
+}
+
+func (mls *MemoryLogStorage) GetFirstLogIndex() int64 {
+	defer mls.lock.RUnlock()
+	mls.lock.RLock()
+	return mls.firstLogIndex
+}
+
+func (mls *MemoryLogStorage) GetLastLogIndex() int64 {
+	defer mls.lock.RUnlock()
+	mls.lock.RLock()
+	return mls.firstLogIndex + int64(len(mls.entries)) - 1
+}
+
+func (mls *MemoryLogStorage) GetEntry(index int64) *entity.LogEntry {
+	defer mls.lock.RUnlock()
+	mls.lock.RLock()
+	return mls.getEntry(index)
+}
+
+func (mls *MemoryLogStorage) getEntry(index int64) *entity.LogEntry {
+	pos := index - mls.firstLogIndex
+	if pos < 0 || pos >= int64(len(mls.entries)) {
+		return nil
+	}
+	return mls.entries[pos]
+}
+
+func (mls *MemoryLogStorage) GetTerm(index int64) int64 {
+	defer mls.lock.RUnlock()
+	mls.lock.RLock()
+	entry := mls.getEntry(index)
+	if entry == nil {
+		return 0
+	}
+	return entry.LogID.GetTerm()
+}
+
+func (mls *MemoryLogStorage) AppendEntry(entry *entity.LogEntry) bool {
+	return mls.AppendEntries([]*entity.LogEntry{entry}) == 1
+}
+
+func (mls *MemoryLogStorage) AppendEntries(entries []*entity.LogEntry) int {
+	defer mls.lock.Unlock()
+	mls.lock.Lock()
+
+	for i, entry := range entries {
+		if len(mls.entries) == 0 {
+			mls.firstLogIndex = entry.LogID.GetIndex()
+		}
+		expect := mls.firstLogIndex + int64(len(mls.entries))
+		if entry.LogID.GetIndex() != expect {
+			utils.RaftLog.Error("append entry index %d mismatch, expect %d", entry.LogID.GetIndex(), expect)
+			return i
+		}
+		mls.entries = append(mls.entries, entry)
+	}
+	return len(entries)
+}
+
+func (mls *MemoryLogStorage) TruncatePrefix(firstIndexKept int64) bool {
+	defer mls.lock.Unlock()
+	mls.lock.Lock()
+
+	if firstIndexKept <= mls.firstLogIndex {
+		return true
+	}
+	pos := firstIndexKept - mls.firstLogIndex
+	if pos >= int64(len(mls.entries)) {
+		mls.entries = make([]*entity.LogEntry, 0)
+	} else {
+		mls.entries = append(make([]*entity.LogEntry, 0, int64(len(mls.entries))-pos), mls.entries[pos:]...)
+	}
+	mls.firstLogIndex = firstIndexKept
+	return true
+}
+
+func (mls *MemoryLogStorage) TruncateSuffix(lastIndexKept int64) bool {
+	defer mls.lock.Unlock()
+	mls.lock.Lock()
+
+	pos := lastIndexKept - mls.firstLogIndex + 1
+	if pos < 0 {
+		pos = 0
+	}
+	if pos < int64(len(mls.entries)) {
+		mls.entries = mls.entries[:pos]
+	}
+	return true
+}
+
+func (mls *MemoryLogStorage) Rest(nextLogIndex int64) bool {
+	if nextLogIndex <= 0 {
+		return false
+	}
+	defer mls.lock.Unlock()
+	mls.lock.Lock()
+
+	entry := mls.getEntry(nextLogIndex)
+	if entry == nil {
+		entry = entity.NewLogEntry(raft.EntryType_EntryTypeNoOp)
+		entry.LogID = entity.NewLogID(nextLogIndex, 0)
+		utils.RaftLog.Warn("entry not found for nextLogIndex %d when reset", nextLogIndex)
+	}
+	mls.firstLogIndex = nextLogIndex
+	mls.entries = []*entity.LogEntry{entry}
+	return true
+}
@@ -0,0 +1,489 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pole-group/lraft/entity"
+	"github.com/pole-group/lraft/rpc"
+)
+
+//startTestNode 在 network 上启动一个节点，initialConf 为空的节点需要等待 Leader 把它加入集群
+func startTestNode(t *testing.T, network *rpc.FaultNetwork, self entity.PeerId, initialConf []entity.PeerId) *nodeImpl {
+	opts := newSingleNodeOptions(t, network, self)
+	opts.InitialConf = entity.NewConfiguration(initialConf, nil)
+	node, err := NewNode(testGroupID, self, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		node.Shutdown(nil)
+		node.Join()
+	})
+	return node.(*nodeImpl)
+}
+
+//waitSingleLeader 等待 nodes 中只有一个节点认为自己是 Leader，并且它在当前任期写入的配置日志已经提交，之后才能发起成员变更
+func waitSingleLeader(t *testing.T, nodes ...*nodeImpl) *nodeImpl {
+	t.Helper()
+	var leader *nodeImpl
+	waitUntil(t, "a single leader", func() bool {
+		leader = nil
+		for _, node := range nodes {
+			if node.IsLeader() {
+				if leader != nil {
+					return false
+				}
+				leader = node
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		leader.lock.RLock()
+		defer leader.lock.RUnlock()
+		return !leader.confCtx.IsBusy()
+	})
+	return leader
+}
+
+//awaitClosure 等待 done 被回调，超时之后测试失败
+func awaitClosure(t *testing.T, what string, done *SynchronizedClosure) entity.Status {
+	t.Helper()
+	result := make(chan entity.Status, 1)
+	go func() {
+		result <- done.Await()
+	}()
+	select {
+	case st := <-result:
+		return st
+	case <-time.After(10 * testElectionTimeoutMs * time.Millisecond):
+		t.Fatalf("%s timeout", what)
+	}
+	return entity.Status{}
+}
+
+//currentConf 节点当前生效的配置
+func currentConf(node *nodeImpl) (*entity.Configuration, bool) {
+	defer node.lock.RUnlock()
+	node.lock.RLock()
+	return node.conf.GetConf().Copy(), node.conf.IsStable()
+}
+
+func TestChangePeersJointConsensus(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peers := newTestPeers(4)
+	nodes := make([]*nodeImpl, 0, len(peers))
+	for _, peer := range peers[:3] {
+		nodes = append(nodes, startTestNode(t, network, peer, peers[:3]))
+	}
+	// 第四个节点启动时不在任何配置中，不会发起选举
+	newcomer := startTestNode(t, network, peers[3], nil)
+	leader := waitSingleLeader(t, nodes...)
+
+	cluster := &testCluster{t: t}
+	index, ok := cluster.appendData(leader, []byte("a"), []byte("b"), []byte("c"))
+	if !ok {
+		t.Fatal("leader steps down")
+	}
+	cluster.waitCommitted(index, nodes...)
+
+	// 集群之外的节点以及 Follower 都不能发起成员变更
+	for _, node := range append(nodes, newcomer) {
+		if node == leader {
+			continue
+		}
+		done := NewSynchronizedClosure(1)
+		node.AddPeer(peers[3], done)
+		if st := awaitClosure(t, "add peer on follower", done); st.GetCode() != entity.EPERM {
+			t.Fatalf("add peer on %s, status %d %s", node.serverID.GetDesc(), st.GetCode(), st.GetMsg())
+		}
+	}
+
+	// 新节点追上日志之后依次提交 joint 配置以及新配置，变更完成时新节点已经拥有全部的日志
+	done := NewSynchronizedClosure(1)
+	leader.AddPeer(peers[3], done)
+	busy := NewSynchronizedClosure(1)
+	leader.RemovePeer(peers[0], busy)
+	if st := awaitClosure(t, "concurrent change", busy); st.GetCode() != entity.EBUSY {
+		t.Fatalf("concurrent change, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if st := awaitClosure(t, "add peer", done); !st.IsOK() {
+		t.Fatalf("add peer, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	nodes = append(nodes, newcomer)
+	cluster.waitCommitted(index+2, nodes...)
+	for _, node := range nodes {
+		waitUntil(t, node.serverID.GetDesc()+" to apply the new configuration", func() bool {
+			conf, stable := currentConf(node)
+			return stable && conf.Equal(entity.NewConfiguration(peers, nil))
+		})
+	}
+
+	// 移除一个 Follower 之后 Leader 不再向它复制日志
+	var removed *nodeImpl
+	for _, node := range nodes[:3] {
+		if node != leader {
+			removed = node
+			break
+		}
+	}
+	done = NewSynchronizedClosure(1)
+	leader.RemovePeer(removed.serverID, done)
+	if st := awaitClosure(t, "remove follower", done); !st.IsOK() {
+		t.Fatalf("remove follower, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if leader.replicatorGroup.GetReplicator(removed.serverID) != nil {
+		t.Fatal("replicator of the removed peer is not stopped")
+	}
+	remains := make([]*nodeImpl, 0, len(nodes))
+	for _, node := range nodes {
+		if node != removed {
+			remains = append(remains, node)
+		}
+	}
+	if conf, stable := currentConf(leader); !stable || conf.Size() != 3 || conf.Contains(removed.serverID) {
+		t.Fatalf("configuration after removing %s : %v", removed.serverID.GetDesc(), conf.ListPeers())
+	}
+
+	// 移除 Leader 自己，变更完成之后 Leader stepDown，剩下的节点选出新的 Leader
+	done = NewSynchronizedClosure(1)
+	leader.RemovePeer(leader.serverID, done)
+	if st := awaitClosure(t, "remove leader", done); !st.IsOK() {
+		t.Fatalf("remove leader, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	oldLeader := leader
+	if oldLeader.IsLeader() {
+		t.Fatal("removed leader does not step down")
+	}
+	survivors := make([]*nodeImpl, 0, len(remains))
+	for _, node := range remains {
+		if node != oldLeader {
+			survivors = append(survivors, node)
+		}
+	}
+	leader = waitSingleLeader(t, survivors...)
+	if conf, _ := currentConf(leader); conf.Size() != 2 || conf.Contains(oldLeader.serverID) {
+		t.Fatalf("configuration of the new leader : %v", conf.ListPeers())
+	}
+	if index, ok = cluster.appendData(leader, []byte("d")); !ok {
+		t.Fatal("new leader steps down")
+	}
+	cluster.waitCommitted(index, survivors...)
+}
+
+func TestAddPeerCatchUpFailure(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peers := newTestPeers(4)
+	nodes := make([]*nodeImpl, 0, 3)
+	for _, peer := range peers[:3] {
+		nodes = append(nodes, startTestNode(t, network, peer, peers[:3]))
+	}
+	leader := waitSingleLeader(t, nodes...)
+
+	// 新节点不可达，变更停在追赶日志的阶段并且以 ECatchup 结束，配置保持不变
+	done := NewSynchronizedClosure(1)
+	leader.AddPeer(peers[3], done)
+	if st := awaitClosure(t, "add unreachable peer", done); st.GetCode() != entity.ECatchup {
+		t.Fatalf("add unreachable peer, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if conf, stable := currentConf(leader); !stable || !conf.Equal(entity.NewConfiguration(peers[:3], nil)) {
+		t.Fatalf("configuration changes after a failed change : %v", conf.ListPeers())
+	}
+	if leader.replicatorGroup.GetReplicator(peers[3]) != nil {
+		t.Fatal("replicator of the failed peer is not stopped")
+	}
+
+	// 失败之后可以发起下一次变更
+	done = NewSynchronizedClosure(1)
+	leader.RemovePeer(peers[2], done)
+	if st := awaitClosure(t, "remove peer", done); !st.IsOK() {
+		t.Fatalf("remove peer after a failed change, status %d %s", st.GetCode(), st.GetMsg())
+	}
+}
+
+func TestLearnerReplication(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peers := newTestPeers(4)
+	voters := make([]*nodeImpl, 0, 3)
+	for _, peer := range peers[:3] {
+		voters = append(voters, startTestNode(t, network, peer, peers[:3]))
+	}
+	learner := startTestNode(t, network, peers[3], nil)
+	leader := waitSingleLeader(t, voters...)
+	changeLearners := func(what string, change func(learners []entity.PeerId, done Closure),
+		learners []entity.PeerId) entity.Status {
+		done := NewSynchronizedClosure(1)
+		change(learners, done)
+		return awaitClosure(t, what, done)
+	}
+
+	if st := changeLearners("add empty learners", leader.AddLearners, nil); st.GetCode() != entity.EINVAL {
+		t.Fatalf("add empty learners, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	// 投票成员不能同时是 Learner
+	if st := changeLearners("add voter as learner", leader.AddLearners, peers[:1]); st.GetCode() != entity.EINVAL {
+		t.Fatalf("add voter as learner, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if st := changeLearners("add learner", leader.AddLearners, peers[3:]); !st.IsOK() {
+		t.Fatalf("add learner, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if conf, stable := currentConf(leader); !stable || conf.Size() != 3 || !conf.GetLearners().Contain(peers[3]) {
+		t.Fatalf("configuration after adding learner : %v %v", conf.ListPeers(), conf.ListLearners())
+	}
+	if r := leader.replicatorGroup.GetReplicator(peers[3]); r == nil || !r.getReplicatorType().IsLearner() {
+		t.Fatal("learner replicator is not started")
+	}
+	waitUntil(t, "learner to apply the configuration", learner.IsLearner)
+
+	cluster := &testCluster{t: t}
+	index, ok := cluster.appendData(leader, []byte("a"))
+	if !ok {
+		t.Fatal("leader steps down")
+	}
+	cluster.waitCommitted(index, append(voters, learner)...)
+
+	// Leader 只能联系上 Learner 时，Learner 收到了日志也不能让日志提交
+	followers := make([]*nodeImpl, 0, 2)
+	for _, node := range voters {
+		if node != leader {
+			followers = append(followers, node)
+		}
+	}
+	network.Partition(cluster.endpoints(leader, learner), cluster.endpoints(followers...))
+	if index, ok = cluster.appendData(leader, []byte("b")); !ok {
+		t.Fatal("leader steps down")
+	}
+	waitUntil(t, "learner to receive the log", func() bool {
+		return learner.logManager.GetLastLogIndex() >= index
+	})
+	if committed := leader.ballotBox.GetLastCommittedIndex(); committed >= index {
+		t.Fatalf("log %d is committed without a quorum of voters, committedIndex=%d", index, committed)
+	}
+	// 旧的 Leader 因为联系不上多数派而 stepDown，和它在同一个分区的 Learner 不会发起选举
+	waitUntil(t, "leader to step down", func() bool {
+		return !leader.IsLeader()
+	})
+	leader = waitSingleLeader(t, followers...)
+	network.HealPartition()
+	if state, _, _ := cluster.status(learner); state != StateFollower {
+		t.Fatalf("learner is in state %s", state.GetName())
+	}
+	if index, ok = cluster.appendData(leader, []byte("c")); !ok {
+		t.Fatal("new leader steps down")
+	}
+	cluster.waitCommitted(index, learner)
+
+	// Learner 随配置一起保存在快照中
+	done := NewSynchronizedClosure(1)
+	leader.Snapshot(done)
+	if st := awaitClosure(t, "snapshot", done); !st.IsOK() {
+		t.Fatalf("snapshot, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	reader := leader.snapshotExecutor.GetSnapshotStorage().Open()
+	meta := reader.Load()
+	reader.Close()
+	if meta == nil || len(meta.Learners) != 1 || meta.Learners[0] != peers[3].GetDesc() {
+		t.Fatalf("learners in snapshot meta : %v", meta)
+	}
+
+	if st := changeLearners("remove learner", leader.RemoveLearners, peers[3:]); !st.IsOK() {
+		t.Fatalf("remove learner, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if conf, _ := currentConf(leader); len(conf.ListLearners()) != 0 {
+		t.Fatalf("learners after removing : %v", conf.ListLearners())
+	}
+	if leader.replicatorGroup.GetReplicator(peers[3]) != nil {
+		t.Fatal("replicator of the removed learner is not stopped")
+	}
+	if st := changeLearners("reset learners", leader.ResetLearners, peers[3:]); !st.IsOK() {
+		t.Fatalf("reset learners, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if conf, _ := currentConf(leader); !conf.GetLearners().Contain(peers[3]) {
+		t.Fatalf("learners after resetting : %v", conf.ListLearners())
+	}
+}
+
+func TestPromoteLearner(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peers := newTestPeers(5)
+	voters := make([]*nodeImpl, 0, 3)
+	for _, peer := range peers[:3] {
+		voters = append(voters, startTestNode(t, network, peer, peers[:3]))
+	}
+	learner := startTestNode(t, network, peers[3], nil)
+	leader := waitSingleLeader(t, voters...)
+	promote := func(what string, node *nodeImpl, peer entity.PeerId, timeoutMs int64) entity.Status {
+		done := NewSynchronizedClosure(1)
+		node.PromoteLearner(peer, timeoutMs, done)
+		return awaitClosure(t, what, done)
+	}
+
+	// peers[4] 没有启动，作为 Learner 加入之后永远追不上日志
+	done := NewSynchronizedClosure(1)
+	leader.AddLearners(peers[3:], done)
+	if st := awaitClosure(t, "add learners", done); !st.IsOK() {
+		t.Fatalf("add learners, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	cluster := &testCluster{t: t}
+	index, ok := cluster.appendData(leader, []byte("a"), []byte("b"))
+	if !ok {
+		t.Fatal("leader steps down")
+	}
+	cluster.waitCommitted(index, learner)
+
+	for _, node := range voters {
+		if node != leader {
+			if st := promote("promote on follower", node, peers[3], 0); st.GetCode() != entity.EPERM {
+				t.Fatalf("promote on follower, status %d %s", st.GetCode(), st.GetMsg())
+			}
+			break
+		}
+	}
+	if st := promote("promote voter", leader, peers[0], 0); st.GetCode() != entity.EINVAL {
+		t.Fatalf("promote voter, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if st := promote("promote lagging learner", leader, peers[4], 500); st.GetCode() != entity.ECatchup {
+		t.Fatalf("promote lagging learner, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if conf, stable := currentConf(leader); !stable || conf.Contains(peers[4]) || !conf.GetLearners().Contain(peers[4]) {
+		t.Fatalf("configuration after a failed promotion : %v %v", conf.ListPeers(), conf.ListLearners())
+	}
+
+	if st := promote("promote learner", leader, peers[3], 0); !st.IsOK() {
+		t.Fatalf("promote learner, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	conf, stable := currentConf(leader)
+	if !stable || conf.Size() != 4 || !conf.Contains(peers[3]) || conf.GetLearners().Contain(peers[3]) {
+		t.Fatalf("configuration after promotion : %v %v", conf.ListPeers(), conf.ListLearners())
+	}
+	if r := leader.replicatorGroup.GetReplicator(peers[3]); r == nil || !r.getReplicatorType().IsFollower() {
+		t.Fatal("replicator of the promoted learner is not a follower")
+	}
+	waitUntil(t, "promoted learner to apply the configuration", func() bool {
+		return !learner.IsLearner()
+	})
+
+	// 四个投票成员需要三个节点确认，隔离一个原来的 Follower 之后只有计入新成员的响应日志才能提交
+	for _, node := range voters {
+		if node != leader {
+			network.Isolate(node.serverID.GetEndpoint())
+			break
+		}
+	}
+	if index, ok = cluster.appendData(leader, []byte("c")); !ok {
+		t.Fatal("leader steps down")
+	}
+	cluster.waitCommitted(index, leader, learner)
+}
+
+func TestResetPeers(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peers := newTestPeers(3)
+	nodes := make([]*nodeImpl, 0, len(peers))
+	for _, peer := range peers {
+		nodes = append(nodes, startTestNode(t, network, peer, peers))
+	}
+	leader := waitSingleLeader(t, nodes...)
+	cluster := &testCluster{t: t}
+	index, ok := cluster.appendData(leader, []byte("a"), []byte("b"))
+	if !ok {
+		t.Fatal("leader steps down")
+	}
+	cluster.waitCommitted(index, nodes...)
+	if st := leader.ResetPeers(entity.NewEmptyConfiguration()); st.GetCode() != entity.EINVAL {
+		t.Fatalf("reset to empty configuration, status %d %s", st.GetCode(), st.GetMsg())
+	}
+
+	// 包括 Leader 在内的两个节点永久丢失，剩下的一个节点无法再选出 Leader
+	var survivor *nodeImpl
+	for _, node := range nodes {
+		if node != leader && survivor == nil {
+			survivor = node
+			continue
+		}
+		network.Isolate(node.serverID.GetEndpoint())
+	}
+	_, term, _ := cluster.status(survivor)
+	cli, err := NewCliService(CliOptions{
+		TimeoutMs:       testElectionTimeoutMs,
+		MaxRetry:        3,
+		ClientTransport: network.NewClient(entity.NewEndpoint("127.0.0.1", 9000)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newConf := entity.NewConfiguration([]entity.PeerId{survivor.serverID}, nil)
+	if st := cli.ResetPeer(testGroupID, &survivor.serverID, newConf); !st.IsOK() {
+		t.Fatalf("reset peers, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	// 只剩下自己时立即发起选举，不需要等待选举超时
+	if !survivor.IsLeader() {
+		t.Fatal("single survivor should become leader once peers are reset")
+	}
+	if _, newTerm, _ := cluster.status(survivor); newTerm <= term {
+		t.Fatalf("term is not raised after resetting, %d -> %d", term, newTerm)
+	}
+	if index, ok = cluster.appendData(survivor, []byte("c")); !ok {
+		t.Fatal("survivor steps down")
+	}
+	cluster.waitCommitted(index, survivor)
+
+	// 新的 Leader 写入了一条配置日志，重启之后从日志中恢复的也是覆盖之后的配置
+	entry := survivor.logManager.GetConfiguration(index)
+	if entry == nil || entry.GetID().GetIndex() != index-1 || !entry.GetConf().Equal(newConf) {
+		t.Fatalf("configuration in log : %v", entry)
+	}
+	if st := cli.ResetPeer(testGroupID, &survivor.serverID, newConf); !st.IsOK() {
+		t.Fatalf("reset to the same configuration, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if st := cli.ResetPeer("unknown", &survivor.serverID, newConf); st.GetCode() != entity.ENOENT {
+		t.Fatalf("reset peers of unknown group, status %d %s", st.GetCode(), st.GetMsg())
+	}
+}
+
+func TestResetPeersMajorityLost(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peers := newTestPeers(5)
+	nodes := make([]*nodeImpl, 0, len(peers))
+	for _, peer := range peers {
+		nodes = append(nodes, startTestNode(t, network, peer, peers))
+	}
+	leader := waitSingleLeader(t, nodes...)
+	cluster := &testCluster{t: t}
+	index, ok := cluster.appendData(leader, []byte("a"))
+	if !ok {
+		t.Fatal("leader steps down")
+	}
+	cluster.waitCommitted(index, nodes...)
+
+	// 包括 Leader 在内的三个节点永久丢失，剩下的两个节点无法再选出 Leader
+	survivors := make([]*nodeImpl, 0, 2)
+	for _, node := range nodes {
+		if node != leader && len(survivors) < 2 {
+			survivors = append(survivors, node)
+			continue
+		}
+		network.Isolate(node.serverID.GetEndpoint())
+	}
+	newConf := entity.NewConfiguration([]entity.PeerId{survivors[0].serverID, survivors[1].serverID}, nil)
+	// 只在一个存活的节点上执行，另一个节点通过新 Leader 写入的配置日志得到覆盖之后的配置
+	if st := survivors[0].ResetPeers(newConf); !st.IsOK() {
+		t.Fatalf("reset peers, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	newLeader := waitSingleLeader(t, survivors...)
+	if index, ok = cluster.appendData(newLeader, []byte("b")); !ok {
+		t.Fatal("new leader steps down")
+	}
+	cluster.waitCommitted(index, survivors...)
+	for _, node := range survivors {
+		if conf, stable := currentConf(node); !stable || !conf.Equal(newConf) {
+			t.Fatalf("configuration of %s : %v, expect %v", node.serverID.GetDesc(), conf.ListPeers(),
+				newConf.ListPeers())
+		}
+	}
+}
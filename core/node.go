@@ -5,15 +5,15 @@
 package core
 
 import (
+	"container/list"
 	"context"
 	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
-	"github.com/golang/protobuf/ptypes"
-	"github.com/jjeffcaii/reactor-go"
-	"github.com/jjeffcaii/reactor-go/mono"
 	polerpc "github.com/pole-group/pole-rpc"
 
 	"github.com/pole-group/lraft/entity"
@@ -51,6 +51,29 @@ func (lac *LogEntryAndClosure) Sequence() int64 {
 	return utils.GetCurrentTimeMs()
 }
 
+//logEntryAndClosureHandler 攒批处理 Node.Apply 提交的任务，一个批次中的日志只需要获取一次节点锁、追加一次日志
+type logEntryAndClosureHandler struct {
+	node      *nodeImpl
+	batchSize int
+	tasks     []*LogEntryAndClosure
+}
+
+func (lch *logEntryAndClosureHandler) OnEvent(event utils.Event, endOfBatch bool) {
+	lch.tasks = append(lch.tasks, event.(*LogEntryAndClosure))
+	if len(lch.tasks) >= lch.batchSize || endOfBatch {
+		lch.node.executeApplyingTasks(lch.tasks)
+		lch.tasks = make([]*LogEntryAndClosure, 0, lch.batchSize)
+	}
+}
+
+func (lch *logEntryAndClosureHandler) IgnoreExpireEvent() bool {
+	return false
+}
+
+func (lch *logEntryAndClosureHandler) SubscribeType() utils.Event {
+	return &LogEntryAndClosure{}
+}
+
 type Stage int16
 
 const (
@@ -82,16 +105,164 @@ func NewConfigurationCtx(node *nodeImpl) *ConfigurationCtx {
 	}
 }
 
+//Start Leader 开始一次成员变更：先等待新加入的节点追上日志，然后依次提交 joint 配置（新配置加上旧配置）以及新配置，
+//新配置提交之后回调 done，调用时需要持有节点锁
 func (cc *ConfigurationCtx) Start(conf, oldConf *entity.Configuration, done Closure) {
+	if cc.IsBusy() {
+		runClosure(done, entity.NewStatus(entity.EBUSY, "Already in busy stage."))
+		return
+	}
+	cc.done = done
+	cc.stage = StageCatchingUp
+	cc.newPeers = conf.ListPeers()
+	cc.oldPeers = oldConf.ListPeers()
+	cc.learners = conf.ListLearners()
+	cc.oldLearners = oldConf.ListLearners()
+	adding, removing := entity.NewEmptyConfiguration(), entity.NewEmptyConfiguration()
+	conf.Diff(oldConf, adding, removing)
+	cc.nChanges = int32(adding.Size() + removing.Size())
+	cc.addNewLearners()
+	if adding.IsEmpty() {
+		cc.nextStage()
+		return
+	}
+	cc.addNewPeers(adding.ListPeers())
+}
+
+//addNewLearners 为新加入的 Learner 创建复制者，Learner 不计入 Ballot，不需要等待它追上日志
+func (cc *ConfigurationCtx) addNewLearners() {
+	node := cc.node
+	oldLearners := entity.NewConfiguration(nil, cc.oldLearners).GetLearners()
+	for _, learner := range cc.learners {
+		if oldLearners.Contain(learner) {
+			continue
+		}
+		if ok, err := node.replicatorGroup.AddReplicator(learner, ReplicatorLearner, true); !ok || err != nil {
+			utils.RaftLog.Error("Node %s fail to add replicator for new learner %s : %v.", node.nodeID.GetDesc(),
+				learner.GetDesc(), err)
+		}
+	}
+}
+
+//addNewPeers 为新加入的节点创建复制者并且等待它们追上日志。新节点还不在配置中，复制给它们的日志不会计入 Ballot，
+//和 Learner 一样只接收日志
+func (cc *ConfigurationCtx) addNewPeers(adding []entity.PeerId) {
+	node := cc.node
+	cc.addingPeers = append(make([]entity.PeerId, 0, len(adding)), adding...)
+	for _, peer := range adding {
+		if ok, err := node.replicatorGroup.AddReplicator(peer, ReplicatorFollower, true); !ok || err != nil {
+			utils.RaftLog.Error("Node %s fail to add replicator for new peer %s : %v.", node.nodeID.GetDesc(),
+				peer.GetDesc(), err)
+			cc.onCaughtUp(cc.version, peer, false)
+			return
+		}
+		if !node.waitCaughtUp(peer, node.currTerm, cc.version) {
+			cc.onCaughtUp(cc.version, peer, false)
+			return
+		}
+	}
+}
+
+//onCaughtUp 所有新节点都追上日志之后进入下一个阶段，任何一个节点追赶失败都会结束这一次变更
+func (cc *ConfigurationCtx) onCaughtUp(version int64, peer entity.PeerId, success bool) {
+	if version != cc.version || cc.stage != StageCatchingUp {
+		return
+	}
+	if success {
+		for i, p := range cc.addingPeers {
+			if p.Equal(peer) {
+				cc.addingPeers = append(cc.addingPeers[:i], cc.addingPeers[i+1:]...)
+				break
+			}
+		}
+		if len(cc.addingPeers) == 0 {
+			cc.nextStage()
+		}
+		return
+	}
+	utils.RaftLog.Warn("Node %s fail to catch up peer %s when trying to change peers from %v to %v.",
+		cc.node.nodeID.GetDesc(), peer.GetDesc(), cc.oldPeers, cc.newPeers)
+	cc.Reset(entity.NewStatus(entity.ECatchup, fmt.Sprintf("Peer %s failed to catch up.", peer.GetDesc())))
+}
+
+//nextStage 上一个阶段的配置日志提交之后推进到下一个阶段：CatchingUp -> Joint -> Stable -> None，Leader 不在新配置中时
+//在变更完成之后 stepDown
+func (cc *ConfigurationCtx) nextStage() {
+	node := cc.node
+	switch cc.stage {
+	case StageCatchingUp:
+		if cc.nChanges > 0 {
+			cc.stage = StageJoint
+			node.unsafeApplyConfiguration(entity.NewConfiguration(cc.newPeers, cc.learners),
+				entity.NewConfiguration(cc.oldPeers, cc.oldLearners))
+			return
+		}
+		fallthrough
+	case StageJoint:
+		cc.stage = StageStable
+		node.unsafeApplyConfiguration(entity.NewConfiguration(cc.newPeers, cc.learners), nil)
+	case StageStable:
+		shouldStepDown := !entity.NewConfiguration(cc.newPeers, nil).Contains(node.serverID)
+		cc.Reset(entity.StatusOK())
+		if shouldStepDown {
+			stepDown(node, node.currTerm, false, entity.NewStatus(entity.ELeaderRemoved, "This node was removed."))
+		}
+	}
+}
 
+//flush 上一任 Leader 的成员变更停在了 joint 阶段，新的 Leader 重新提交当前的配置把变更推进下去
+func (cc *ConfigurationCtx) flush(conf, oldConf *entity.Configuration) {
+	cc.newPeers = conf.ListPeers()
+	cc.learners = conf.ListLearners()
+	if oldConf.IsEmpty() {
+		cc.stage = StageStable
+		cc.oldPeers = cc.newPeers
+		cc.oldLearners = cc.learners
+		oldConf = nil
+	} else {
+		cc.stage = StageJoint
+		cc.oldPeers = oldConf.ListPeers()
+		cc.oldLearners = oldConf.ListLearners()
+	}
+	cc.node.unsafeApplyConfiguration(conf, oldConf)
 }
 
 func (cc *ConfigurationCtx) IsBusy() bool {
 	return cc.stage != StageNone
 }
 
-func (cc *ConfigurationCtx) Reset() {
+//Reset 结束当前的成员变更并且回调 done。变更成功时停止被移除的节点以及 Learner 的复制者，失败时停止为新节点以及新 Learner
+//创建的复制者
+func (cc *ConfigurationCtx) Reset(status entity.Status) {
+	newConf := entity.NewConfiguration(cc.newPeers, cc.learners)
+	oldConf := entity.NewConfiguration(cc.oldPeers, cc.oldLearners)
+	if status.IsOK() {
+		cc.node.stopReplicators(newConf, oldConf)
+	} else {
+		cc.node.stopReplicators(oldConf, newConf)
+	}
+	cc.newPeers = nil
+	cc.oldPeers = nil
+	cc.addingPeers = nil
+	cc.learners = nil
+	cc.oldLearners = nil
+	cc.version++
+	cc.stage = StageNone
+	cc.nChanges = 0
+	if cc.done != nil {
+		runClosure(cc.done, status)
+		cc.done = nil
+	}
+}
 
+//runClosure 在另外的协程中回调 done，调用方可能持有节点锁
+func runClosure(done Closure, status entity.Status) {
+	if done == nil {
+		return
+	}
+	polerpc.Go(context.Background(), func(ctx context.Context) {
+		done.Run(status)
+	})
 }
 
 type Node interface {
@@ -137,6 +308,8 @@ type Node interface {
 
 	ResetLearners(learners []entity.PeerId, done Closure)
 
+	PromoteLearner(learner entity.PeerId, timeoutMs int64, done Closure)
+
 	Snapshot(done Closure)
 
 	ResetElectionTimeoutMs(electionTimeoutMs int32)
@@ -226,22 +399,201 @@ type nodeImpl struct {
 	logManager               LogManager
 	metaStorage              *RaftMetaStorage
 	snapshotExecutor         *SnapshotExecutor
-	rpcServer                *rpc.RaftRPCServer
+	rpcServer                rpc.ServerTransport
+	ownTransport             bool
+	nodeManager              *NodeManager
+	eventBus                 *utils.EventBus
 	shutdownWait             *sync.WaitGroup
+	shutdownContinuations    []Closure
 	raftOperator             *RaftClientOperator
 	replicatorStateListeners []ReplicatorStateListener
-	transferFuture           polerpc.Future
+	transferTimer            utils.Timer
 	wakingCandidate          *Replicator
 	stopTransferArg          *StopTransferArg
 }
 
-func (node *nodeImpl) init() {
+//NewNode 创建并且启动一个 raft 节点，NodeOptions 不合法或者任何一个组件初始化失败时返回错误，已经创建的组件会被关闭
+func NewNode(groupID string, serverID entity.PeerId, opts NodeOptions) (Node, error) {
+	return newNode(groupID, serverID, opts, nil)
+}
+
+//newNode nodeManager 不为空时，节点的请求由 NodeManager 统一分发，否则节点独占 ServerTransport
+func newNode(groupID string, serverID entity.PeerId, opts NodeOptions, nodeManager *NodeManager) (Node, error) {
+	if groupID == "" {
+		return nil, fmt.Errorf("group id must not be empty")
+	}
+	if serverID.IsEmpty() || serverID.GetIP() == utils.IPAny {
+		return nil, fmt.Errorf("node can't be started from %s", serverID.GetDesc())
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	node := &nodeImpl{
+		lock:        &sync.RWMutex{},
+		state:       StateUninitialized,
+		groupID:     groupID,
+		serverID:    serverID.Copy(),
+		nodeID:      entity.NodeId{GroupID: groupID, Peer: serverID.Copy()},
+		leaderID:    entity.EmptyPeer,
+		votedId:     entity.EmptyPeer,
+		options:     opts,
+		raftOptions: opts.RaftOptions,
+		voteCtx:     &entity.Ballot{},
+		preVoteCtx:  &entity.Ballot{},
+		nodeManager: nodeManager,
+	}
+	if err := node.init(); err != nil {
+		utils.RaftLog.Error("Node %s init failed : %s", node.nodeID.GetDesc(), err)
+		node.Shutdown(nil)
+		node.Join()
+		return nil, err
+	}
+	return node, nil
+}
+
+//init 按照依赖顺序创建元数据存储、日志、状态机、投票箱以及快照，恢复配置之后注册 RPC 的处理函数，最后以 Follower 的身份
+//启动选举的定时任务，单节点的集群直接发起投票
+func (node *nodeImpl) init() error {
+	if !node.initTransport() {
+		return fmt.Errorf("fail to init transport on %s", node.serverID.GetEndpoint().GetDesc())
+	}
+	node.raftNodeJobMgn = NewRaftNodeJobManager(node)
+	node.confCtx = NewConfigurationCtx(node)
+	node.replicatorGroup = NewReplicatorGroup(node.raftOptions)
+	node.raftOperator = NewRaftClientOperator(&node.options, node.options.ClientTransport, node.replicatorGroup)
+
+	if !node.initMetaStorage() {
+		return fmt.Errorf("fail to init meta storage, uri=%s", node.options.RaftMetaURI)
+	}
+	// 日志落盘、状态机以及 ReadIndex 的事件只在节点内部流转，同一个进程中的多个节点互不干扰
+	node.eventBus = utils.NewEventBus()
+	fsmCaller := &FSMCallerImpl{}
+	node.fsmCaller = fsmCaller
+	if !node.initLogStorage() {
+		return fmt.Errorf("fail to init log storage, uri=%s", node.options.LogURI)
+	}
+	closureQueue := &ClosureQueue{}
+	if !fsmCaller.Init(context.Background(), FSMCallerOptions{
+		LogManager:   node.logManager,
+		FSM:          node.options.Fsm,
+		BootstrapID:  entity.NewLogID(0, 0),
+		ClosureQueue: closureQueue,
+		Node:         node,
+		EventBus:     node.eventBus,
+	}) {
+		return fmt.Errorf("fail to init fsm caller")
+	}
+	node.ballotBox = &BallotBox{}
+	node.ballotBox.Init(BallotBoxOptions{Waiter: node.fsmCaller, ClosureQueue: closureQueue})
+	if !node.initSnapshotStorage() {
+		return fmt.Errorf("fail to init snapshot storage, uri=%s", node.options.SnapshotURI)
+	}
+	if st := node.logManager.CheckConsistency(); !st.IsOK() {
+		return fmt.Errorf("inconsistent log : %s", st.GetMsg())
+	}
+
+	initialConf := entity.NewEmptyConfiguration()
+	if node.options.InitialConf != nil {
+		initialConf = node.options.InitialConf.Copy()
+	}
+	node.conf = entity.NewConfigurationEntry(entity.NewLogID(0, 0), initialConf, entity.NewEmptyConfiguration())
+	// 日志中的配置比 InitialConf 更新，重启之后以日志为准
+	node.logManager.CheckAndSetConfiguration(node.conf)
+	if !node.conf.IsEmpty() && !node.conf.IsValid() {
+		return fmt.Errorf("invalid configuration %v", node.conf.GetConf().ListPeers())
+	}
+
+	node.initReplicatorGroup()
+	node.readOnlyOperator = &ReadOnlyOperator{
+		fsmCaller:           node.fsmCaller,
+		raftOpt:             node.raftOptions,
+		node:                node,
+		replicatorGroup:     node.replicatorGroup,
+		raftClientOperator:  node.raftOperator,
+		pendingNotifyStatus: make(map[int64]*list.List),
+	}
+	node.fsmCaller.AddLastAppliedLogIndexListener(node.readOnlyOperator)
+	if err := node.initApplyQueue(); err != nil {
+		return err
+	}
+	node.handler = &raftRpcHandler{node: node}
+	if node.nodeManager == nil {
+		node.handler.init()
+	} else if !node.nodeManager.add(node) {
+		return fmt.Errorf("fail to register node %s to node manager", node.nodeID.GetDesc())
+	}
+
 	node.lock.Lock()
+	node.state = StateFollower
+	utils.RaftLog.Info("Node %s init, term=%d, lastLogId=%v, conf=%v, oldConf=%v.", node.nodeID.GetDesc(),
+		node.currTerm, node.logManager.GetLastLogID(false), node.conf.GetConf().ListPeers(),
+		node.conf.GetOldConf().ListPeers())
+	if node.snapshotExecutor != nil && node.options.SnapshotIntervalSecs > 0 {
+		node.raftNodeJobMgn.startJob(JobForSnapshot)
+	}
+	if !node.conf.IsEmpty() {
+		stepDown(node, node.currTerm, false, entity.StatusOK())
+	}
 	if node.conf.IsStable() && node.conf.GetConf().Size() == 1 && node.conf.ContainPeer(node.serverID) {
 		electSelf(node)
 	} else {
 		node.lock.Unlock()
 	}
+	return nil
+}
+
+//initApplyQueue Apply 以及 ReadIndex 的请求先进入各自的队列，由订阅者攒批之后再交给节点处理
+func (node *nodeImpl) initApplyQueue() error {
+	batchSize := int(node.raftOptions.MaxAppendBatchSize)
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	if err := node.eventBus.RegisterPublisherDefault(&LogEntryAndClosure{}); err != nil {
+		return err
+	}
+	if err := node.eventBus.RegisterSubscriber(&logEntryAndClosureHandler{
+		node:      node,
+		batchSize: batchSize,
+		tasks:     make([]*LogEntryAndClosure, 0, batchSize),
+	}); err != nil {
+		return err
+	}
+	if err := node.eventBus.RegisterPublisherDefault(&ReadIndexEvent{}); err != nil {
+		return err
+	}
+	return node.eventBus.RegisterSubscriber(&ReadIndexEventSubscriber{
+		rop:        node.readOnlyOperator,
+		batchSize:  int32(batchSize),
+		batchEvent: make([]*ReadIndexEvent, 0, batchSize),
+	})
+}
+
+//initTransport NodeOptions 中没有指定传输层时，按照 serverID 的端口创建基于 RSocket 的实现
+func (node *nodeImpl) initTransport() bool {
+	if node.options.ServerTransport != nil && node.options.ClientTransport != nil {
+		node.rpcServer = node.options.ServerTransport
+		return true
+	}
+	if node.options.ServerTransport != nil || node.options.ClientTransport != nil {
+		utils.RaftLog.Error("ServerTransport and ClientTransport must be set at the same time.")
+		return false
+	}
+	server, err := rpc.NewRaftRPCServer(rpc.ServiceName, int32(node.serverID.GetPort()), false)
+	if err != nil {
+		utils.RaftLog.Error("Node %s fail to create rpc server : %s", node.nodeID.GetDesc(), err)
+		return false
+	}
+	client, err := rpc.NewRaftClient(false)
+	if err != nil {
+		server.Close()
+		utils.RaftLog.Error("Node %s fail to create rpc client : %s", node.nodeID.GetDesc(), err)
+		return false
+	}
+	node.rpcServer = server
+	node.options.ServerTransport = server
+	node.options.ClientTransport = client
+	node.ownTransport = true
+	return true
 }
 
 func (node *nodeImpl) GetLeaderID() entity.PeerId {
@@ -279,8 +631,16 @@ func (node *nodeImpl) IsLeader() bool {
 	return node.IsLeaderWithBLock(true)
 }
 
+//IsLearner 节点是否是当前配置中的 Learner，Learner 只接收日志，既不参与投票也不会发起选举
 func (node *nodeImpl) IsLearner() bool {
-	return false
+	defer node.lock.RUnlock()
+	node.lock.RLock()
+	return node.isLearner()
+}
+
+//isLearner 调用时需要持有节点锁
+func (node *nodeImpl) isLearner() bool {
+	return node.conf.ContainLearner(node.serverID)
 }
 
 func (node *nodeImpl) IsLeaderWithBLock(blocking bool) bool {
@@ -292,21 +652,111 @@ func (node *nodeImpl) IsLeaderWithBLock(blocking bool) bool {
 	return node.state == StateLeader
 }
 
+//Shutdown 关闭节点：停止定时任务以及复制者，等待状态机执行完已经提交的任务并且回调 StateMachine.OnShutdown，最后关闭
+//日志以及元数据存储。关闭是异步进行的，全部结束之后回调 done，也可以通过 Join 等待
 func (node *nodeImpl) Shutdown(done Closure) {
+	node.lock.Lock()
+	if node.state < StateShutting {
+		utils.RaftLog.Info("Node %s shutdown, term=%d, state=%s.", node.nodeID.GetDesc(), node.currTerm,
+			node.state.GetName())
+		if IsNodeActive(node.state) {
+			stepDown(node, node.currTerm, false, entity.NewStatus(entity.EShutdown, "Raft node is going to quit."))
+		}
+		node.state = StateShutting
+		node.shutdownWait = &sync.WaitGroup{}
+		node.shutdownWait.Add(1)
+		if node.raftNodeJobMgn != nil {
+			node.raftNodeJobMgn.shutdown()
+		}
+		if node.replicatorGroup != nil {
+			node.replicatorGroup.stopAll()
+		}
+		polerpc.Go(context.Background(), func(ctx context.Context) {
+			node.doShutdown()
+		})
+	}
+	if node.state != StateShutdown {
+		if done != nil {
+			node.shutdownContinuations = append(node.shutdownContinuations, done)
+		}
+		node.lock.Unlock()
+		return
+	}
+	node.lock.Unlock()
+	if done != nil {
+		done.Run(entity.StatusOK())
+	}
+}
+
+//doShutdown 按顺序关闭各个组件，状态机执行完 TaskShutdown 之后才关闭日志，保证状态机 apply 的过程中仍然可以读取日志
+func (node *nodeImpl) doShutdown() {
+	if node.nodeManager != nil {
+		node.nodeManager.remove(node)
+	}
+	if node.ownTransport {
+		node.rpcServer.Close()
+	}
+	if node.snapshotExecutor != nil {
+		node.snapshotExecutor.Shutdown()
+		node.snapshotExecutor.Join()
+	}
+	if node.fsmCaller != nil {
+		node.fsmCaller.Shutdown()
+		node.fsmCaller.Join()
+	}
+	if node.ballotBox != nil {
+		node.ballotBox.Shutdown()
+	}
+	if node.logManager != nil {
+		node.logManager.Shutdown()
+		node.logManager.Join()
+	}
+	if node.metaStorage != nil {
+		node.metaStorage.shutdown()
+	}
+	if node.eventBus != nil {
+		node.eventBus.Shutdown()
+	}
 
+	node.lock.Lock()
+	node.state = StateShutdown
+	continuations := node.shutdownContinuations
+	node.shutdownContinuations = nil
+	node.lock.Unlock()
+	utils.RaftLog.Info("Node %s shutdown complete.", node.nodeID.GetDesc())
+	for _, done := range continuations {
+		done.Run(entity.StatusOK())
+	}
+	node.shutdownWait.Done()
 }
 
+//Join 阻塞直到 Shutdown 发起的关闭流程全部结束，没有调用过 Shutdown 时直接返回
 func (node *nodeImpl) Join() {
+	node.lock.RLock()
+	shutdownWait := node.shutdownWait
+	node.lock.RUnlock()
+	if shutdownWait != nil {
+		shutdownWait.Wait()
+	}
+}
 
+//isShuttingDown shutdownWait 由 Shutdown 在持有锁时赋值，其他地方读取时同样需要持有锁
+func (node *nodeImpl) isShuttingDown() bool {
+	defer node.lock.RUnlock()
+	node.lock.RLock()
+	return node.shutdownWait != nil
 }
 
 func (node *nodeImpl) Apply(task *Task) error {
-	if node.shutdownWait != nil {
-		task.Done.Run(entity.NewStatus(entity.ENodeShutdown, "Node is shutting down."))
-		return fmt.Errorf("node is shutting down")
+	// task 是具体类型的指针，转换为 interface 之后不为 nil，不能使用 utils.RequireNonNil 判断
+	if task == nil {
+		return fmt.Errorf("nil task")
 	}
-	if _, err := utils.RequireNonNil(task, "nil task"); err != nil {
-		return err
+	if node.isShuttingDown() {
+		if task.Done != nil {
+			task.Done.Run(entity.NewStatus(entity.ENodeShutdown, "Node is shutting down."))
+		}
+		return fmt.Errorf("node is shutting down")
 	}
 
 	entry := &entity.LogEntry{}
@@ -314,7 +764,7 @@ func (node *nodeImpl) Apply(task *Task) error {
 
 	retryCnt := 3
 	for i := 0; i < retryCnt; i++ {
-		success, err := utils.PublishEventNonBlock(&LogEntryAndClosure{
+		success, err := node.eventBus.PublishEventNonBlock(&LogEntryAndClosure{
 			Entry:        entry,
 			Done:         task.Done,
 			ExpectedTerm: task.ExpectTerm,
@@ -333,20 +783,20 @@ func (node *nodeImpl) Apply(task *Task) error {
 }
 
 func (node *nodeImpl) ReadIndex(reqCtx []byte, done *ReadIndexClosure) error {
-	if node.shutdownWait != nil {
+	if done == nil {
+		return fmt.Errorf("nil closure")
+	}
+	if node.isShuttingDown() {
 		done.Run(entity.NewStatus(entity.ENodeShutdown, "Node is shutting down."))
 		return fmt.Errorf("node is shutting down")
 	}
-	if _, err := utils.RequireNonNil(done, "nil closure"); err != nil {
-		return err
-	}
 	node.readOnlyOperator.addRequest(reqCtx, done)
 	return nil
 }
 
 func (node *nodeImpl) ListPeers() ([]entity.PeerId, error) {
 	defer node.lock.RUnlock()
-	node.lock.Lock()
+	node.lock.RLock()
 	if node.state != StateLeader {
 		return nil, fmt.Errorf("not leader")
 	}
@@ -355,16 +805,16 @@ func (node *nodeImpl) ListPeers() ([]entity.PeerId, error) {
 
 func (node *nodeImpl) ListAlivePeers() ([]entity.PeerId, error) {
 	defer node.lock.RUnlock()
-	node.lock.Lock()
+	node.lock.RLock()
 	if node.state != StateLeader {
 		return nil, fmt.Errorf("not leader")
 	}
-	return node.getAlivePeers(node.conf.GetConf().ListPeers(), utils.GetCurrentTimeMs()), nil
+	return node.getAlivePeers(node.conf.GetConf().ListPeers(), node.options.getClock().NowMs()), nil
 }
 
 func (node *nodeImpl) ListLearners() ([]entity.PeerId, error) {
 	defer node.lock.RUnlock()
-	node.lock.Lock()
+	node.lock.RLock()
 	if node.state != StateLeader {
 		return nil, fmt.Errorf("not leader")
 	}
@@ -373,69 +823,380 @@ func (node *nodeImpl) ListLearners() ([]entity.PeerId, error) {
 
 func (node *nodeImpl) ListAliveLearners() ([]entity.PeerId, error) {
 	defer node.lock.RUnlock()
-	node.lock.Lock()
+	node.lock.RLock()
 	if node.state != StateLeader {
 		return nil, fmt.Errorf("not leader")
 	}
-	return node.getAlivePeers(node.conf.GetConf().ListLearners(), utils.GetCurrentTimeMs()), nil
+	return node.getAlivePeers(node.conf.GetConf().ListLearners(), node.options.getClock().NowMs()), nil
 }
 
+//AddPeer 向集群中加入一个节点，新节点追上 Leader 的日志之后才会进入配置，变更完成之后回调 done
 func (node *nodeImpl) AddPeer(peer entity.PeerId, done Closure) {
-
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	if node.conf.GetConf().Contains(peer) {
+		runClosure(done, entity.NewStatus(entity.EINVAL, fmt.Sprintf("Peer %s already exists in current "+
+			"configuration.", peer.GetDesc())))
+		return
+	}
+	newConf := node.conf.GetConf().Copy()
+	newConf.AddPeer(peer.Copy())
+	node.unsafeRegisterConfChange(node.conf.GetConf(), newConf, done)
 }
 
+//RemovePeer 从集群中移除一个节点，移除的是 Leader 自己时，变更完成之后 Leader 会 stepDown
 func (node *nodeImpl) RemovePeer(peer entity.PeerId, done Closure) {
-
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	if !node.conf.GetConf().Contains(peer) {
+		runClosure(done, entity.NewStatus(entity.EINVAL, fmt.Sprintf("Peer %s not found in current "+
+			"configuration.", peer.GetDesc())))
+		return
+	}
+	newConf := node.conf.GetConf().Copy()
+	newConf.RemovePeer(&peer)
+	node.unsafeRegisterConfChange(node.conf.GetConf(), newConf, done)
 }
 
+//ChangePeers 将集群的成员变更为 newConf，可以同时加入以及移除多个节点
 func (node *nodeImpl) ChangePeers(newConf *entity.Configuration, done Closure) {
-
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	if newConf.IsEmpty() {
+		runClosure(done, entity.NewStatus(entity.EINVAL, "Empty new configuration."))
+		return
+	}
+	node.unsafeRegisterConfChange(node.conf.GetConf(), newConf.Copy(), done)
 }
 
-func (node *nodeImpl) ResetPeers(newConf *entity.Configuration) entity.Status {
-	return entity.Status{}
+//unsafeRegisterConfChange 只有 Leader 可以发起成员变更，并且同一时间只能有一个变更，调用时需要持有节点锁
+func (node *nodeImpl) unsafeRegisterConfChange(oldConf, newConf *entity.Configuration, done Closure) {
+	if !newConf.IsValid() || !entity.NewConfigurationEntry(nil, newConf, oldConf).IsValid() {
+		runClosure(done, entity.NewStatus(entity.EINVAL, fmt.Sprintf("Invalid new configuration, peers=%v, "+
+			"learners=%v.", newConf.ListPeers(), newConf.ListLearners())))
+		return
+	}
+	if node.state != StateLeader {
+		utils.RaftLog.Warn("Node %s refused configuration changing as the state=%s.", node.nodeID.GetDesc(),
+			node.state.GetName())
+		if node.state == StateTransferring {
+			runClosure(done, entity.NewStatus(entity.EBUSY, "Is transferring leadership."))
+		} else {
+			runClosure(done, entity.NewStatus(entity.EPERM, "Not leader"))
+		}
+		return
+	}
+	if node.confCtx.IsBusy() {
+		utils.RaftLog.Warn("Node %s refused configuration concurrent changing.", node.nodeID.GetDesc())
+		runClosure(done, entity.NewStatus(entity.EBUSY, "Doing another configuration change."))
+		return
+	}
+	if node.conf.GetConf().Equal(newConf) {
+		runClosure(done, entity.StatusOK())
+		return
+	}
+	utils.RaftLog.Info("Node %s change configuration from %v to %v.", node.nodeID.GetDesc(), oldConf.ListPeers(),
+		newConf.ListPeers())
+	node.confCtx.Start(newConf, oldConf, done)
+}
+
+//unsafeApplyConfiguration 追加一条配置日志，oldConf 不为空时这条日志需要同时得到新旧两个配置的多数派确认，
+//提交之后推进成员变更的阶段，调用时需要持有节点锁
+func (node *nodeImpl) unsafeApplyConfiguration(conf, oldConf *entity.Configuration) {
+	entry := entity.NewLogEntry(proto2.EntryType_EntryTypeConfiguration)
+	entry.LogID = entity.NewLogID(0, node.currTerm)
+	entry.Peers = conf.ListPeers()
+	entry.Learners = conf.ListLearners()
+	if oldConf != nil {
+		entry.OldPeers = oldConf.ListPeers()
+		entry.OldLearners = oldConf.ListLearners()
+	}
+	done := &configurationChangeDone{node: node, term: node.currTerm}
+	if !node.ballotBox.AppendPendingTask(conf, oldConf, done) {
+		runClosure(done, entity.NewStatus(entity.EInternal, "Fail to append task."))
+		return
+	}
+	node.logManager.AppendEntries([]*entity.LogEntry{entry}, &LeaderStableClosure{
+		BaseStableClosure: BaseStableClosure{NEntries: 1},
+		node:              node,
+	})
+	// 配置日志追加之后立即生效，不需要等待提交
+	node.logManager.CheckAndSetConfiguration(node.conf)
 }
 
-func (node *nodeImpl) AddLearners(learners []entity.PeerId, done Closure) {
-
+//executeApplyingTasks 只有 Leader 可以追加 Apply 提交的日志，ExpectedTerm 大于 0 时还需要和当前的任期一致
+func (node *nodeImpl) executeApplyingTasks(tasks []*LogEntryAndClosure) {
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	if node.state != StateLeader {
+		st := entity.NewStatus(entity.EPERM, "Is not leader.")
+		if node.state == StateTransferring {
+			st = entity.NewStatus(entity.EBUSY, "Is transferring leadership.")
+		}
+		for _, task := range tasks {
+			runClosure(task.Done, st)
+		}
+		return
+	}
+	var oldConf *entity.Configuration
+	if !node.conf.IsStable() {
+		oldConf = node.conf.GetOldConf()
+	}
+	entries := make([]*entity.LogEntry, 0, len(tasks))
+	for _, task := range tasks {
+		if task.ExpectedTerm > 0 && task.ExpectedTerm != node.currTerm {
+			runClosure(task.Done, entity.NewStatus(entity.EPERM, fmt.Sprintf("expected_term=%d doesn't match "+
+				"current_term=%d", task.ExpectedTerm, node.currTerm)))
+			continue
+		}
+		if !node.ballotBox.AppendPendingTask(node.conf.GetConf(), oldConf, task.Done) {
+			runClosure(task.Done, entity.NewStatus(entity.EInternal, "Fail to append task."))
+			continue
+		}
+		task.Entry.LogType = proto2.EntryType_EntryTypeData
+		task.Entry.LogID = entity.NewLogID(0, node.currTerm)
+		entries = append(entries, task.Entry)
+	}
+	if len(entries) == 0 {
+		return
+	}
+	node.logManager.AppendEntries(entries, &LeaderStableClosure{
+		BaseStableClosure: BaseStableClosure{NEntries: int32(len(entries))},
+		node:              node,
+	})
+	node.logManager.CheckAndSetConfiguration(node.conf)
+}
+
+//waitCaughtUp 等待新节点追上日志，最多等待一个选举超时，调用时需要持有节点锁
+func (node *nodeImpl) waitCaughtUp(peer entity.PeerId, term, version int64) bool {
+	done := &CatchUpClosure{}
+	done.F = func(status entity.Status) {
+		node.onCaughtUp(peer, term, version, status)
+	}
+	return node.replicatorGroup.waitCaughtUp(peer, int64(node.options.CatchupMargin),
+		time.Duration(node.options.ElectionTimeoutMs)*time.Millisecond, done)
 }
 
-func (node *nodeImpl) RemoveLearners(learners []entity.PeerId, done Closure) {
-
+//onCaughtUp 新节点追赶日志超时的时候，如果它最近还响应过 Leader 的请求，说明它仍然在追赶，继续等待
+func (node *nodeImpl) onCaughtUp(peer entity.PeerId, term, version int64, status entity.Status) {
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	if term != node.currTerm || node.state != StateLeader {
+		return
+	}
+	if status.IsOK() {
+		node.confCtx.onCaughtUp(version, peer, true)
+		return
+	}
+	if status.GetCode() == entity.ETIMEDOUT && node.options.getClock().NowMs()-
+		node.replicatorGroup.getLastRpcSendTimestamp(peer) <= node.options.ElectionTimeoutMs {
+		utils.RaftLog.Debug("Node %s waits peer %s to catch up.", node.nodeID.GetDesc(), peer.GetDesc())
+		if node.waitCaughtUp(peer, term, version) {
+			return
+		}
+	}
+	utils.RaftLog.Warn("Node %s caught up failed, status=%s, peer=%s.", node.nodeID.GetDesc(), status.GetMsg(),
+		peer.GetDesc())
+	node.confCtx.onCaughtUp(version, peer, false)
 }
 
-func (node *nodeImpl) ResetLearners(learners []entity.PeerId, done Closure) {
-
+//stopReplicators 停止 drop 中的节点以及 Learner 的复制者，仍然是 keep 中的节点或者 Learner 的除外
+func (node *nodeImpl) stopReplicators(keep, drop *entity.Configuration) {
+	for _, peer := range append(drop.ListPeers(), drop.ListLearners()...) {
+		if keep.Contains(peer) || keep.GetLearners().Contain(peer) || peer.Equal(node.serverID) {
+			continue
+		}
+		node.replicatorGroup.stopReplicator(peer)
+	}
 }
 
-func (node *nodeImpl) Snapshot(done Closure) {
-
+//onConfigurationChangeDone 配置日志提交之后推进成员变更，任期已经变化时说明这次变更已经被 stepDown 中止
+func (node *nodeImpl) onConfigurationChangeDone(term int64) {
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	if term != node.currTerm || node.state > StateTransferring {
+		utils.RaftLog.Warn("Node %s process onConfigurationChangeDone at term %d while state=%s, currTerm=%d.",
+			node.nodeID.GetDesc(), term, node.state.GetName(), node.currTerm)
+		return
+	}
+	node.confCtx.nextStage()
 }
 
-func (node *nodeImpl) ResetElectionTimeoutMs(electionTimeoutMs int32) {
-
+//ResetPeers 多数派节点永久丢失、集群无法再选出 Leader 时，由运维人员在存活的节点上强制把配置覆盖为 newConf。这个操作不经过
+//多数派确认，可能丢失已经提交的日志，只能用于灾难恢复。覆盖之后节点提升任期，newConf 只有自己时立即发起选举，否则等待
+//选举超时之后发起选举，新的 Leader 会写入一条配置日志。运维人员应当在每一个存活的节点上执行 ResetPeers；没有执行的节点
+//仍然使用旧的配置，只能等到执行过的节点成为 Leader 之后，通过这条配置日志得到覆盖之后的配置
+func (node *nodeImpl) ResetPeers(newConf *entity.Configuration) entity.Status {
+	if newConf == nil || newConf.IsEmpty() || !newConf.IsValid() {
+		return entity.NewStatus(entity.EINVAL, "Invalid new configuration.")
+	}
+	doUnLock := true
+	defer func() {
+		if doUnLock {
+			node.lock.Unlock()
+		}
+	}()
+	node.lock.Lock()
+	if !IsNodeActive(node.state) {
+		utils.RaftLog.Warn("Node %s is in state %s, can't reset peers.", node.nodeID.GetDesc(), node.state.GetName())
+		return entity.NewStatus(entity.EPERM, "Bad state: "+node.state.GetName())
+	}
+	if !node.conf.IsStable() {
+		utils.RaftLog.Error("Node %s is in its configuration changing, can't reset peers.", node.nodeID.GetDesc())
+		return entity.NewStatus(entity.EBUSY, "Can not reset peers in joint state.")
+	}
+	if node.conf.GetConf().Equal(newConf) {
+		return entity.StatusOK()
+	}
+	utils.RaftLog.Warn("Node %s UNSAFELY resets configuration from %v to %v, safety is traded for availability and "+
+		"committed logs may be lost.", node.nodeID.GetDesc(), node.conf.GetConf().ListPeers(), newConf.ListPeers())
+	node.conf.SetConf(newConf.Copy())
+	node.conf.SetOldConf(entity.NewEmptyConfiguration())
+	stepDown(node, node.currTerm+1, false, entity.NewStatus(entity.EStepEer, "Set peer from cli"))
+	if newConf.Size() == 1 && newConf.Contains(node.serverID) {
+		// 只剩下自己时不需要等待选举超时，electSelf 返回时锁已经释放
+		doUnLock = false
+		electSelf(node)
+	}
+	return entity.StatusOK()
 }
 
-func (node *nodeImpl) TransferLeadershipTo(peer entity.PeerId) entity.Status {
-	if peer.IsEmpty() {
-		return entity.NewStatus(entity.ERequest, "peer is empty")
+//AddLearners 向集群中加入 Learner，Learner 只接收日志，不计入日志提交以及选举的多数派
+func (node *nodeImpl) AddLearners(learners []entity.PeerId, done Closure) {
+	if st := checkLearners(learners); !st.IsOK() {
+		runClosure(done, st)
+		return
 	}
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	newConf := node.conf.GetConf().Copy()
+	newConf.AddLearners(learners)
+	node.unsafeRegisterConfChange(node.conf.GetConf(), newConf, done)
+}
 
-	if peer.GetIP() == utils.IPAny {
-		return entity.NewStatus(entity.ERequest, "illegal peer")
+//RemoveLearners 从集群中移除 Learner，变更完成之后 Leader 不再向它们复制日志
+func (node *nodeImpl) RemoveLearners(learners []entity.PeerId, done Closure) {
+	if st := checkLearners(learners); !st.IsOK() {
+		runClosure(done, st)
+		return
 	}
-
-	if peer.Equal(node.serverID) {
-		return entity.StatusOK()
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	newConf := node.conf.GetConf().Copy()
+	for i := range learners {
+		newConf.RemoveLearners(&learners[i])
 	}
+	node.unsafeRegisterConfChange(node.conf.GetConf(), newConf, done)
+}
 
-	if !node.conf.ContainPeer(peer) {
-		return entity.NewStatus(entity.EINVAL, fmt.Sprintf("peer %s not in current configuration", peer.GetDesc()))
+//ResetLearners 将集群的 Learner 替换为 learners
+func (node *nodeImpl) ResetLearners(learners []entity.PeerId, done Closure) {
+	if st := checkLearners(learners); !st.IsOK() {
+		runClosure(done, st)
+		return
 	}
-
 	defer node.lock.Unlock()
 	node.lock.Lock()
+	newConf := node.conf.GetConf().Copy()
+	newConf.SetLearners(learners)
+	node.unsafeRegisterConfChange(node.conf.GetConf(), newConf, done)
+}
 
+//PromoteLearner 等待 Learner 和 Leader 的日志差距不超过 CatchupMargin，之后发起成员变更把它提升为投票成员，变更完成之后
+//回调 done。timeoutMs 之内没有追上时以 ECatchup 回调，timeoutMs 不大于 0 时使用 ElectionTimeoutMs
+func (node *nodeImpl) PromoteLearner(learner entity.PeerId, timeoutMs int64, done Closure) {
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	if node.state != StateLeader {
+		runClosure(done, entity.NewStatus(entity.EPERM, "Not leader"))
+		return
+	}
+	if !node.conf.GetConf().GetLearners().Contain(learner) {
+		runClosure(done, entity.NewStatus(entity.EINVAL, fmt.Sprintf("Learner %s not found in current "+
+			"configuration.", learner.GetDesc())))
+		return
+	}
+	if timeoutMs <= 0 {
+		timeoutMs = node.options.ElectionTimeoutMs
+	}
+	term := node.currTerm
+	catchUp := &CatchUpClosure{}
+	catchUp.F = func(status entity.Status) {
+		node.onLearnerCaughtUp(learner, term, status, done)
+	}
+	if !node.replicatorGroup.waitCaughtUp(learner, int64(node.options.CatchupMargin),
+		time.Duration(timeoutMs)*time.Millisecond, catchUp) {
+		runClosure(done, entity.NewStatus(entity.ECatchup, fmt.Sprintf("Learner %s is not connected.",
+			learner.GetDesc())))
+	}
+}
+
+//onLearnerCaughtUp Learner 追上日志之后将它从 learners 移到 peers，Learner 的复制者在变更开始时转为 Follower 类型
+func (node *nodeImpl) onLearnerCaughtUp(learner entity.PeerId, term int64, status entity.Status, done Closure) {
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	if !status.IsOK() {
+		utils.RaftLog.Warn("Node %s fail to promote learner %s : %s.", node.nodeID.GetDesc(), learner.GetDesc(),
+			status.GetMsg())
+		runClosure(done, entity.NewStatus(entity.ECatchup, fmt.Sprintf("Learner %s failed to catch up.",
+			learner.GetDesc())))
+		return
+	}
+	if term != node.currTerm || node.state != StateLeader {
+		runClosure(done, entity.NewStatus(entity.EPERM, "Leader stepped down."))
+		return
+	}
+	if !node.conf.GetConf().GetLearners().Contain(learner) {
+		runClosure(done, entity.NewStatus(entity.EINVAL, fmt.Sprintf("Learner %s was removed.", learner.GetDesc())))
+		return
+	}
+	newConf := node.conf.GetConf().Copy()
+	newConf.RemoveLearners(&learner)
+	newConf.AddPeer(learner.Copy())
+	utils.RaftLog.Info("Node %s promotes learner %s.", node.nodeID.GetDesc(), learner.GetDesc())
+	node.unsafeRegisterConfChange(node.conf.GetConf(), newConf, done)
+}
+
+//checkLearners learners 不能为空，也不能包含 0.0.0.0 这样的地址
+func checkLearners(learners []entity.PeerId) entity.Status {
+	if len(learners) == 0 {
+		return entity.NewStatus(entity.EINVAL, "Empty learners.")
+	}
+	for _, learner := range learners {
+		if learner.IsEmpty() || learner.GetIP() == utils.IPAny {
+			return entity.NewStatus(entity.EINVAL, fmt.Sprintf("Invalid learner %s.", learner.GetDesc()))
+		}
+	}
+	return entity.StatusOK()
+}
+
+func (node *nodeImpl) Snapshot(done Closure) {
+	doSnapshot(node, done)
+}
+
+func (node *nodeImpl) ResetElectionTimeoutMs(electionTimeoutMs int32) {
+
+}
+
+func (node *nodeImpl) TransferLeadershipTo(peer entity.PeerId) entity.Status {
+	if peer.IsEmpty() {
+		return entity.NewStatus(entity.ERequest, "peer is empty")
+	}
+
+	if peer.GetIP() == utils.IPAny {
+		return entity.NewStatus(entity.ERequest, "illegal peer")
+	}
+
+	if peer.Equal(node.serverID) {
+		return entity.StatusOK()
+	}
+
+	defer node.lock.Unlock()
+	node.lock.Lock()
+
+	if !node.conf.ContainPeer(peer) {
+		return entity.NewStatus(entity.EINVAL, fmt.Sprintf("peer %s not in current configuration", peer.GetDesc()))
+	}
 	if node.state != StateLeader {
 		utils.RaftLog.Warn("node %s can't transfer leadership to peer %s as it is in state %s.",
 			node.nodeID.GetDesc(), peer.GetDesc(), node.state.GetName())
@@ -458,14 +1219,15 @@ func (node *nodeImpl) TransferLeadershipTo(peer entity.PeerId) entity.Status {
 	st := entity.NewStatus(entity.ETransferLeaderShip, fmt.Sprintf("raft leader is transferring leadership to %s",
 		peer.GetDesc()))
 	node.onLeaderStop(st)
-	arg := StopTransferArg{}
-	node.transferFuture = polerpc.NewMonoFuture(mono.
-		Delay(time.Duration(node.options.ElectionTimeoutMs) * time.Millisecond).
-		DoOnNext(
-			func(v reactor.Any) error {
-				node.onTransferTimeout(arg)
-				return nil
-			}))
+	arg := &StopTransferArg{
+		term: node.currTerm,
+		peer: peer,
+	}
+	node.stopTransferArg = arg
+	node.transferTimer = node.options.getClock().AfterFunc(
+		time.Duration(node.options.ElectionTimeoutMs)*time.Millisecond, func() {
+			node.onTransferTimeout(arg)
+		})
 	return entity.StatusOK()
 }
 
@@ -489,15 +1251,116 @@ func (node *nodeImpl) GetNodeTargetPriority() int32 {
 	return node.targetPriority
 }
 
-func (node *nodeImpl) onError(err entity.RaftError) {
+//initMetaStorage 加载持久化的 term 以及 votedFor，节点重启之后不能在同一个 term 内再次投票
+func (node *nodeImpl) initMetaStorage() bool {
+	node.metaStorage = NewRaftMetaStorage(node.options.RaftMetaURI, node.raftOptions)
+	if !node.metaStorage.init(node) {
+		utils.RaftLog.Error("Node %s init meta storage failed, uri=%s.", node.serverID.GetDesc(), node.options.RaftMetaURI)
+		return false
+	}
+	node.currTerm = node.metaStorage.getTerm()
+	node.votedId = node.metaStorage.getVotedFor().Copy()
+	return true
+}
 
+//initLogStorage 创建 LogManager，日志中的配置变更记录在 ConfigurationManager 中，重启之后用来恢复节点的配置
+func (node *nodeImpl) initLogStorage() bool {
+	logStorage, err := NewLogStorage(node.options.LogURI, node.raftOptions)
+	if err != nil {
+		utils.RaftLog.Error("Node %s fail to create log storage : %s", node.nodeID.GetDesc(), err)
+		return false
+	}
+	logManager := NewLogManager()
+	if !logManager.Init(LogManagerOptions{
+		LogStorage: logStorage,
+		ConfMgn:    entity.NewConfigurationManager(),
+		FsmCaller:  node.fsmCaller,
+		RaftOpts:   node.raftOptions,
+		EventBus:   node.eventBus,
+		Clock:      node.options.getClock(),
+	}) {
+		return false
+	}
+	node.logManager = logManager
+	return true
+}
+
+//initReplicatorGroup 所有复制者共享的参数，成为 Leader 之后以此为模板为每一个 Follower 创建复制者
+func (node *nodeImpl) initReplicatorGroup() {
+	opts := &replicatorOptions{
+		dynamicHeartBeatTimeoutMs: int32(node.options.ElectionTimeoutMs / 10),
+		electionTimeoutMs:         int32(node.options.ElectionTimeoutMs),
+		groupID:                   node.groupID,
+		serverId:                  node.serverID,
+		logMgn:                    node.logManager,
+		ballotBox:                 node.ballotBox,
+		node:                      node,
+		raftRpcOperator:           node.raftOperator,
+		clock:                     node.options.getClock(),
+	}
+	if node.snapshotExecutor != nil {
+		opts.snapshotStorage = node.snapshotExecutor.GetSnapshotStorage()
+	}
+	if node.nodeManager != nil {
+		opts.heartbeatBatcher = node.nodeManager.heartbeatBatcher
+	}
+	node.replicatorGroup.commonOptions = opts
+}
+
+//initSnapshotStorage 创建 SnapshotExecutor，本地存在快照时会先交由状态机加载，之后才开始回放快照之后的日志
+func (node *nodeImpl) initSnapshotStorage() bool {
+	if node.options.SnapshotURI == "" {
+		utils.RaftLog.Warn("Do not set snapshot uri, ignore initSnapshotStorage.")
+		return true
+	}
+	node.snapshotExecutor = NewSnapshotExecutor()
+	return node.snapshotExecutor.Init(SnapshotExecutorOptions{
+		URI:                    node.options.SnapshotURI,
+		FsmCaller:              node.fsmCaller,
+		Node:                   node,
+		LogManager:             node.logManager,
+		InitTerm:               node.currTerm,
+		Addr:                   node.serverID.GetEndpoint(),
+		FilterBeforeCopyRemote: node.options.FilterBeforeCopyRemote,
+		SnapshotThrottle:       node.options.SnapshotThrottle,
+		RaftClientOperator:     node.raftOperator,
+		NodeOpts:               node.options,
+		RaftOpts:               node.raftOptions,
+	})
+}
+
+//updateConfigurationAfterInstallingSnapshot 安装快照之后，快照中的配置可能比当前的配置更新
+func (node *nodeImpl) updateConfigurationAfterInstallingSnapshot() {
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	node.logManager.CheckAndSetConfiguration(node.conf)
+}
+
+//onError 节点出现了不可恢复的错误，Leader 或者 Follower 都需要 stepDown，之后节点进入 StateError 状态不再参与选举
+func (node *nodeImpl) onError(err entity.RaftError) {
+	utils.RaftLog.Warn("Node %s got error: %s.", node.nodeID.GetDesc(), err.Status.GetMsg())
+	if node.fsmCaller != nil {
+		node.fsmCaller.OnError(err)
+	}
+	if node.readOnlyOperator != nil {
+		node.readOnlyOperator.setError(err)
+	}
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	if node.state <= StateFollower {
+		stepDown(node, node.currTerm, node.state == StateLeader, entity.NewStatus(entity.EBadNode,
+			"Raft node(leader or candidate) is in error."))
+	}
+	if node.state < StateError {
+		node.state = StateError
+	}
 }
 
 func (node *nodeImpl) getAlivePeers(peers []entity.PeerId, monotonicNowMs int64) []entity.PeerId {
 	leaderLeaseTimeoutMs := node.options.getLeaderLeaseTimeoutMs()
 	newPeers := make([]entity.PeerId, 0, 0)
 	for _, peer := range peers {
-		if peer.Equal(node.serverID) || monotonicNowMs-node.replicatorGroup.GetReplicator(peer).lastRpcSendTimestamp <= leaderLeaseTimeoutMs {
+		if peer.Equal(node.serverID) || monotonicNowMs-node.replicatorGroup.getLastRpcSendTimestamp(peer) <= leaderLeaseTimeoutMs {
 			newPeers = append(newPeers, peer.Copy())
 		}
 	}
@@ -509,20 +1372,21 @@ func (node *nodeImpl) getLeaderLeaseTimeoutMs() int64 {
 }
 
 func (node *nodeImpl) currentLeaderIsValid() bool {
-	return utils.GetCurrentTimeMs()-node.lastLeaderTimestamp < node.options.ElectionTimeoutMs
+	lastLeaderTimestamp := atomic.LoadInt64(&node.lastLeaderTimestamp)
+	return node.options.getClock().NowMs()-lastLeaderTimestamp < node.options.ElectionTimeoutMs
 }
 
 func (node *nodeImpl) leaderLeaseIsValid() bool {
-	nowTime := time.Now()
-	if node.checkLeaderLease(nowTime) {
+	monotonicNowMs := node.options.getClock().NowMs()
+	if node.checkLeaderLease(monotonicNowMs) {
 		return true
 	}
-	node.checkDeadNodes0(node.conf.GetConf().GetPeers(), nowTime, false, nil)
-	return node.checkLeaderLease(nowTime)
+	node.checkDeadNodes0(node.conf.GetConf().ListPeers(), monotonicNowMs, false, nil)
+	return node.checkLeaderLease(monotonicNowMs)
 }
 
-func (node *nodeImpl) checkLeaderLease(t time.Time) bool {
-	return t.Unix()-node.lastLeaderTimestamp < int64(node.options.LeaderLeaseTimeRatio)
+func (node *nodeImpl) checkLeaderLease(monotonicNowMs int64) bool {
+	return monotonicNowMs-atomic.LoadInt64(&node.lastLeaderTimestamp) < node.getLeaderLeaseTimeoutMs()
 }
 
 func (node *nodeImpl) checkReplicator(peer entity.PeerId) {
@@ -531,12 +1395,86 @@ func (node *nodeImpl) checkReplicator(peer entity.PeerId) {
 	}
 }
 
-func (node *nodeImpl) checkDeadNodes0(peers *utils.Set, monotonicNowMs time.Time, checkReplicator bool, deadNodes *entity.Configuration) {
+//checkDeadNodes Leader 定期检查自己是否还和半数以上的节点保持着联系，如果没有，说明自己可能处于少数派的网络分区中，
+//stepDownOnCheckFail 为 true 时主动降级为 Follower，避免少数派中的 Leader 继续对外提供服务，调用时需要持有锁
+func (node *nodeImpl) checkDeadNodes(conf *entity.Configuration, monotonicNowMs int64, stepDownOnCheckFail bool) bool {
+	// Learner 不会发起预投票，创建失败的复制者只能在这里重试
+	for _, learner := range conf.ListLearners() {
+		node.checkReplicator(learner)
+	}
+	peers := conf.ListPeers()
+	deadNodes := entity.NewEmptyConfiguration()
+	if node.checkDeadNodes0(peers, monotonicNowMs, true, deadNodes) {
+		return true
+	}
+	if stepDownOnCheckFail {
+		utils.RaftLog.Warn("node %s steps down when alive nodes don't satisfy quorum, term=%d, deadNodes=%v, conf=%v.",
+			node.nodeID.GetDesc(), node.currTerm, deadNodes.ListPeers(), peers)
+		stepDown(node, node.currTerm, false, entity.NewStatus(entity.ERaftTimedOut,
+			fmt.Sprintf("Majority of the group dies: %d/%d", deadNodes.Size(), len(peers))))
+	}
+	return false
+}
 
+//checkDeadNodes0 统计在 leaderLeaseTimeoutMs 之内响应过自己请求的节点，超过半数时以其中最早的请求发送时间续约 Leader 的租约
+func (node *nodeImpl) checkDeadNodes0(peers []entity.PeerId, monotonicNowMs int64, checkReplicator bool,
+	deadNodes *entity.Configuration) bool {
+	leaderLeaseTimeoutMs := node.getLeaderLeaseTimeoutMs()
+	aliveCount := 0
+	startLease := int64(math.MaxInt64)
+	for _, peer := range peers {
+		if peer.Equal(node.serverID) {
+			aliveCount++
+			continue
+		}
+		if checkReplicator {
+			node.checkReplicator(peer)
+		}
+		lastRpcSendTimestamp := node.replicatorGroup.getLastRpcSendTimestamp(peer)
+		if monotonicNowMs-lastRpcSendTimestamp <= leaderLeaseTimeoutMs {
+			aliveCount++
+			if startLease > lastRpcSendTimestamp {
+				startLease = lastRpcSendTimestamp
+			}
+			continue
+		}
+		if deadNodes != nil {
+			deadNodes.AddPeer(peer)
+		}
+	}
+	if aliveCount >= len(peers)/2+1 {
+		// 单节点的集群没有其他节点可以参考，租约从当前时间开始计算
+		if startLease == math.MaxInt64 {
+			startLease = monotonicNowMs
+		}
+		node.updateLastLeaderTimestamp(startLease)
+		return true
+	}
+	return false
 }
 
-func (node *nodeImpl) onTransferTimeout(arg StopTransferArg) {
+func (node *nodeImpl) updateLastLeaderTimestamp(lastLeaderTimestamp int64) {
+	// ReadIndex 只持有读锁，多个读请求可能同时续约
+	atomic.StoreInt64(&node.lastLeaderTimestamp, lastLeaderTimestamp)
+}
 
+//onTransferTimeout 一个选举超时之内目标节点没有当选，停止领导权转移并且恢复为 Leader 继续处理请求
+func (node *nodeImpl) onTransferTimeout(arg *StopTransferArg) {
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	// 领导权转移已经结束，或者节点已经降级
+	if arg != node.stopTransferArg || arg.term != node.currTerm {
+		return
+	}
+	node.replicatorGroup.stopTransferLeadership(arg.peer)
+	if node.state == StateTransferring {
+		utils.RaftLog.Warn("node %s fail to transfer leadership to %s in %d ms, back to leader, term=%d.",
+			node.nodeID.GetDesc(), arg.peer.GetDesc(), node.options.ElectionTimeoutMs, node.currTerm)
+		node.fsmCaller.OnLeaderStart(node.currTerm)
+		node.state = StateLeader
+	}
+	node.stopTransferArg = nil
+	node.transferTimer = nil
 }
 
 func (node *nodeImpl) stepDown(term int64, wakeupCandidate bool, ) {
@@ -549,6 +1487,16 @@ func (node *nodeImpl) stepDown(term int64, wakeupCandidate bool, ) {
 	}
 }
 
+//increaseTermTo 收到了更高任期的响应，需要降级为 Follower
+func (node *nodeImpl) increaseTermTo(newTerm int64, status entity.Status) {
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	if newTerm < node.currTerm {
+		return
+	}
+	stepDown(node, newTerm, false, status)
+}
+
 func (node *nodeImpl) onLeaderStop(st entity.Status) {
 	node.replicatorGroup.clearFailureReplicators()
 	node.fsmCaller.OnLeaderStop(st)
@@ -579,6 +1527,450 @@ func (node *nodeImpl) resetLeaderId(newLeaderId entity.PeerId, status entity.Sta
 	}
 }
 
+//checkStepDown 收到了来自 Leader 的请求，任期更高或者自己还不是 Follower 的时候需要 stepDown，并且记住新的 Leader，调用时需要持有锁。
+//新的 term 落盘失败时返回 false，调用方不能再处理该请求
+func (node *nodeImpl) checkStepDown(requestTerm int64, serverID entity.PeerId) bool {
+	st := entity.NewStatus(entity.ENewLeader, "Follower receives message from new leader with the same term.")
+	if requestTerm > node.currTerm {
+		st = entity.NewStatus(entity.ENewLeader, "Raft node receives message from new leader with higher term.")
+		if !stepDown(node, requestTerm, false, st) {
+			return false
+		}
+	} else if node.state != StateFollower {
+		st = entity.NewStatus(entity.ENewLeader, "Candidate receives message from new leader with the same term.")
+		stepDown(node, requestTerm, false, st)
+	} else if node.leaderID.IsEmpty() {
+		stepDown(node, requestTerm, false, st)
+	}
+	if node.leaderID.IsEmpty() {
+		node.resetLeaderId(serverID, st)
+	}
+	return true
+}
+
+//handleRequestVoteRequest 处理 Candidate 的投票请求，同一个任期内只会投出一票，并且投票的信息在回复之前已经持久化
+func (node *nodeImpl) handleRequestVoteRequest(req *proto2.RequestVoteRequest) *proto2.RequestVoteResponse {
+	doUnLock := true
+	defer func() {
+		if doUnLock {
+			node.lock.Unlock()
+		}
+	}()
+	node.lock.Lock()
+
+	if !IsNodeActive(node.state) {
+		utils.RaftLog.Warn("Node %s is not in active state, currTerm=%d.", node.nodeID.GetDesc(), node.currTerm)
+		return &proto2.RequestVoteResponse{
+			ErrorResponse: entity.NewErrorResponse(entity.EINVAL, "Node %s is not in active state, state %s.",
+				node.nodeID.GetDesc(), node.state.GetName()),
+		}
+	}
+
+	candidateId := entity.PeerId{}
+	if !candidateId.Parse(req.ServerID) {
+		utils.RaftLog.Warn("Node %s received RequestVoteRequest from %s serverId bad format.",
+			node.nodeID.GetDesc(), req.ServerID)
+		return &proto2.RequestVoteResponse{
+			ErrorResponse: entity.NewErrorResponse(entity.EINVAL, "Parse candidateId failed: %s.", req.ServerID),
+		}
+	}
+
+	for {
+		if req.Term < node.currTerm {
+			utils.RaftLog.Info("Node %s ignore RequestVoteRequest from %s, term=%d, currTerm=%d.",
+				node.nodeID.GetDesc(), req.ServerID, req.Term, node.currTerm)
+			break
+		}
+		if req.Term > node.currTerm && !stepDown(node, req.Term, false, entity.NewStatus(entity.EHigherTermRequest,
+			"Raft node receives higher term RequestVoteRequest.")) {
+			return &proto2.RequestVoteResponse{
+				Term:    node.currTerm,
+				Granted: false,
+				ErrorResponse: entity.NewErrorResponse(entity.EIO, "Node %s fail to persist term %d.",
+					node.nodeID.GetDesc(), req.Term),
+			}
+		}
+		doUnLock = false
+		node.lock.Unlock()
+
+		lastLogID := node.logManager.GetLastLogID(true)
+		doUnLock = true
+		node.lock.Lock()
+		if req.Term != node.currTerm {
+			utils.RaftLog.Warn("Node %s raise term %d when get lastLogId.", node.nodeID.GetDesc(), node.currTerm)
+			break
+		}
+		logIsOk := entity.NewLogID(req.LastLogIndex, req.LastLogTerm).Compare(lastLogID) >= 0
+		if logIsOk && node.votedId.IsEmpty() {
+			stepDown(node, req.Term, false, entity.NewStatus(entity.EVoteForCandidate,
+				"Raft node votes for some candidate, step down to restart election_timer."))
+			node.votedId = candidateId.Copy()
+			if !node.metaStorage.setTermAndVotedFor(req.Term, candidateId) {
+				// 投票没有落盘就同意的话，节点重启之后可能在同一个 term 内再投给其他节点，这里撤销这次投票
+				utils.RaftLog.Error("Node %s fail to persist vote for %s, term=%d.", node.nodeID.GetDesc(),
+					candidateId.GetDesc(), req.Term)
+				node.votedId = entity.EmptyPeer
+				return &proto2.RequestVoteResponse{
+					Term:    node.currTerm,
+					Granted: false,
+					ErrorResponse: entity.NewErrorResponse(entity.EIO, "Node %s fail to persist vote for %s.",
+						node.nodeID.GetDesc(), candidateId.GetDesc()),
+				}
+			}
+		}
+		break
+	}
+	return &proto2.RequestVoteResponse{
+		Term:    node.currTerm,
+		Granted: req.Term == node.currTerm && node.votedId.Equal(candidateId),
+	}
+}
+
+//handleAppendEntriesRequest 处理 Leader 的日志复制以及心跳请求。心跳请求直接返回响应，携带日志的请求需要等到日志落盘之后
+//由 FollowerStableClosure 回复，此时返回 nil
+func (node *nodeImpl) handleAppendEntriesRequest(req *proto2.AppendEntriesRequest,
+	done *RpcRequestClosure) *proto2.AppendEntriesResponse {
+	doUnLock := true
+	defer func() {
+		if doUnLock {
+			node.lock.Unlock()
+		}
+	}()
+	node.lock.Lock()
+
+	if !IsNodeActive(node.state) {
+		utils.RaftLog.Warn("Node %s is not in active state, currTerm=%d.", node.nodeID.GetDesc(), node.currTerm)
+		return &proto2.AppendEntriesResponse{
+			ErrorResponse: entity.NewErrorResponse(entity.EINVAL, "Node %s is not in active state, state %s.",
+				node.nodeID.GetDesc(), node.state.GetName()),
+		}
+	}
+
+	serverID := entity.PeerId{}
+	if !serverID.Parse(req.ServerID) {
+		utils.RaftLog.Warn("Node %s received AppendEntriesRequest from %s serverId bad format.",
+			node.nodeID.GetDesc(), req.ServerID)
+		return &proto2.AppendEntriesResponse{
+			ErrorResponse: entity.NewErrorResponse(entity.EINVAL, "Parse serverId failed: %s.", req.ServerID),
+		}
+	}
+
+	if req.Term < node.currTerm {
+		utils.RaftLog.Warn("Node %s ignore stale AppendEntriesRequest from %s, term=%d, currTerm=%d.",
+			node.nodeID.GetDesc(), req.ServerID, req.Term, node.currTerm)
+		return &proto2.AppendEntriesResponse{
+			Term:    node.currTerm,
+			Success: false,
+		}
+	}
+
+	if !node.checkStepDown(req.Term, serverID) {
+		return &proto2.AppendEntriesResponse{
+			ErrorResponse: entity.NewErrorResponse(entity.EIO, "Node %s fail to persist term %d.",
+				node.nodeID.GetDesc(), req.Term),
+		}
+	}
+	if !serverID.Equal(node.leaderID) {
+		utils.RaftLog.Error("Another peer %s declares that it is the leader at term %d which was occupied by leader %s.",
+			serverID.GetDesc(), node.currTerm, node.leaderID.GetDesc())
+		// 同一个任期内出现了两个 Leader，提升任期让它们都 stepDown 之后重新选举
+		stepDown(node, req.Term+1, false, entity.NewStatus(entity.ELeaderConflict,
+			"More than one leader in the same term."))
+		return &proto2.AppendEntriesResponse{
+			Term:    req.Term + 1,
+			Success: false,
+		}
+	}
+	node.updateLastLeaderTimestamp(node.options.getClock().NowMs())
+
+	if len(req.Entries) != 0 && node.snapshotExecutor != nil && node.snapshotExecutor.IsInstallingSnapshot() {
+		utils.RaftLog.Warn("Node %s received AppendEntriesRequest while installing snapshot.", node.nodeID.GetDesc())
+		return &proto2.AppendEntriesResponse{
+			ErrorResponse: entity.NewErrorResponse(entity.EBUSY, "Node %s is installing snapshot.",
+				node.nodeID.GetDesc()),
+		}
+	}
+
+	prevLogIndex := req.PrevLogIndex
+	localPrevLogTerm := node.logManager.GetTerm(prevLogIndex)
+	if localPrevLogTerm != req.PrevLogTerm {
+		resp := &proto2.AppendEntriesResponse{
+			Term:    node.currTerm,
+			Success: false,
+		}
+		fillConflictHints(resp, node.logManager, prevLogIndex)
+		utils.RaftLog.Warn("Node %s reject term_unmatched AppendEntriesRequest from %s, term=%d, prevLogIndex=%d, "+
+			"prevLogTerm=%d, localPrevLogTerm=%d, lastLogIndex=%d, entriesSize=%d.", node.nodeID.GetDesc(),
+			req.ServerID, req.Term, prevLogIndex, req.PrevLogTerm, localPrevLogTerm, resp.LastLogIndex,
+			len(req.Entries))
+		return resp
+	}
+
+	if len(req.Entries) == 0 {
+		// 心跳或者探测请求，只需要根据 Leader 的 committedIndex 推进自己的 commit 位置
+		resp := &proto2.AppendEntriesResponse{
+			Term:         node.currTerm,
+			Success:      true,
+			LastLogIndex: node.logManager.GetLastLogIndex(),
+		}
+		doUnLock = false
+		node.lock.Unlock()
+		committedIndex := req.CommittedIndex
+		if prevLogIndex < committedIndex {
+			committedIndex = prevLogIndex
+		}
+		if _, err := node.ballotBox.SetLastCommittedIndex(committedIndex); err != nil {
+			utils.RaftLog.Error("Node %s fail to set lastCommittedIndex %d : %s", node.nodeID.GetDesc(),
+				committedIndex, err)
+		}
+		return resp
+	}
+
+	entries, st := node.parseEntries(req)
+	if !st.IsOK() {
+		utils.RaftLog.Error("Node %s fail to parse AppendEntriesRequest from %s : %s", node.nodeID.GetDesc(),
+			req.ServerID, st.GetMsg())
+		return &proto2.AppendEntriesResponse{
+			ErrorResponse: entity.NewErrorResponse(st.GetCode(), "%s", st.GetMsg()),
+		}
+	}
+	closure := &FollowerStableClosure{
+		BaseStableClosure: BaseStableClosure{
+			Entries:  entries,
+			NEntries: int32(len(entries)),
+		},
+		node: node,
+		req:  req,
+		term: node.currTerm,
+		done: done,
+	}
+	node.logManager.AppendEntries(entries, closure)
+	// 日志中可能包含新的配置信息，LogManager 更新了内存状态之后需要同步更新节点的配置
+	node.logManager.CheckAndSetConfiguration(node.conf)
+	return nil
+}
+
+//parseEntries 根据 EntryMeta 以及拼接在一起的日志数据还原出 LogEntry，日志的索引从 prevLogIndex + 1 开始递增
+func (node *nodeImpl) parseEntries(req *proto2.AppendEntriesRequest) ([]*entity.LogEntry, entity.Status) {
+	entries := make([]*entity.LogEntry, 0, len(req.Entries))
+	index := req.PrevLogIndex
+	offset := int64(0)
+	for _, em := range req.Entries {
+		index++
+		entry := entity.NewLogEntry(em.Type)
+		entry.LogID = entity.NewLogID(index, em.Term)
+		entry.Peers = decodePeerDesc(em.Peers)
+		entry.OldPeers = decodePeerDesc(em.OldPeers)
+		entry.Learners = decodePeerDesc(em.Learners)
+		entry.OldLearners = decodePeerDesc(em.OldLearners)
+		if em.DataLen > 0 {
+			if offset+em.DataLen > int64(len(req.Data)) {
+				st := entity.NewEmptyStatus()
+				st.SetError(entity.EINVAL, "The data of log entry %d is out of range, offset=%d, dataLen=%d, size=%d",
+					index, offset, em.DataLen, len(req.Data))
+				return nil, st
+			}
+			entry.Data = req.Data[offset : offset+em.DataLen]
+			offset += em.DataLen
+		}
+		if node.raftOptions.EnableLogEntryChecksum {
+			entry.SetChecksum(em.Checksum)
+			if entry.IsCorrupted() {
+				st := entity.NewEmptyStatus()
+				st.SetError(entity.EINVAL, "The log entry is corrupted, index=%d, term=%d, expectedChecksum=%d, "+
+					"realChecksum=%d", index, em.Term, em.Checksum, entry.Checksum())
+				return nil, st
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, entity.StatusOK()
+}
+
+//handleHeartbeatRequest 处理合并心跳中属于当前节点的一项，和空的 AppendEntriesRequest 一样校验任期并且更新 Leader 的时间戳。
+//Leader 只会携带已经确认和 Follower 日志一致的 committedIndex，因此不需要 prevLogIndex 的检查
+func (node *nodeImpl) handleHeartbeatRequest(req *proto2.HeartbeatRequestEntry) *proto2.HeartbeatResponseEntry {
+	resp := node.acceptHeartbeat(req)
+	if !resp.Success {
+		return resp
+	}
+	committedIndex := req.CommittedIndex
+	if resp.LastLogIndex < committedIndex {
+		committedIndex = resp.LastLogIndex
+	}
+	if _, err := node.ballotBox.SetLastCommittedIndex(committedIndex); err != nil {
+		utils.RaftLog.Error("Node %s fail to set lastCommittedIndex %d : %s", node.nodeID.GetDesc(),
+			committedIndex, err)
+	}
+	return resp
+}
+
+//acceptHeartbeat 判断是否承认心跳的发送者是当前任期的 Leader
+func (node *nodeImpl) acceptHeartbeat(req *proto2.HeartbeatRequestEntry) *proto2.HeartbeatResponseEntry {
+	defer node.lock.Unlock()
+	node.lock.Lock()
+	resp := &proto2.HeartbeatResponseEntry{
+		GroupID: req.GroupID,
+		PeerID:  req.PeerID,
+	}
+	if !IsNodeActive(node.state) {
+		resp.ErrorResponse = entity.NewErrorResponse(entity.EINVAL, "Node %s is not in active state, state %s.",
+			node.nodeID.GetDesc(), node.state.GetName())
+		return resp
+	}
+	serverID := entity.PeerId{}
+	if !serverID.Parse(req.ServerID) {
+		resp.ErrorResponse = entity.NewErrorResponse(entity.EINVAL, "Parse serverId failed: %s.", req.ServerID)
+		return resp
+	}
+	if req.Term < node.currTerm {
+		utils.RaftLog.Warn("Node %s ignore stale heartbeat from %s, term=%d, currTerm=%d.",
+			node.nodeID.GetDesc(), req.ServerID, req.Term, node.currTerm)
+		resp.Term = node.currTerm
+		return resp
+	}
+
+	if !node.checkStepDown(req.Term, serverID) {
+		resp.ErrorResponse = entity.NewErrorResponse(entity.EIO, "Node %s fail to persist term %d.",
+			node.nodeID.GetDesc(), req.Term)
+		return resp
+	}
+	if !serverID.Equal(node.leaderID) {
+		utils.RaftLog.Error("Another peer %s declares that it is the leader at term %d which was occupied by leader %s.",
+			serverID.GetDesc(), node.currTerm, node.leaderID.GetDesc())
+		stepDown(node, req.Term+1, false, entity.NewStatus(entity.ELeaderConflict,
+			"More than one leader in the same term."))
+		resp.Term = req.Term + 1
+		return resp
+	}
+	node.updateLastLeaderTimestamp(node.options.getClock().NowMs())
+	resp.Term = node.currTerm
+	resp.Success = true
+	resp.LastLogIndex = node.logManager.GetLastLogIndex()
+	return resp
+}
+
+//handleInstallSnapshot 校验 Leader 的任期之后交由 SnapshotExecutor 下载并安装快照，由 SnapshotExecutor 负责回复，此时返回 nil
+func (node *nodeImpl) handleInstallSnapshot(req *proto2.InstallSnapshotRequest,
+	done *RpcRequestClosure) *proto2.InstallSnapshotResponse {
+	if node.snapshotExecutor == nil {
+		return &proto2.InstallSnapshotResponse{
+			ErrorResponse: entity.NewErrorResponse(entity.EINVAL, "Not supported snapshot"),
+		}
+	}
+	serverID := entity.PeerId{}
+	if !serverID.Parse(req.ServerID) {
+		utils.RaftLog.Warn("Node %s received InstallSnapshotRequest from %s serverId bad format.",
+			node.nodeID.GetDesc(), req.ServerID)
+		return &proto2.InstallSnapshotResponse{
+			ErrorResponse: entity.NewErrorResponse(entity.EINVAL, "Parse serverId failed: %s.", req.ServerID),
+		}
+	}
+
+	resp := func() *proto2.InstallSnapshotResponse {
+		defer node.lock.Unlock()
+		node.lock.Lock()
+		if !IsNodeActive(node.state) {
+			utils.RaftLog.Warn("Node %s is not in active state, currTerm=%d.", node.nodeID.GetDesc(), node.currTerm)
+			return &proto2.InstallSnapshotResponse{
+				ErrorResponse: entity.NewErrorResponse(entity.EINVAL, "Node %s is not in active state, state %s.",
+					node.nodeID.GetDesc(), node.state.GetName()),
+			}
+		}
+		if req.Term < node.currTerm {
+			utils.RaftLog.Warn("Node %s ignore stale InstallSnapshotRequest from %s, term=%d, currTerm=%d.",
+				node.nodeID.GetDesc(), req.PeerID, req.Term, node.currTerm)
+			return &proto2.InstallSnapshotResponse{
+				Term:    node.currTerm,
+				Success: false,
+			}
+		}
+		if !node.checkStepDown(req.Term, serverID) {
+			return &proto2.InstallSnapshotResponse{
+				ErrorResponse: entity.NewErrorResponse(entity.EIO, "Node %s fail to persist term %d.",
+					node.nodeID.GetDesc(), req.Term),
+			}
+		}
+		if !serverID.Equal(node.leaderID) {
+			utils.RaftLog.Error("Another peer %s declares that it is the leader at term %d which was occupied by leader %s.",
+				serverID.GetDesc(), node.currTerm, node.leaderID.GetDesc())
+			stepDown(node, req.Term+1, false, entity.NewStatus(entity.ELeaderConflict,
+				"More than one leader in the same term."))
+			return &proto2.InstallSnapshotResponse{
+				Term:    req.Term + 1,
+				Success: false,
+			}
+		}
+		node.updateLastLeaderTimestamp(node.options.getClock().NowMs())
+		return nil
+	}()
+	if resp != nil {
+		return resp
+	}
+	utils.RaftLog.Info("Node %s received InstallSnapshotRequest from %s, lastIncludedLogIndex=%d, "+
+		"lastIncludedLogTerm=%d.", node.nodeID.GetDesc(), req.ServerID, req.GetMeta().GetLastIncludedIndex(),
+		req.GetMeta().GetLastIncludedTerm())
+	node.snapshotExecutor.InstallSnapshot(req, done)
+	return nil
+}
+
+//handleTimeoutNowRequest Leader 转移领导权时让自己立即发起选举，回复之后再开始 electSelf，此时返回 nil
+func (node *nodeImpl) handleTimeoutNowRequest(req *proto2.TimeoutNowRequest,
+	done *RpcRequestClosure) *proto2.TimeoutNowResponse {
+	doUnLock := true
+	defer func() {
+		if doUnLock {
+			node.lock.Unlock()
+		}
+	}()
+	node.lock.Lock()
+
+	if req.Term != node.currTerm {
+		savedCurrTerm := node.currTerm
+		if req.Term > node.currTerm {
+			stepDown(node, req.Term, false, entity.NewStatus(entity.EHigherTermRequest,
+				"Raft node receives higher term request"))
+		}
+		utils.RaftLog.Info("Node %s received TimeoutNowRequest from %s while currTerm=%d didn't match "+
+			"requestTerm=%d.", node.nodeID.GetDesc(), req.PeerID, savedCurrTerm, req.Term)
+		return &proto2.TimeoutNowResponse{
+			Term:    node.currTerm,
+			Success: false,
+		}
+	}
+	if node.state != StateFollower {
+		utils.RaftLog.Info("Node %s received TimeoutNowRequest from %s, while state=%s, term=%d.",
+			node.nodeID.GetDesc(), req.ServerID, node.state.GetName(), node.currTerm)
+		return &proto2.TimeoutNowResponse{
+			Term:    node.currTerm,
+			Success: false,
+		}
+	}
+
+	// 先回复 Leader，Leader 收到响应之后会 stepDown，之后自己的选举才不会被原来的 Leader 干扰
+	done.SendProtoResponse(rpc.CoreTimeoutNowRequest, &proto2.TimeoutNowResponse{
+		Term:    node.currTerm + 1,
+		Success: true,
+	})
+	utils.RaftLog.Info("Node %s received TimeoutNowRequest from %s, term=%d.", node.nodeID.GetDesc(),
+		req.ServerID, node.currTerm)
+	doUnLock = false
+	electSelf(node)
+	return nil
+}
+
+//handleReadIndexRequest 处理其他节点转发过来的 ReadIndexRequest，由 ReadOnlyOperator 确认 Leader 身份之后回复 readIndex
+func (node *nodeImpl) handleReadIndexRequest(req *proto2.ReadIndexRequest, done *RpcRequestClosure) {
+	if node.readOnlyOperator == nil {
+		done.SendProtoResponse(rpc.CoreReadIndexRequest, &proto2.ReadIndexResponse{
+			ErrorResponse: entity.NewErrorResponse(entity.EINVAL, "Node %s does not support read-index.",
+				node.nodeID.GetDesc()),
+		})
+		return
+	}
+	node.readOnlyOperator.handleReadIndexRequest(req, newReadIndexRpcResponseClosure(req, done))
+}
+
 func (node *nodeImpl) GetQuorum() int {
 	c := node.conf.GetConf()
 	if c.IsEmpty() {
@@ -587,132 +1979,266 @@ func (node *nodeImpl) GetQuorum() int {
 	return c.GetPeers().Size()/2 + 1
 }
 
+//StopTransferArg 领导权转移超时之后需要的参数，term 用来丢弃节点降级之后才触发的超时
 type StopTransferArg struct {
+	term int64
+	peer entity.PeerId
+}
+
+//configurationChangeDone 配置日志提交之后由状态机回调，stepDown 清空投票箱时以 EPERM 回调
+type configurationChangeDone struct {
+	node *nodeImpl
+	term int64
+}
+
+func (ccd *configurationChangeDone) Run(status entity.Status) {
+	if !status.IsOK() {
+		utils.RaftLog.Warn("Node %s fail to apply configuration at term %d : %s", ccd.node.nodeID.GetDesc(),
+			ccd.term, status.GetMsg())
+		return
+	}
+	ccd.node.onConfigurationChangeDone(ccd.term)
 }
 
 type LeaderStableClosure struct {
-	StableClosure
+	BaseStableClosure
 	node *nodeImpl
 }
 
 func (lsc *LeaderStableClosure) Run(status entity.Status) {
 	node := lsc.node
 	if status.IsOK() {
-		node.ballotBox.CommitAt(node.firstLogIndex, node.firstLogIndex+int64(node.nEntries)-1, node.serverID)
+		node.ballotBox.CommitAt(lsc.FirstLogIndex, lsc.FirstLogIndex+int64(lsc.NEntries)-1, node.serverID)
 	} else {
 		utils.RaftLog.Error("Node %s append [%d, %d] failed, status=%#v.", node.nodeID.GetDesc(),
-			node.firstLogIndex, node.firstLogIndex+int64(node.nEntries)-1, status)
+			lsc.FirstLogIndex, lsc.FirstLogIndex+int64(lsc.NEntries)-1, status)
 	}
 }
 
+//FollowerStableClosure Follower 的日志落盘之后回复 Leader，并且根据 Leader 的 committedIndex 推进自己的 commit 位置
+type FollowerStableClosure struct {
+	BaseStableClosure
+	node *nodeImpl
+	req  *proto2.AppendEntriesRequest
+	term int64
+	done *RpcRequestClosure
+}
+
+func (fsc *FollowerStableClosure) Run(status entity.Status) {
+	if !status.IsOK() {
+		fsc.done.SendProtoResponse(rpc.CoreAppendEntriesRequest, &proto2.AppendEntriesResponse{
+			ErrorResponse: entity.NewErrorResponse(status.GetCode(), "%s", status.GetMsg()),
+		})
+		return
+	}
+	// LogManager 可能在追加日志的协程中直接回调，这个时候节点锁仍然被持有，因此需要在另外的协程中检查任期
+	polerpc.Go(context.Background(), func(ctx context.Context) {
+		node := fsc.node
+		node.lock.RLock()
+		currTerm := node.currTerm
+		node.lock.RUnlock()
+		resp := &proto2.AppendEntriesResponse{
+			Term:    currTerm,
+			Success: false,
+		}
+		if fsc.term == currTerm {
+			// 只有和 Leader 一致的日志才可以被提交
+			committedIndex := fsc.req.PrevLogIndex + int64(len(fsc.req.Entries))
+			if fsc.req.CommittedIndex < committedIndex {
+				committedIndex = fsc.req.CommittedIndex
+			}
+			if _, err := node.ballotBox.SetLastCommittedIndex(committedIndex); err != nil {
+				utils.RaftLog.Error("Node %s fail to set lastCommittedIndex %d : %s", node.nodeID.GetDesc(),
+					committedIndex, err)
+			}
+			resp.Success = true
+		}
+		fsc.done.SendProtoResponse(rpc.CoreAppendEntriesRequest, resp)
+	})
+}
+
 type raftRpcHandler struct {
 	node *nodeImpl
 }
 
+type raftRequestHandler func(rrh *raftRpcHandler, ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext)
+
+//raftRequestHandlers 节点之间的请求与处理函数的对应关系，NodeManager 根据 GroupID 找到节点之后同样按照这个表分发
+var raftRequestHandlers = map[string]raftRequestHandler{
+	rpc.CoreRequestPreVoteRequest:  (*raftRpcHandler).handlePreVoteRequest,
+	rpc.CoreRequestVoteRequest:     (*raftRpcHandler).handleRequestVoteRequest,
+	rpc.CoreAppendEntriesRequest:   (*raftRpcHandler).handleAppendEntriesRequest,
+	rpc.CoreInstallSnapshotRequest: (*raftRpcHandler).handleInstallSnapshotRequest,
+	rpc.CoreTimeoutNowRequest:      (*raftRpcHandler).handleTimeoutNowRequest,
+	rpc.CoreReadIndexRequest:       (*raftRpcHandler).handleReadIndexRequest,
+	rpc.CoreGetFileRequest:         (*raftRpcHandler).handleGetFileRequest,
+}
+
 func (rrh *raftRpcHandler) init() {
-	rrh.node.rpcServer.GetRealServer().RegisterRequestHandler(rpc.CoreRequestPreVoteRequest, rrh.handlePreVoteRequest())
+	for command, handler := range raftRequestHandlers {
+		handler := handler
+		rrh.node.rpcServer.RegisterRequestHandler(command, func(ctx context.Context, req proto.Message,
+			rpcCtx polerpc.RpcServerContext) {
+			handler(rrh, ctx, req, rpcCtx)
+		})
+	}
+	for command, handler := range cliRequestHandlers {
+		handler := handler
+		rrh.node.rpcServer.RegisterRequestHandler(command, func(ctx context.Context, req proto.Message,
+			rpcCtx polerpc.RpcServerContext) {
+			rrh.handleCliRequest(handler, ctx, req, rpcCtx)
+		})
+	}
 }
 
-func (rrh *raftRpcHandler) handlePreVoteRequest() func(cxt context.Context,
+//handleRequestVoteRequest Candidate 发起的正式投票请求
+func (rrh *raftRpcHandler) handleRequestVoteRequest(ctx context.Context, req proto.Message,
 	rpcCtx polerpc.RpcServerContext) {
-	return func(cxt context.Context, rpcCtx polerpc.RpcServerContext) {
-		node := rrh.node
-		doUnLock := true
-		defer func() {
-			if doUnLock {
-				node.lock.Unlock()
-			}
-		}()
-		node.lock.Lock()
+	voteReq := req.(*proto2.RequestVoteRequest)
+	NewRpcRequestClosure(rpcCtx).SendProtoResponse(rpc.CoreRequestVoteRequest,
+		rrh.node.handleRequestVoteRequest(voteReq))
+}
 
-		preVoteReq := &proto2.RequestVoteRequest{}
-		if err := ptypes.UnmarshalAny(rpcCtx.GetReq().Body, preVoteReq); err != nil {
-			panic(err)
+//handleAppendEntriesRequest Leader 的日志复制以及心跳请求，携带日志的请求在日志落盘之后才会回复
+func (rrh *raftRpcHandler) handleAppendEntriesRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	appendReq := req.(*proto2.AppendEntriesRequest)
+	done := NewRpcRequestClosure(rpcCtx)
+	if resp := rrh.node.handleAppendEntriesRequest(appendReq, done); resp != nil {
+		done.SendProtoResponse(rpc.CoreAppendEntriesRequest, resp)
+	}
+}
+
+//handleInstallSnapshotRequest 下载快照的时间可能比较长，放在单独的协程中处理，不阻塞其他请求
+func (rrh *raftRpcHandler) handleInstallSnapshotRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	installReq := req.(*proto2.InstallSnapshotRequest)
+	done := NewRpcRequestClosure(rpcCtx)
+	polerpc.Go(context.Background(), func(ctx context.Context) {
+		if resp := rrh.node.handleInstallSnapshot(installReq, done); resp != nil {
+			done.SendProtoResponse(rpc.CoreInstallSnapshotRequest, resp)
 		}
+	})
+}
 
-		if !IsNodeActive(node.state) {
-			utils.RaftLog.Warn("Node %s is not in active state, currTerm=%d.", node.nodeID.GetDesc(), node.currTerm)
-			voteResp := &proto2.RequestVoteResponse{
-				Term:    0,
-				Granted: false,
-				ErrorResponse: entity.NewErrorResponse(entity.EINVAL, "Node %s is not in active state, state %s.",
-					node.nodeID.GetDesc(), node.state.GetName()),
-			}
-			resp, err := rrh.convertToGrpcResp(voteResp)
-			if err != nil {
-				panic(err)
-			}
-			rpcCtx.Send(resp)
-			return
+//handleTimeoutNowRequest Leader 转移领导权时发送的请求
+func (rrh *raftRpcHandler) handleTimeoutNowRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	timeoutNowReq := req.(*proto2.TimeoutNowRequest)
+	done := NewRpcRequestClosure(rpcCtx)
+	if resp := rrh.node.handleTimeoutNowRequest(timeoutNowReq, done); resp != nil {
+		done.SendProtoResponse(rpc.CoreTimeoutNowRequest, resp)
+	}
+}
+
+//handleReadIndexRequest Follower 转发过来的 ReadIndexRequest
+func (rrh *raftRpcHandler) handleReadIndexRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	readIndexReq := req.(*proto2.ReadIndexRequest)
+	rrh.node.handleReadIndexRequest(readIndexReq, NewRpcRequestClosure(rpcCtx))
+}
+
+//handleGetFileRequest follower 下载快照文件的请求，交由 FileService 根据 readerID 找到对应的 FileReader 读取
+func (rrh *raftRpcHandler) handleGetFileRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	getFileReq := req.(*proto2.GetFileRequest)
+	NewRpcRequestClosure(rpcCtx).SendProtoResponse(rpc.CoreGetFileRequest,
+		GetFileService().HandleGetFile(getFileReq))
+}
+
+//fillConflictHints Follower 拒绝 AppendEntriesRequest 时填充冲突信息，Leader 根据这些信息可以一次跳过整个任期的日志：
+//日志比 prevLogIndex 短时 conflictIndex 为 lastLogIndex + 1，否则为 prevLogIndex 处日志的任期以及该任期的第一条日志
+func fillConflictHints(resp *proto2.AppendEntriesResponse, logMgn LogManager, prevLogIndex int64) {
+	lastLogIndex := logMgn.GetLastLogIndex()
+	resp.LastLogIndex = lastLogIndex
+	if prevLogIndex > lastLogIndex {
+		resp.ConflictTerm = 0
+		resp.ConflictIndex = lastLogIndex + 1
+		return
+	}
+	conflictTerm := logMgn.GetTerm(prevLogIndex)
+	firstLogIndex := logMgn.GetFirstLogIndex()
+	if conflictTerm == 0 || prevLogIndex < firstLogIndex {
+		// prevLogIndex 处的日志已经被压缩到快照中了，没有办法给出冲突的信息
+		return
+	}
+	resp.ConflictTerm = conflictTerm
+	resp.ConflictIndex = searchLogIndex(logMgn, firstLogIndex, prevLogIndex, func(t int64) bool {
+		return t >= conflictTerm
+	})
+}
+
+func (rrh *raftRpcHandler) handlePreVoteRequest(ctx context.Context, req proto.Message,
+	rpcCtx polerpc.RpcServerContext) {
+	node := rrh.node
+	doUnLock := true
+	defer func() {
+		if doUnLock {
+			node.lock.Unlock()
 		}
+	}()
+	node.lock.Lock()
 
-		candidateId := entity.PeerId{}
-		if !candidateId.Parse(preVoteReq.ServerID) {
-			utils.RaftLog.Warn("Node %s received PreVoteRequest from %s serverId bad format.",
-				node.nodeID.GetDesc(), preVoteReq.ServerID)
-			voteResp := &proto2.RequestVoteResponse{
-				Term:          0,
-				Granted:       false,
-				ErrorResponse: entity.NewErrorResponse(entity.EINVAL, "Parse candidateId failed: %s.", preVoteReq.ServerID),
-			}
-			resp, err := rrh.convertToGrpcResp(voteResp)
-			if err != nil {
-				panic(err)
-			}
-			rpcCtx.Send(resp)
-			return
+	preVoteReq := req.(*proto2.RequestVoteRequest)
+
+	if !IsNodeActive(node.state) {
+		utils.RaftLog.Warn("Node %s is not in active state, currTerm=%d.", node.nodeID.GetDesc(), node.currTerm)
+		voteResp := &proto2.RequestVoteResponse{
+			Term:    0,
+			Granted: false,
+			ErrorResponse: entity.NewErrorResponse(entity.EINVAL, "Node %s is not in active state, state %s.",
+				node.nodeID.GetDesc(), node.state.GetName()),
 		}
-		granted := false
-		for {
-			if !node.leaderID.IsEmpty() && node.currentLeaderIsValid() {
-				utils.RaftLog.Info("Node %s ignore PreVoteRequest from %s, term=%d, currTerm=%d, "+
-					"because the leader %s's lease is still valid.",
-					node.nodeID.GetDesc(), preVoteReq.ServerID, preVoteReq.Term, node.currTerm, node.leaderID.GetDesc())
-				break
-			}
-			if preVoteReq.Term < node.currTerm {
-				utils.RaftLog.Info("Node %s ignore PreVoteRequest from %s, term=%d, currTerm=%d.", node.nodeID.GetDesc(), preVoteReq.ServerID, preVoteReq.Term, node.currTerm)
-				rrh.checkReplicator(candidateId)
-				break
-			} else if preVoteReq.Term == node.currTerm+1 {
-				rrh.checkReplicator(candidateId)
-			}
-			doUnLock = false
-			node.lock.Unlock()
+		NewRpcRequestClosure(rpcCtx).SendProtoResponse(rpc.CoreRequestPreVoteRequest, voteResp)
+		return
+	}
 
-			lastLogID := node.logManager.GetLastLogID(true)
-			doUnLock = true
-			node.lock.Lock()
-			requestLastLogId := entity.NewLogID(preVoteReq.LastLogIndex, preVoteReq.LastLogTerm)
-			granted = requestLastLogId.Compare(lastLogID) >= 0
-			if false {
-				break
-			}
+	candidateId := entity.PeerId{}
+	if !candidateId.Parse(preVoteReq.ServerID) {
+		utils.RaftLog.Warn("Node %s received PreVoteRequest from %s serverId bad format.",
+			node.nodeID.GetDesc(), preVoteReq.ServerID)
+		voteResp := &proto2.RequestVoteResponse{
+			Term:          0,
+			Granted:       false,
+			ErrorResponse: entity.NewErrorResponse(entity.EINVAL, "Parse candidateId failed: %s.", preVoteReq.ServerID),
 		}
-		preVoteResp := &proto2.RequestVoteResponse{
-			Term:    node.currTerm,
-			Granted: granted,
+		NewRpcRequestClosure(rpcCtx).SendProtoResponse(rpc.CoreRequestPreVoteRequest, voteResp)
+		return
+	}
+	granted := false
+	for {
+		if !node.leaderID.IsEmpty() && node.currentLeaderIsValid() {
+			utils.RaftLog.Info("Node %s ignore PreVoteRequest from %s, term=%d, currTerm=%d, "+
+				"because the leader %s's lease is still valid.",
+				node.nodeID.GetDesc(), preVoteReq.ServerID, preVoteReq.Term, node.currTerm, node.leaderID.GetDesc())
+			break
 		}
-		resp, err := rrh.convertToGrpcResp(preVoteResp)
-		if err != nil {
-			panic(err)
+		if preVoteReq.Term < node.currTerm {
+			utils.RaftLog.Info("Node %s ignore PreVoteRequest from %s, term=%d, currTerm=%d.", node.nodeID.GetDesc(), preVoteReq.ServerID, preVoteReq.Term, node.currTerm)
+			rrh.checkReplicator(candidateId)
+			break
+		} else if preVoteReq.Term == node.currTerm+1 {
+			rrh.checkReplicator(candidateId)
 		}
-		rpcCtx.Send(resp)
-		return
+		doUnLock = false
+		node.lock.Unlock()
+
+		lastLogID := node.logManager.GetLastLogID(true)
+		doUnLock = true
+		node.lock.Lock()
+		requestLastLogId := entity.NewLogID(preVoteReq.LastLogIndex, preVoteReq.LastLogTerm)
+		granted = requestLastLogId.Compare(lastLogID) >= 0
+		break
+	}
+	preVoteResp := &proto2.RequestVoteResponse{
+		Term:    node.currTerm,
+		Granted: granted,
 	}
+	NewRpcRequestClosure(rpcCtx).SendProtoResponse(rpc.CoreRequestPreVoteRequest, preVoteResp)
 }
 
+//checkReplicator 作为 Leader 收到了其他节点的投票请求，说明到该节点的复制者可能创建失败了，需要重新尝试创建
 func (rrh *raftRpcHandler) checkReplicator(candidate entity.PeerId) {
-
-}
-
-func (rrh *raftRpcHandler) convertToGrpcResp(resp proto.Message) (*polerpc.ServerResponse, error) {
-	body, err := ptypes.MarshalAny(resp)
-	if err != nil {
-		return nil, err
-	}
-	gRPCResp := &polerpc.ServerResponse{
-		Body: body,
-	}
-	return gRPCResp, nil
+	rrh.node.checkReplicator(candidate)
 }
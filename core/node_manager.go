@@ -0,0 +1,301 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	"github.com/pole-group/lraft/rpc"
+	"github.com/pole-group/lraft/utils"
+)
+
+//groupRequest 按照 raft 组分发的请求都带有 GroupID 以及目标节点的 PeerID
+type groupRequest interface {
+	GetGroupID() string
+	GetPeerID() string
+}
+
+//leaderRequest 发给 Leader 的运维命令由 LeaderID 指定目标节点，这些命令中的 PeerID 是被操作的节点
+type leaderRequest interface {
+	GetGroupID() string
+	GetLeaderID() string
+}
+
+//requestTarget 请求的目标节点所在的 raft 组以及目标节点，请求中没有 GroupID 时返回 false
+func requestTarget(req proto.Message) (string, string, bool) {
+	if leaderReq, ok := req.(leaderRequest); ok {
+		return leaderReq.GetGroupID(), leaderReq.GetLeaderID(), true
+	}
+	if groupReq, ok := req.(groupRequest); ok {
+		return groupReq.GetGroupID(), groupReq.GetPeerID(), true
+	}
+	return "", "", false
+}
+
+//NodeManager 在同一个 RPC 服务端上注册多个 raft 组的节点，请求按照 GroupID 以及 PeerID 分发给对应的节点，
+//所有节点共享同一个 ClientTransport 以及处理请求的协程池
+type NodeManager struct {
+	lock         sync.RWMutex
+	endpoint     entity.Endpoint
+	server       rpc.ServerTransport
+	client       rpc.ClientTransport
+	ownTransport bool
+	raftPool     *utils.RoutinePool
+	cliPool      *utils.RoutinePool
+	nodes        map[string]map[string]*nodeImpl // <groupID, <serverID, node>>
+	// 为空时表示没有开启心跳合并
+	heartbeatBatcher *heartbeatBatcher
+	isShutdown       bool
+}
+
+//NewNodeManager 创建 NodeManager 并且注册节点之间的请求的处理函数
+func NewNodeManager(opts NodeManagerOptions) (*NodeManager, error) {
+	if opts.Endpoint.GetIP() == "" || opts.Endpoint.GetIP() == utils.IPAny {
+		return nil, fmt.Errorf("node manager can't be started from %s", opts.Endpoint.GetDesc())
+	}
+	if opts.RaftRpcGoroutinePoolSize <= 0 || opts.CliRpcGoroutinePoolSize <= 0 {
+		return nil, fmt.Errorf("invalid goroutine pool size, raft=%d, cli=%d", opts.RaftRpcGoroutinePoolSize,
+			opts.CliRpcGoroutinePoolSize)
+	}
+	if (opts.ServerTransport == nil) != (opts.ClientTransport == nil) {
+		return nil, fmt.Errorf("ServerTransport and ClientTransport must be set at the same time")
+	}
+	nm := &NodeManager{
+		endpoint: opts.Endpoint,
+		server:   opts.ServerTransport,
+		client:   opts.ClientTransport,
+		nodes:    make(map[string]map[string]*nodeImpl),
+	}
+	if nm.server == nil {
+		server, err := rpc.NewRaftRPCServer(rpc.ServiceName, int32(opts.Endpoint.GetPort()), false)
+		if err != nil {
+			return nil, err
+		}
+		client, err := rpc.NewRaftClient(false)
+		if err != nil {
+			server.Close()
+			return nil, err
+		}
+		nm.server = server
+		nm.client = client
+		nm.ownTransport = true
+	}
+	nm.raftPool = utils.NewRoutinePool(opts.RaftRpcGoroutinePoolSize, opts.RaftRpcGoroutinePoolSize<<3)
+	nm.cliPool = utils.NewRoutinePool(opts.CliRpcGoroutinePoolSize, opts.CliRpcGoroutinePoolSize<<3)
+	if opts.HeartbeatBatchWindowMs > 0 {
+		nm.heartbeatBatcher = newHeartbeatBatcher(nm.client, opts.HeartbeatBatchWindowMs)
+	}
+	nm.registerRaftHandlers()
+	nm.registerCliHandlers()
+	return nm, nil
+}
+
+//NewNode 创建一个注册在当前 NodeManager 上的节点，节点使用 NodeManager 的传输层，NodeOptions 中的传输层会被忽略
+func (nm *NodeManager) NewNode(groupID string, serverID entity.PeerId, opts NodeOptions) (Node, error) {
+	if !serverID.GetEndpoint().Equal(nm.endpoint) {
+		return nil, fmt.Errorf("node %s is not on the endpoint %s of node manager", serverID.GetDesc(),
+			nm.endpoint.GetDesc())
+	}
+	opts.ServerTransport = nm.server
+	opts.ClientTransport = nm.client
+	return newNode(groupID, serverID, opts, nm)
+}
+
+//GetNode 根据 GroupID 以及 PeerID 查找节点，不存在时返回 nil
+func (nm *NodeManager) GetNode(groupID string, peerID entity.PeerId) Node {
+	defer nm.lock.RUnlock()
+	nm.lock.RLock()
+	if node, exist := nm.nodes[groupID][peerID.GetDesc()]; exist {
+		return node
+	}
+	return nil
+}
+
+//GetNodesByGroupID 当前 NodeManager 上属于该 raft 组的所有节点
+func (nm *NodeManager) GetNodesByGroupID(groupID string) []Node {
+	defer nm.lock.RUnlock()
+	nm.lock.RLock()
+	nodes := make([]Node, 0, len(nm.nodes[groupID]))
+	for _, node := range nm.nodes[groupID] {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+//Shutdown 关闭所有注册的节点并且等待关闭完成，之后释放协程池，传输层由 NodeManager 创建时一起关闭
+func (nm *NodeManager) Shutdown() {
+	nm.lock.Lock()
+	if nm.isShutdown {
+		nm.lock.Unlock()
+		return
+	}
+	nm.isShutdown = true
+	nodes := make([]*nodeImpl, 0)
+	for _, group := range nm.nodes {
+		for _, node := range group {
+			nodes = append(nodes, node)
+		}
+	}
+	nm.lock.Unlock()
+
+	for _, node := range nodes {
+		node.Shutdown(nil)
+	}
+	for _, node := range nodes {
+		node.Join()
+	}
+	if nm.heartbeatBatcher != nil {
+		nm.heartbeatBatcher.shutdown()
+	}
+	defer nm.lock.Unlock()
+	nm.lock.Lock()
+	nm.raftPool.Close()
+	nm.cliPool.Close()
+	if nm.ownTransport {
+		nm.server.Close()
+	}
+}
+
+//add 节点初始化完成之后注册到 NodeManager，同一个 raft 组中的 serverID 不能重复
+func (nm *NodeManager) add(node *nodeImpl) bool {
+	defer nm.lock.Unlock()
+	nm.lock.Lock()
+	if nm.isShutdown {
+		return false
+	}
+	group, exist := nm.nodes[node.groupID]
+	if !exist {
+		group = make(map[string]*nodeImpl)
+		nm.nodes[node.groupID] = group
+	}
+	key := node.serverID.GetDesc()
+	if _, exist := group[key]; exist {
+		utils.RaftLog.Error("Node %s is already registered in node manager.", node.nodeID.GetDesc())
+		return false
+	}
+	group[key] = node
+	return true
+}
+
+//remove 节点关闭时从 NodeManager 中移除，之后发给该节点的请求回复 ENOENT
+func (nm *NodeManager) remove(node *nodeImpl) {
+	defer nm.lock.Unlock()
+	nm.lock.Lock()
+	group := nm.nodes[node.groupID]
+	key := node.serverID.GetDesc()
+	if group[key] != node {
+		return
+	}
+	delete(group, key)
+	if len(group) == 0 {
+		delete(nm.nodes, node.groupID)
+	}
+}
+
+//findNode PeerID 为空时，只有该 raft 组在当前 NodeManager 上仅有一个节点才能确定目标节点
+func (nm *NodeManager) findNode(groupID, peerID string) (*nodeImpl, entity.Status) {
+	defer nm.lock.RUnlock()
+	nm.lock.RLock()
+	group, exist := nm.nodes[groupID]
+	if !exist {
+		return nil, entity.NewStatus(entity.ENOENT, fmt.Sprintf("group %s not found", groupID))
+	}
+	if peerID == "" {
+		if len(group) == 1 {
+			for _, node := range group {
+				return node, entity.StatusOK()
+			}
+		}
+		return nil, entity.NewStatus(entity.EINVAL, fmt.Sprintf("peer must be specified since there're %d nodes "+
+			"in group %s", len(group), groupID))
+	}
+	peer := entity.PeerId{}
+	if !peer.Parse(peerID) {
+		return nil, entity.NewStatus(entity.EINVAL, fmt.Sprintf("fail to parse peer %s", peerID))
+	}
+	node, exist := group[peer.GetDesc()]
+	if !exist {
+		return nil, entity.NewStatus(entity.ENOENT, fmt.Sprintf("peer %s not found in group %s", peerID, groupID))
+	}
+	return node, entity.StatusOK()
+}
+
+//registerRaftHandlers 节点之间的请求都在 raftPool 中处理
+func (nm *NodeManager) registerRaftHandlers() {
+	// 快照文件由全局的 FileService 根据 readerID 查找，和具体的 raft 组无关
+	fileHandler := &raftRpcHandler{}
+	for command, handler := range raftRequestHandlers {
+		handler := handler
+		if command == rpc.CoreGetFileRequest {
+			nm.server.RegisterRequestHandler(command, func(ctx context.Context, req proto.Message,
+				rpcCtx polerpc.RpcServerContext) {
+				nm.submit(nm.raftPool, rpcCtx, func() {
+					handler(fileHandler, ctx, req, rpcCtx)
+				})
+			})
+			continue
+		}
+		nm.registerHandler(command, nm.raftPool, func(node *nodeImpl, ctx context.Context, req proto.Message,
+			rpcCtx polerpc.RpcServerContext) {
+			handler(node.handler, ctx, req, rpcCtx)
+		})
+	}
+	// 合并的心跳中包含多个 raft 组，由 NodeManager 自己逐项分发
+	nm.server.RegisterRequestHandler(rpc.CoreBatchHeartbeatRequest, func(ctx context.Context, req proto.Message,
+		rpcCtx polerpc.RpcServerContext) {
+		nm.submit(nm.raftPool, rpcCtx, func() {
+			nm.handleBatchHeartbeatRequest(ctx, req, rpcCtx)
+		})
+	})
+}
+
+//registerCliHandlers 运维命令在 cliPool 中处理，不会占用节点之间的请求的协程
+func (nm *NodeManager) registerCliHandlers() {
+	for command, handler := range cliRequestHandlers {
+		handler := handler
+		nm.registerHandler(command, nm.cliPool, func(node *nodeImpl, ctx context.Context, req proto.Message,
+			rpcCtx polerpc.RpcServerContext) {
+			node.handler.handleCliRequest(handler, ctx, req, rpcCtx)
+		})
+	}
+}
+
+//registerHandler 注册按照 GroupID 以及 PeerID 分发的请求，找不到目标节点时直接回复错误，否则交给 pool 执行 handler
+func (nm *NodeManager) registerHandler(command string, pool *utils.RoutinePool,
+	handler func(node *nodeImpl, ctx context.Context, req proto.Message, rpcCtx polerpc.RpcServerContext)) {
+	nm.server.RegisterRequestHandler(command, func(ctx context.Context, req proto.Message,
+		rpcCtx polerpc.RpcServerContext) {
+		groupID, peerID, ok := requestTarget(req)
+		if !ok {
+			rpcCtx.Send(rpc.NewErrorServerResponse(entity.EINVAL, fmt.Sprintf("command %s has no group id", command)))
+			return
+		}
+		node, st := nm.findNode(groupID, peerID)
+		if !st.IsOK() {
+			rpcCtx.Send(rpc.NewErrorServerResponse(st.GetCode(), st.GetMsg()))
+			return
+		}
+		nm.submit(pool, rpcCtx, func() {
+			handler(node, ctx, req, rpcCtx)
+		})
+	})
+}
+
+//submit NodeManager 关闭之后协程池已经释放，不再接收新的请求
+func (nm *NodeManager) submit(pool *utils.RoutinePool, rpcCtx polerpc.RpcServerContext, task func()) {
+	defer nm.lock.RUnlock()
+	nm.lock.RLock()
+	if nm.isShutdown {
+		rpcCtx.Send(rpc.NewErrorServerResponse(entity.EShutdown, "node manager is shutdown"))
+		return
+	}
+	pool.Submit(task)
+}
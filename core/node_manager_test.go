@@ -0,0 +1,234 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/rpc"
+)
+
+//newTestNodeManagers 每个 Endpoint 上启动一个 NodeManager，每个 raft 组在每个 NodeManager 上都有一个节点，
+//configure 可以在创建 NodeManager 之前修改参数
+func newTestNodeManagers(t *testing.T, network *rpc.FaultNetwork, peers []entity.PeerId, groups []string,
+	configure ...func(opts *NodeManagerOptions)) []*NodeManager {
+	managers := make([]*NodeManager, 0, len(peers))
+	for _, peer := range peers {
+		server, err := network.NewServer(peer.GetEndpoint())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(server.Close)
+		opts := NewDefaultNodeManagerOptions(peer.GetEndpoint())
+		opts.ServerTransport = server
+		opts.ClientTransport = network.NewClient(peer.GetEndpoint())
+		opts.RaftRpcGoroutinePoolSize = 4
+		opts.CliRpcGoroutinePoolSize = 1
+		for _, f := range configure {
+			f(&opts)
+		}
+		nm, err := NewNodeManager(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(nm.Shutdown)
+		managers = append(managers, nm)
+	}
+	for _, groupID := range groups {
+		for i, nm := range managers {
+			opts := NewDefaultNodeOptions()
+			opts.ElectionTimeoutMs = testElectionTimeoutMs
+			opts.Fsm = &recordStateMachine{}
+			opts.LogURI = "mem://"
+			opts.RaftMetaURI = t.TempDir()
+			opts.InitialConf = entity.NewConfiguration(peers, nil)
+			if _, err := nm.NewNode(groupID, peers[i], opts); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return managers
+}
+
+//groupLeaders raft 组中认为自己是 Leader 的节点
+func groupLeaders(managers []*NodeManager, groupID string) []Node {
+	leaders := make([]Node, 0)
+	for _, nm := range managers {
+		for _, node := range nm.GetNodesByGroupID(groupID) {
+			if node.IsLeader() {
+				leaders = append(leaders, node)
+			}
+		}
+	}
+	return leaders
+}
+
+func TestNodeManagerMultiGroup(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peers := newTestPeers(3)
+	groups := []string{"group-0", "group-1", "group-2"}
+	managers := newTestNodeManagers(t, network, peers, groups)
+
+	for _, groupID := range groups {
+		groupID := groupID
+		waitUntil(t, groupID+" to elect a leader", func() bool {
+			return len(groupLeaders(managers, groupID)) == 1
+		})
+		if node := managers[0].GetNode(groupID, peers[0]); node == nil || node.GetGroupID() != groupID {
+			t.Fatalf("node %s of %s not found", peers[0].GetDesc(), groupID)
+		}
+	}
+
+	// 关闭一个 raft 组的 Leader 不影响其他 raft 组
+	leader := groupLeaders(managers, groups[0])[0]
+	leader.Shutdown(nil)
+	leader.Join()
+	waitUntil(t, groups[0]+" to elect a new leader", func() bool {
+		leaders := groupLeaders(managers, groups[0])
+		return len(leaders) == 1 && leaders[0] != leader
+	})
+	for _, groupID := range groups[1:] {
+		if len(groupLeaders(managers, groupID)) != 1 {
+			t.Fatalf("%s lost its leader", groupID)
+		}
+	}
+}
+
+func TestNodeManagerUnknownGroup(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peer := entity.PeerId{}
+	peer.Parse("127.0.0.1:8081")
+	newTestNodeManagers(t, network, []entity.PeerId{peer}, []string{testGroupID})
+
+	client := network.NewClient(peer.GetEndpoint())
+	send := func(groupID, peerID string) entity.Status {
+		body, err := ptypes.MarshalAny(&raft.RequestVoteRequest{GroupID: groupID, ServerID: peer.GetDesc(),
+			PeerID: peerID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.SendRequest(peer.GetEndpoint(), &polerpc.ServerRequest{
+			FunName: rpc.CoreRequestVoteRequest,
+			Body:    body,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, st := rpc.GlobalProtoRegistry.DecodeResponse(rpc.CoreRequestVoteRequest, resp)
+		return st
+	}
+
+	if st := send("unknown", peer.GetDesc()); st.GetCode() != entity.ENOENT {
+		t.Fatalf("unknown group, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if st := send(testGroupID, "127.0.0.1:8082"); st.GetCode() != entity.ENOENT {
+		t.Fatalf("unknown peer, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if st := send(testGroupID, peer.GetDesc()); !st.IsOK() {
+		t.Fatalf("registered node, status %d %s", st.GetCode(), st.GetMsg())
+	}
+}
+
+//heartbeatCountingClient 统计发出的 AppendEntriesRequest 以及合并心跳的请求数和其中的心跳项数
+type heartbeatCountingClient struct {
+	rpc.ClientTransport
+	appendEntries    int64
+	batches          int64
+	heartbeatEntries int64
+}
+
+func (c *heartbeatCountingClient) SendRequest(endpoint entity.Endpoint, req *polerpc.ServerRequest) (
+	*polerpc.ServerResponse, error) {
+	switch req.FunName {
+	case rpc.CoreAppendEntriesRequest:
+		atomic.AddInt64(&c.appendEntries, 1)
+	case rpc.CoreBatchHeartbeatRequest:
+		if msg, err := rpc.GlobalProtoRegistry.DecodeRequest(req); err == nil {
+			atomic.AddInt64(&c.batches, 1)
+			atomic.AddInt64(&c.heartbeatEntries, int64(len(msg.(*raft.BatchHeartbeatRequest).Entries)))
+		}
+	}
+	return c.ClientTransport.SendRequest(endpoint, req)
+}
+
+func TestNodeManagerBatchHeartbeat(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peers := newTestPeers(3)
+	// raft 组比节点多，至少有一个节点是多个 raft 组的 Leader，它发往同一个 Follower 的心跳会被合并
+	groups := []string{"group-0", "group-1", "group-2", "group-3"}
+	clients := make([]*heartbeatCountingClient, 0, len(peers))
+	managers := newTestNodeManagers(t, network, peers, groups, func(opts *NodeManagerOptions) {
+		client := &heartbeatCountingClient{ClientTransport: opts.ClientTransport}
+		clients = append(clients, client)
+		opts.ClientTransport = client
+	})
+	count := func(f func(c *heartbeatCountingClient) *int64) int64 {
+		n := int64(0)
+		for _, c := range clients {
+			n += atomic.LoadInt64(f(c))
+		}
+		return n
+	}
+	currTerm := func(node *nodeImpl) int64 {
+		defer node.lock.RUnlock()
+		node.lock.RLock()
+		return node.currTerm
+	}
+
+	// 只借用 testCluster 追加日志以及等待提交的方法
+	cluster := &testCluster{t: t}
+	leaders := make(map[string]*nodeImpl)
+	terms := make(map[string]int64)
+	for _, groupID := range groups {
+		groupID := groupID
+		waitUntil(t, groupID+" to elect a leader", func() bool {
+			return len(groupLeaders(managers, groupID)) == 1
+		})
+		leader := groupLeaders(managers, groupID)[0].(*nodeImpl)
+		leaders[groupID] = leader
+		terms[groupID] = currTerm(leader)
+		index, ok := cluster.appendData(leader, []byte(groupID))
+		if !ok {
+			t.Fatalf("%s leader steps down", groupID)
+		}
+		// 日志复制完成之后 Follower 只能通过心跳得知日志已经提交
+		nodes := make([]*nodeImpl, 0, len(peers))
+		for _, nm := range managers {
+			for _, node := range nm.GetNodesByGroupID(groupID) {
+				nodes = append(nodes, node.(*nodeImpl))
+			}
+		}
+		cluster.waitCommitted(index, nodes...)
+	}
+
+	appendEntries := count(func(c *heartbeatCountingClient) *int64 { return &c.appendEntries })
+	batches := count(func(c *heartbeatCountingClient) *int64 { return &c.batches })
+	time.Sleep(2 * testElectionTimeoutMs * time.Millisecond)
+	if n := count(func(c *heartbeatCountingClient) *int64 { return &c.appendEntries }) - appendEntries; n != 0 {
+		t.Fatalf("leaders send %d AppendEntriesRequest while idle", n)
+	}
+	batches = count(func(c *heartbeatCountingClient) *int64 { return &c.batches })
+	entries := count(func(c *heartbeatCountingClient) *int64 { return &c.heartbeatEntries })
+	if batches == 0 || entries <= batches {
+		t.Fatalf("heartbeats are not coalesced, batches=%d, entries=%d", batches, entries)
+	}
+	// 合并心跳的响应同样续约 Leader 的租约，并且 Leader 保持不变
+	for _, groupID := range groups {
+		leader := leaders[groupID]
+		if !leader.IsLeader() || currTerm(leader) != terms[groupID] {
+			t.Fatalf("%s leader changes", groupID)
+		}
+		if alive := leader.getAlivePeers(peers, leader.options.getClock().NowMs()); len(alive) != len(peers) {
+			t.Fatalf("%s leader lease only covers %d peers", groupID, len(alive))
+		}
+	}
+}
@@ -0,0 +1,619 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/rpc"
+	"github.com/pole-group/lraft/utils"
+)
+
+//followerFsmCaller Follower 只会通知状态机日志的提交以及 Leader 的变化
+type followerFsmCaller struct {
+	committedRecorder
+}
+
+func (f *followerFsmCaller) OnStartFollowing(ctx entity.LeaderChangeContext) bool {
+	return true
+}
+
+func (f *followerFsmCaller) OnStopFollowing(ctx entity.LeaderChangeContext) bool {
+	return true
+}
+
+func (f *followerFsmCaller) OnError(err entity.RaftError) bool {
+	return true
+}
+
+//newTestFollower 只初始化处理 Leader 请求需要的组件，不启动任何定时任务，peers 为集群的配置
+func newTestFollower(t *testing.T, self entity.PeerId, peers []entity.PeerId) *nodeImpl {
+	raftOpts := NewDefaultRaftOptions()
+	node := &nodeImpl{
+		lock:        &sync.RWMutex{},
+		state:       StateFollower,
+		groupID:     testGroupID,
+		serverID:    self,
+		nodeID:      entity.NodeId{GroupID: testGroupID, Peer: self},
+		leaderID:    entity.EmptyPeer,
+		votedId:     entity.EmptyPeer,
+		options:     NewDefaultNodeOptions(),
+		raftOptions: raftOpts,
+		voteCtx:     &entity.Ballot{},
+		preVoteCtx:  &entity.Ballot{},
+		fsmCaller:   &followerFsmCaller{},
+	}
+	node.conf = entity.NewConfigurationEntry(entity.NewLogID(0, 0), entity.NewConfiguration(peers, nil),
+		entity.NewEmptyConfiguration())
+	node.logManager = newTestLogManager(t, NewMemoryLogStorage(), raftOpts)
+	node.ballotBox = &BallotBox{}
+	node.ballotBox.Init(BallotBoxOptions{Waiter: node.fsmCaller, ClosureQueue: &ClosureQueue{}})
+	node.metaStorage = NewRaftMetaStorage(t.TempDir(), raftOpts)
+	if !node.metaStorage.init(node) {
+		t.Fatal("fail to init meta storage")
+	}
+	node.confCtx = NewConfigurationCtx(node)
+	node.raftNodeJobMgn = &RaftNodeJobManager{node: node}
+	node.replicatorGroup = &ReplicatorGroup{
+		replicators:        &utils.ConcurrentMap{},
+		failureReplicators: &utils.ConcurrentMap{},
+		raftOpt:            raftOpts,
+	}
+	node.replicatorGroup.replicators.Clear()
+	node.replicatorGroup.failureReplicators.Clear()
+	return node
+}
+
+func TestHandleAppendEntriesRequest(t *testing.T) {
+	peers := newTestPeers(3)
+	follower, leader := newTestFollower(t, peers[1], peers), peers[0].GetDesc()
+	// Follower 上 [1, 3] 的任期为 1，[4, 6] 的任期为 2
+	appendAndWait(t, follower.logManager.(*LogManagerImpl),
+		append(newTestLogEntries(1, 3, 1), newTestLogEntries(4, 6, 2)...)...)
+	heartbeat := func(term, prevLogIndex, prevLogTerm, committedIndex int64) *raft.AppendEntriesResponse {
+		return follower.handleAppendEntriesRequest(&raft.AppendEntriesRequest{
+			GroupID:        testGroupID,
+			ServerID:       leader,
+			PeerID:         follower.serverID.GetDesc(),
+			Term:           term,
+			PrevLogIndex:   prevLogIndex,
+			PrevLogTerm:    prevLogTerm,
+			CommittedIndex: committedIndex,
+		}, NewRpcRequestClosure(newTestRpcContext()))
+	}
+	// 第一个心跳让 Follower 进入任期 3 并且认可 Leader
+	if resp := heartbeat(3, 6, 2, 4); !resp.GetSuccess() || resp.GetTerm() != 3 || resp.GetLastLogIndex() != 6 {
+		t.Fatalf("first heartbeat, response %v", resp)
+	}
+
+	for _, c := range []struct {
+		name                                       string
+		term, prevLogIndex, prevLogTerm, committed int64
+		expect                                     *raft.AppendEntriesResponse
+		expectCommitted                            int64
+	}{
+		{"stale term", 2, 6, 2, 6, &raft.AppendEntriesResponse{Term: 3}, 4},
+		{"follower is shorter", 3, 9, 3, 6, &raft.AppendEntriesResponse{Term: 3, LastLogIndex: 6, ConflictIndex: 7}, 4},
+		{"prevLogTerm mismatch", 3, 5, 3, 6, &raft.AppendEntriesResponse{Term: 3, LastLogIndex: 6, ConflictTerm: 2,
+			ConflictIndex: 4}, 4},
+		{"prevLogTerm mismatch at the first term", 3, 2, 2, 6, &raft.AppendEntriesResponse{Term: 3, LastLogIndex: 6,
+			ConflictTerm: 1, ConflictIndex: 1}, 4},
+		// 只有 prevLogIndex 之前的日志确认和 Leader 一致，committedIndex 不能超过 prevLogIndex
+		{"heartbeat capped at prevLogIndex", 3, 5, 2, 6, &raft.AppendEntriesResponse{Term: 3, Success: true,
+			LastLogIndex: 6}, 5},
+		{"heartbeat never decreases committedIndex", 3, 6, 2, 3, &raft.AppendEntriesResponse{Term: 3, Success: true,
+			LastLogIndex: 6}, 5},
+		{"heartbeat advances committedIndex", 3, 6, 2, 6, &raft.AppendEntriesResponse{Term: 3, Success: true,
+			LastLogIndex: 6}, 6},
+	} {
+		if resp := heartbeat(c.term, c.prevLogIndex, c.prevLogTerm, c.committed); !proto.Equal(resp, c.expect) {
+			t.Errorf("%s, response %v, expect %v", c.name, resp, c.expect)
+		}
+		if committed := follower.ballotBox.GetLastCommittedIndex(); committed != c.expectCommitted {
+			t.Errorf("%s, lastCommittedIndex %d, expect %d", c.name, committed, c.expectCommitted)
+		}
+	}
+	follower.lock.RLock()
+	state, term, leaderID := follower.state, follower.currTerm, follower.leaderID
+	follower.lock.RUnlock()
+	if state != StateFollower || term != 3 || leaderID.GetDesc() != leader {
+		t.Fatalf("follower state %s, term %d, leader %s after rejections", state.GetName(), term, leaderID.GetDesc())
+	}
+}
+
+func TestVoteNotGrantedWhenPersistFails(t *testing.T) {
+	peers := newTestPeers(3)
+	node := newTestFollower(t, peers[0], peers)
+	// 元数据目录被删除之后投票无法落盘
+	if err := os.RemoveAll(node.metaStorage.path); err != nil {
+		t.Fatal(err)
+	}
+
+	// 使用当前的 term 投票，只有投票本身需要落盘
+	node.lock.RLock()
+	term := node.currTerm
+	node.lock.RUnlock()
+	resp := node.handleRequestVoteRequest(&raft.RequestVoteRequest{
+		GroupID:      testGroupID,
+		ServerID:     peers[1].GetDesc(),
+		PeerID:       peers[0].GetDesc(),
+		Term:         term,
+		LastLogIndex: 1 << 20,
+		LastLogTerm:  term,
+	})
+	if resp.Granted || resp.ErrorResponse == nil || resp.ErrorResponse.ErrorCode != int32(entity.EIO) {
+		t.Fatalf("vote must not be granted when it is not persisted, response %v", resp)
+	}
+	node.lock.RLock()
+	votedId := node.votedId
+	node.lock.RUnlock()
+	if !votedId.IsEmpty() {
+		t.Fatalf("unpersisted vote for %s is kept", votedId.GetDesc())
+	}
+}
+
+func TestStepDownStopsWhenTermPersistFails(t *testing.T) {
+	peers := newTestPeers(3)
+	node := newTestFollower(t, peers[1], peers)
+	if err := os.RemoveAll(node.metaStorage.path); err != nil {
+		t.Fatal(err)
+	}
+
+	// 更高任期的 Leader 让节点 stepDown，新的 term 无法落盘，节点停止工作并且不能认可该 Leader
+	resp := node.handleAppendEntriesRequest(&raft.AppendEntriesRequest{
+		GroupID:  testGroupID,
+		ServerID: peers[0].GetDesc(),
+		PeerID:   peers[1].GetDesc(),
+		Term:     3,
+	}, NewRpcRequestClosure(newTestRpcContext()))
+	if resp.GetSuccess() || resp.ErrorResponse == nil || resp.ErrorResponse.ErrorCode != int32(entity.EIO) {
+		t.Fatalf("request must fail when the new term is not persisted, response %v", resp)
+	}
+	node.lock.RLock()
+	state, term, leaderID := node.state, node.currTerm, node.leaderID
+	node.lock.RUnlock()
+	if state != StateError || term != 0 || !leaderID.IsEmpty() {
+		t.Fatalf("node state %s, term %d, leader %s after failing to persist term", state.GetName(), term,
+			leaderID.GetDesc())
+	}
+	if node.metaStorage.getTerm() != 0 {
+		t.Fatalf("unpersisted term %d is kept in raft meta storage", node.metaStorage.getTerm())
+	}
+}
+
+func TestRpcHandlersReplyProtoResponses(t *testing.T) {
+	peers := newTestPeers(1)
+	rrh := &raftRpcHandler{node: newTestFollower(t, peers[0], peers)}
+	call := func(handler func(ctx context.Context, req proto.Message, rpcCtx polerpc.RpcServerContext),
+		command string, req proto.Message) (proto.Message, entity.Status) {
+		t.Helper()
+		rpcCtx := newTestRpcContext()
+		handler(context.Background(), req, rpcCtx)
+		select {
+		case resp := <-rpcCtx.respC:
+			if resp.FunName != command {
+				t.Fatalf("response of %s is sent as %s", command, resp.FunName)
+			}
+			return rpc.GlobalProtoRegistry.DecodeResponse(command, resp)
+		case <-time.After(testWaitTimeout):
+			t.Fatalf("no response for %s", command)
+		}
+		return nil, entity.StatusOK()
+	}
+
+	msg, st := call(rrh.handlePreVoteRequest, rpc.CoreRequestPreVoteRequest,
+		&raft.RequestVoteRequest{GroupID: testGroupID, ServerID: "bad-peer", PreVote: true})
+	if !st.IsOK() {
+		t.Fatalf("decode pre vote response, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if resp := msg.(*raft.RequestVoteResponse); resp.Granted || resp.ErrorResponse.GetErrorCode() != int32(entity.EINVAL) {
+		t.Fatalf("pre vote from a bad peer, response %v", resp)
+	}
+
+	msg, st = call(rrh.handleGetFileRequest, rpc.CoreGetFileRequest,
+		&raft.GetFileRequest{ReaderID: -1, Filename: "data", Count: 1})
+	if !st.IsOK() {
+		t.Fatalf("decode get file response, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if resp := msg.(*raft.GetFileResponse); resp.ErrorResponse == nil {
+		t.Fatalf("get file from an unknown reader, response %v", resp)
+	}
+}
+
+//recordStateMachine 只记录 OnShutdown 的调用次数，提交的日志直接跳过
+type recordStateMachine struct {
+	shutdownCnt int32
+}
+
+func (fsm *recordStateMachine) OnApply(iterator Iterator) {
+	for iterator.HasNext() {
+		iterator.Next()
+	}
+}
+
+func (fsm *recordStateMachine) OnShutdown() {
+	atomic.AddInt32(&fsm.shutdownCnt, 1)
+}
+
+func (fsm *recordStateMachine) OnSnapshotSave(writer SnapshotWriter, done Closure) {
+	done.Run(entity.StatusOK())
+}
+
+func (fsm *recordStateMachine) OnSnapshotLoad(reader SnapshotReader) bool {
+	return true
+}
+
+func (fsm *recordStateMachine) OnLeaderStart(term int64) {
+}
+
+func (fsm *recordStateMachine) OnLeaderStop(status entity.Status) {
+}
+
+func (fsm *recordStateMachine) OnError(e entity.RaftError) {
+}
+
+func (fsm *recordStateMachine) OnConfigurationCommitted(conf *entity.Configuration) {
+}
+
+func (fsm *recordStateMachine) OnStopFollowing(ctx entity.LeaderChangeContext) {
+}
+
+func (fsm *recordStateMachine) OnStartFollowing(ctx entity.LeaderChangeContext) {
+}
+
+//countClosure 记录被回调的次数
+type countClosure struct {
+	cnt int32
+}
+
+func (c *countClosure) Run(status entity.Status) {
+	atomic.AddInt32(&c.cnt, 1)
+}
+
+func newSingleNodeOptions(t *testing.T, network *rpc.FaultNetwork, self entity.PeerId) NodeOptions {
+	server, err := network.NewServer(self.GetEndpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	opts := NewDefaultNodeOptions()
+	opts.ElectionTimeoutMs = testElectionTimeoutMs
+	opts.Fsm = &recordStateMachine{}
+	opts.LogURI = "mem://"
+	opts.RaftMetaURI = t.TempDir()
+	opts.SnapshotURI = t.TempDir()
+	opts.InitialConf = entity.NewConfiguration([]entity.PeerId{self}, nil)
+	opts.ServerTransport = server
+	opts.ClientTransport = network.NewClient(self.GetEndpoint())
+	return opts
+}
+
+func TestNewNodeInvalidOptions(t *testing.T) {
+	self := entity.PeerId{}
+	self.Parse("127.0.0.1:8081")
+	if _, err := NewNode(testGroupID, entity.EmptyPeer, NewDefaultNodeOptions()); err == nil {
+		t.Fatal("node must not be created with an empty server id")
+	}
+	if _, err := NewNode("", self, NewDefaultNodeOptions()); err == nil {
+		t.Fatal("node must not be created with an empty group id")
+	}
+	if _, err := NewNode(testGroupID, self, NewDefaultNodeOptions()); err == nil {
+		t.Fatal("node must not be created without fsm and storage uri")
+	}
+}
+
+func TestNodeShutdownAndJoin(t *testing.T) {
+	self := entity.PeerId{}
+	self.Parse("127.0.0.1:8081")
+	opts := newSingleNodeOptions(t, rpc.NewFaultNetwork(1), self)
+	fsm := opts.Fsm.(*recordStateMachine)
+
+	node, err := NewNode(testGroupID, self, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "single node to become leader", node.IsLeader)
+
+	done := &countClosure{}
+	node.Shutdown(done)
+	node.Join()
+	if atomic.LoadInt32(&done.cnt) != 1 {
+		t.Fatalf("shutdown closure should run once, actual %d", done.cnt)
+	}
+	if atomic.LoadInt32(&fsm.shutdownCnt) != 1 {
+		t.Fatalf("StateMachine.OnShutdown should be called once, actual %d", fsm.shutdownCnt)
+	}
+	if node.IsLeader() {
+		t.Fatal("node should step down after shutdown")
+	}
+
+	// 重复关闭不会再次回调状态机，但是 done 依旧会被执行
+	again := &countClosure{}
+	node.Shutdown(again)
+	node.Join()
+	if atomic.LoadInt32(&again.cnt) != 1 || atomic.LoadInt32(&fsm.shutdownCnt) != 1 {
+		t.Fatalf("repeated shutdown, closure=%d, OnShutdown=%d", again.cnt, fsm.shutdownCnt)
+	}
+}
+
+func TestApplyDuringShutdown(t *testing.T) {
+	self := newTestPeers(1)[0]
+	node, err := NewNode(testGroupID, self, newSingleNodeOptions(t, rpc.NewFaultNetwork(1), self))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "single node to become leader", node.IsLeader)
+	if err := node.Apply(nil); err == nil {
+		t.Fatal("nil task must be rejected")
+	}
+	if err := node.ReadIndex(nil, nil); err == nil {
+		t.Fatal("nil read index closure must be rejected")
+	}
+
+	// 和 Shutdown 并发的 Apply 在 -race 下不能出现数据竞争，Done 为空的 task 也不能 panic
+	stop := make(chan struct{})
+	applied := make(chan struct{})
+	go func() {
+		defer close(applied)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			node.Apply(&Task{Data: []byte("data")})
+		}
+	}()
+	node.Shutdown(nil)
+	node.Join()
+	close(stop)
+	<-applied
+
+	done := &countClosure{}
+	if err := node.Apply(&Task{Data: []byte("data"), Done: done}); err == nil {
+		t.Fatal("apply after shutdown must fail")
+	}
+	if err := node.Apply(&Task{Data: []byte("data")}); err == nil {
+		t.Fatal("apply without closure after shutdown must fail")
+	}
+	if atomic.LoadInt32(&done.cnt) != 1 {
+		t.Fatalf("closure of task applied after shutdown should run once, actual %d", done.cnt)
+	}
+}
+
+//statusClosure 将回调的 status 放入 channel
+type statusClosure chan entity.Status
+
+func (c statusClosure) Run(status entity.Status) {
+	c <- status
+}
+
+//dataStateMachine 按顺序记录 apply 的数据，并且回调每一条日志对应的 Done
+type dataStateMachine struct {
+	recordStateMachine
+	lock sync.Mutex
+	data []string
+}
+
+func (fsm *dataStateMachine) OnApply(iterator Iterator) {
+	for iterator.HasNext() {
+		done := iterator.Done()
+		data := iterator.Next()
+		fsm.lock.Lock()
+		fsm.data = append(fsm.data, string(data))
+		fsm.lock.Unlock()
+		if done != nil {
+			done.Run(entity.StatusOK())
+		}
+	}
+}
+
+func (fsm *dataStateMachine) applied() []string {
+	defer fsm.lock.Unlock()
+	fsm.lock.Lock()
+	return append([]string(nil), fsm.data...)
+}
+
+func TestApplyAndReadIndexOnLeader(t *testing.T) {
+	self := newTestPeers(1)[0]
+	opts := newSingleNodeOptions(t, rpc.NewFaultNetwork(1), self)
+	fsm := &dataStateMachine{}
+	opts.Fsm = fsm
+	node, err := NewNode(testGroupID, self, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		node.Shutdown(nil)
+		node.Join()
+	})
+	waitUntil(t, "single node to become leader", node.IsLeader)
+
+	const count = 10
+	done := make(statusClosure, count)
+	expect := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		expect = append(expect, fmt.Sprintf("data-%d", i))
+		if err := node.Apply(&Task{Data: []byte(expect[i]), Done: done}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case st := <-done:
+			if !st.IsOK() {
+				t.Fatalf("apply task, status %d %s", st.GetCode(), st.GetMsg())
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only %d of %d tasks applied", i, count)
+		}
+	}
+	if applied := fsm.applied(); !reflect.DeepEqual(applied, expect) {
+		t.Fatalf("applied %v, expect %v", applied, expect)
+	}
+
+	// 读到的 readIndex 之前的日志都已经 apply 到状态机
+	type readResult struct {
+		status entity.Status
+		index  int64
+		reqCtx []byte
+	}
+	result := make(chan readResult, 1)
+	if err := node.ReadIndex([]byte("ctx"), NewReadIndexClosure(func(status entity.Status, index int64,
+		reqCtx []byte) {
+		result <- readResult{status: status, index: index, reqCtx: reqCtx}
+	}, 10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	r := <-result
+	if !r.status.IsOK() || string(r.reqCtx) != "ctx" {
+		t.Fatalf("read index, status %d %s, reqCtx %s", r.status.GetCode(), r.status.GetMsg(), r.reqCtx)
+	}
+	if lastLogIndex := node.(*nodeImpl).logManager.GetLastLogIndex(); r.index != lastLogIndex {
+		t.Fatalf("read index %d, expect last log index %d", r.index, lastLogIndex)
+	}
+
+	// ExpectTerm 和当前任期不一致的任务不会被追加
+	if err := node.Apply(&Task{Data: []byte("stale"), ExpectTerm: 100, Done: done}); err != nil {
+		t.Fatal(err)
+	}
+	if st := <-done; st.GetCode() != entity.EPERM {
+		t.Fatalf("apply task with a stale term, status %d %s", st.GetCode(), st.GetMsg())
+	}
+}
+
+//readIndexOnce 在 node 上执行一次 ReadIndex，返回回调的 status 以及 readIndex
+func readIndexOnce(t *testing.T, node Node) (entity.Status, int64) {
+	t.Helper()
+	type readResult struct {
+		status entity.Status
+		index  int64
+	}
+	result := make(chan readResult, 1)
+	if err := node.ReadIndex(nil, NewReadIndexClosure(func(status entity.Status, index int64, reqCtx []byte) {
+		result <- readResult{status: status, index: index}
+	}, 10*time.Second)); err != nil {
+		return entity.NewStatus(entity.EInternal, err.Error()), InvalidLogIndex
+	}
+	r := <-result
+	return r.status, r.index
+}
+
+func TestReadIndexOnNewlyElectedLeader(t *testing.T) {
+	network := rpc.NewFaultNetwork(1)
+	peers := newTestPeers(3)
+	nodes := make([]*nodeImpl, 0, len(peers))
+	for _, peer := range peers {
+		nodes = append(nodes, startTestNode(t, network, peer, peers))
+	}
+
+	// 没有任何客户端写入，Leader 在当前任期写入的配置日志提交之后就可以处理 ReadIndex
+	readOnLeader := func(candidates []*nodeImpl) (*nodeImpl, int64) {
+		var leader *nodeImpl
+		var index int64
+		waitUntil(t, "read index on leader", func() bool {
+			for _, node := range candidates {
+				if !node.IsLeader() {
+					continue
+				}
+				st, readIndex := readIndexOnce(t, node)
+				if st.IsOK() {
+					leader, index = node, readIndex
+					return true
+				}
+			}
+			return false
+		})
+		return leader, index
+	}
+	leader, index := readOnLeader(nodes)
+	if index <= 0 {
+		t.Fatalf("read index %d on the first leader", index)
+	}
+
+	// 重新选举出来的 Leader 同样不需要客户端写入，并且 readIndex 不会回退
+	leader.Shutdown(nil)
+	leader.Join()
+	rest := make([]*nodeImpl, 0, len(nodes)-1)
+	for _, node := range nodes {
+		if node != leader {
+			rest = append(rest, node)
+		}
+	}
+	_, newIndex := readOnLeader(rest)
+	if newIndex <= index {
+		t.Fatalf("read index %d on the new leader, expect greater than %d", newIndex, index)
+	}
+}
+
+//TestTransferLeadership 目标节点追上 Leader 调用 TransferLeadershipTo 时的日志之后收到 TimeoutNowRequest，立即发起选举成为新的 Leader
+func TestTransferLeadership(t *testing.T) {
+	c := newTestCluster(t, 3, 1)
+	n1, n2, n3 := c.nodes[0], c.nodes[1], c.nodes[2]
+	c.electSelf(n1)
+	term := c.waitLeader(n1, n2, n3)
+
+	lastIndex := c.apply(n1, 10)
+	if st := n1.TransferLeadershipTo(n2.serverID); !st.IsOK() {
+		t.Fatalf("transfer leadership, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if newTerm := c.waitLeader(n2, n1, n3); newTerm <= term {
+		t.Fatalf("new leader term %d, expect greater than %d", newTerm, term)
+	}
+	c.waitCommitted(lastIndex, n1, n2, n3)
+	c.checkLogs(lastIndex, n2, n1, n3)
+}
+
+//TestTransferLeadershipTimeout 目标节点被隔离时领导权转移在一个选举超时之后放弃，期间 Leader 拒绝写入，超时之后恢复服务，
+//目标节点追上日志之后也不会再发起选举
+func TestTransferLeadershipTimeout(t *testing.T) {
+	c := newTestCluster(t, 3, 2)
+	n1, n2, n3 := c.nodes[0], c.nodes[1], c.nodes[2]
+	c.electSelf(n1)
+	term := c.waitLeader(n1, n2, n3)
+
+	c.network.Isolate(n3.serverID.GetEndpoint())
+	c.waitCommitted(c.apply(n1, 10), n1, n2)
+	if st := n1.TransferLeadershipTo(n3.serverID); !st.IsOK() {
+		t.Fatalf("transfer leadership, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if state, _, _ := c.status(n1); state != StateTransferring {
+		t.Fatalf("leader is %s during transferring", state.GetName())
+	}
+	if st := n1.TransferLeadershipTo(n2.serverID); st.GetCode() != entity.EBUSY {
+		t.Fatalf("transfer leadership again, status %d %s", st.GetCode(), st.GetMsg())
+	}
+	done := make(statusClosure, 1)
+	if err := n1.Apply(&Task{Data: []byte("transferring"), Done: done}); err != nil {
+		t.Fatal(err)
+	}
+	if st := <-done; st.GetCode() != entity.EBUSY {
+		t.Fatalf("apply during transferring, status %d %s", st.GetCode(), st.GetMsg())
+	}
+
+	waitUntil(t, "leader to stop transferring", func() bool {
+		state, _, _ := c.status(n1)
+		return state == StateLeader
+	})
+	c.network.HealPartition()
+	lastIndex := c.apply(n1, 1)
+	c.waitCommitted(lastIndex, n1, n2, n3)
+	time.Sleep(testElectionTimeoutMs * time.Millisecond)
+	if newTerm := c.waitLeader(n1, n2, n3); newTerm != term {
+		t.Fatalf("term is raised from %d to %d after transfer timeout", term, newTerm)
+	}
+}
@@ -5,9 +5,12 @@
 package core
 
 import (
+	"fmt"
 	"runtime"
 
 	"github.com/pole-group/lraft/entity"
+	"github.com/pole-group/lraft/rpc"
+	"github.com/pole-group/lraft/utils"
 )
 
 type RpcOptions struct {
@@ -49,6 +52,12 @@ type NodeOptions struct {
 	RaftRpcGoroutinePoolSize int32
 	EnableMetrics            bool
 	SnapshotThrottle         SnapshotThrottle
+	RaftOptions              RaftOptions
+	// 选举、心跳、租约等定时任务以及超时时间的随机数都来自 Clock，测试中可以替换为 utils.SimulationClock
+	Clock utils.Clock
+	// 节点之间通信使用的传输层，为空时按照 serverID 的端口创建基于 RSocket 的实现，并且在节点关闭时一起关闭
+	ServerTransport rpc.ServerTransport
+	ClientTransport rpc.ClientTransport
 }
 
 func NewDefaultNodeOptions() NodeOptions {
@@ -72,13 +81,84 @@ func NewDefaultNodeOptions() NodeOptions {
 		RaftRpcGoroutinePoolSize: int32(runtime.NumCPU()) << 2,
 		EnableMetrics:            true,
 		SnapshotThrottle:         nil,
+		RaftOptions:              NewDefaultRaftOptions(),
+		Clock:                    utils.SystemClock,
 	}
 }
 
+//validate 检查创建节点所必须的参数
+func (opts NodeOptions) validate() error {
+	if opts.ElectionTimeoutMs <= 0 {
+		return fmt.Errorf("invalid electionTimeoutMs %d", opts.ElectionTimeoutMs)
+	}
+	if opts.LeaderLeaseTimeRatio <= 0 || opts.LeaderLeaseTimeRatio > 100 {
+		return fmt.Errorf("leaderLeaseTimeRatio %d is not in range (0, 100]", opts.LeaderLeaseTimeRatio)
+	}
+	if opts.Fsm == nil {
+		return fmt.Errorf("fsm must not be nil")
+	}
+	if opts.LogURI == "" {
+		return fmt.Errorf("log uri must not be empty")
+	}
+	if opts.RaftMetaURI == "" {
+		return fmt.Errorf("raft meta uri must not be empty")
+	}
+	if opts.InitialConf != nil && !opts.InitialConf.IsEmpty() && !opts.InitialConf.IsValid() {
+		return fmt.Errorf("invalid initial configuration %v", opts.InitialConf.ListPeers())
+	}
+	return nil
+}
+
 func (opts NodeOptions) getLeaderLeaseTimeoutMs() int64 {
 	return opts.ElectionTimeoutMs * int64(opts.LeaderLeaseTimeRatio) / 100
 }
 
+func (opts NodeOptions) getClock() utils.Clock {
+	if opts.Clock == nil {
+		return utils.SystemClock
+	}
+	return opts.Clock
+}
+
+//NodeManagerOptions 同一个进程中多个 raft 组共享的 RPC 服务端以及处理请求的协程池
+type NodeManagerOptions struct {
+	Endpoint entity.Endpoint
+	// 为空时按照 Endpoint 的端口创建基于 RSocket 的实现，并且在 NodeManager 关闭时一起关闭
+	ServerTransport          rpc.ServerTransport
+	ClientTransport          rpc.ClientTransport
+	CliRpcGoroutinePoolSize  int32
+	RaftRpcGoroutinePoolSize int32
+	// 大于 0 时，在这个时间窗口内发往同一个 Endpoint 的心跳合并为一个 BatchHeartbeatRequest，要求对端的节点同样由
+	// NodeManager 管理；小于等于 0 时每个 raft 组仍然单独发送空的 AppendEntriesRequest 作为心跳
+	HeartbeatBatchWindowMs int32
+}
+
+func NewDefaultNodeManagerOptions(endpoint entity.Endpoint) NodeManagerOptions {
+	return NodeManagerOptions{
+		Endpoint:                 endpoint,
+		CliRpcGoroutinePoolSize:  int32(runtime.NumCPU()),
+		RaftRpcGoroutinePoolSize: int32(runtime.NumCPU()) << 2,
+		HeartbeatBatchWindowMs:   5,
+	}
+}
+
+//CliOptions 运维客户端 CliService 的参数
+type CliOptions struct {
+	// 单个请求的超时时间
+	TimeoutMs int32
+	// 查找 Leader 以及请求被 Leader 拒绝之后重试的次数
+	MaxRetry int32
+	// 为空时创建基于 RSocket 的实现
+	ClientTransport rpc.ClientTransport
+}
+
+func NewDefaultCliOptions() CliOptions {
+	return CliOptions{
+		TimeoutMs: 1000,
+		MaxRetry:  3,
+	}
+}
+
 type ReadOnlyOption string
 
 const (
@@ -87,9 +167,37 @@ const (
 )
 
 type RaftOptions struct {
-	StepDownWhenVoteTimeout bool
-	ReadOnlyOpt             ReadOnlyOption
-	MaxReplicatorInflightMs int64
+	StepDownWhenVoteTimeout    bool
+	ReadOnlyOpt                ReadOnlyOption
+	MaxReplicatorInflightMs    int64
+	MaxSegmentFileSize         int64
+	Sync                       bool
+	MaxAppendBatchSize         int32
+	AppendFlushIntervalMs      int64
+	DiskRingBufferSize         int64
+	MaxByteCountPerRpc         int64
+	MaxEntriesSize             int32
+	MaxBodySize                int32
+	MaxReplicatorInflightBytes int64
+	EnableLogEntryChecksum     bool
+}
+
+func NewDefaultRaftOptions() RaftOptions {
+	return RaftOptions{
+		StepDownWhenVoteTimeout:    true,
+		ReadOnlyOpt:                ReadOnlySafe,
+		MaxReplicatorInflightMs:    256,
+		MaxSegmentFileSize:         64 * 1024 * 1024,
+		Sync:                       true,
+		MaxAppendBatchSize:         256,
+		AppendFlushIntervalMs:      0,
+		DiskRingBufferSize:         16384,
+		MaxByteCountPerRpc:         128 * 1024,
+		MaxEntriesSize:             1024,
+		MaxBodySize:                512 * 1024,
+		MaxReplicatorInflightBytes: 16 * 512 * 1024,
+		EnableLogEntryChecksum:     false,
+	}
 }
 
 type replicatorOptions struct {
@@ -105,6 +213,9 @@ type replicatorOptions struct {
 	snapshotStorage           SnapshotStorage
 	raftRpcOperator           *RaftClientOperator
 	replicatorType            ReplicatorType
+	clock                     utils.Clock
+	// 不为空时定时的心跳交给 NodeManager 合并发送
+	heartbeatBatcher *heartbeatBatcher
 }
 
 func (r *replicatorOptions) Copy() *replicatorOptions {
@@ -121,6 +232,8 @@ func (r *replicatorOptions) Copy() *replicatorOptions {
 		snapshotStorage:           r.snapshotStorage,
 		raftRpcOperator:           r.raftRpcOperator,
 		replicatorType:            r.replicatorType,
+		clock:                     r.clock,
+		heartbeatBatcher:          r.heartbeatBatcher,
 	}
 }
 
@@ -136,7 +249,43 @@ type FSMCallerOptions struct {
 	BootstrapID   *entity.LogId
 	ClosureQueue  *ClosureQueue
 	Node          *nodeImpl
+	// 为空时 FSMCaller 使用自己独占的 EventBus
+	EventBus *utils.EventBus
+}
+
+type LogManagerOptions struct {
+	LogStorage LogStorage
+	ConfMgn    *entity.ConfigurationManager
+	FsmCaller  FSMCaller
+	RaftOpts   RaftOptions
+	// 为空时 LogManager 使用自己独占的 EventBus
+	EventBus *utils.EventBus
+	// 磁盘写线程攒批的定时器来自 Clock，为空时使用 utils.SystemClock
+	Clock utils.Clock
+}
+
+type LogStorageOptions struct {
+	ConfMgn *entity.ConfigurationManager
+}
+
+type SnapshotExecutorOptions struct {
+	URI                    string
+	FsmCaller              FSMCaller
+	Node                   *nodeImpl
+	LogManager             LogManager
+	InitTerm               int64
+	Addr                   entity.Endpoint
+	FilterBeforeCopyRemote bool
+	SnapshotThrottle       SnapshotThrottle
+	RaftClientOperator     *RaftClientOperator
+	NodeOpts               NodeOptions
+	RaftOpts               RaftOptions
 }
 
 type SnapshotCopierOptions struct {
+	RaftClientOperator *RaftClientOperator
+	RaftOpts           RaftOptions
+	NodeOpts           *NodeOptions
+	MaxRetry           int32
+	RetryIntervalMs    int64
 }
@@ -5,6 +5,9 @@
 package core
 
 import (
+	"context"
+	"sync"
+
 	proto2 "github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/jjeffcaii/reactor-go"
@@ -19,13 +22,13 @@ import (
 
 // RaftClient 的一些操作
 type RaftClientOperator struct {
-	raftClient     *rpc.RaftClient
+	raftClient     rpc.ClientTransport
 	replicateGroup *ReplicatorGroup
 	nodeOpt        *NodeOptions
 	endpointGoPool map[string]*ants.PoolWithFunc
 }
 
-func NewRaftClientOperator(nodeOpt *NodeOptions, raftClient *rpc.RaftClient, replicateGroup *ReplicatorGroup) *RaftClientOperator {
+func NewRaftClientOperator(nodeOpt *NodeOptions, raftClient rpc.ClientTransport, replicateGroup *ReplicatorGroup) *RaftClientOperator {
 	return &RaftClientOperator{
 		raftClient:     raftClient,
 		replicateGroup: replicateGroup,
@@ -64,7 +67,12 @@ func (rcop *RaftClientOperator) TimeoutNow(endpoint entity.Endpoint, req *proto.
 	return invokeWithClosure(endpoint, rcop.raftClient, rpc.CoreTimeoutNowRequest, req, &done.RpcResponseClosure)
 }
 
-func invokeWithClosure(endpoint entity.Endpoint, rpcClient *rpc.RaftClient, path string, req proto2.Message,
+func (rcop *RaftClientOperator) GetFile(endpoint entity.Endpoint, req *proto.GetFileRequest,
+	done *GetFileResponseClosure) mono.Mono {
+	return invokeWithClosure(endpoint, rcop.raftClient, rpc.CoreGetFileRequest, req, &done.RpcResponseClosure)
+}
+
+func invokeWithClosure(endpoint entity.Endpoint, rpcClient rpc.ClientTransport, path string, req proto2.Message,
 	done *RpcResponseClosure) mono.Mono {
 	body, err := ptypes.MarshalAny(req)
 	if err != nil {
@@ -82,14 +90,9 @@ func invokeWithClosure(endpoint entity.Endpoint, rpcClient *rpc.RaftClient, path
 	}
 
 	return mono.Just(resp).DoOnNext(func(v reactor.Any) error {
-		resp := v.(*pole_rpc.ServerResponse)
-		supplier := rpc.GlobalProtoRegistry.FindProtoMessageSupplier(resp.FunName)
-		bzResp := supplier()
-		if err := ptypes.UnmarshalAny(resp.Body, supplier()); err != nil {
-			return err
-		}
+		bzResp, status := rpc.GlobalProtoRegistry.DecodeResponse(path, v.(*pole_rpc.ServerResponse))
 		done.Resp = bzResp
-		done.Run(entity.StatusOK())
+		done.Run(status)
 		return nil
 	}).DoOnCancel(func() {
 		done.Run(entity.NewStatus(entity.ECANCELED, "RPC request was canceled by future."))
@@ -97,3 +100,22 @@ func invokeWithClosure(endpoint entity.Endpoint, rpcClient *rpc.RaftClient, path
 		done.Run(entity.NewStatus(entity.UNKNOWN, e.Error()))
 	})
 }
+
+//sendAsync 在单独的协程中发送请求，持有锁的时候不需要等待 RPC 返回，这样才能有多个请求同时在途；
+//无论请求成功、失败还是被取消，done 都只会被执行一次
+func sendAsync(done *RpcResponseClosure, send func() mono.Mono) pole_rpc.Future {
+	f := done.F
+	once := sync.Once{}
+	done.F = func(resp proto2.Message, status entity.Status) {
+		once.Do(func() {
+			f(resp, status)
+		})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pole_rpc.Go(ctx, func(ctx context.Context) {
+		if _, err := send().Block(ctx); err != nil {
+			done.Run(entity.NewStatus(entity.EHostDown, err.Error()))
+		}
+	})
+	return pole_rpc.NewCtxFuture(ctx, cancel)
+}
@@ -5,14 +5,15 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"math"
-	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/jjeffcaii/reactor-go/mono"
 
 	"github.com/pole-group/lraft/entity"
 	raft "github.com/pole-group/lraft/proto"
@@ -44,6 +45,60 @@ type repeatJob interface {
 	stop()
 }
 
+//repeatTimer 基于 Clock 的重复定时器，每次 work 执行完之后再通过 nextDelay 计算下一次执行的延迟
+type repeatTimer struct {
+	lock      sync.Mutex
+	clock     utils.Clock
+	work      func()
+	nextDelay func() time.Duration
+	timer     utils.Timer
+	stopped   bool
+}
+
+func startRepeatTimer(clock utils.Clock, work func(), delay time.Duration,
+	nextDelay func() time.Duration) *repeatTimer {
+	rt := &repeatTimer{
+		clock:     clock,
+		work:      work,
+		nextDelay: nextDelay,
+	}
+	rt.schedule(delay)
+	return rt
+}
+
+func (rt *repeatTimer) schedule(delay time.Duration) {
+	defer rt.lock.Unlock()
+	rt.lock.Lock()
+	if rt.stopped {
+		return
+	}
+	rt.timer = rt.clock.AfterFunc(delay, rt.run)
+}
+
+func (rt *repeatTimer) run() {
+	rt.work()
+	rt.schedule(rt.nextDelay())
+}
+
+//Cancel 停止定时器，正在执行的 work 不受影响，但是不会再调度下一次
+func (rt *repeatTimer) Cancel() {
+	defer rt.lock.Unlock()
+	rt.lock.Lock()
+	rt.stopped = true
+	if rt.timer != nil {
+		rt.timer.Stop()
+	}
+}
+
+//randomElectionTimeout 在 ElectionTimeoutMs 的基础上增加 [0, ElectionMaxDelayMs) 的随机延迟，避免多个节点同时发起选举
+func randomElectionTimeout(node *nodeImpl) time.Duration {
+	timeoutMs := node.options.ElectionTimeoutMs
+	if node.options.ElectionMaxDelayMs > 0 {
+		timeoutMs += node.options.getClock().Int63n(node.options.ElectionMaxDelayMs)
+	}
+	return time.Duration(timeoutMs) * time.Millisecond
+}
+
 type RaftNodeJobManager struct {
 	node        *nodeImpl
 	voteJob     repeatJob
@@ -107,17 +162,17 @@ func (mgn *RaftNodeJobManager) stopJob(jType JobType) {
 }
 
 func (mgn *RaftNodeJobManager) shutdown() {
-	mgn.voteJob.stop()
-	mgn.snapshotJob.stop()
-	mgn.electionJob.stop()
-	mgn.stepDownJob.stop()
+	mgn.stopJob(JobForVote)
+	mgn.stopJob(JobForSnapshot)
+	mgn.stopJob(JobForElection)
+	mgn.stopJob(JobForStepDown)
 }
 
 type VoteJob struct {
 	jobMgn   *RaftNodeJobManager
 	node     *nodeImpl
 	lock     *sync.RWMutex
-	future   polerpc.Future
+	future   *repeatTimer
 	stopSign JobSwitch
 }
 
@@ -137,19 +192,24 @@ func (v *VoteJob) start() {
 
 func (v *VoteJob) stop() {
 	atomic.StoreInt32((*int32)(&v.stopSign), int32(Suspend))
-	v.future.Cancel()
+	if v.future != nil {
+		v.future.Cancel()
+	}
 }
 
 // initVoteJob 初始化投票的定时任务
 func (v *VoteJob) initVoteJob() {
-	v.future = polerpc.DoTimerSchedule(func() {
+	if v.future != nil {
+		v.future.Cancel()
+	}
+	v.future = startRepeatTimer(v.node.options.getClock(), func() {
 		// 如果当前任务可执行的状态依旧 open 状态的话，则继续执行处理
 		if atomic.LoadInt32((*int32)(&v.stopSign)) == int32(OpenJob) {
 			// 如果到了指定的超时时间
 			v.handleVoteTimeout()
 		}
-	}, time.Duration(v.node.options.ElectionTimeoutMs)*time.Millisecond, func() time.Duration {
-		return time.Duration(v.node.options.ElectionTimeoutMs+rand.Int63n(v.node.options.ElectionMaxDelayMs)) * time.Millisecond
+	}, randomElectionTimeout(v.node), func() time.Duration {
+		return randomElectionTimeout(v.node)
 	})
 }
 
@@ -178,7 +238,7 @@ type ElectionJob struct {
 	electionCnt int32
 	lock        *sync.RWMutex
 	stopSign    JobSwitch
-	future      polerpc.Future
+	future      *repeatTimer
 }
 
 func newElector(node *nodeImpl, mgn *RaftNodeJobManager) *ElectionJob {
@@ -196,18 +256,23 @@ func (el *ElectionJob) start() {
 
 func (el *ElectionJob) stop() {
 	atomic.StoreInt32((*int32)(&el.stopSign), int32(Suspend))
-	el.future.Cancel()
+	if el.future != nil {
+		el.future.Cancel()
+	}
 }
 
 //initElectionJob 处理来自 Leader 的心跳包数据，判断如果 Leader 超过多久没有向自己续约 Leader 信息的话，就会开启 preVote 机制先判断是否可以竞争 Leader
 //，同时由于是采用了 preVote，避免了 term 可能会疯狂上涨的问题
 func (el *ElectionJob) initElectionJob() {
-	el.future = polerpc.DoTimerSchedule(func() {
+	if el.future != nil {
+		el.future.Cancel()
+	}
+	el.future = startRepeatTimer(el.node.options.getClock(), func() {
 		if atomic.LoadInt32((*int32)(&el.stopSign)) == int32(OpenJob) {
 			el.handleElectionTimeout()
 		}
-	}, time.Duration(el.node.options.ElectionTimeoutMs)*time.Millisecond, func() time.Duration {
-		return time.Duration(el.node.options.ElectionTimeoutMs+rand.Int63n(el.node.options.ElectionMaxDelayMs)) * time.Millisecond
+	}, randomElectionTimeout(el.node), func() time.Duration {
+		return randomElectionTimeout(el.node)
 	})
 }
 
@@ -283,8 +348,7 @@ type SnapshotJob struct {
 	node          *nodeImpl
 	lock          *sync.RWMutex
 	stopSign      JobSwitch
-	snapshotSign  chan int8
-	future        polerpc.Future
+	future        *repeatTimer
 }
 
 func newSnapshotJob(node *nodeImpl, mgn *RaftNodeJobManager) repeatJob {
@@ -294,7 +358,6 @@ func newSnapshotJob(node *nodeImpl, mgn *RaftNodeJobManager) repeatJob {
 		node:          node,
 		lock:          node.lock,
 		stopSign:      0,
-		snapshotSign:  make(chan int8, 1),
 	}
 }
 
@@ -302,13 +365,11 @@ func newSnapshotJob(node *nodeImpl, mgn *RaftNodeJobManager) repeatJob {
 func (sj *SnapshotJob) start() {
 	atomic.StoreInt32((*int32)(&sj.stopSign), int32(OpenJob))
 
-	polerpc.GoEmpty(func() {
-		for range sj.snapshotSign {
-
-		}
-	})
-
-	sj.future = polerpc.DoTimerSchedule(func() {
+	if sj.future != nil {
+		sj.future.Cancel()
+	}
+	clock := sj.node.options.getClock()
+	sj.future = startRepeatTimer(clock, func() {
 		if atomic.LoadInt32((*int32)(&sj.stopSign)) == int32(OpenJob) {
 			sj.handleSnapshotTimeout()
 		}
@@ -319,7 +380,7 @@ func (sj *SnapshotJob) start() {
 		sj.firstSchedule = false
 		if sj.node.options.SnapshotIntervalSecs > 0 {
 			half := sj.node.options.SnapshotIntervalSecs / 2
-			return time.Duration(half+rand.Int31n(half)) * time.Second
+			return time.Duration(int64(half)+clock.Int63n(int64(half))) * time.Second
 		} else {
 			return time.Duration(sj.node.options.SnapshotIntervalSecs) * time.Second
 		}
@@ -329,8 +390,9 @@ func (sj *SnapshotJob) start() {
 //stop 任务不执行
 func (sj *SnapshotJob) stop() {
 	atomic.StoreInt32((*int32)(&sj.stopSign), int32(Suspend))
-	close(sj.snapshotSign)
-	sj.future.Cancel()
+	if sj.future != nil {
+		sj.future.Cancel()
+	}
 }
 
 func (sj *SnapshotJob) handleSnapshotTimeout() {
@@ -340,13 +402,19 @@ func (sj *SnapshotJob) handleSnapshotTimeout() {
 		return
 	}
 	sj.lock.Unlock()
-	sj.snapshotSign <- int8(1)
+	// 快照可能耗时较长，不能阻塞定时器
+	polerpc.Go(context.Background(), func(ctx context.Context) {
+		doSnapshot(sj.node, nil)
+	})
 }
 
 type StepDownJob struct {
-	node   *nodeImpl
-	jogMgn *RaftNodeJobManager
-	lock   *sync.RWMutex
+	node     *nodeImpl
+	jogMgn   *RaftNodeJobManager
+	lock     *sync.RWMutex
+	stopSign JobSwitch
+	version  int64
+	timer    utils.Timer
 }
 
 func newStepDownJob(node *nodeImpl, mgn *RaftNodeJobManager) *StepDownJob {
@@ -357,14 +425,51 @@ func newStepDownJob(node *nodeImpl, mgn *RaftNodeJobManager) *StepDownJob {
 	}
 }
 
-//start 任务启动
+//start 任务启动，成为 Leader 之后调用，调用时需要持有节点的锁
 func (sj *StepDownJob) start() {
-
+	atomic.StoreInt32((*int32)(&sj.stopSign), int32(OpenJob))
+	sj.version++
+	sj.schedule(sj.version)
 }
 
-//stop 任务不执行
+//stop 任务不执行，调用时需要持有节点的锁
 func (sj *StepDownJob) stop() {
+	atomic.StoreInt32((*int32)(&sj.stopSign), int32(Suspend))
+	if sj.timer != nil {
+		sj.timer.Stop()
+		sj.timer = nil
+	}
+}
+
+//schedule 每隔 ElectionTimeoutMs 的一半检查一次，每次检查完之后再调度下一次，version 用来丢弃 stop 之后仍然在等待锁的旧任务
+func (sj *StepDownJob) schedule(version int64) {
+	sj.timer = sj.node.options.getClock().AfterFunc(time.Duration(sj.node.options.ElectionTimeoutMs/2)*time.Millisecond,
+		func() {
+			sj.handleStepDownTimeout(version)
+		})
+}
 
+//handleStepDownTimeout Leader 检查自己是否还能够联系上半数以上的节点，联系不上的话主动降级
+func (sj *StepDownJob) handleStepDownTimeout(version int64) {
+	defer sj.lock.Unlock()
+	sj.lock.Lock()
+	if atomic.LoadInt32((*int32)(&sj.stopSign)) != int32(OpenJob) || version != sj.version {
+		return
+	}
+	node := sj.node
+	if node.state > StateTransferring {
+		utils.RaftLog.Debug("node %s stop step down timer, term=%d, state=%s.", node.nodeID.GetDesc(),
+			node.currTerm, node.state.GetName())
+		return
+	}
+	monotonicNowMs := node.options.getClock().NowMs()
+	if !node.checkDeadNodes(node.conf.GetConf(), monotonicNowMs, true) {
+		return
+	}
+	if !node.conf.IsStable() && !node.checkDeadNodes(node.conf.GetOldConf(), monotonicNowMs, true) {
+		return
+	}
+	sj.schedule(version)
 }
 
 //electSelf 通过 preVote 之后，就开始真正的将自己的term上调并进行Leader的竞选
@@ -384,6 +489,13 @@ func electSelf(node *nodeImpl) {
 			node.raftNodeJobMgn.stopJob(JobForElection)
 		}
 		// 因为自己的状态提升为了 StateCandidate，因此自己不认当前的 Leader，直接将自己原来记住的 Leader 信息丢弃
+		// 先将新的 term 以及投给自己的一票落盘，失败的话不能发起本轮选举，错误已经由 metaStorage 上报，这里直接停止
+		if !node.metaStorage.setTermAndVotedFor(node.currTerm+1, node.serverID) {
+			utils.RaftLog.Error("node %s fail to persist term %d when electSelf, currTerm=%d.",
+				node.nodeID.GetDesc(), node.currTerm+1, node.currTerm)
+			node.state = StateError
+			return false, -1
+		}
 		node.resetLeaderId(entity.EmptyPeer, entity.NewStatus(entity.ERaftTimedOut,
 			"a follower's leader_id is reset to NULL as it begins to request_vote."))
 		node.state = StateCandidate
@@ -446,17 +558,18 @@ func electSelf(node *nodeImpl) {
 
 		done.F = func(resp proto.Message, status entity.Status) {
 			if status.IsOK() {
-				handleRequestVoteResponse(done.PeerId, done.Term, done.Resp.(*raft.RequestVoteResponse))
+				handleRequestVoteResponse(node, done.PeerId, done.Term, done.Resp.(*raft.RequestVoteResponse))
 			} else {
 				utils.RaftLog.Warn("node : %s request vote to : %s error : %s", node.nodeID.GetDesc(),
 					done.PeerId.GetDesc(), status.GetMsg())
 			}
 		}
-		node.raftOperator.RequestVote(peer.GetEndpoint(), done.Req, done)
+		// 持有节点锁的时候不能同步等待 RPC 的返回，否则两个节点同时发起选举时会相互等待对方的锁
+		sendAsync(&done.RpcResponseClosure, func() mono.Mono {
+			return node.raftOperator.RequestVote(peer.GetEndpoint(), done.Req, done)
+		})
 	})
 
-	// 保存元数据信息
-	node.metaStorage.setTermAndVotedFor(node.currTerm, node.serverID)
 	node.voteCtx.Grant(node.serverID)
 	// 如果当前已经有超过半数的 Follower 同意了自己的 Leader 竞争选举，那么就正式成为 Leader
 	if node.voteCtx.IsGrant() {
@@ -465,15 +578,18 @@ func electSelf(node *nodeImpl) {
 }
 
 //doPreVote 为了避免 Term 因为选举失败而导致不堵上涨的问题，这里做了优化，采用预投票的方式，先试探一下自己是否可以竞争为 Leader,
-//如果可以的话, 在执行真正的 Vote 机制
+//如果可以的话, 在执行真正的 Vote 机制。调用时持有节点的锁，返回时锁已经释放
 func doPreVote(node *nodeImpl) {
 	utils.RaftLog.Info("node : %s term : %d startJob preVote", node.nodeID.GetDesc(), node.currTerm)
 	if node.snapshotExecutor != nil && node.snapshotExecutor.IsInstallingSnapshot() {
 		utils.RaftLog.Warn("node : %s term : %d doesn't do preVote when installing snapshot as the configuration may" +
 			" be out of date")
+		node.lock.Unlock()
 		return
 	}
+	// 已经被移出集群的节点不能发起选举
 	if !node.conf.ContainPeer(node.serverID) {
+		node.lock.Unlock()
 		return
 	}
 	oldTerm := node.currTerm
@@ -494,7 +610,7 @@ func doPreVote(node *nodeImpl) {
 		return
 	}
 	var oldConf *entity.Configuration
-	if node.conf.IsStable() {
+	if !node.conf.IsStable() {
 		oldConf = node.conf.GetOldConf()
 	}
 	node.preVoteCtx.Init(node.conf.GetConf(), oldConf)
@@ -531,7 +647,9 @@ func doPreVote(node *nodeImpl) {
 			}
 		}
 
-		node.raftOperator.PreVote(peer.GetEndpoint(), done.Req, done)
+		sendAsync(&done.RpcResponseClosure, func() mono.Mono {
+			return node.raftOperator.PreVote(peer.GetEndpoint(), done.Req, done)
+		})
 	})
 	node.preVoteCtx.Grant(node.serverID)
 	if node.preVoteCtx.IsGrant() {
@@ -540,9 +658,39 @@ func doPreVote(node *nodeImpl) {
 	}
 }
 
-// handleRequestVoteResponse
-func handleRequestVoteResponse(peer entity.PeerId, term int64, resp *raft.RequestVoteResponse) {
+// handleRequestVoteResponse 统计投票的结果，获得了半数以上的投票之后成为 Leader
+func handleRequestVoteResponse(node *nodeImpl, peer entity.PeerId, term int64, resp *raft.RequestVoteResponse) {
+	defer node.lock.Unlock()
+	node.lock.Lock()
 
+	if node.state != StateCandidate {
+		utils.RaftLog.Warn("Node %s received invalid RequestVoteResponse from %s, state not in StateCandidate but %s.",
+			node.nodeID.GetDesc(), peer.GetDesc(), node.state.GetName())
+		return
+	}
+	if term != node.currTerm {
+		utils.RaftLog.Warn("Node %s received stale RequestVoteResponse from %s, term=%d, currTerm=%d.",
+			node.nodeID.GetDesc(), peer.GetDesc(), term, node.currTerm)
+		return
+	}
+	if resp.ErrorResponse != nil {
+		utils.RaftLog.Warn("Node %s received error RequestVoteResponse from %s : %s.", node.nodeID.GetDesc(),
+			peer.GetDesc(), resp.ErrorResponse.ErrorMsg)
+		return
+	}
+	if resp.Term > node.currTerm {
+		utils.RaftLog.Warn("Node %s received error RequestVoteResponse from %s, term=%d, expect=%d.",
+			node.nodeID.GetDesc(), peer.GetDesc(), resp.Term, node.currTerm)
+		stepDown(node, resp.Term, false, entity.NewStatus(entity.EHigherTermResponse,
+			"Raft node receives higher term request_vote_response."))
+		return
+	}
+	if resp.Granted {
+		node.voteCtx.Grant(peer)
+		if node.voteCtx.IsGrant() {
+			becomeLeader(node)
+		}
+	}
 }
 
 // handlePreVoteResponse
@@ -580,10 +728,11 @@ func handlePreVoteResponse(node *nodeImpl, peer entity.PeerId, term int64, resp
 	}
 }
 
-// stepDown 停止自己的一些任务，只有在出现状态转换的时候需要做这个动作，并且是从 Leader 降级为 Follower
-func stepDown(node *nodeImpl, term int64, wakeupCandidate bool, status entity.Status) {
+// stepDown 停止自己的一些任务，只有在出现状态转换的时候需要做这个动作，并且是从 Leader 降级为 Follower，
+// 新的 term 落盘失败时节点进入 StateError 并返回 false
+func stepDown(node *nodeImpl, term int64, wakeupCandidate bool, status entity.Status) bool {
 	if !IsNodeActive(node.state) {
-		return
+		return true
 	}
 
 	// 自己处于 Candidate 状态的时候，就不能够在进行投票的操作了
@@ -600,15 +749,22 @@ func stepDown(node *nodeImpl, term int64, wakeupCandidate bool, status entity.St
 	node.resetLeaderId(entity.EmptyPeer, status)
 	node.state = StateFollower
 	// 清空自己的配置信息，这个信息只能以 Leader 的为准
-	node.confCtx.Reset()
-	node.lastLeaderTimestamp = utils.GetCurrentTimeMs()
+	node.confCtx.Reset(entity.NewStatus(entity.EPERM, "Leader stepped down."))
+	node.updateLastLeaderTimestamp(node.options.getClock().NowMs())
 	if node.snapshotExecutor != nil {
 		node.snapshotExecutor.stopDownloadingSnapshot(term)
 	}
 	if term > node.currTerm {
+		// 新的 term 没有落盘就不能使用，否则节点重启之后 term 会回退，错误已经由 metaStorage 上报，这里直接停止
+		if !node.metaStorage.setTermAndVotedFor(term, entity.EmptyPeer) {
+			utils.RaftLog.Error("node %s fail to persist term %d when step down, currTerm=%d.",
+				node.nodeID.GetDesc(), term, node.currTerm)
+			node.replicatorGroup.stopAll()
+			node.state = StateError
+			return false
+		}
 		node.currTerm = term
 		node.votedId = entity.EmptyPeer
-		node.metaStorage.setTermAndVotedFor(term, node.votedId)
 	}
 
 	if wakeupCandidate {
@@ -620,16 +776,18 @@ func stepDown(node *nodeImpl, term int64, wakeupCandidate bool, status entity.St
 		node.replicatorGroup.stopAll()
 	}
 	if node.stopTransferArg != nil {
-		if node.transferFuture != nil {
-			node.transferFuture.Cancel()
+		if node.transferTimer != nil {
+			node.transferTimer.Stop()
 		}
 		node.stopTransferArg = nil
+		node.transferTimer = nil
 	}
-	if !node.IsLearner() {
+	if !node.isLearner() {
 		node.raftNodeJobMgn.startJob(JobForElection)
 	} else {
 		utils.RaftLog.Info("node %s is a learner, election timer is not started.", node.nodeID.GetDesc())
 	}
+	return true
 }
 
 func becomeLeader(node *nodeImpl) {
@@ -642,6 +800,10 @@ func becomeLeader(node *nodeImpl) {
 	node.state = StateLeader
 	node.leaderID = node.serverID.Copy()
 	node.replicatorGroup.resetTerm(node.currTerm)
+	// 定期检查自己是否还能联系上半数以上的节点，处于少数派的网络分区中时主动降级
+	node.raftNodeJobMgn.startJob(JobForStepDown)
+	// 新的任期内 Leader 的日志从 lastLogIndex + 1 开始等待投票
+	node.ballotBox.RestPendingIndex(node.logManager.GetLastLogIndex() + 1)
 
 	node.conf.ListPeers().Range(func(value interface{}) {
 		peer := value.(entity.PeerId)
@@ -652,8 +814,24 @@ func becomeLeader(node *nodeImpl) {
 			utils.RaftLog.Error("fail to add a replicator, peer %s, err %s", peer.GetDesc(), err)
 		}
 	})
+	// Learner 的复制者只复制日志，它们的响应不会推进 Ballot
+	node.conf.ListLearners().Range(func(value interface{}) {
+		learner := value.(entity.PeerId)
+		if success, err := node.replicatorGroup.AddReplicator(learner, ReplicatorLearner, true); !success || err != nil {
+			utils.RaftLog.Error("fail to add a replicator, learner %s, err %s", learner.GetDesc(), err)
+		}
+	})
+	// 每一个新的任期都先写入一条当前任期的配置日志：它提交之后 ReadIndex 才能确认 committedIndex 属于当前任期，
+	// 上一任 Leader 停在 joint 阶段的成员变更也由它继续完成，ResetPeers 覆盖的配置同样借此写入日志
+	node.confCtx.flush(node.conf.GetConf(), node.conf.GetOldConf())
 }
 
 func doSnapshot(node *nodeImpl, done Closure) {
-
+	if node.snapshotExecutor != nil {
+		node.snapshotExecutor.DoSnapshot(done)
+		return
+	}
+	if done != nil {
+		done.Run(entity.NewStatus(entity.EINVAL, "Snapshot is not supported"))
+	}
 }
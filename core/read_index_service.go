@@ -11,9 +11,11 @@ import (
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/jjeffcaii/reactor-go/mono"
 
 	"github.com/pole-group/lraft/entity"
 	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/rpc"
 	"github.com/pole-group/lraft/utils"
 )
 
@@ -51,7 +53,7 @@ type ReadOnlyOperator struct {
 	node                *nodeImpl
 	replicatorGroup     *ReplicatorGroup
 	raftClientOperator  *RaftClientOperator
-	pendingNotifyStatus *utils.TreeMap // <Long, List<*ReadIndexStatus>>
+	pendingNotifyStatus map[int64]*list.List // <readIndex, List<*ReadIndexStatus>>
 	shutdownWait        *sync.WaitGroup
 }
 
@@ -60,9 +62,17 @@ func (rop *ReadOnlyOperator) addRequest(reqCtx []byte, done *ReadIndexClosure) {
 		done.Run(entity.NewStatus(entity.ENodeShutdown, "node was stopped"))
 		return
 	}
+	rop.rwLock.RLock()
+	raftErr := rop.err
+	rop.rwLock.RUnlock()
+	if raftErr != nil {
+		done.SetResult(InvalidLogIndex, reqCtx)
+		done.Run(raftErr.Status)
+		return
+	}
 	retryCnt := 3
 	for i := 0; i < retryCnt; i++ {
-		success, err := utils.PublishEventNonBlock(&ReadIndexEvent{
+		success, err := rop.node.eventBus.PublishEventNonBlock(&ReadIndexEvent{
 			reqCtx:    reqCtx,
 			done:      done,
 			startTime: time.Now(),
@@ -86,35 +96,21 @@ func (rop *ReadOnlyOperator) OnApplied(lastAppliedLogIndex int64) () {
 	defer func() {
 		rop.rwLock.Unlock()
 		if notifyList.Len() != 0 {
-			ele := notifyList.Front()
-			for {
-				if ele == nil {
-					break
-				}
-				status := ele.Value.(*ReadIndexStatus)
-				rop.notifySuccess(*status)
+			for ele := notifyList.Front(); ele != nil; ele = ele.Next() {
+				rop.notifySuccess(*ele.Value.(*ReadIndexStatus))
 			}
 		}
 	}()
 
-	//因为涉及 TreeMap 的数据查询以及删除，因此这里需要加上 WriteLock
+	//因为涉及 pendingNotifyStatus 的数据查询以及删除，因此这里需要加上 WriteLock
 	rop.rwLock.Lock()
-	if rop.pendingNotifyStatus.IsEmpty() {
-		return
-	}
-	rop.pendingNotifyStatus.RangeLessThan(lastAppliedLogIndex, func(k, v interface{}) {
-		statusList := v.(*list.List)
-		ele := statusList.Front()
-		for {
-			if ele == nil {
-				break
-			}
-			status := ele.Value.(*ReadIndexStatus)
-			notifyList.PushBack(ele.Value)
-			ele = ele.Next()
-			rop.pendingNotifyStatus.RemoveKey(status.Index)
+	for index, statusList := range rop.pendingNotifyStatus {
+		if index > lastAppliedLogIndex {
+			continue
 		}
-	})
+		notifyList.PushBackList(statusList)
+		delete(rop.pendingNotifyStatus, index)
+	}
 
 	if rop.err != nil {
 		rop.resetPendingStatusError(rop.err.Status)
@@ -135,23 +131,34 @@ func (rop *ReadOnlyOperator) notifySuccess(status ReadIndexStatus) {
 	}
 }
 
-func (rop *ReadOnlyOperator) resetPendingStatusError(st entity.Status) {
+//setError 节点出错之后，所有等待中的 read-index 请求都以该错误结束，之后的请求也会直接失败
+func (rop *ReadOnlyOperator) setError(err entity.RaftError) {
 	defer rop.rwLock.Unlock()
 	rop.rwLock.Lock()
-	rop.pendingNotifyStatus.RangeEntry(func(k, v interface{}) {
-		status := v.(*ReadIndexStatus)
-		nowTime := time.Now()
-		states := status.States
-		for _, state := range states {
-			done := state.Done
-			if done != nil {
-				//TODO metrics 记录每一个 read-index 从请求开始到可以处理的时间信息
-				utils.RaftLog.Debug("read-index : %s", nowTime.Sub(state.startTime))
-				done.Run(st)
+	if rop.err == nil {
+		rop.err = &err
+	}
+	rop.resetPendingStatusError(err.Status)
+}
+
+//resetPendingStatusError 以 st 结束所有等待中的 read-index 请求，调用时需要持有 rwLock
+func (rop *ReadOnlyOperator) resetPendingStatusError(st entity.Status) {
+	nowTime := time.Now()
+	// pendingNotifyStatus 中每一个 readIndex 对应一个 *list.List，其中是等待在该 readIndex 上的 ReadIndexStatus
+	for index, statusList := range rop.pendingNotifyStatus {
+		for ele := statusList.Front(); ele != nil; ele = ele.Next() {
+			for _, state := range ele.Value.(*ReadIndexStatus).States {
+				done := state.Done
+				if done != nil {
+					//TODO metrics 记录每一个 read-index 从请求开始到可以处理的时间信息
+					utils.RaftLog.Debug("read-index : %s", nowTime.Sub(state.startTime))
+					done.SetResult(InvalidLogIndex, state.reqCtx)
+					done.Run(st)
+				}
 			}
 		}
-	})
-	rop.pendingNotifyStatus.Clear()
+		delete(rop.pendingNotifyStatus, index)
+	}
 }
 
 func (rop *ReadOnlyOperator) handleReadIndexRequest(req *raft.ReadIndexRequest, done *ReadIndexResponseClosure) {
@@ -189,7 +196,7 @@ func (rop *ReadOnlyOperator) readLeader(req *raft.ReadIndexRequest, done *ReadIn
 	quorum := n.GetQuorum()
 	if quorum <= 1 {
 		done.Resp = &raft.ReadIndexResponse{
-			Index:   n.ballotBox.lastCommittedIndex,
+			Index:   n.ballotBox.GetLastCommittedIndex(),
 			Success: true,
 		}
 		done.Run(entity.StatusOK())
@@ -198,7 +205,7 @@ func (rop *ReadOnlyOperator) readLeader(req *raft.ReadIndexRequest, done *ReadIn
 
 	resp := &raft.ReadIndexResponse{}
 
-	lastCommittedIndex := n.ballotBox.lastCommittedIndex
+	lastCommittedIndex := n.ballotBox.GetLastCommittedIndex()
 	if logMgn.GetTerm(lastCommittedIndex) != n.currTerm {
 		done.Run(entity.NewStatus(entity.EAGAIN,
 			fmt.Sprintf("ReadIndex request rejected because leader has not committed any log entry at its term, "+
@@ -207,6 +214,7 @@ func (rop *ReadOnlyOperator) readLeader(req *raft.ReadIndexRequest, done *ReadIn
 	}
 
 	resp.Index = lastCommittedIndex
+	// 只有 Follower 转发过来的请求才会携带 PeerId，Leader 自己的请求不需要检查
 	if req.PeerID != "" {
 		peer := entity.PeerId{}
 		peer.Parse(req.PeerID)
@@ -215,10 +223,6 @@ func (rop *ReadOnlyOperator) readLeader(req *raft.ReadIndexRequest, done *ReadIn
 				req.PeerID, n.conf)))
 			return
 		}
-	} else {
-		// 如果请求没有携带 PeerId 的信息，认为该请求是错误的，有问题的
-		done.Run(entity.NewStatus(entity.ERequest, fmt.Sprintf("ReadIndexRequest must be have Peer info")))
-		return
 	}
 
 	readOnlyOpt := n.raftOptions.ReadOnlyOpt
@@ -244,7 +248,7 @@ func (rop *ReadOnlyOperator) readLeader(req *raft.ReadIndexRequest, done *ReadIn
 			if peer.Equal(n.serverID) {
 				continue
 			}
-			n.replicatorGroup.sendHeartbeat(peer, &heartbeatDone.AppendEntriesResponseClosure)
+			n.replicatorGroup.sendHeartbeat(peer, heartbeatDone.newHeartbeatClosure())
 		}
 	}
 }
@@ -258,7 +262,10 @@ func (rop *ReadOnlyOperator) readFollower(req *raft.ReadIndexRequest, done *Read
 	}
 	req.PeerID = n.leaderID.GetDesc()
 
-	rop.raftClientOperator.ReadIndex(n.leaderID.GetEndpoint(), req, done)
+	leaderEndpoint := n.leaderID.GetEndpoint()
+	sendAsync(&done.RpcResponseClosure, func() mono.Mono {
+		return rop.raftClientOperator.ReadIndex(leaderEndpoint, req, done)
+	})
 }
 
 type ReadIndexEvent struct {
@@ -282,7 +289,6 @@ type ReadIndexEventSubscriber struct {
 	rop        *ReadOnlyOperator
 	batchEvent []*ReadIndexEvent
 	batchSize  int32
-	cursor     int32
 }
 
 func (res *ReadIndexEventSubscriber) OnEvent(event utils.Event, endOfBatch bool) {
@@ -293,12 +299,10 @@ func (res *ReadIndexEventSubscriber) OnEvent(event utils.Event, endOfBatch bool)
 		e.shutdownWait.Done()
 		return
 	}
-	res.batchEvent[res.cursor] = e
-	res.cursor++
-	if res.cursor >= res.batchSize || endOfBatch {
+	res.batchEvent = append(res.batchEvent, e)
+	if int32(len(res.batchEvent)) >= res.batchSize || endOfBatch {
 		res.execReadIndexEvent(res.batchEvent)
-		res.batchEvent = make([]*ReadIndexEvent, res.batchSize, res.batchSize)
-		res.cursor = 0
+		res.batchEvent = make([]*ReadIndexEvent, 0, res.batchSize)
 	}
 }
 
@@ -338,16 +342,40 @@ type ReadIndexResponseClosure struct {
 	states            []*ReadIndexState
 	req               *raft.ReadIndexRequest
 	readIndexOperator *ReadOnlyOperator
+	rpcDone           *RpcRequestClosure
 }
 
 func NewReadIndexResponseClosure(states []*ReadIndexState, req *raft.ReadIndexRequest) *ReadIndexResponseClosure {
-	return &ReadIndexResponseClosure{
+	rrc := &ReadIndexResponseClosure{
 		states: states,
 		req:    req,
 	}
+	// Follower 将请求转发给 Leader 时，Leader 的响应通过 RpcResponseClosure 回调回来
+	rrc.F = func(resp proto.Message, status entity.Status) {
+		rrc.Run(status)
+	}
+	return rrc
+}
+
+//newReadIndexRpcResponseClosure 其他节点转发过来的 ReadIndexRequest，确认了 readIndex 之后直接回复请求方，
+//由请求方自己等待状态机 apply 到 readIndex
+func newReadIndexRpcResponseClosure(req *raft.ReadIndexRequest, done *RpcRequestClosure) *ReadIndexResponseClosure {
+	rrc := NewReadIndexResponseClosure(nil, req)
+	rrc.rpcDone = done
+	return rrc
 }
 
 func (rrc *ReadIndexResponseClosure) Run(status entity.Status) {
+	if rrc.rpcDone != nil {
+		resp, ok := rrc.Resp.(*raft.ReadIndexResponse)
+		if !status.IsOK() || !ok {
+			resp = &raft.ReadIndexResponse{
+				ErrorResponse: entity.NewErrorResponse(status.GetCode(), "%s", status.GetMsg()),
+			}
+		}
+		rrc.rpcDone.SendProtoResponse(rpc.CoreReadIndexRequest, resp)
+		return
+	}
 	if !status.IsOK() {
 		rrc.notifyFail(status)
 		return
@@ -381,9 +409,13 @@ func (rrc *ReadIndexResponseClosure) Run(status entity.Status) {
 		rrc.readIndexOperator.notifySuccess(readIndexStatus)
 		return
 	} else {
-		rrc.readIndexOperator.pendingNotifyStatus.ComputeIfAbsent(readIndexStatus.Index, func() interface{} {
-			return list.New()
-		}).(*list.List).PushBack(readIndexStatus)
+		pending := rrc.readIndexOperator.pendingNotifyStatus
+		statusList, ok := pending[readIndexStatus.Index]
+		if !ok {
+			statusList = list.New()
+			pending[readIndexStatus.Index] = statusList
+		}
+		statusList.PushBack(&readIndexStatus)
 	}
 
 }
@@ -402,7 +434,7 @@ func (rrc *ReadIndexResponseClosure) notifyFail(status entity.Status) {
 }
 
 type readIndexHeartbeatResponseClosure struct {
-	AppendEntriesResponseClosure
+	lock               sync.Mutex
 	readIndexResp      *raft.ReadIndexResponse
 	closure            *ReadIndexResponseClosure
 	quorum             int32
@@ -413,9 +445,10 @@ type readIndexHeartbeatResponseClosure struct {
 }
 
 //NewReadIndexHeartbeatResponseClosure readIndexResp 不涉及网络传输，根据从 Leader 返回的 AppendEntriesResponse 信息决定 readIndexResp
-//的内容是什么
+//的内容是什么。多个 Follower 的心跳响应会并发回调，只有确认了半数以上的节点仍然认可自己，或者失败的节点数量已经使得
+//不可能再凑够半数时才结束，不能因为第一个到达的失败响应就判定读失败
 func NewReadIndexHeartbeatResponseClosure(done *ReadIndexResponseClosure, readIndexResp *raft.ReadIndexResponse, quorum, peerSize int32) *readIndexHeartbeatResponseClosure {
-	rhc := &readIndexHeartbeatResponseClosure{
+	return &readIndexHeartbeatResponseClosure{
 		readIndexResp:      readIndexResp,
 		closure:            done,
 		quorum:             quorum,
@@ -424,38 +457,50 @@ func NewReadIndexHeartbeatResponseClosure(done *ReadIndexResponseClosure, readIn
 		ackFailures:        0,
 		isDone:             false,
 	}
+}
 
-	rhc.AppendEntriesResponseClosure = AppendEntriesResponseClosure{
-		RpcResponseClosure{
-			F: func(resp proto.Message, status entity.Status) {
-				if rhc.isDone {
-					return
-				}
-				if status.IsOK() && resp.(*raft.AppendEntriesResponse).Success {
-					rhc.ackSuccess++
-				} else {
-					rhc.ackFailures++
-				}
-				_, err := utils.RequireNonNil(rhc.readIndexResp, "ReadIndexResponse")
-				if err != nil {
-					rhc.closure.Run(entity.NewStatus(entity.EInternal, err.Error()))
-					return
-				}
-				if rhc.ackSuccess+1 >= rhc.quorum {
-					rhc.readIndexResp.Success = true
-				} else if rhc.ackFailures >= rhc.failPeersThreshold {
-					rhc.readIndexResp.Success = false
-				}
-				rhc.closure.Resp = rhc.readIndexResp
-				rhc.closure.Run(entity.StatusOK())
-				rhc.isDone = true
-			},
-		},
+//newHeartbeatClosure 每个 Follower 的心跳都需要单独的 AppendEntriesResponseClosure，sendAsync 会改写 closure 的 F
+//并且保证只执行一次，多个心跳共用一个 closure 时只有第一个响应会被统计
+func (rhc *readIndexHeartbeatResponseClosure) newHeartbeatClosure() *AppendEntriesResponseClosure {
+	done := &AppendEntriesResponseClosure{}
+	done.F = func(resp proto.Message, status entity.Status) {
+		rhc.onHeartbeatReturn(resp, status)
 	}
+	return done
+}
 
-	return rhc
+func (rhc *readIndexHeartbeatResponseClosure) onHeartbeatReturn(resp proto.Message, status entity.Status) {
+	if !rhc.countAck(resp, status) {
+		return
+	}
+	if _, err := utils.RequireNonNil(rhc.readIndexResp, "ReadIndexResponse"); err != nil {
+		rhc.closure.Run(entity.NewStatus(entity.EInternal, err.Error()))
+		return
+	}
+	rhc.closure.Resp = rhc.readIndexResp
+	rhc.closure.Run(entity.StatusOK())
 }
 
-func (rhc *readIndexHeartbeatResponseClosure) Run(status entity.Status) {
-	rhc.RpcResponseClosure.Run(status)
+//countAck 统计一个心跳的响应，返回 true 表示这次响应使得读请求有了结果，需要通知 closure
+func (rhc *readIndexHeartbeatResponseClosure) countAck(resp proto.Message, status entity.Status) bool {
+	defer rhc.lock.Unlock()
+	rhc.lock.Lock()
+	if rhc.isDone {
+		return false
+	}
+	if appendResp, ok := resp.(*raft.AppendEntriesResponse); status.IsOK() && ok && appendResp.Success {
+		rhc.ackSuccess++
+	} else {
+		rhc.ackFailures++
+	}
+	// Leader 自己也算作一票
+	if rhc.ackSuccess+1 >= rhc.quorum {
+		rhc.readIndexResp.Success = true
+	} else if rhc.ackFailures >= rhc.failPeersThreshold {
+		rhc.readIndexResp.Success = false
+	} else {
+		return false
+	}
+	rhc.isDone = true
+	return true
 }
@@ -5,12 +5,17 @@
 package core
 
 import (
+	"bytes"
+	"container/heap"
 	"container/list"
+	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/jjeffcaii/reactor-go/mono"
 	polerpc "github.com/pole-group/pole-rpc"
 
 	"github.com/pole-group/lraft/entity"
@@ -84,8 +89,8 @@ func (ifl *InFlight) IsSendingLogEntries() bool {
 
 type RpcResponse struct {
 	status      entity.Status
-	req         *proto.Message
-	resp        *proto.Message
+	req         proto.Message
+	resp        proto.Message
 	rpcSendTime int64
 	seq         int64
 	reqType     RequestType
@@ -95,6 +100,34 @@ func (rp *RpcResponse) Compare(other *RpcResponse) int {
 	return int(rp.seq - other.seq)
 }
 
+//rpcResponseQueue 按照 seq 从小到大排列的响应队列，实现了 heap.Interface
+type rpcResponseQueue []*RpcResponse
+
+func (q rpcResponseQueue) Len() int {
+	return len(q)
+}
+
+func (q rpcResponseQueue) Less(i, j int) bool {
+	return q[i].Compare(q[j]) < 0
+}
+
+func (q rpcResponseQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *rpcResponseQueue) Push(x interface{}) {
+	*q = append(*q, x.(*RpcResponse))
+}
+
+func (q *rpcResponseQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	v := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return v
+}
+
 //Replicator 这个对象本身，是一个临界资源，log的发送要是竞争的
 type Replicator struct {
 	lock                   sync.Locker
@@ -116,22 +149,30 @@ type Replicator struct {
 	waitId                 int64
 	rpcInFly               *InFlight
 	inFlights              list.List // <*InFlight>
+	inFlightBytes          int64
+	pendingResponses       rpcResponseQueue
 	options                *replicatorOptions
 	raftOptions            RaftOptions
+	reader                 SnapshotReader
 	heartbeatInFly         polerpc.Future
 	timeoutNowInFly        polerpc.Future
+	heartbeatTimer         utils.Timer
+	blockTimer             utils.Timer
+	catchUpClosure         *CatchUpClosure
 	destroy                bool
-	futures                *polerpc.ConcurrentSlice
 }
 
 func NewReplicator(opts *replicatorOptions, raftOpts RaftOptions) *Replicator {
+	if opts.clock == nil {
+		opts.clock = utils.SystemClock
+	}
 	return &Replicator{
 		lock:         &sync.Mutex{},
 		options:      opts,
 		raftOptions:  raftOpts,
 		nextIndex:    opts.logMgn.GetLastLogIndex() + 1,
 		raftOperator: opts.raftRpcOperator,
-		futures:      &polerpc.ConcurrentSlice{},
+		waitId:       -1,
 	}
 }
 
@@ -142,15 +183,35 @@ func (r *Replicator) Start() (bool, error) {
 	}
 	r.lock.Lock()
 	notifyReplicatorStatusListener(r, ReplicatorCreatedEvent, entity.NewEmptyStatus())
-	utils.RaftLog.Info("replicator=%#v@%s is started", r, r.options.peerId.GetDesc())
-	r.lastRpcSendTimestamp = utils.GetCurrentTimeMs()
-	r.startHeartbeat(utils.GetCurrentTimeMs())
+	utils.RaftLog.Info("replicator %s is started, nextIndex=%d", r.options.peerId.GetDesc(), r.nextIndex)
+	r.lastRpcSendTimestamp = r.options.clock.NowMs()
+	r.startHeartbeat(r.options.clock.NowMs())
 	r.sendEmptyEntries(false, nil)
 	return true, nil
 }
 
+//Stop 停止 Replicator，取消所有在途的请求以及定时任务
 func (r *Replicator) Stop() {
+	r.setError(entity.EStop)
+}
 
+func (r *Replicator) getLastRpcSendTimestamp() int64 {
+	defer r.lock.Unlock()
+	r.lock.Lock()
+	return r.lastRpcSendTimestamp
+}
+
+func (r *Replicator) getReplicatorType() ReplicatorType {
+	defer r.lock.Unlock()
+	r.lock.Lock()
+	return r.options.replicatorType
+}
+
+//setReplicatorType Learner 提升为 Follower 之后，它的响应才会计入 Ballot
+func (r *Replicator) setReplicatorType(replicatorType ReplicatorType) {
+	defer r.lock.Unlock()
+	r.lock.Lock()
+	r.options.replicatorType = replicatorType
 }
 
 //AddInFlights
@@ -165,15 +226,19 @@ func (r *Replicator) AddInFlights(reqType RequestType, startIndex int64, cnt, si
 		future:     rpcInFly,
 	}
 	r.inFlights.PushBack(r.rpcInFly)
+	r.inFlightBytes += int64(size)
 	// TODO metrics
 }
 
-//GetNextSendIndex
+//GetNextSendIndex 返回下一次需要发送的日志索引，在途请求的数量或者字节数超过了窗口的限制时返回 -1
 func (r *Replicator) GetNextSendIndex() int64 {
 	if r.inFlights.Len() == 0 {
 		return r.nextIndex
 	}
-	if int64(r.inFlights.Len()) > r.raftOptions.MaxReplicatorInflightMs {
+	if int64(r.inFlights.Len()) >= r.raftOptions.MaxReplicatorInflightMs {
+		return -1
+	}
+	if r.raftOptions.MaxReplicatorInflightBytes > 0 && r.inFlightBytes >= r.raftOptions.MaxReplicatorInflightBytes {
 		return -1
 	}
 	if r.rpcInFly != nil && r.rpcInFly.IsSendingLogEntries() {
@@ -185,44 +250,202 @@ func (r *Replicator) GetNextSendIndex() int64 {
 //pollInFlight
 func (r *Replicator) pollInFlight() *InFlight {
 	v := r.inFlights.Front()
+	if v == nil {
+		return nil
+	}
 	r.inFlights.Remove(v)
-	return v.Value.(*InFlight)
+	inflight := v.Value.(*InFlight)
+	r.inFlightBytes -= int64(inflight.size)
+	return inflight
+}
+
+//resetInFlights 丢弃所有在途的请求，版本号加一之后，旧版本请求的响应都会被忽略
+func (r *Replicator) resetInFlights() {
+	r.version++
+	r.inFlights.Init()
+	r.inFlightBytes = 0
+	r.pendingResponses = r.pendingResponses[:0]
+	rs := r.reqSeq
+	if r.requiredNextSeq > rs {
+		rs = r.requiredNextSeq
+	}
+	r.reqSeq = rs
+	r.requiredNextSeq = rs
+	r.rpcInFly = nil
+}
+
+func (r *Replicator) setState(state ReplicatorState) {
+	atomic.StoreInt32((*int32)(&r.state), int32(state))
 }
 
-//startHeartbeat 当
+func (r *Replicator) getState() ReplicatorState {
+	return ReplicatorState(atomic.LoadInt32((*int32)(&r.state)))
+}
+
+//startHeartbeat 在 startMs + dynamicHeartBeatTimeoutMs 时刻触发一次心跳，心跳的响应返回之后再开启下一次
 func (r *Replicator) startHeartbeat(startMs int64) {
 	dueTime := startMs + int64(r.options.dynamicHeartBeatTimeoutMs)
-	future := polerpc.DoTimerSchedule(func() {
-		// 实际这里会触发的是 sendHeartbeat 的操作
-		r.setError(entity.ETIMEDOUT)
-	}, time.Duration(dueTime)*time.Millisecond, func() time.Duration {
-		return time.Duration(dueTime) * time.Millisecond
-	})
-	r.futures.Add(future)
+	r.heartbeatTimer = r.options.clock.AfterFunc(time.Duration(dueTime-r.options.clock.NowMs())*time.Millisecond,
+		func() {
+			// 实际这里会触发的是 sendHeartbeat 的操作
+			r.setError(entity.ETIMEDOUT)
+		})
+	if r.options.heartbeatBatcher != nil {
+		r.options.heartbeatBatcher.wait(r)
+	}
 }
 
 func (r *Replicator) setError(errCode entity.RaftErrorCode) {
+	r.lock.Lock()
 	if r.destroy {
+		r.lock.Unlock()
+		return
+	}
+	onError(r, errCode)
+}
+
+//block 请求失败之后等待一段时间再重新探测 Follower，避免不停的重试，调用时需要持有锁，返回时锁已经被释放
+func (r *Replicator) block(startTimeMs int64, errCode entity.RaftErrorCode) {
+	if r.blockTimer != nil {
+		r.lock.Unlock()
 		return
 	}
+	dueTime := startTimeMs + int64(r.options.dynamicHeartBeatTimeoutMs)
+	utils.RaftLog.Debug("blocking %s for %d ms, errCode %d", r.options.peerId.GetDesc(),
+		r.options.dynamicHeartBeatTimeoutMs, errCode)
+	r.blockTimer = r.options.clock.AfterFunc(time.Duration(dueTime-r.options.clock.NowMs())*time.Millisecond,
+		func() {
+			r.continueSending(entity.ETIMEDOUT)
+		})
+	r.statInfo.runningState = Blocking
+	r.lock.Unlock()
+}
+
+//continueSending 等待新日志或者 block 超时之后继续发送
+func (r *Replicator) continueSending(errCode entity.RaftErrorCode) {
 	r.lock.Lock()
 	if r.destroy {
 		r.lock.Unlock()
 		return
 	}
-	onError(r, errCode)
+	r.waitId = -1
+	switch errCode {
+	case entity.ETIMEDOUT:
+		r.blockTimer = nil
+		r.sendEmptyEntries(false, nil)
+	case entity.EStop:
+		r.lock.Unlock()
+	default:
+		r.sendEntries()
+	}
+}
+
+//OnNewLog LogManager 中有新的日志写入时触发
+func (r *Replicator) OnNewLog(arg interface{}, errCode int32) {
+	r.continueSending(entity.RaftErrorCode(errCode))
+}
+
+//waitMoreEntries 没有可以发送的日志了，注册到 LogManager 中等待新日志的到来，返回时锁已经被释放
+func (r *Replicator) waitMoreEntries(nextWaitIndex int64) {
+	defer r.lock.Unlock()
+	if r.waitId >= 0 {
+		return
+	}
+	r.waitId = r.options.logMgn.Wait(nextWaitIndex-1, r, nil)
+	r.statInfo.runningState = Idle
 }
 
 //installSnapshot 告诉Follower，需要从自己这里拉取snapshot然后在Follower上进行snapshot的load, 因为从 Replicator 内部记录的日志索引
-//信息得出，当前的 Replicator 复制 Leader 的日志已经过慢了，
+//信息得出，当前的 Replicator 复制 Leader 的日志已经过慢了，需要的日志已经被压缩掉了。调用时需要持有锁，返回时锁已经被释放
 func (r *Replicator) installSnapshot() {
+	if r.getState() == ReplicatorSnapshot {
+		utils.RaftLog.Warn("replicator %s is installing snapshot, ignore the new request.", r.options.peerId.GetDesc())
+		r.lock.Unlock()
+		return
+	}
+	r.releaseReader()
+	if r.options.snapshotStorage != nil {
+		r.reader = r.options.snapshotStorage.Open()
+	}
+	if r.reader == nil {
+		r.lock.Unlock()
+		r.reportError(entity.EIO, "Fail to open snapshot")
+		return
+	}
+	uri := r.reader.GenerateURIForCopy()
+	if uri == "" {
+		r.releaseReader()
+		r.lock.Unlock()
+		r.reportError(entity.EIO, "Fail to generate uri for snapshot reader")
+		return
+	}
+	meta := r.reader.Load()
+	if meta == nil {
+		path := r.reader.GetPath()
+		r.releaseReader()
+		r.lock.Unlock()
+		r.reportError(entity.EIO, "Fail to load meta from %s", path)
+		return
+	}
+
+	opt := r.options
+	req := &raft.InstallSnapshotRequest{
+		Term:     opt.term,
+		GroupID:  opt.groupID,
+		ServerID: opt.serverId.GetDesc(),
+		PeerID:   opt.peerId.GetDesc(),
+		Meta:     meta,
+		Uri:      uri,
+	}
+	r.statInfo.runningState = InstallingSnapshot
+	r.statInfo.lastLogIncluded = meta.LastIncludedIndex
+	r.statInfo.lastTermIncluded = meta.LastIncludedTerm
+	r.setState(ReplicatorSnapshot)
+	r.installSnapshotCounter++
+	sendTime := r.options.clock.NowMs()
+	stateVersion := r.version
+	reqSeq := r.getAndIncrementReqSeq()
+
+	done := &InstallSnapshotResponseClosure{}
+	done.F = func(resp proto.Message, status entity.Status) {
+		r.onRpcReturn(RequestTypeForSnapshot, status, req, resp, reqSeq, stateVersion, sendTime)
+	}
+	future := sendAsync(&done.RpcResponseClosure, func() mono.Mono {
+		return r.raftOperator.InstallSnapshot(opt.peerId.GetEndpoint(), req, done)
+	})
+	r.AddInFlights(RequestTypeForSnapshot, meta.LastIncludedIndex+1, 0, 0, reqSeq, future)
+	utils.RaftLog.Info("node %s send InstallSnapshotRequest to %s term %d lastIncludedIndex %d",
+		opt.serverId.GetDesc(), opt.peerId.GetDesc(), opt.term, meta.LastIncludedIndex)
+	r.lock.Unlock()
+}
+
+func (r *Replicator) releaseReader() {
+	if r.reader != nil {
+		r.reader.Close()
+		r.reader = nil
+	}
+}
 
+//reportError 不能在持有 Replicator 锁的时候调用，node 的 onError 需要获取 node 的锁
+func (r *Replicator) reportError(code entity.RaftErrorCode, format string, args ...interface{}) {
+	st := entity.NewEmptyStatus()
+	st.SetError(code, format, args...)
+	utils.RaftLog.Error("replicator %s got error: %s", r.options.peerId.GetDesc(), st.GetMsg())
+	if node := r.options.node; node != nil {
+		polerpc.Go(context.Background(), func(ctx context.Context) {
+			node.onError(entity.RaftError{
+				ErrType: raft.ErrorType_ErrorTypeSnapshot,
+				Status:  st,
+			})
+		})
+	}
 }
 
-//sendEmptyEntries 发送一个空的LogEntry，用于心跳或者探测
+//sendEmptyEntries 发送一个空的LogEntry，用于心跳或者探测，调用时需要持有锁，返回时锁已经被释放
 func (r *Replicator) sendEmptyEntries(isHeartbeat bool, heartbeatClosure *AppendEntriesResponseClosure) {
 	req := &raft.AppendEntriesRequest{}
-	if r.fillCommonFields(req, r.nextIndex-1, isHeartbeat) {
+	if !r.fillCommonFields(req, r.nextIndex-1, isHeartbeat) {
+		// prevLogIndex 对应的日志已经被压缩掉了，只能通过安装快照的方式让 Follower 追上
 		r.installSnapshot()
 		return
 	}
@@ -231,69 +454,647 @@ func (r *Replicator) sendEmptyEntries(isHeartbeat bool, heartbeatClosure *Append
 		r.lock.Unlock()
 	}()
 
-	var heartbeatDone *AppendEntriesResponseClosure
-	sendTime := time.Now()
+	endpoint := r.options.peerId.GetEndpoint()
+	sendTime := r.options.clock.NowMs()
 	if isHeartbeat {
 		r.heartbeatCounter++
-		heartbeatDone = utils.IF(heartbeatClosure == nil, &AppendEntriesResponseClosure{RpcResponseClosure{F: func(resp proto.Message, status entity.Status) {
-			r.onHeartbeatReqReturn(status, heartbeatClosure.Resp.(*raft.AppendEntriesResponse), sendTime)
-		}}}, heartbeatClosure).(*AppendEntriesResponseClosure)
-
-		r.heartbeatInFly = polerpc.NewMonoFuture(r.raftOperator.AppendEntries(r.options.peerId.GetEndpoint(), req,
-			heartbeatDone))
+		heartbeatDone := heartbeatClosure
+		if heartbeatDone == nil {
+			heartbeatDone = &AppendEntriesResponseClosure{}
+			heartbeatDone.F = func(resp proto.Message, status entity.Status) {
+				r.onHeartbeatReqReturn(status, resp, sendTime)
+			}
+		}
+		r.heartbeatInFly = sendAsync(&heartbeatDone.RpcResponseClosure, func() mono.Mono {
+			return r.raftOperator.AppendEntries(endpoint, req, heartbeatDone)
+		})
 	} else {
 		req.Data = utils.EmptyBytes
 		r.statInfo.runningState = AppendingEntries
 		r.statInfo.firstLogIndex = r.nextIndex
 		r.statInfo.lastLogIncluded = r.nextIndex - 1
 		r.appendEntriesCounter++
-		atomic.StoreInt32((*int32)(&r.state), int32(ReplicatorProbe))
+		r.setState(ReplicatorProbe)
 		stateVersion := r.version
 		reqSeq := r.getAndIncrementReqSeq()
 
-		m := r.raftOperator.AppendEntries(r.options.peerId.GetEndpoint(), req,
-			&AppendEntriesResponseClosure{RpcResponseClosure{
-				F: func(resp proto.Message, status entity.Status) {
-					r.onRpcReturn(RequestTypeForAppendEntries, status, req, resp, reqSeq, stateVersion, sendTime)
-				},
-			}})
-		// 创建一个MonoFuture时，内部会自动做一个Subscribe(context.Context)的操作
-		future := polerpc.NewMonoFuture(m)
+		done := &AppendEntriesResponseClosure{}
+		done.F = func(resp proto.Message, status entity.Status) {
+			r.onRpcReturn(RequestTypeForAppendEntries, status, req, resp, reqSeq, stateVersion, sendTime)
+		}
+		future := sendAsync(&done.RpcResponseClosure, func() mono.Mono {
+			return r.raftOperator.AppendEntries(endpoint, req, done)
+		})
 		r.AddInFlights(RequestTypeForAppendEntries, r.nextIndex, 0, 0, reqSeq, future)
 	}
-	utils.RaftLog.Debug("node %s send HeartbeatRequest to %s term %s lastCommittedIndex %d",
-		r.options.node.nodeID.GetDesc(), r.options.peerId.GetDesc(), r.options.term, req.CommittedIndex)
+	utils.RaftLog.Debug("node %s send HeartbeatRequest to %s term %d lastCommittedIndex %d",
+		r.options.serverId.GetDesc(), r.options.peerId.GetDesc(), r.options.term, req.CommittedIndex)
 }
 
-func (r *Replicator) onRpcReturn(reqType RequestType, status entity.Status, req, resp proto.Message,
-	seq int64, stateVersion int32, rpcSendTime time.Time) {
-
+//sendEntries 在窗口允许的范围内尽可能多的发送日志，调用时需要持有锁，返回时锁已经被释放
+func (r *Replicator) sendEntries() {
+	prevSendIndex := int64(-1)
+	for {
+		nextSendingIndex := r.GetNextSendIndex()
+		if nextSendingIndex <= prevSendIndex {
+			break
+		}
+		if !r.sendNextEntries(nextSendingIndex) {
+			// 锁已经在 sendNextEntries 中被释放了
+			return
+		}
+		prevSendIndex = nextSendingIndex
+	}
+	r.lock.Unlock()
 }
 
-func (r *Replicator) sendNextEntries(nextSendingIndex int64) {
+//sendNextEntries 从 nextSendingIndex 开始打包一批日志发送给 Follower，返回 false 时表示无法继续发送，并且锁已经被释放
+func (r *Replicator) sendNextEntries(nextSendingIndex int64) bool {
 	req := new(raft.AppendEntriesRequest)
 	if !r.fillCommonFields(req, nextSendingIndex-1, false) {
+		r.installSnapshot()
+		return false
+	}
+
+	data := bytes.NewBuffer(nil)
+	for i := int32(0); i < r.raftOptions.MaxEntriesSize; i++ {
+		if !r.prepareEntry(nextSendingIndex, i, req, data) {
+			break
+		}
+	}
+	if len(req.Entries) == 0 {
+		if nextSendingIndex < r.options.logMgn.GetFirstLogIndex() {
+			r.installSnapshot()
+			return false
+		}
+		r.waitMoreEntries(nextSendingIndex)
+		return false
+	}
+	req.Data = data.Bytes()
+
+	r.appendEntriesCounter++
+	r.statInfo.runningState = AppendingEntries
+	r.statInfo.firstLogIndex = req.PrevLogIndex + 1
+	r.statInfo.lastLogIndex = req.PrevLogIndex + int64(len(req.Entries))
+	sendTime := r.options.clock.NowMs()
+	stateVersion := r.version
+	reqSeq := r.getAndIncrementReqSeq()
+
+	done := &AppendEntriesResponseClosure{}
+	done.F = func(resp proto.Message, status entity.Status) {
+		r.onRpcReturn(RequestTypeForAppendEntries, status, req, resp, reqSeq, stateVersion, sendTime)
+	}
+	endpoint := r.options.peerId.GetEndpoint()
+	future := sendAsync(&done.RpcResponseClosure, func() mono.Mono {
+		return r.raftOperator.AppendEntries(endpoint, req, done)
+	})
+	r.AddInFlights(RequestTypeForAppendEntries, nextSendingIndex, int32(len(req.Entries)), int32(len(req.Data)), reqSeq,
+		future)
+	utils.RaftLog.Debug("node %s send AppendEntriesRequest to %s term %d entries [%d, %d]",
+		r.options.serverId.GetDesc(), r.options.peerId.GetDesc(), r.options.term, r.statInfo.firstLogIndex,
+		r.statInfo.lastLogIndex)
+	return true
+}
+
+//prepareEntry 将 nextSendingIndex + offset 处的日志填充到 req 中，日志的数据追加到 data 中，超过 MaxBodySize 或者日志不存在时返回 false
+func (r *Replicator) prepareEntry(nextSendingIndex int64, offset int32, req *raft.AppendEntriesRequest,
+	data *bytes.Buffer) bool {
+	if data.Len() >= int(r.raftOptions.MaxBodySize) {
+		return false
+	}
+	logIndex := nextSendingIndex + int64(offset)
+	entry := r.options.logMgn.GetEntry(logIndex)
+	if entry == nil {
+		return false
+	}
+	em := &raft.EntryMeta{
+		Term:        entry.LogID.GetTerm(),
+		Type:        entry.LogType,
+		Checksum:    int64(entry.Checksum()),
+		Peers:       encodePeerDesc(entry.Peers),
+		OldPeers:    encodePeerDesc(entry.OldPeers),
+		Learners:    encodePeerDesc(entry.Learners),
+		OldLearners: encodePeerDesc(entry.OldLearners),
+	}
+	if entry.LogType == raft.EntryType_EntryTypeConfiguration && len(em.Peers) == 0 {
+		utils.RaftLog.Error("empty peers at logIndex=%d", logIndex)
+	}
+	if len(entry.Data) != 0 {
+		em.DataLen = int64(len(entry.Data))
+		data.Write(entry.Data)
+	}
+	req.Entries = append(req.Entries, em)
+	return true
+}
+
+func encodePeerDesc(peers []entity.PeerId) []string {
+	if len(peers) == 0 {
+		return nil
+	}
+	result := make([]string, len(peers))
+	for i, peer := range peers {
+		result[i] = peer.GetDesc()
+	}
+	return result
+}
 
+//decodePeerDesc encodePeerDesc 的逆过程，Follower 根据 EntryMeta 中的字符串还原出 PeerId
+func decodePeerDesc(peers []string) []entity.PeerId {
+	if len(peers) == 0 {
+		return nil
+	}
+	result := make([]entity.PeerId, 0, len(peers))
+	for _, s := range peers {
+		peer := entity.PeerId{}
+		if !peer.Parse(s) {
+			utils.RaftLog.Warn("fail to parse peer %s", s)
+			continue
+		}
+		result = append(result, peer)
 	}
+	return result
+}
+
+//onRpcReturn 响应返回的顺序可能和请求发送的顺序不一致，先放入 pendingResponses 中，按照 seq 从 requiredNextSeq 开始依次处理
+func (r *Replicator) onRpcReturn(reqType RequestType, status entity.Status, req, resp proto.Message,
+	seq int64, stateVersion int32, rpcSendTime int64) {
+	startTimeMs := r.options.clock.NowMs()
+	r.lock.Lock()
+	if r.destroy || stateVersion != r.version {
+		utils.RaftLog.Debug("replicator %s ignored old version response %d, current version is %d",
+			r.options.peerId.GetDesc(), stateVersion, r.version)
+		r.lock.Unlock()
+		return
+	}
+
+	heap.Push(&r.pendingResponses, &RpcResponse{
+		status:      status,
+		req:         req,
+		resp:        resp,
+		rpcSendTime: rpcSendTime,
+		seq:         seq,
+		reqType:     reqType,
+	})
+	if int64(r.pendingResponses.Len()) > r.raftOptions.MaxReplicatorInflightMs {
+		utils.RaftLog.Warn("too many pending responses %d for replicator %s, maxReplicatorInflightMsgs=%d",
+			r.pendingResponses.Len(), r.options.peerId.GetDesc(), r.raftOptions.MaxReplicatorInflightMs)
+		r.resetInFlights()
+		r.setState(ReplicatorProbe)
+		r.sendEmptyEntries(false, nil)
+		return
+	}
+
+	continueSendEntries := false
+	processed := 0
+	for r.pendingResponses.Len() > 0 {
+		queued := r.pendingResponses[0]
+		if queued.seq != r.requiredNextSeq {
+			// 前面还有请求的响应没有返回，需要等待
+			break
+		}
+		heap.Pop(&r.pendingResponses)
+		processed++
+		r.getAndIncrementRequiredNextSeq()
+
+		inflight := r.pollInFlight()
+		if inflight == nil {
+			utils.RaftLog.Debug("replicator %s ignore response because of empty inflights", r.options.peerId.GetDesc())
+			continue
+		}
+		if inflight.seq != queued.seq {
+			utils.RaftLog.Warn("replicator %s response sequence out of order, expect %d, but it is %d, "+
+				"reset state to try again.", r.options.peerId.GetDesc(), inflight.seq, queued.seq)
+			r.resetInFlights()
+			r.setState(ReplicatorProbe)
+			r.block(startTimeMs, entity.ERequest)
+			return
+		}
+
+		switch queued.reqType {
+		case RequestTypeForAppendEntries:
+			continueSendEntries = r.onAppendEntriesReturn(inflight, queued.status,
+				queued.req.(*raft.AppendEntriesRequest), queued.resp, queued.rpcSendTime, startTimeMs)
+		case RequestTypeForSnapshot:
+			continueSendEntries = r.onInstallSnapshotReqReturn(queued.status,
+				queued.req.(*raft.InstallSnapshotRequest), queued.resp, startTimeMs)
+		}
+		if !continueSendEntries {
+			// 锁已经在处理响应的时候被释放了
+			return
+		}
+	}
+	if continueSendEntries {
+		r.sendEntries()
+		return
+	}
+	r.lock.Unlock()
+}
+
+//onAppendEntriesReturn 返回 true 时表示可以继续发送日志并且仍然持有锁，返回 false 时锁已经被释放
+func (r *Replicator) onAppendEntriesReturn(inflight *InFlight, status entity.Status, req *raft.AppendEntriesRequest,
+	resp proto.Message, rpcSendTime, startTimeMs int64) bool {
+	if inflight.startIndex != req.PrevLogIndex+1 {
+		utils.RaftLog.Warn("replicator %s received invalid AppendEntriesResponse, in-flight startIndex=%d, "+
+			"request prevLogIndex=%d, reset the replicator state and probe again.", r.options.peerId.GetDesc(),
+			inflight.startIndex, req.PrevLogIndex)
+		r.resetInFlights()
+		r.setState(ReplicatorProbe)
+		r.sendEmptyEntries(false, nil)
+		return false
+	}
+
+	var appendResp *raft.AppendEntriesResponse
+	if status.IsOK() {
+		appendResp, status = parseAppendEntriesResponse(resp)
+	}
+	if !status.IsOK() {
+		r.consecutiveErrorTimes++
+		if r.consecutiveErrorTimes%10 == 0 {
+			utils.RaftLog.Warn("fail to issue RPC to %s, consecutiveErrorTimes=%d, error=%s",
+				r.options.peerId.GetDesc(), r.consecutiveErrorTimes, status.GetMsg())
+		}
+		notifyReplicatorStatusListener(r, ReplicatorErrorEvent, status)
+		r.resetInFlights()
+		r.setState(ReplicatorProbe)
+		r.block(startTimeMs, status.GetCode())
+		return false
+	}
+	r.consecutiveErrorTimes = 0
+
+	if !appendResp.Success {
+		if appendResp.Term > r.options.term {
+			r.onHigherTerm(appendResp.Term, "Leader receives higher term AppendEntriesResponse from peer:%s")
+			return false
+		}
+		if rpcSendTime > r.lastRpcSendTimestamp {
+			r.lastRpcSendTimestamp = rpcSendTime
+		}
+		r.resetInFlights()
+		// Follower 上的日志和 Leader 不匹配，回退 nextIndex 重新进行探测
+		r.nextIndex = r.backtrackNextIndex(req.PrevLogIndex, appendResp)
+		utils.RaftLog.Debug("replicator %s log mismatch, follower lastLogIndex=%d, conflictTerm=%d, "+
+			"conflictIndex=%d, probe again with nextIndex=%d", r.options.peerId.GetDesc(), appendResp.LastLogIndex,
+			appendResp.ConflictTerm, appendResp.ConflictIndex, r.nextIndex)
+		r.sendEmptyEntries(false, nil)
+		return false
+	}
+
+	if appendResp.Term != r.options.term {
+		utils.RaftLog.Warn("replicator %s received AppendEntriesResponse with term %d, current term is %d",
+			r.options.peerId.GetDesc(), appendResp.Term, r.options.term)
+		r.resetInFlights()
+		r.setState(ReplicatorProbe)
+		r.lock.Unlock()
+		return false
+	}
+	if rpcSendTime > r.lastRpcSendTimestamp {
+		r.lastRpcSendTimestamp = rpcSendTime
+	}
+	entriesSize := int64(len(req.Entries))
+	if entriesSize > 0 && r.options.replicatorType.IsFollower() {
+		// Learner 不参与日志的提交
+		r.options.ballotBox.CommitAt(req.PrevLogIndex+1, req.PrevLogIndex+entriesSize, r.options.peerId)
+	}
+	r.setState(ReplicatorReplicate)
+	r.blockTimer = nil
+	r.nextIndex += entriesSize
+	r.hasSucceeded = true
+	notifyOnCaughtUp(r, entity.SUCCESS)
+	// 等待领导权转移的 Follower 已经追上了 timeoutNowIndex
+	if r.timeoutNowIndex > 0 && r.timeoutNowIndex < r.nextIndex {
+		r.sendTimeoutNow(false)
+	}
+	return true
+}
+
+//backtrackNextIndex 根据 Follower 返回的冲突信息计算新的 nextIndex：Leader 也有 conflictTerm 的日志时，从 Leader 上该任期的
+//最后一条日志之后开始探测，否则从 Follower 上该任期的第一条日志开始探测，这样一次往返就能跳过整个任期的日志
+func (r *Replicator) backtrackNextIndex(prevLogIndex int64, resp *raft.AppendEntriesResponse) int64 {
+	var nextIndex int64
+	switch {
+	case resp.ConflictIndex > 0 && resp.ConflictTerm > 0:
+		nextIndex = resp.ConflictIndex
+		if idx := r.findLastIndexOfTerm(resp.ConflictTerm, prevLogIndex); idx > 0 {
+			nextIndex = idx + 1
+		}
+	case resp.ConflictIndex > 0:
+		nextIndex = resp.ConflictIndex
+	default:
+		// Follower 没有返回冲突信息，只能根据 lastLogIndex 逐条回退
+		nextIndex = prevLogIndex
+		if resp.LastLogIndex+1 < nextIndex {
+			nextIndex = resp.LastLogIndex + 1
+		}
+	}
+	// 至少回退一条日志，避免 Follower 返回错误的冲突信息时一直探测同一个位置
+	if nextIndex > prevLogIndex {
+		nextIndex = prevLogIndex
+	}
+	if nextIndex > resp.LastLogIndex+1 {
+		nextIndex = resp.LastLogIndex + 1
+	}
+	if nextIndex < 1 {
+		nextIndex = 1
+	}
+	return nextIndex
+}
+
+//findLastIndexOfTerm 在 Leader 的 [firstLogIndex, maxIndex] 中查找任期为 term 的最后一条日志，不存在时返回 0
+func (r *Replicator) findLastIndexOfTerm(term, maxIndex int64) int64 {
+	logMgn := r.options.logMgn
+	firstLogIndex := logMgn.GetFirstLogIndex()
+	if maxIndex < firstLogIndex {
+		return 0
+	}
+	idx := searchLogIndex(logMgn, firstLogIndex, maxIndex, func(t int64) bool {
+		return t > term
+	}) - 1
+	if idx < firstLogIndex || logMgn.GetTerm(idx) != term {
+		return 0
+	}
+	return idx
+}
+
+//searchLogIndex 日志的任期是单调不减的，在 [from, to] 中二分查找第一条任期满足 f 的日志，都不满足时返回 to + 1
+func searchLogIndex(logMgn LogManager, from, to int64, f func(term int64) bool) int64 {
+	return from + int64(sort.Search(int(to-from+1), func(i int) bool {
+		return f(logMgn.GetTerm(from + int64(i)))
+	}))
+}
+
+func parseAppendEntriesResponse(resp proto.Message) (*raft.AppendEntriesResponse, entity.Status) {
+	appendResp, ok := resp.(*raft.AppendEntriesResponse)
+	if !ok || appendResp == nil {
+		return nil, entity.NewStatus(entity.ERequest, "invalid AppendEntriesResponse")
+	}
+	if errResp := appendResp.ErrorResponse; errResp != nil && errResp.ErrorCode != int32(entity.SUCCESS) {
+		return nil, entity.NewStatus(entity.RaftErrorCode(errResp.ErrorCode), errResp.ErrorMsg)
+	}
+	return appendResp, entity.StatusOK()
+}
+
+//onHigherTerm Follower 的任期比自己的大，停止当前的 Replicator 并且让 node 降级为 Follower，调用时需要持有锁，返回时锁已经被释放
+func (r *Replicator) onHigherTerm(term int64, format string) {
+	st := entity.NewEmptyStatus()
+	st.SetError(entity.EHigherTermResponse, format, r.options.peerId.GetDesc())
+	utils.RaftLog.Warn("replicator %s receives higher term %d, current term is %d", r.options.peerId.GetDesc(),
+		term, r.options.term)
+	onError(r, entity.EStop)
+	if node := r.options.node; node != nil {
+		node.increaseTermTo(term, st)
+	}
+}
+
+//transferLeadership Follower 已经追上 logIndex 时立即发送 TimeoutNowRequest，否则等到追上之后再发送
+func (r *Replicator) transferLeadership(logIndex int64) bool {
+	defer r.lock.Unlock()
+	r.lock.Lock()
+	if r.destroy {
+		return false
+	}
+	if r.hasSucceeded && r.nextIndex > logIndex {
+		r.sendTimeoutNow(false)
+		return true
+	}
+	r.timeoutNowIndex = logIndex
+	return true
+}
+
+//stopTransferLeadership 领导权转移超时之后，Follower 追上了也不再发送 TimeoutNowRequest
+func (r *Replicator) stopTransferLeadership() {
+	defer r.lock.Unlock()
+	r.lock.Lock()
+	r.timeoutNowIndex = 0
+}
+
+//sendTimeoutNowAndStop Leader 降级时让下一个候选者立即发起选举，收到响应或者超过 timeoutMs 之后停止复制者
+func (r *Replicator) sendTimeoutNowAndStop(timeoutMs int64) {
+	r.lock.Lock()
+	if r.destroy {
+		r.lock.Unlock()
+		return
+	}
+	r.sendTimeoutNow(true)
+	r.lock.Unlock()
+	r.options.clock.AfterFunc(time.Duration(timeoutMs)*time.Millisecond, r.Stop)
+}
+
+//sendTimeoutNow 让 Follower 不再等待选举超时立即发起选举，调用时需要持有锁，返回时仍然持有锁
+func (r *Replicator) sendTimeoutNow(stopAfterFinish bool) {
+	req := &raft.TimeoutNowRequest{
+		GroupID:  r.options.groupID,
+		ServerID: r.options.serverId.GetDesc(),
+		PeerID:   r.options.peerId.GetDesc(),
+		Term:     r.options.term,
+	}
+	endpoint := r.options.peerId.GetEndpoint()
+	done := &TimeoutNowResponseClosure{}
+	done.F = func(resp proto.Message, status entity.Status) {
+		r.onTimeoutNowReturn(status, resp, stopAfterFinish)
+	}
+	r.timeoutNowInFly = sendAsync(&done.RpcResponseClosure, func() mono.Mono {
+		return r.raftOperator.TimeoutNow(endpoint, req, done)
+	})
+	r.timeoutNowIndex = 0
+	utils.RaftLog.Info("node %s send TimeoutNowRequest to %s term %d", r.options.serverId.GetDesc(),
+		r.options.peerId.GetDesc(), r.options.term)
+}
+
+func (r *Replicator) onTimeoutNowReturn(status entity.Status, resp proto.Message, stopAfterFinish bool) {
+	r.lock.Lock()
+	if r.destroy {
+		r.lock.Unlock()
+		return
+	}
+	r.timeoutNowInFly = nil
+	var timeoutNowResp *raft.TimeoutNowResponse
+	if status.IsOK() {
+		timeoutNowResp, status = parseTimeoutNowResponse(resp)
+	}
+	if !status.IsOK() {
+		utils.RaftLog.Warn("replicator %s fail to send TimeoutNowRequest : %s", r.options.peerId.GetDesc(),
+			status.GetMsg())
+		if stopAfterFinish {
+			onError(r, entity.EStop)
+			return
+		}
+		r.lock.Unlock()
+		return
+	}
+	if timeoutNowResp.Term > r.options.term {
+		r.onHigherTerm(timeoutNowResp.Term, "Leader receives higher term TimeoutNowResponse from peer:%s")
+		return
+	}
+	if stopAfterFinish {
+		onError(r, entity.EStop)
+		return
+	}
+	r.lock.Unlock()
+}
+
+func parseTimeoutNowResponse(resp proto.Message) (*raft.TimeoutNowResponse, entity.Status) {
+	timeoutNowResp, ok := resp.(*raft.TimeoutNowResponse)
+	if !ok || timeoutNowResp == nil {
+		return nil, entity.NewStatus(entity.ERequest, "invalid TimeoutNowResponse")
+	}
+	if errResp := timeoutNowResp.ErrorResponse; errResp != nil && errResp.ErrorCode != int32(entity.SUCCESS) {
+		return nil, entity.NewStatus(entity.RaftErrorCode(errResp.ErrorCode), errResp.ErrorMsg)
+	}
+	return timeoutNowResp, entity.StatusOK()
 }
 
 //sendHeartbeat
 func (r *Replicator) sendHeartbeat(closure *AppendEntriesResponseClosure) {
 	r.lock.Lock()
-	r.sendEmptyEntries(true, nil)
+	if r.destroy {
+		r.lock.Unlock()
+		if closure != nil {
+			closure.Run(entity.NewStatus(entity.EStop, "replicator is stopped"))
+		}
+		return
+	}
+	if closure == nil && r.options.heartbeatBatcher != nil {
+		r.sendBatchedHeartbeat()
+		return
+	}
+	r.sendEmptyEntries(true, closure)
+}
+
+//sendBatchedHeartbeat 定时的心跳交给 NodeManager 和其他 raft 组发往同一个 Endpoint 的心跳合并发送，
+//调用时需要持有锁，返回时锁已经被释放
+func (r *Replicator) sendBatchedHeartbeat() {
+	entry := r.newHeartbeatEntry()
+	r.lock.Unlock()
+	r.options.heartbeatBatcher.add(r, entry)
+}
+
+//pullHeartbeat 其他 raft 组发往同一个 Endpoint 的心跳发送时，提前发送自己还在等待定时器的心跳，之后两者的心跳时刻就对齐了。
+//定时器已经触发或者 Replicator 已经停止时返回 nil
+func (r *Replicator) pullHeartbeat() *raft.HeartbeatRequestEntry {
+	defer r.lock.Unlock()
+	r.lock.Lock()
+	if r.destroy || r.heartbeatTimer == nil || !r.heartbeatTimer.Stop() {
+		return nil
+	}
+	r.heartbeatTimer = nil
+	return r.newHeartbeatEntry()
+}
+
+//newHeartbeatEntry 合并心跳中不携带 prevLogIndex，只有 Follower 确认过的日志才能被提交，因此 committedIndex
+//不能超过已经复制成功的位置，调用时需要持有锁
+func (r *Replicator) newHeartbeatEntry() *raft.HeartbeatRequestEntry {
+	committedIndex := int64(0)
+	if r.getState() == ReplicatorReplicate {
+		committedIndex = r.options.ballotBox.GetLastCommittedIndex()
+		if r.nextIndex-1 < committedIndex {
+			committedIndex = r.nextIndex - 1
+		}
+	}
+	r.heartbeatCounter++
+	return &raft.HeartbeatRequestEntry{
+		GroupID:        r.options.groupID,
+		ServerID:       r.options.serverId.GetDesc(),
+		PeerID:         r.options.peerId.GetDesc(),
+		Term:           r.options.term,
+		CommittedIndex: committedIndex,
+	}
+}
+
+//onBatchedHeartbeatReturn 合并心跳中属于当前 Replicator 的响应，转换为 AppendEntriesResponse 之后和普通的心跳一样处理，
+//包括更新租约使用的 lastRpcSendTimestamp 以及开启下一次心跳
+func (r *Replicator) onBatchedHeartbeatReturn(resp *raft.HeartbeatResponseEntry, status entity.Status, sendTime int64) {
+	var heartbeatResp proto.Message
+	if status.IsOK() {
+		heartbeatResp = &raft.AppendEntriesResponse{
+			Term:          resp.Term,
+			Success:       resp.Success,
+			LastLogIndex:  resp.LastLogIndex,
+			ErrorResponse: resp.ErrorResponse,
+		}
+	}
+	r.onHeartbeatReqReturn(status, heartbeatResp, sendTime)
 }
 
 //onVoteReqReturn
 func (r *Replicator) onVoteReqReturn(resp *raft.RequestVoteResponse) {
 }
 
-//onHeartbeatReqReturn
-func (r *Replicator) onHeartbeatReqReturn(status entity.Status, resp *raft.AppendEntriesResponse, sendTime time.Time) {
+//onHeartbeatReqReturn 处理心跳的响应，并且开启下一次的心跳
+func (r *Replicator) onHeartbeatReqReturn(status entity.Status, resp proto.Message, sendTime int64) {
+	r.lock.Lock()
+	if r.destroy {
+		r.lock.Unlock()
+		return
+	}
+	var heartbeatResp *raft.AppendEntriesResponse
+	if status.IsOK() {
+		heartbeatResp, status = parseAppendEntriesResponse(resp)
+	}
+	if !status.IsOK() {
+		r.setState(ReplicatorProbe)
+		r.consecutiveErrorTimes++
+		if r.consecutiveErrorTimes%10 == 0 {
+			utils.RaftLog.Warn("fail to issue RPC to %s, consecutiveErrorTimes=%d, error=%s",
+				r.options.peerId.GetDesc(), r.consecutiveErrorTimes, status.GetMsg())
+		}
+		r.startHeartbeat(sendTime)
+		r.lock.Unlock()
+		return
+	}
+	r.consecutiveErrorTimes = 0
+	if heartbeatResp.Term > r.options.term {
+		r.onHigherTerm(heartbeatResp.Term, "Leader receives higher term heartbeat_response from peer:%s")
+		return
+	}
+	if sendTime > r.lastRpcSendTimestamp {
+		r.lastRpcSendTimestamp = sendTime
+	}
+	r.startHeartbeat(sendTime)
+	if !heartbeatResp.Success && heartbeatResp.LastLogIndex > 0 {
+		utils.RaftLog.Warn("heartbeat to peer %s failure, try to send a probe request.", r.options.peerId.GetDesc())
+		r.sendEmptyEntries(false, nil)
+		return
+	}
+	r.lock.Unlock()
 }
 
-//onInstallSnapshotReqReturn
-func (r *Replicator) onInstallSnapshotReqReturn(resp *raft.InstallSnapshotResponse) {
-
+//onInstallSnapshotReqReturn 返回 true 时表示可以继续发送日志并且仍然持有锁，返回 false 时锁已经被释放
+func (r *Replicator) onInstallSnapshotReqReturn(status entity.Status, req *raft.InstallSnapshotRequest,
+	resp proto.Message, startTimeMs int64) bool {
+	r.releaseReader()
+	success := status.IsOK()
+	if success {
+		installResp, ok := resp.(*raft.InstallSnapshotResponse)
+		switch {
+		case !ok || installResp == nil:
+			status = entity.NewStatus(entity.ERequest, "invalid InstallSnapshotResponse")
+			success = false
+		case installResp.ErrorResponse != nil && installResp.ErrorResponse.ErrorCode != int32(entity.SUCCESS):
+			status = entity.NewStatus(entity.RaftErrorCode(installResp.ErrorResponse.ErrorCode),
+				installResp.ErrorResponse.ErrorMsg)
+			success = false
+		case installResp.Term > r.options.term:
+			r.onHigherTerm(installResp.Term, "Leader receives higher term InstallSnapshotResponse from peer:%s")
+			return false
+		case !installResp.Success:
+			status = entity.NewStatus(entity.ERequest, "follower refused to install snapshot")
+			success = false
+		}
+	}
+	if !success {
+		utils.RaftLog.Warn("fail to install snapshot at peer=%s, lastIncludedIndex=%d, error=%s",
+			r.options.peerId.GetDesc(), req.Meta.LastIncludedIndex, status.GetMsg())
+		r.resetInFlights()
+		r.setState(ReplicatorProbe)
+		r.block(startTimeMs, status.GetCode())
+		return false
+	}
+	utils.RaftLog.Info("install snapshot %d to %s success", req.Meta.LastIncludedIndex, r.options.peerId.GetDesc())
+	r.nextIndex = req.Meta.LastIncludedIndex + 1
+	r.hasSucceeded = true
+	notifyOnCaughtUp(r, entity.SUCCESS)
+	r.setState(ReplicatorReplicate)
+	return true
 }
 
 func (r *Replicator) getAndIncrementReqSeq() int64 {
@@ -305,6 +1106,16 @@ func (r *Replicator) getAndIncrementReqSeq() int64 {
 	return pre
 }
 
+func (r *Replicator) getAndIncrementRequiredNextSeq() int64 {
+	pre := r.requiredNextSeq
+	r.requiredNextSeq++
+	if r.requiredNextSeq < 0 {
+		r.requiredNextSeq = 0
+	}
+	return pre
+}
+
+//fillCommonFields 填充请求的公共字段，prevLogIndex 对应的日志已经被压缩时返回 false
 func (r *Replicator) fillCommonFields(req *raft.AppendEntriesRequest, prevLogIndex int64, isHeartbeat bool) bool {
 	prevLogTerm := r.options.logMgn.GetTerm(prevLogIndex)
 	if prevLogTerm == 0 && prevLogIndex != 0 {
@@ -313,43 +1124,81 @@ func (r *Replicator) fillCommonFields(req *raft.AppendEntriesRequest, prevLogInd
 			if err := utils.RequireTrue(prevLogIndex < r.options.logMgn.GetFirstLogIndex(),
 				"prevLogIndex must be less then current log manager first logIndex which logIndex have term"+
 					" information"); err != nil {
-				// 因为RaftLog被compacted了，因此该LogIndex对应的信息都不在了，无法填充相应的信息数据
-				return false
+				utils.RaftLog.Error("replicator %s : %s", r.options.peerId.GetDesc(), err)
 			}
-		} else {
-			prevLogIndex = 0
+			// 因为RaftLog被compacted了，因此该LogIndex对应的信息都不在了，无法填充相应的信息数据
+			return false
 		}
+		// 心跳请求中 prevLogIndex 以及 prevLogTerm 都为 0，Follower 收到之后只会更新 Leader 的时间戳
+		prevLogIndex = 0
 	}
 
 	opt := r.options
 	req.Term = opt.term
 	req.GroupID = opt.groupID
 	req.ServerID = opt.serverId.GetDesc()
-	req.ServerID = opt.serverId.GetDesc()
 	req.PeerID = opt.peerId.GetDesc()
 	req.PrevLogIndex = prevLogIndex
 	req.PrevLogTerm = prevLogTerm
-	req.CommittedIndex = opt.ballotBox.lastCommittedIndex
+	req.CommittedIndex = opt.ballotBox.GetLastCommittedIndex()
 
 	return true
 }
 
-func (r *Replicator) shutdown() {
-	r.destroy = true
-	r.futures.ForEach(func(index int, v interface{}) {
-		v.(polerpc.Future).Cancel()
-	})
+//waitForCaughtUp Follower 的日志和 Leader 的差距不超过 maxMargin 时回调 done，timeout 之内没有追上时以 ETIMEDOUT 回调，
+//同一时间只能有一个等待者
+func (r *Replicator) waitForCaughtUp(maxMargin int64, timeout time.Duration, done *CatchUpClosure) {
+	defer r.lock.Unlock()
+	r.lock.Lock()
+	if r.destroy || r.catchUpClosure != nil {
+		utils.RaftLog.Error("replicator %s fail to wait for caught up, destroy=%t.", r.options.peerId.GetDesc(),
+			r.destroy)
+		runClosure(done, entity.NewStatus(entity.EINVAL, "Duplicated call or replicator is stopped"))
+		return
+	}
+	done.SetMaxMargin(maxMargin)
+	if timeout > 0 {
+		done.timer = r.options.clock.AfterFunc(timeout, func() {
+			defer r.lock.Unlock()
+			r.lock.Lock()
+			notifyOnCaughtUp(r, entity.ETIMEDOUT)
+		})
+	}
+	r.catchUpClosure = done
+	// Follower 可能已经追上了
+	notifyOnCaughtUp(r, entity.SUCCESS)
 }
 
+//notifyOnCaughtUp 日志复制成功之后检查 Follower 是否已经追上，超时或者 Replicator 停止时直接以错误回调，调用时需要持有锁
 func notifyOnCaughtUp(r *Replicator, errCode entity.RaftErrorCode) {
-
+	done := r.catchUpClosure
+	if done == nil {
+		return
+	}
+	if errCode == entity.SUCCESS {
+		if !r.hasSucceeded || r.nextIndex-1+done.maxMargin < r.options.logMgn.GetLastLogIndex() {
+			return
+		}
+	}
+	// 定时任务可能已经在等待锁，它获取到锁之后发现 catchUpClosure 已经为空会直接返回
+	if done.timer != nil && errCode != entity.ETIMEDOUT {
+		done.timer.Stop()
+	}
+	r.catchUpClosure = nil
+	done.status = entity.StatusOK()
+	if errCode != entity.SUCCESS {
+		done.status = entity.NewStatus(errCode, fmt.Sprintf("replicator %s fail to catch up, errCode=%d",
+			r.options.peerId.GetDesc(), errCode))
+	}
+	done.SetErrorWasSet(true)
+	runClosure(done, done.status)
 }
 
 func notifyReplicatorStatusListener(r *Replicator, event ReplicatorEvent, st entity.Status) {
 
 }
 
-//onError 根据异常码 errCode 处理不同的逻辑
+//onError 根据异常码 errCode 处理不同的逻辑，调用时需要持有锁，返回时锁已经被释放
 func onError(r *Replicator, errCode entity.RaftErrorCode) {
 	switch errCode {
 	case entity.ETIMEDOUT:
@@ -360,38 +1209,38 @@ func onError(r *Replicator, errCode entity.RaftErrorCode) {
 		})
 	case entity.EStop:
 		// 停止某一个 Replicator
-		defer r.shutdown()
-		ele := r.inFlights.Front()
-		for {
-			val := ele.Next()
-			if val == nil {
-				break
-			}
-			inflight := val.Value.(*InFlight)
-			if inflight != r.rpcInFly {
-				inflight.future.Cancel()
-			}
-			if r.rpcInFly != nil {
-				r.rpcInFly.future.Cancel()
-				r.rpcInFly = nil
-			}
-			if r.heartbeatInFly != nil {
-				r.heartbeatInFly.Cancel()
-				r.heartbeatInFly = nil
-			}
-			if r.timeoutNowInFly != nil {
-				r.timeoutNowInFly.Cancel()
-				r.timeoutNowInFly = nil
+		for ele := r.inFlights.Front(); ele != nil; ele = ele.Next() {
+			ele.Value.(*InFlight).future.Cancel()
+		}
+		r.resetInFlights()
+		for _, f := range []polerpc.Future{r.heartbeatInFly, r.timeoutNowInFly} {
+			if f != nil {
+				f.Cancel()
 			}
-			r.futures.ForEach(func(index int, v interface{}) {
-				v.(polerpc.Future).Cancel()
-			})
-			if r.waitId >= 0 {
-				r.options.logMgn.RemoveWaiter(r.waitId)
+		}
+		for _, t := range []utils.Timer{r.heartbeatTimer, r.blockTimer} {
+			if t != nil {
+				t.Stop()
 			}
-			notifyOnCaughtUp(r, errCode)
-			ele = val.Next()
 		}
+		if r.options.heartbeatBatcher != nil {
+			r.options.heartbeatBatcher.cancelWait(r)
+		}
+		r.heartbeatInFly = nil
+		r.timeoutNowInFly = nil
+		r.heartbeatTimer = nil
+		r.blockTimer = nil
+		if r.waitId >= 0 {
+			r.options.logMgn.RemoveWaiter(r.waitId)
+			r.waitId = -1
+		}
+		r.releaseReader()
+		r.destroy = true
+		r.setState(ReplicatorDestroyed)
+		notifyOnCaughtUp(r, errCode)
+		r.lock.Unlock()
+		notifyReplicatorStatusListener(r, ReplicatorDestroyedEvent, entity.NewEmptyStatus())
+		utils.RaftLog.Info("replicator %s is stopped", r.options.peerId.GetDesc())
 	default:
 		r.lock.Unlock()
 		panic(fmt.Errorf("unknown error code for replicator: %d", errCode))
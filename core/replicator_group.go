@@ -6,6 +6,7 @@ package core
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/pole-group/lraft/entity"
 	"github.com/pole-group/lraft/utils"
@@ -33,6 +34,18 @@ type ReplicatorGroup struct {
 	failureReplicators *utils.ConcurrentMap // <string, ReplicatorType>
 }
 
+//NewReplicatorGroup 创建一个空的复制者组，commonOptions 在节点的各个组件初始化完成之后再设置
+func NewReplicatorGroup(raftOpt RaftOptions) *ReplicatorGroup {
+	rpg := &ReplicatorGroup{
+		replicators:        &utils.ConcurrentMap{},
+		raftOpt:            raftOpt,
+		failureReplicators: &utils.ConcurrentMap{},
+	}
+	rpg.replicators.Clear()
+	rpg.failureReplicators.Clear()
+	return rpg
+}
+
 func (rpg *ReplicatorGroup) checkReplicator(peer entity.PeerId, lockNode bool) {
 	replicator := rpg.GetReplicator(peer)
 	if replicator == nil {
@@ -45,7 +58,8 @@ func (rpg *ReplicatorGroup) checkReplicator(peer entity.PeerId, lockNode bool) {
 		if lockNode {
 			node.lock.Lock()
 		}
-		if node.IsLeader() {
+		// 此时已经持有节点锁，不能再通过 IsLeader 加读锁
+		if node.IsLeaderWithBLock(false) {
 			rType := rpg.failureReplicators.Get(peer.GetDesc())
 			if rType != nil {
 				if ok, _ := rpg.AddReplicator(peer, rType.(ReplicatorType), false); ok {
@@ -60,8 +74,20 @@ func (rpg *ReplicatorGroup) clearFailureReplicators() {
 	rpg.failureReplicators.Clear()
 }
 
+//transferLeadershipTo peer 追上 lastLogIndex 之后向它发送 TimeoutNowRequest，peer 没有对应的复制者时返回错误
 func (rpg *ReplicatorGroup) transferLeadershipTo(peer entity.PeerId, lastLogIndex int64) (bool, error) {
-	return false, nil
+	replicator := rpg.GetReplicator(peer)
+	if replicator == nil {
+		return false, fmt.Errorf("replicator of peer %s not found", peer.GetDesc())
+	}
+	return replicator.transferLeadership(lastLogIndex), nil
+}
+
+//stopTransferLeadership 领导权转移超时之后调用，peer 追上之后不再向它发送 TimeoutNowRequest
+func (rpg *ReplicatorGroup) stopTransferLeadership(peer entity.PeerId) {
+	if replicator := rpg.GetReplicator(peer); replicator != nil {
+		replicator.stopTransferLeadership()
+	}
 }
 
 //sendHeartbeat
@@ -76,22 +102,40 @@ func (rpg *ReplicatorGroup) sendHeartbeat(peer entity.PeerId, closure *AppendEnt
 	replicator.sendHeartbeat(closure)
 }
 
-func (rpg *ReplicatorGroup) resetTerm(term int64)  {
-	// TODO
+//resetTerm 成为 Leader 之后更新复制者使用的任期，之后新建的 Replicator 都会使用新的任期
+func (rpg *ReplicatorGroup) resetTerm(term int64) bool {
+	if term <= rpg.commonOptions.term {
+		return false
+	}
+	rpg.commonOptions.term = term
+	return true
 }
 
 //GetReplicator
 func (rpg *ReplicatorGroup) GetReplicator(peer entity.PeerId) *Replicator {
-	return rpg.replicators.Get(peer.GetDesc()).(*Replicator)
+	if r, ok := rpg.replicators.Get(peer.GetDesc()).(*Replicator); ok {
+		return r
+	}
+	return nil
+}
+
+//getLastRpcSendTimestamp 最近一次得到 peer 响应的请求的发送时间，peer 没有对应的复制者时返回 0
+func (rpg *ReplicatorGroup) getLastRpcSendTimestamp(peer entity.PeerId) int64 {
+	replicator := rpg.GetReplicator(peer)
+	if replicator == nil {
+		return 0
+	}
+	return replicator.getLastRpcSendTimestamp()
 }
 
-//AddReplicator 添加一个复制者
+//AddReplicator 添加一个复制者，peer 已经有复制者时只更新它的类型
 func (rpg *ReplicatorGroup) AddReplicator(peer entity.PeerId, replicatorType ReplicatorType, sync bool) (bool, error) {
 	if err := utils.RequireTrue(rpg.commonOptions.term != 0, "term is zero"); err != nil {
 		return false, err
 	}
 	rpg.failureReplicators.Remove(peer.GetDesc())
-	if rpg.replicators.Contains(peer.GetDesc()) {
+	if replicator := rpg.GetReplicator(peer); replicator != nil {
+		replicator.setReplicatorType(replicatorType)
 		return true, nil
 	}
 	// 判断是否需要重新新建一个 replicatorOptions
@@ -102,14 +146,15 @@ func (rpg *ReplicatorGroup) AddReplicator(peer entity.PeerId, replicatorType Rep
 		if ok, err := opts.raftRpcOperator.raftClient.CheckConnection(peer.GetEndpoint()); !ok || err != nil {
 			utils.RaftLog.Error("Fail to check replicator connection to peer=%s, replicatorType=%s.", peer.GetDesc(),
 				replicatorType)
-			rpg.failureReplicators.Put(peer.GetDesc(), peer)
+			rpg.failureReplicators.Put(peer.GetDesc(), replicatorType)
 			return false, err
 		}
 	}
 
 	replicator := NewReplicator(opts, rpg.raftOpt)
 	if ok, err := replicator.Start(); !ok || err != nil {
-		utils.RaftLog.Error("fail to startJob replicator to peer=%s, replicatorType=%", peer.GetDesc(), replicatorType)
+		utils.RaftLog.Error("fail to startJob replicator to peer=%s, replicatorType=%s", peer.GetDesc(), replicatorType)
+		rpg.failureReplicators.Put(peer.GetDesc(), replicatorType)
 		return false, err
 	}
 
@@ -117,6 +162,29 @@ func (rpg *ReplicatorGroup) AddReplicator(peer entity.PeerId, replicatorType Rep
 	return true, nil
 }
 
+//waitCaughtUp 等待 peer 的复制者追上 Leader 的日志，peer 没有对应的复制者时返回 false
+func (rpg *ReplicatorGroup) waitCaughtUp(peer entity.PeerId, maxMargin int64, timeout time.Duration,
+	done *CatchUpClosure) bool {
+	replicator := rpg.GetReplicator(peer)
+	if replicator == nil {
+		return false
+	}
+	replicator.waitForCaughtUp(maxMargin, timeout, done)
+	return true
+}
+
+//stopReplicator 停止 peer 的复制者，peer 被移出配置之后不再向它复制日志
+func (rpg *ReplicatorGroup) stopReplicator(peer entity.PeerId) bool {
+	rpg.failureReplicators.Remove(peer.GetDesc())
+	replicator := rpg.GetReplicator(peer)
+	if replicator == nil {
+		return false
+	}
+	rpg.replicators.Remove(peer.GetDesc())
+	replicator.Stop()
+	return true
+}
+
 func (rpg *ReplicatorGroup) stopAllAndFindTheNextCandidate(conf *entity.ConfigurationEntry) *Replicator {
 	var replicator *Replicator
 	candidateId := rpg.findTheNextCandidate(conf)
@@ -128,7 +196,7 @@ func (rpg *ReplicatorGroup) stopAllAndFindTheNextCandidate(conf *entity.Configur
 	rpg.replicators.ForEach(func(k, v interface{}) {
 		r := v.(*Replicator)
 		if r != replicator {
-			r.shutdown()
+			r.Stop()
 		}
 	})
 	rpg.replicators.Clear()
@@ -168,10 +236,16 @@ func (rpg *ReplicatorGroup) findTheNextCandidate(conf *entity.ConfigurationEntry
 	return peer
 }
 
+//sendTimeoutNowAndStop 让下一个候选者立即发起选举，最多等待 electionTimeoutMs 之后停止它的复制者
 func (rpg *ReplicatorGroup) sendTimeoutNowAndStop(replicator *Replicator, electionTimeoutMs int64) {
-
+	replicator.sendTimeoutNowAndStop(electionTimeoutMs)
 }
 
+//stopAll 停止所有的复制者，在节点不再是 Leader 的时候调用
 func (rpg *ReplicatorGroup) stopAll() {
-
+	rpg.replicators.ForEach(func(k, v interface{}) {
+		v.(*Replicator).Stop()
+	})
+	rpg.replicators.Clear()
+	rpg.failureReplicators.Clear()
 }
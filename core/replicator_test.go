@@ -0,0 +1,264 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	polerpc "github.com/pole-group/pole-rpc"
+
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/rpc"
+)
+
+const replicatorTestTerm = 4
+
+//capturedAppendEntries follower 截获的 AppendEntriesRequest，由测试用例决定回复的内容以及顺序
+type capturedAppendEntries struct {
+	req    *raft.AppendEntriesRequest
+	rpcCtx polerpc.RpcServerContext
+}
+
+func (c *capturedAppendEntries) reply(resp *raft.AppendEntriesResponse) {
+	NewRpcRequestClosure(c.rpcCtx).SendProtoResponse(rpc.CoreAppendEntriesRequest, resp)
+}
+
+func (c *capturedAppendEntries) succeed() {
+	c.reply(&raft.AppendEntriesResponse{
+		Term:         replicatorTestTerm,
+		Success:      true,
+		LastLogIndex: c.req.GetPrevLogIndex() + int64(len(c.req.GetEntries())),
+	})
+}
+
+//committedRecorder BallotBox 只需要 FSMCaller 的 OnCommitted
+type committedRecorder struct {
+	FSMCaller
+}
+
+func (c *committedRecorder) OnCommitted(committedIndex int64) bool {
+	return true
+}
+
+type replicatorTestEnv struct {
+	t        *testing.T
+	r        *Replicator
+	requests chan *capturedAppendEntries
+}
+
+//newReplicatorTestEnv Leader 上 [1, 5] 的任期为 1，[6, 10] 的任期为 2，[11, 15] 的任期为 4，每个请求最多携带 5 条日志，
+//最多 3 个请求同时在途
+func newReplicatorTestEnv(t *testing.T) *replicatorTestEnv {
+	network := rpc.NewLoopbackNetwork()
+	peers := newTestPeers(2)
+	server, err := network.NewServer(peers[1].GetEndpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	env := &replicatorTestEnv{
+		t:        t,
+		requests: make(chan *capturedAppendEntries, 16),
+	}
+	server.RegisterRequestHandler(rpc.CoreAppendEntriesRequest, func(ctx context.Context, req proto.Message,
+		rpcCtx polerpc.RpcServerContext) {
+		env.requests <- &capturedAppendEntries{
+			req:    req.(*raft.AppendEntriesRequest),
+			rpcCtx: rpcCtx,
+		}
+	})
+
+	lm := newTestLogManager(t, NewMemoryLogStorage(), NewDefaultRaftOptions())
+	entries := append(newTestLogEntries(1, 5, 1), newTestLogEntries(6, 10, 2)...)
+	appendAndWait(t, lm, append(entries, newTestLogEntries(11, 15, replicatorTestTerm)...)...)
+
+	raftOpts := NewDefaultRaftOptions()
+	raftOpts.MaxEntriesSize = 5
+	raftOpts.MaxReplicatorInflightMs = 3
+	// 没有调用 Start，不会启动心跳的定时任务
+	env.r = NewReplicator(&replicatorOptions{
+		dynamicHeartBeatTimeoutMs: 100,
+		electionTimeoutMs:         1000,
+		groupID:                   testGroupID,
+		serverId:                  peers[0],
+		peerId:                    peers[1],
+		logMgn:                    lm,
+		ballotBox:                 &BallotBox{waiter: &committedRecorder{}},
+		term:                      replicatorTestTerm,
+		raftRpcOperator:           NewRaftClientOperator(nil, network.NewClient(), nil),
+		replicatorType:            ReplicatorFollower,
+	}, raftOpts)
+	t.Cleanup(env.r.Stop)
+	return env
+}
+
+//probe 从 nextIndex 开始发送探测请求
+func (env *replicatorTestEnv) probe(nextIndex int64) {
+	env.r.lock.Lock()
+	env.r.nextIndex = nextIndex
+	env.r.sendEmptyEntries(false, nil)
+}
+
+//receive 等待 n 个请求，请求是异步发送的，到达的顺序不确定，按照 prevLogIndex 排序之后返回
+func (env *replicatorTestEnv) receive(n int) []*capturedAppendEntries {
+	env.t.Helper()
+	result := make([]*capturedAppendEntries, 0, n)
+	for len(result) < n {
+		select {
+		case c := <-env.requests:
+			result = append(result, c)
+		case <-time.After(testWaitTimeout):
+			env.t.Fatalf("received %d AppendEntriesRequests, expect %d", len(result), n)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].req.GetPrevLogIndex() < result[j].req.GetPrevLogIndex()
+	})
+	return result
+}
+
+//checkRequests 检查请求的 prevLogIndex、prevLogTerm 以及携带的日志数
+func (env *replicatorTestEnv) checkRequests(requests []*capturedAppendEntries, expect ...[3]int64) {
+	env.t.Helper()
+	for i, c := range requests {
+		req := c.req
+		if req.GetPrevLogIndex() != expect[i][0] || req.GetPrevLogTerm() != expect[i][1] ||
+			int64(len(req.GetEntries())) != expect[i][2] {
+			env.t.Fatalf("request %d, prevLogIndex %d, prevLogTerm %d, %d entries, expect %v", i,
+				req.GetPrevLogIndex(), req.GetPrevLogTerm(), len(req.GetEntries()), expect[i])
+		}
+	}
+}
+
+//state 返回 nextIndex、在途请求数以及等待处理的乱序响应数
+func (env *replicatorTestEnv) state() (int64, int, int) {
+	defer env.r.lock.Unlock()
+	env.r.lock.Lock()
+	return env.r.nextIndex, env.r.inFlights.Len(), env.r.pendingResponses.Len()
+}
+
+func (env *replicatorTestEnv) waitState(what string, nextIndex int64, inflights, pending int) {
+	env.t.Helper()
+	waitUntil(env.t, what, func() bool {
+		n, i, p := env.state()
+		return n == nextIndex && i == inflights && p == pending
+	})
+}
+
+func TestReplicatorBacktrackNextIndex(t *testing.T) {
+	env := newReplicatorTestEnv(t)
+	for _, c := range []struct {
+		name string
+		resp *raft.AppendEntriesResponse
+		// 探测请求的 prevLogIndex 均为 15
+		expect int64
+	}{
+		{"follower is shorter", &raft.AppendEntriesResponse{LastLogIndex: 7, ConflictIndex: 8}, 8},
+		{"leader has conflictTerm", &raft.AppendEntriesResponse{LastLogIndex: 20, ConflictTerm: 2,
+			ConflictIndex: 6}, 11},
+		{"leader has the first term", &raft.AppendEntriesResponse{LastLogIndex: 20, ConflictTerm: 1,
+			ConflictIndex: 1}, 6},
+		{"leader lacks conflictTerm", &raft.AppendEntriesResponse{LastLogIndex: 20, ConflictTerm: 3,
+			ConflictIndex: 11}, 11},
+		{"no hints from a long follower", &raft.AppendEntriesResponse{LastLogIndex: 20}, 15},
+		{"no hints from a short follower", &raft.AppendEntriesResponse{LastLogIndex: 3}, 4},
+		{"conflictIndex beyond prevLogIndex", &raft.AppendEntriesResponse{LastLogIndex: 30, ConflictIndex: 30}, 15},
+		{"conflictIndex beyond follower log", &raft.AppendEntriesResponse{LastLogIndex: 4, ConflictTerm: 1,
+			ConflictIndex: 1}, 5},
+	} {
+		if nextIndex := env.r.backtrackNextIndex(15, c.resp); nextIndex != c.expect {
+			t.Errorf("%s, nextIndex %d, expect %d", c.name, nextIndex, c.expect)
+		}
+	}
+}
+
+func TestReplicatorProbeBacktracksWithConflictHints(t *testing.T) {
+	env := newReplicatorTestEnv(t)
+	env.probe(16)
+	probe := env.receive(1)
+	env.checkRequests(probe, [3]int64{15, replicatorTestTerm, 0})
+
+	// Follower 在 [6, 12] 上是任期 2 的日志，一次往返就跳过了整个任期
+	probe[0].reply(&raft.AppendEntriesResponse{
+		Term:          replicatorTestTerm,
+		LastLogIndex:  12,
+		ConflictTerm:  2,
+		ConflictIndex: 6,
+	})
+	probe = env.receive(1)
+	env.checkRequests(probe, [3]int64{10, 2, 0})
+	if st := env.r.getState(); st != ReplicatorProbe {
+		t.Fatalf("replicator state %d after log mismatch, expect probe", st)
+	}
+
+	probe[0].succeed()
+	entries := env.receive(1)
+	env.checkRequests(entries, [3]int64{10, 2, 5})
+	entries[0].succeed()
+	env.waitState("entries to be replicated", 16, 0, 0)
+	if st := env.r.getState(); st != ReplicatorReplicate {
+		t.Fatalf("replicator state %d after entries are replicated, expect replicate", st)
+	}
+}
+
+func TestReplicatorOutOfOrderResponses(t *testing.T) {
+	env := newReplicatorTestEnv(t)
+	env.probe(1)
+	env.receive(1)[0].succeed()
+	requests := env.receive(3)
+	env.checkRequests(requests, [3]int64{0, 0, 5}, [3]int64{5, 1, 5}, [3]int64{10, 2, 5})
+
+	// 后发送的请求先返回，响应暂存在 pendingResponses 中，在途请求不会被清除
+	requests[2].succeed()
+	requests[1].succeed()
+	env.waitState("out-of-order responses to be queued", 1, 3, 2)
+
+	// 第一个请求返回之后按照 seq 依次处理，在途请求全部清除
+	requests[0].succeed()
+	env.waitState("responses to be processed in order", 16, 0, 0)
+	select {
+	case c := <-env.requests:
+		t.Fatalf("unexpected request with prevLogIndex %d after all entries are replicated", c.req.GetPrevLogIndex())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReplicatorIgnoresStaleVersionResponses(t *testing.T) {
+	env := newReplicatorTestEnv(t)
+	env.probe(1)
+	env.receive(1)[0].succeed()
+	requests := env.receive(3)
+
+	// 第二个请求被拒绝，Follower 上只剩下 [1, 3] 的日志，清除所有在途的请求，回退之后重新探测
+	requests[0].succeed()
+	requests[1].reply(&raft.AppendEntriesResponse{
+		Term:          replicatorTestTerm,
+		LastLogIndex:  3,
+		ConflictIndex: 4,
+	})
+	probe := env.receive(1)
+	env.checkRequests(probe, [3]int64{3, 1, 0})
+	env.waitState("inflights to be reset", 4, 1, 0)
+
+	// 重置之前发出的第三个请求的响应属于旧的版本，直接忽略
+	requests[2].succeed()
+	time.Sleep(50 * time.Millisecond)
+	if nextIndex, inflights, pending := env.state(); nextIndex != 4 || inflights != 1 || pending != 0 {
+		t.Fatalf("stale response is processed, nextIndex %d, %d inflights, %d pending responses", nextIndex,
+			inflights, pending)
+	}
+
+	probe[0].succeed()
+	requests = env.receive(3)
+	env.checkRequests(requests, [3]int64{3, 1, 5}, [3]int64{8, 2, 5}, [3]int64{13, replicatorTestTerm, 2})
+	for _, c := range requests {
+		c.succeed()
+	}
+	env.waitState("entries to be replicated", 16, 0, 0)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pole-group/lraft/rpc"
+	"github.com/pole-group/lraft/utils"
+)
+
+var simulationSeed = flag.Int64("simulation.seed", 0, "replay the simulation tests with the given seed")
+
+//simulationSettleTime 网络上没有在途消息之后再等待的真实时间，消息的回调以及由它触发的新消息需要在这段时间内完成
+const simulationSettleTime = 10 * time.Millisecond
+
+//simulation 运行在虚拟时间上的集群，选举、心跳、租约以及链路延迟都来自同一个种子。每次只执行一个到期的定时任务，
+//等到它引发的消息全部处理完之后再执行下一个，因此同一个种子每次运行的过程都是一样的，失败的用例可以通过
+//-simulation.seed 重放
+type simulation struct {
+	*testCluster
+	seed  int64
+	clock *utils.SimulationClock
+}
+
+func newSimulation(t *testing.T, size int, seed int64) *simulation {
+	if *simulationSeed != 0 {
+		seed = *simulationSeed
+	}
+	clock := utils.NewSimulationClock(seed)
+	c := newTestClusterWithClock(t, size, seed, clock)
+	c.network.SetClock(clock)
+	c.network.SetDefaultFault(rpc.LinkFault{Latency: time.Millisecond, Jitter: 5 * time.Millisecond})
+	s := &simulation{
+		testCluster: c,
+		seed:        seed,
+		clock:       clock,
+	}
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("simulation failed at %s, replay with -simulation.seed=%d", clock.Elapsed(), seed)
+		}
+	})
+	c.enableElection()
+	return s
+}
+
+//step 执行下一个到期的定时任务，并且等待它引发的消息全部处理完，没有定时任务时返回 false
+func (s *simulation) step() bool {
+	if !s.clock.Step() {
+		return false
+	}
+	s.settle()
+	return true
+}
+
+func (s *simulation) settle() {
+	s.t.Helper()
+	deadline := time.Now().Add(testWaitTimeout)
+	idleSince := time.Time{}
+	for time.Now().Before(deadline) {
+		switch {
+		case s.network.InFlight() != 0:
+			idleSince = time.Time{}
+		case idleSince.IsZero():
+			idleSince = time.Now()
+		case time.Since(idleSince) >= simulationSettleTime:
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.t.Fatalf("network does not settle at %s, %d messages in flight", s.clock.Elapsed(), s.network.InFlight())
+}
+
+//runFor 推进 d 的虚拟时间
+func (s *simulation) runFor(d time.Duration) {
+	target := s.clock.Elapsed() + d
+	for {
+		if deadline, ok := s.clock.NextDeadline(); !ok || deadline > target {
+			break
+		}
+		s.step()
+	}
+	s.clock.Advance(target - s.clock.Elapsed())
+}
+
+//runUntil 推进虚拟时间直到 cond 成立，超过 limit 的虚拟时间仍然不成立时测试失败
+func (s *simulation) runUntil(what string, limit time.Duration, cond func() bool) {
+	s.t.Helper()
+	target := s.clock.Elapsed() + limit
+	for !cond() {
+		if s.clock.Elapsed() > target || !s.step() {
+			s.t.Fatalf("%s is not satisfied after %s of virtual time", what, limit)
+		}
+	}
+}
+
+//electLeader 推进虚拟时间直到 nodes 中选出 Leader 并且其余的节点都认可它，返回 Leader 以及这次选举的记录
+func (s *simulation) electLeader(nodes ...*nodeImpl) (*nodeImpl, string) {
+	s.t.Helper()
+	var leader *nodeImpl
+	var term int64
+	s.runUntil("leader election", 20*testElectionTimeoutMs*time.Millisecond, func() bool {
+		leader, term = nil, 0
+		for _, node := range nodes {
+			if state, nodeTerm, _ := s.status(node); state == StateLeader && nodeTerm > term {
+				leader, term = node, nodeTerm
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, follower := range nodes {
+			if follower == leader {
+				continue
+			}
+			state, followerTerm, leaderID := s.status(follower)
+			if state != StateFollower || followerTerm != term || !leaderID.Equal(leader.serverID) {
+				return false
+			}
+		}
+		return true
+	})
+	return leader, fmt.Sprintf("%s elected at term %d, %dms", leader.serverID.GetDesc(), term,
+		s.clock.Elapsed().Milliseconds())
+}
+
+//runLeaderFailover 选出 Leader 之后隔离它，剩下的节点选出新的 Leader，网络恢复之后旧 Leader 重新加入集群，
+//返回每一次选举的记录
+func runLeaderFailover(t *testing.T, seed int64) []string {
+	s := newSimulation(t, 3, seed)
+	trace := make([]string, 0, 3)
+
+	leader, event := s.electLeader(s.nodes...)
+	trace = append(trace, event)
+	s.runFor(testElectionTimeoutMs * time.Millisecond)
+
+	s.network.Isolate(leader.serverID.GetEndpoint())
+	_, event = s.electLeader(s.others(leader)...)
+	trace = append(trace, event)
+
+	s.network.HealPartition()
+	_, event = s.electLeader(s.nodes...)
+	return append(trace, event)
+}
+
+//TestSimulationLeaderFailover 同一个种子的两次运行，每一次选举的 Leader、任期以及完成的虚拟时间都完全一样
+func TestSimulationLeaderFailover(t *testing.T) {
+	const seed = 20201016
+	var traces [][]string
+	for i := 0; i < 2; i++ {
+		t.Run(fmt.Sprintf("run-%d", i), func(t *testing.T) {
+			traces = append(traces, runLeaderFailover(t, seed))
+		})
+	}
+	if len(traces) == 2 && !reflect.DeepEqual(traces[0], traces[1]) {
+		t.Fatalf("simulation with seed %d is not deterministic :\n%v\n%v", seed, traces[0], traces[1])
+	}
+	t.Log(traces[0])
+}
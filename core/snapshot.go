@@ -12,13 +12,17 @@ import (
 )
 
 const (
-	raftSnapshotMetaFile   = "__raft_snapshot_meta"
-	raftSnapshotPrefix     = "snapshot_"
+	raftSnapshotMetaFile    = "__raft_snapshot_meta"
+	raftSnapshotPrefix      = "snapshot_"
+	raftSnapshotTempPath    = "temp"
 	RemoteSnapshotURISchema = "remote://"
 )
 
 type SnapshotThrottle interface {
 	ThrottledByThroughput(bytes int64) int64
+
+	//ReturnUnusedThroughput 归还 acquired 中没有用到的额度，elapsedTimeUs 为获取额度到现在经过的时间
+	ReturnUnusedThroughput(acquired, consumed, elapsedTimeUs int64)
 }
 
 type Snapshot interface {
@@ -37,19 +41,27 @@ type SnapshotReader interface {
 	Load() *raft.SnapshotMeta
 
 	GenerateURIForCopy() string
+
+	Close()
 }
 
 type SnapshotWriter interface {
-	SaveMeta(meta raft.SnapshotMeta) bool
+	Snapshot
+
+	Status() entity.Status
+
+	SaveMeta(meta *raft.SnapshotMeta) bool
 
-	AddFile(fileName string, meta proto.Message)
+	AddFile(fileName string, meta proto.Message) bool
 
-	RemoveFile(fileName string)
+	RemoveFile(fileName string) bool
 
-	Close(keepDataOnError bool)
+	Close(keepDataOnError bool) error
 }
 
 type SnapshotCopier interface {
+	Status() entity.Status
+
 	Cancel()
 
 	Join()
@@ -68,6 +80,10 @@ type NewLogCallback interface {
 }
 
 type LogStorage interface {
+	Init(opts LogStorageOptions) bool
+
+	Shutdown()
+
 	GetFirstLogIndex() int64
 
 	GetLastLogIndex() int64
@@ -94,10 +110,14 @@ type SnapshotStorage interface {
 
 	Open() SnapshotReader
 
-	CopyFrom(uri string, opts SnapshotCopierOptions)
+	CopyFrom(uri string, opts SnapshotCopierOptions) SnapshotReader
+
+	StartToCopyFrom(uri string, opts SnapshotCopierOptions) SnapshotCopier
 }
 
 type LogManager interface {
+	Shutdown()
+
 	AddLastLogIndexListener(listener LastLogIndexListener)
 
 	RemoveLogIndexListener(listener LastLogIndexListener)
@@ -106,7 +126,7 @@ type LogManager interface {
 
 	AppendEntries(entries []*entity.LogEntry, done StableClosure)
 
-	SetSnapshot(meta raft.SnapshotMeta)
+	SetSnapshot(meta *raft.SnapshotMeta)
 
 	ClearBufferedLogs()
 
@@ -0,0 +1,448 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/utils"
+)
+
+const (
+	defaultCopyMaxRetry        = 3
+	defaultCopyRetryIntervalMs = 1000
+)
+
+//RemoteFileCopier 解析 remote://ip:port/readerID 形式的 uri，通过 CoreGetFileRequest 从 leader 上分块下载文件
+type RemoteFileCopier struct {
+	readerID        int64
+	endpoint        entity.Endpoint
+	raftOperator    *RaftClientOperator
+	maxByteCount    int64
+	maxRetry        int32
+	retryIntervalMs int64
+	throttle        SnapshotThrottle
+}
+
+func newRemoteFileCopier() *RemoteFileCopier {
+	return &RemoteFileCopier{}
+}
+
+func (rfc *RemoteFileCopier) init(uri string, throttle SnapshotThrottle, opts SnapshotCopierOptions) bool {
+	if !strings.HasPrefix(uri, RemoteSnapshotURISchema) {
+		utils.RaftLog.Error("Invalid uri %s.", uri)
+		return false
+	}
+	uri = strings.TrimPrefix(uri, RemoteSnapshotURISchema)
+	slash := strings.LastIndex(uri, "/")
+	if slash < 0 {
+		utils.RaftLog.Error("Invalid uri %s, readerID is missing.", uri)
+		return false
+	}
+	readerID, err := strconv.ParseInt(uri[slash+1:], 10, 64)
+	if err != nil {
+		utils.RaftLog.Error("Fail to parse readerID of uri %s : %s", uri, err)
+		return false
+	}
+	host, port, err := net.SplitHostPort(uri[:slash])
+	if err != nil {
+		utils.RaftLog.Error("Fail to parse address of uri %s : %s", uri, err)
+		return false
+	}
+	p, err := strconv.ParseInt(port, 10, 64)
+	if err != nil {
+		utils.RaftLog.Error("Fail to parse port of uri %s : %s", uri, err)
+		return false
+	}
+	if opts.RaftClientOperator == nil {
+		utils.RaftLog.Error("RaftClientOperator is required to copy snapshot from %s.", uri)
+		return false
+	}
+	rfc.readerID = readerID
+	rfc.throttle = throttle
+	rfc.endpoint = entity.NewEndpoint(host, p)
+	rfc.raftOperator = opts.RaftClientOperator
+	rfc.maxByteCount = opts.RaftOpts.MaxByteCountPerRpc
+	if rfc.maxByteCount <= 0 {
+		rfc.maxByteCount = NewDefaultRaftOptions().MaxByteCountPerRpc
+	}
+	rfc.maxRetry = opts.MaxRetry
+	if rfc.maxRetry <= 0 {
+		rfc.maxRetry = defaultCopyMaxRetry
+	}
+	rfc.retryIntervalMs = opts.RetryIntervalMs
+	if rfc.retryIntervalMs <= 0 {
+		rfc.retryIntervalMs = defaultCopyRetryIntervalMs
+	}
+	return true
+}
+
+func (rfc *RemoteFileCopier) copyToFile(ctx context.Context, source, destPath string) error {
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(destPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := rfc.readFile(ctx, source, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (rfc *RemoteFileCopier) copyToBytes(ctx context.Context, source string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := rfc.readFile(ctx, source, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//readFile 从 offset 0 开始分块读取，直到 leader 返回 eof，单次请求失败时按照 retryIntervalMs 重试 maxRetry 次
+func (rfc *RemoteFileCopier) readFile(ctx context.Context, source string, w io.Writer) error {
+	offset := int64(0)
+	retry := int32(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		count := rfc.maxByteCount
+		throttled := rfc.throttle != nil && source != raftSnapshotMetaFile
+		startUs := monotonicUs()
+		if throttled {
+			count = rfc.throttle.ThrottledByThroughput(count)
+		}
+		if count <= 0 {
+			// 本地的限流额度已经用完，等待下一个周期，不计入重试次数
+			if err := rfc.waitRetryInterval(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		resp, err := rfc.getFile(ctx, &raft.GetFileRequest{
+			ReaderID:   rfc.readerID,
+			Filename:   source,
+			Count:      count,
+			Offset:     offset,
+			ReadPartly: true,
+		})
+		if throttled {
+			// 只计入真正收到的字节，失败的请求、leader 端的限流以及最后一个不满的分块都需要归还额度
+			rfc.throttle.ReturnUnusedThroughput(count, int64(len(resp.GetData())), monotonicUs()-startUs)
+		}
+		if err == ErrSnapshotThrottled {
+			// leader 端触发了限流，同样等待之后重试
+			if err := rfc.waitRetryInterval(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			retry++
+			if retry > rfc.maxRetry {
+				return err
+			}
+			utils.RaftLog.Warn("Fail to get file %s from %s, offset=%d, retry=%d : %s", source,
+				rfc.endpoint.GetDesc(), offset, retry, err)
+			if err := rfc.waitRetryInterval(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		retry = 0
+		if _, err := w.Write(resp.GetData()); err != nil {
+			return err
+		}
+		offset += int64(len(resp.GetData()))
+		if resp.GetEof() {
+			return nil
+		}
+	}
+}
+
+func (rfc *RemoteFileCopier) waitRetryInterval(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(rfc.retryIntervalMs) * time.Millisecond):
+		return nil
+	}
+}
+
+func (rfc *RemoteFileCopier) getFile(ctx context.Context, req *raft.GetFileRequest) (*raft.GetFileResponse, error) {
+	var (
+		resp *raft.GetFileResponse
+		st   entity.Status
+	)
+	done := &GetFileResponseClosure{
+		RpcResponseClosure: RpcResponseClosure{
+			F: func(r proto.Message, status entity.Status) {
+				st = status
+				if r != nil {
+					resp = r.(*raft.GetFileResponse)
+				}
+			},
+		},
+	}
+	if _, err := rfc.raftOperator.GetFile(rfc.endpoint, req, done).Block(ctx); err != nil {
+		return nil, err
+	}
+	if !st.IsOK() {
+		return nil, fmt.Errorf("get file failed : %s", st.GetMsg())
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("get file failed : empty response")
+	}
+	if errResp := resp.GetErrorResponse(); errResp != nil && errResp.GetErrorCode() == int32(entity.EAGAIN) {
+		return nil, ErrSnapshotThrottled
+	}
+	if errResp := resp.GetErrorResponse(); errResp != nil && errResp.GetErrorCode() != 0 {
+		return nil, fmt.Errorf("get file failed, code=%d : %s", errResp.GetErrorCode(), errResp.GetErrorMsg())
+	}
+	return resp, nil
+}
+
+//LocalSnapshotCopier follower 安装快照时使用，先下载 leader 的快照元数据，再逐个下载元数据中登记的文件，
+//全部下载完成之后写入本地的 LocalSnapshotStorage
+type LocalSnapshotCopier struct {
+	lock                   sync.Mutex
+	storage                *LocalSnapshotStorage
+	copier                 *RemoteFileCopier
+	filterBeforeCopyRemote bool
+	writer                 *LocalSnapshotWriter
+	reader                 SnapshotReader
+	remoteMeta             *localSnapshotMetaTable
+	status                 entity.Status
+	ctx                    context.Context
+	cancelF                context.CancelFunc
+	wait                   sync.WaitGroup
+}
+
+func newLocalSnapshotCopier(storage *LocalSnapshotStorage, filterBeforeCopyRemote bool) *LocalSnapshotCopier {
+	ctx, cancelF := context.WithCancel(context.Background())
+	return &LocalSnapshotCopier{
+		storage:                storage,
+		copier:                 newRemoteFileCopier(),
+		filterBeforeCopyRemote: filterBeforeCopyRemote,
+		remoteMeta:             newLocalSnapshotMetaTable(),
+		status:                 entity.NewEmptyStatus(),
+		ctx:                    ctx,
+		cancelF:                cancelF,
+	}
+}
+
+func (lsc *LocalSnapshotCopier) init(uri string, throttle SnapshotThrottle, opts SnapshotCopierOptions) bool {
+	return lsc.copier.init(uri, throttle, opts)
+}
+
+func (lsc *LocalSnapshotCopier) Start() {
+	lsc.wait.Add(1)
+	polerpc.Go(lsc.ctx, func(ctx context.Context) {
+		defer lsc.wait.Done()
+		lsc.startCopy()
+	})
+}
+
+func (lsc *LocalSnapshotCopier) Cancel() {
+	lsc.setError(entity.ECANCELED, "Copy snapshot was canceled")
+	lsc.cancelF()
+}
+
+func (lsc *LocalSnapshotCopier) Join() {
+	lsc.wait.Wait()
+}
+
+func (lsc *LocalSnapshotCopier) GetReader() SnapshotReader {
+	defer lsc.lock.Unlock()
+	lsc.lock.Lock()
+	return lsc.reader
+}
+
+func (lsc *LocalSnapshotCopier) Status() entity.Status {
+	defer lsc.lock.Unlock()
+	lsc.lock.Lock()
+	return entity.NewStatus(lsc.status.GetCode(), lsc.status.GetMsg())
+}
+
+func (lsc *LocalSnapshotCopier) isOK() bool {
+	defer lsc.lock.Unlock()
+	lsc.lock.Lock()
+	return lsc.status.IsOK()
+}
+
+//setError 只记录第一次发生的错误
+func (lsc *LocalSnapshotCopier) setError(code entity.RaftErrorCode, format string, args ...interface{}) {
+	defer lsc.lock.Unlock()
+	lsc.lock.Lock()
+	if !lsc.status.IsOK() {
+		return
+	}
+	lsc.status.SetError(code, format, args...)
+}
+
+func (lsc *LocalSnapshotCopier) startCopy() {
+	lsc.copyRemote()
+	if lsc.writer != nil {
+		if !lsc.isOK() {
+			st := lsc.Status()
+			lsc.writer.status.SetError(st.GetCode(), "%s", st.GetMsg())
+		}
+		// 开启了 filterBeforeCopyRemote 时保留已经下载的数据，下次安装快照时可以复用
+		if err := lsc.writer.Close(lsc.filterBeforeCopyRemote); err != nil {
+			lsc.setError(entity.EIO, "Fail to close snapshot writer : %s", err)
+		}
+		lsc.writer = nil
+	}
+	if lsc.isOK() {
+		reader := lsc.storage.Open()
+		if reader == nil {
+			lsc.setError(entity.EIO, "Fail to open snapshot after copying")
+			return
+		}
+		lsc.lock.Lock()
+		lsc.reader = reader
+		lsc.lock.Unlock()
+	}
+}
+
+func (lsc *LocalSnapshotCopier) copyRemote() {
+	if !lsc.loadMetaTable() {
+		return
+	}
+	lsc.filter()
+	if !lsc.isOK() {
+		return
+	}
+	for _, fileName := range lsc.remoteMeta.listFiles() {
+		lsc.copyFile(fileName)
+		if !lsc.isOK() {
+			return
+		}
+	}
+	lsc.writer.SaveMeta(lsc.remoteMeta.meta)
+}
+
+func (lsc *LocalSnapshotCopier) loadMetaTable() bool {
+	b, err := lsc.copier.copyToBytes(lsc.ctx, raftSnapshotMetaFile)
+	if err != nil {
+		utils.RaftLog.Warn("Fail to copy snapshot meta from %s : %s", lsc.copier.endpoint.GetDesc(), err)
+		lsc.setError(entity.EIO, "Fail to copy snapshot meta : %s", err)
+		return false
+	}
+	if err := lsc.remoteMeta.loadFromBytes(b); err != nil {
+		lsc.setError(entity.EIO, "Bad snapshot meta : %s", err)
+		return false
+	}
+	if !lsc.remoteMeta.hasMeta() {
+		lsc.setError(entity.EIO, "Remote snapshot meta is empty")
+		return false
+	}
+	return true
+}
+
+func (lsc *LocalSnapshotCopier) copyFile(fileName string) {
+	if lsc.writer.GetFileMeta(fileName) != nil {
+		utils.RaftLog.Info("Skipped downloading %s, path=%s.", fileName, lsc.writer.GetPath())
+		return
+	}
+	filePath := filepath.Join(lsc.writer.GetPath(), fileName)
+	if err := lsc.copier.copyToFile(lsc.ctx, fileName, filePath); err != nil {
+		utils.RaftLog.Error("Fail to copy %s from %s : %s", fileName, lsc.copier.endpoint.GetDesc(), err)
+		lsc.setError(entity.EIO, "Fail to copy %s : %s", fileName, err)
+		return
+	}
+	// 下载的内容和 leader 记录的 checksum 不一致时不能使用，删除之后整个下载失败
+	remote := lsc.remoteMeta.getFileMeta(fileName)
+	if remote.GetChecksum() != "" {
+		checksum, err := utils.FileChecksum(filePath)
+		if err != nil || checksum != remote.GetChecksum() {
+			utils.RaftLog.Error("Checksum of %s mismatch, checksum=%s, expect=%s, err=%v", fileName, checksum,
+				remote.GetChecksum(), err)
+			_ = os.Remove(filePath)
+			lsc.setError(entity.EIO, "Checksum of %s mismatch", fileName)
+			return
+		}
+	}
+	if !lsc.writer.AddFile(fileName, remote) {
+		lsc.setError(entity.EIO, "Fail to add file %s to writer", fileName)
+		return
+	}
+	if err := lsc.writer.sync(); err != nil {
+		lsc.setError(entity.EIO, "Fail to sync writer : %s", err)
+	}
+}
+
+//filter 创建 writer，开启 filterBeforeCopyRemote 时复用 temp 目录中以及当前快照中 checksum 一致的文件，避免重复下载
+func (lsc *LocalSnapshotCopier) filter() {
+	writer, ok := lsc.storage.create(!lsc.filterBeforeCopyRemote).(*LocalSnapshotWriter)
+	if !ok || writer == nil {
+		lsc.setError(entity.EINVAL, "Fail to create snapshot writer")
+		return
+	}
+	lsc.writer = writer
+	// temp 目录中写了一半的元数据在这里先保存下来，否则复用的文件在下次启动时无法识别
+	writer.SaveMeta(lsc.remoteMeta.meta)
+	if !lsc.filterBeforeCopyRemote {
+		return
+	}
+	for _, fileName := range writer.ListFiles() {
+		remote := lsc.remoteMeta.getFileMeta(fileName)
+		local := writer.metaTable.getFileMeta(fileName)
+		if remote == nil || remote.GetChecksum() == "" || remote.GetChecksum() != local.GetChecksum() {
+			writer.RemoveFile(fileName)
+			_ = os.Remove(filepath.Join(writer.GetPath(), fileName))
+		}
+	}
+	lastReader, ok := lsc.storage.Open().(*LocalSnapshotReader)
+	if ok && lastReader != nil {
+		defer lastReader.Close()
+		for _, fileName := range lsc.remoteMeta.listFiles() {
+			if writer.GetFileMeta(fileName) != nil {
+				continue
+			}
+			remote := lsc.remoteMeta.getFileMeta(fileName)
+			local := lastReader.metaTable.getFileMeta(fileName)
+			if local == nil || remote.GetChecksum() == "" || local.GetChecksum() != remote.GetChecksum() {
+				continue
+			}
+			src := filepath.Join(lastReader.GetPath(), fileName)
+			dst := filepath.Join(writer.GetPath(), fileName)
+			_ = os.MkdirAll(filepath.Dir(dst), 0755)
+			_ = os.Remove(dst)
+			if err := os.Link(src, dst); err != nil {
+				utils.RaftLog.Warn("Fail to link %s to %s : %s", src, dst, err)
+				continue
+			}
+			utils.RaftLog.Info("Reused %s from the last snapshot %s.", fileName, lastReader.GetPath())
+			writer.AddFile(fileName, remote)
+		}
+	}
+	if err := writer.sync(); err != nil {
+		lsc.setError(entity.EIO, "Fail to sync writer : %s", err)
+	}
+}
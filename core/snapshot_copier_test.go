@@ -0,0 +1,266 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/rpc"
+	"github.com/pole-group/lraft/utils"
+)
+
+//faultyFileServer 在 LoopbackNetwork 上提供 CoreGetFileRequest，fail 返回 true 的请求直接回复 EIO，模拟下载到一半失败
+type faultyFileServer struct {
+	lock     sync.Mutex
+	requests map[string]int
+	fail     func(req *raft.GetFileRequest) bool
+}
+
+const testWaitTimeout = 10 * time.Second
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testWaitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newFaultyFileServer(t *testing.T, network *rpc.LoopbackNetwork, endpoint entity.Endpoint) *faultyFileServer {
+	server, err := network.NewServer(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	ffs := &faultyFileServer{
+		requests: make(map[string]int),
+	}
+	server.RegisterRequestHandler(rpc.CoreGetFileRequest, func(ctx context.Context, req proto.Message,
+		rpcCtx polerpc.RpcServerContext) {
+		getFileReq := req.(*raft.GetFileRequest)
+		ffs.lock.Lock()
+		ffs.requests[getFileReq.GetFilename()]++
+		fail := ffs.fail != nil && ffs.fail(getFileReq)
+		ffs.lock.Unlock()
+		resp := &raft.GetFileResponse{
+			ErrorResponse: &raft.ErrorResponse{ErrorCode: int32(entity.EIO), ErrorMsg: "injected failure"},
+		}
+		if !fail {
+			resp = GetFileService().HandleGetFile(getFileReq)
+		}
+		NewRpcRequestClosure(rpcCtx).SendProtoResponse(rpc.CoreGetFileRequest, resp)
+	})
+	return ffs
+}
+
+func (ffs *faultyFileServer) setFail(fail func(req *raft.GetFileRequest) bool) {
+	defer ffs.lock.Unlock()
+	ffs.lock.Lock()
+	ffs.fail = fail
+	ffs.requests = make(map[string]int)
+}
+
+func (ffs *faultyFileServer) requestCount(fileName string) int {
+	defer ffs.lock.Unlock()
+	ffs.lock.Lock()
+	return ffs.requests[fileName]
+}
+
+//copierTestEnv leader 上有一个包含 small、large 两个文件的快照，follower 通过 FaultNetwork 下载
+type copierTestEnv struct {
+	server   *faultyFileServer
+	leader   *LocalSnapshotStorage
+	reader   SnapshotReader
+	large    []byte
+	follower *LocalSnapshotStorage
+	opts     SnapshotCopierOptions
+}
+
+func newCopierTestEnv(t *testing.T) *copierTestEnv {
+	network := rpc.NewLoopbackNetwork()
+	leaderAddr := entity.NewEndpoint("127.0.0.1", 8001)
+	env := &copierTestEnv{
+		server: newFaultyFileServer(t, network, leaderAddr),
+		large:  bytes.Repeat([]byte("0123456789"), 10000),
+	}
+
+	leader := NewLocalSnapshotStorage(t.TempDir(), NewDefaultRaftOptions())
+	env.leader = leader
+	if !leader.Init() {
+		t.Fatal("fail to init leader snapshot storage")
+	}
+	leader.SetServerAddr(leaderAddr)
+	writer := leader.Create()
+	for name, data := range map[string][]byte{"small": []byte("small"), "large": env.large} {
+		if err := ioutil.WriteFile(filepath.Join(writer.GetPath(), name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		writer.AddFile(name, nil)
+	}
+	writer.SaveMeta(&raft.SnapshotMeta{LastIncludedIndex: 7, LastIncludedTerm: 2})
+	if err := writer.Close(false); err != nil {
+		t.Fatal(err)
+	}
+	env.reader = leader.Open()
+	t.Cleanup(env.reader.Close)
+
+	env.follower = NewLocalSnapshotStorage(t.TempDir(), NewDefaultRaftOptions())
+	if !env.follower.Init() {
+		t.Fatal("fail to init follower snapshot storage")
+	}
+	raftOpts := NewDefaultRaftOptions()
+	// 每次只下载 16K，large 需要分多次请求
+	raftOpts.MaxByteCountPerRpc = 16 * 1024
+	env.opts = SnapshotCopierOptions{
+		RaftClientOperator: NewRaftClientOperator(nil, network.NewClient(), nil),
+		RaftOpts:           raftOpts,
+		MaxRetry:           2,
+		RetryIntervalMs:    1,
+	}
+	return env
+}
+
+func (env *copierTestEnv) checkCopied(t *testing.T, reader SnapshotReader) {
+	t.Helper()
+	if reader == nil {
+		t.Fatal("fail to copy snapshot")
+	}
+	defer reader.Close()
+	if meta := reader.Load(); meta.GetLastIncludedIndex() != 7 || meta.GetLastIncludedTerm() != 2 {
+		t.Fatalf("copied snapshot meta : %v", meta)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(reader.GetPath(), "large"))
+	if err != nil || !bytes.Equal(data, env.large) {
+		t.Fatalf("copied large file, %d bytes : %v", len(data), err)
+	}
+	remote := env.reader.GetFileMeta("large").(*raft.LocalFileMeta)
+	if local := reader.GetFileMeta("large").(*raft.LocalFileMeta); local.GetChecksum() != remote.GetChecksum() {
+		t.Fatalf("checksum of copied large file %s, expect %s", local.GetChecksum(), remote.GetChecksum())
+	}
+}
+
+func TestSnapshotCopierRetriesTransientFailures(t *testing.T) {
+	env := newCopierTestEnv(t)
+	// 每个分块的第一次请求都失败，重试之后可以继续从失败的 offset 下载
+	failed := make(map[int64]bool)
+	env.server.setFail(func(req *raft.GetFileRequest) bool {
+		if req.GetFilename() != "large" || failed[req.GetOffset()] {
+			return false
+		}
+		failed[req.GetOffset()] = true
+		return true
+	})
+	env.checkCopied(t, env.follower.CopyFrom(env.reader.GenerateURIForCopy(), env.opts))
+	// 100000 字节按照 16K 分为 7 块，每一块都失败一次
+	if n := env.server.requestCount("large"); n != 14 {
+		t.Fatalf("requests for large file %d, expect 14", n)
+	}
+}
+
+func TestSnapshotCopierFailsMidway(t *testing.T) {
+	env := newCopierTestEnv(t)
+	env.server.setFail(func(req *raft.GetFileRequest) bool {
+		return req.GetFilename() == "large" && req.GetOffset() > 0
+	})
+	if reader := env.follower.CopyFrom(env.reader.GenerateURIForCopy(), env.opts); reader != nil {
+		reader.Close()
+		t.Fatal("copy snapshot should fail once retries are exhausted")
+	}
+	if n := env.server.requestCount("large"); n != 1+int(env.opts.MaxRetry)+1 {
+		t.Fatalf("requests for large file %d, expect %d", n, 1+env.opts.MaxRetry+1)
+	}
+	// 下载失败的快照不会生效，没有开启 filterBeforeCopyRemote 时 temp 目录被清理
+	if env.follower.Open() != nil {
+		t.Fatal("partially copied snapshot is visible")
+	}
+	if utils.FileExist(filepath.Join(env.follower.GetPath(), raftSnapshotTempPath)) {
+		t.Fatal("temp dir of a failed copy is kept")
+	}
+}
+
+func TestSnapshotCopierChecksumMismatch(t *testing.T) {
+	env := newCopierTestEnv(t)
+	// leader 上的文件内容被破坏，和快照元数据中的 checksum 不再一致
+	corrupted := bytes.Repeat([]byte("x"), len(env.large))
+	if err := ioutil.WriteFile(filepath.Join(env.reader.GetPath(), "large"), corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	copier := env.follower.StartToCopyFrom(env.reader.GenerateURIForCopy(), env.opts)
+	if copier == nil {
+		t.Fatal("fail to start copier")
+	}
+	copier.Join()
+	if st := copier.Status(); st.GetCode() != entity.EIO {
+		t.Fatalf("copier status %d %s, expect %d", st.GetCode(), st.GetMsg(), entity.EIO)
+	}
+	if copier.GetReader() != nil || env.follower.Open() != nil {
+		t.Fatal("snapshot with a corrupted file is visible")
+	}
+}
+
+func TestSnapshotCopierResumesWithFilter(t *testing.T) {
+	env := newCopierTestEnv(t)
+	env.follower.SetFilterBeforeCopyRemote()
+	// 文件按照名字顺序下载，large 下载完成之后 small 下载失败
+	env.server.setFail(func(req *raft.GetFileRequest) bool {
+		return req.GetFilename() == "small"
+	})
+	if reader := env.follower.CopyFrom(env.reader.GenerateURIForCopy(), env.opts); reader != nil {
+		reader.Close()
+		t.Fatal("copy snapshot should fail once retries are exhausted")
+	}
+	if env.server.requestCount("large") == 0 {
+		t.Fatal("large file should be copied before small file")
+	}
+
+	// 开启 filterBeforeCopyRemote 之后保留已经下载的 large，再次下载时只需要下载 small
+	env.server.setFail(nil)
+	env.checkCopied(t, env.follower.CopyFrom(env.reader.GenerateURIForCopy(), env.opts))
+	if n := env.server.requestCount("large"); n != 0 {
+		t.Fatalf("large file is downloaded again, %d requests", n)
+	}
+	if env.server.requestCount("small") == 0 {
+		t.Fatal("small file is not downloaded")
+	}
+}
+
+func TestSnapshotCopierCancel(t *testing.T) {
+	env := newCopierTestEnv(t)
+	// leader 持续失败，取消之后下载立即结束
+	env.server.setFail(func(req *raft.GetFileRequest) bool {
+		return true
+	})
+	env.opts.MaxRetry = 1000
+	env.opts.RetryIntervalMs = 10
+	copier := env.follower.StartToCopyFrom(env.reader.GenerateURIForCopy(), env.opts)
+	if copier == nil {
+		t.Fatal("fail to start copier")
+	}
+	waitUntil(t, "copier to send requests", func() bool {
+		return env.server.requestCount(raftSnapshotMetaFile) > 0
+	})
+	copier.Cancel()
+	copier.Join()
+	if st := copier.Status(); st.GetCode() != entity.ECANCELED {
+		t.Fatalf("canceled copier status %d %s", st.GetCode(), st.GetMsg())
+	}
+	if copier.GetReader() != nil || env.follower.Open() != nil {
+		t.Fatal("canceled copy is visible")
+	}
+}
@@ -5,10 +5,16 @@
 package core
 
 import (
+	"context"
+	"sync"
 	"sync/atomic"
 
+	polerpc "github.com/pole-group/pole-rpc"
+
 	"github.com/pole-group/lraft/entity"
 	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/rpc"
+	"github.com/pole-group/lraft/utils"
 )
 
 type DownloadingSnapshot struct {
@@ -23,8 +29,12 @@ func NewDownloadingSnapshot(req *raft.InstallSnapshotRequest, done *RpcRequestCl
 	}
 }
 
+//loadSnapshotDone 快照加载完成之后的回调，启动时加载本地快照以及 follower 安装 leader 的快照都会使用
 type loadSnapshotDone struct {
-	reader SnapshotReader
+	executor *SnapshotExecutor
+	reader   SnapshotReader
+	latch    *sync.WaitGroup
+	status   entity.Status
 }
 
 func (ld *loadSnapshotDone) Start() SnapshotReader {
@@ -32,12 +42,19 @@ func (ld *loadSnapshotDone) Start() SnapshotReader {
 }
 
 func (ld *loadSnapshotDone) Run(st entity.Status) {
+	ld.status = st
+	ld.executor.onSnapshotLoadDone(st)
+	ld.reader.Close()
+	if ld.latch != nil {
+		ld.latch.Done()
+	}
 }
 
 type saveSnapshotDone struct {
-	writer SnapshotWriter
-	done   Closure
-	meta   *raft.SnapshotMeta
+	executor *SnapshotExecutor
+	writer   SnapshotWriter
+	done     Closure
+	meta     *raft.SnapshotMeta
 }
 
 func (sd *saveSnapshotDone) Run(st entity.Status) {
@@ -45,9 +62,14 @@ func (sd *saveSnapshotDone) Run(st entity.Status) {
 }
 
 func (sd *saveSnapshotDone) continueRun(st entity.Status) {
-
+	code := onSnapshotSaveDone(st, sd.meta, sd.writer, sd.executor)
+	if code != entity.SUCCESS && st.IsOK() {
+		st = entity.NewStatus(code, "Fail to save snapshot")
+	}
 	if sd.done != nil {
-		sd.done.Run(st)
+		polerpc.Go(context.Background(), func(ctx context.Context) {
+			sd.done.Run(st)
+		})
 	}
 }
 
@@ -56,47 +78,441 @@ func (sd *saveSnapshotDone) Start(meta *raft.SnapshotMeta) SnapshotWriter {
 	return sd.writer
 }
 
-func onSnapshotSaveDone(st entity.Status, meta *raft.SnapshotMeta, writer SnapshotWriter, executor *SnapshotExecutor) {
+//onSnapshotSaveDone 状态机保存快照结束，将快照元数据写入 writer 并关闭，成功之后截断 LogManager 中已经包含在快照中的日志
+func onSnapshotSaveDone(st entity.Status, meta *raft.SnapshotMeta, writer SnapshotWriter, executor *SnapshotExecutor) entity.RaftErrorCode {
+	executor.lock.Lock()
+	code := st.GetCode()
+	if st.IsOK() && meta.GetLastIncludedIndex() <= executor.lastSnapshotIndex {
+		code = entity.ESTALE
+		utils.RaftLog.Warn("Node %s discards an stale snapshot lastIncludedIndex=%d, lastSnapshotIndex=%d.",
+			executor.nodeDesc(), meta.GetLastIncludedIndex(), executor.lastSnapshotIndex)
+		writer.Status().SetError(entity.ESTALE, "Installing snapshot is older than local snapshot")
+	}
+	executor.lock.Unlock()
 
+	if code == entity.SUCCESS {
+		if !writer.SaveMeta(meta) {
+			utils.RaftLog.Warn("Fail to save snapshot %s.", writer.GetPath())
+			code = entity.EIO
+		}
+	} else if writer.Status().IsOK() {
+		writer.Status().SetError(code, "Fail to save snapshot : %s", st.GetMsg())
+	}
+	if err := writer.Close(false); err != nil && code == entity.SUCCESS {
+		utils.RaftLog.Error("Fail to close writer %s : %s", writer.GetPath(), err)
+		code = entity.EIO
+	}
+
+	executor.lock.Lock()
+	if code == entity.SUCCESS {
+		executor.lastSnapshotIndex = meta.GetLastIncludedIndex()
+		executor.lastSnapshotTerm = meta.GetLastIncludedTerm()
+		executor.lock.Unlock()
+		executor.logMgn.SetSnapshot(meta)
+		executor.lock.Lock()
+	}
+	if code == entity.EIO {
+		executor.reportError(entity.EIO, "Fail to save snapshot")
+	}
+	executor.savingSnapshot = false
+	executor.lock.Unlock()
+	executor.runningJobs.Done()
+	return code
 }
 
+//SnapshotExecutor 负责快照的保存、启动时的加载以及 follower 从 leader 下载并安装快照
 type SnapshotExecutor struct {
+	lock                sync.Mutex
 	node                *nodeImpl
 	lastSnapshotTerm    int64
 	lastSnapshotIndex   int64
 	term                int64
-	savingSnapshot      int32
-	loadingSnapshot     int32
-	stopped             int32
+	savingSnapshot      bool
+	loadingSnapshot     bool
+	stopped             bool
 	fsmCaller           FSMCaller
 	snapshotStorage     SnapshotStorage
 	curCopier           SnapshotCopier
 	logMgn              LogManager
-	loadingSnapshotMeta raft.SnapshotMeta
-	downloadingSnapshot atomic.Value // DownloadingSnapshot
+	loadingSnapshotMeta *raft.SnapshotMeta
+	downloadingSnapshot atomic.Value // *DownloadingSnapshot
+	runningJobs         sync.WaitGroup
+	copierOpts          SnapshotCopierOptions
+	snapshotLogMargin   int64
+}
 
+func NewSnapshotExecutor() *SnapshotExecutor {
+	return &SnapshotExecutor{}
+}
+
+//Init 初始化快照存储，如果本地存在快照，则同步的交由状态机加载，保证在日志回放之前状态机已经恢复到快照的状态
+func (se *SnapshotExecutor) Init(opts SnapshotExecutorOptions) bool {
+	if opts.URI == "" {
+		utils.RaftLog.Error("Snapshot uri is empty.")
+		return false
+	}
+	se.node = opts.Node
+	se.logMgn = opts.LogManager
+	se.fsmCaller = opts.FsmCaller
+	se.term = opts.InitTerm
+	se.snapshotLogMargin = int64(opts.NodeOpts.SnapshotLogIndexMargin)
+	se.copierOpts = SnapshotCopierOptions{
+		RaftClientOperator: opts.RaftClientOperator,
+		RaftOpts:           opts.RaftOpts,
+		NodeOpts:           &opts.NodeOpts,
+	}
+	se.downloadingSnapshot.Store((*DownloadingSnapshot)(nil))
+
+	storage := NewLocalSnapshotStorage(opts.URI, opts.RaftOpts)
+	if opts.FilterBeforeCopyRemote {
+		storage.SetFilterBeforeCopyRemote()
+	}
+	if opts.SnapshotThrottle != nil {
+		storage.SetSnapshotThrottle(opts.SnapshotThrottle)
+	}
+	if !storage.Init() {
+		utils.RaftLog.Error("Fail to init snapshot storage %s.", opts.URI)
+		return false
+	}
+	storage.SetServerAddr(opts.Addr)
+	se.snapshotStorage = storage
+
+	reader := storage.Open()
+	if reader == nil {
+		return true
+	}
+	se.loadingSnapshotMeta = reader.Load()
+	if se.loadingSnapshotMeta == nil {
+		utils.RaftLog.Error("Fail to load meta from %s.", reader.GetPath())
+		reader.Close()
+		return false
+	}
+	utils.RaftLog.Info("Loading snapshot, meta=%s.", se.loadingSnapshotMeta.String())
+	se.loadingSnapshot = true
+	se.runningJobs.Add(1)
+	done := &loadSnapshotDone{
+		executor: se,
+		reader:   reader,
+		latch:    &sync.WaitGroup{},
+	}
+	done.latch.Add(1)
+	if !se.fsmCaller.OnSnapshotLoad(done) {
+		utils.RaftLog.Error("Fail to submit snapshot load task to FSMCaller.")
+		done.Run(entity.NewStatus(entity.EHostDown, "The raft node is down"))
+	}
+	done.latch.Wait()
+	if !done.status.IsOK() {
+		utils.RaftLog.Error("Fail to load snapshot from %s, status=%s.", reader.GetPath(), done.status.GetMsg())
+		return false
+	}
+	return true
 }
 
 func (se *SnapshotExecutor) GetNode() *nodeImpl {
 	return se.node
 }
 
+func (se *SnapshotExecutor) GetLastSnapshotIndex() int64 {
+	defer se.lock.Unlock()
+	se.lock.Lock()
+	return se.lastSnapshotIndex
+}
+
+func (se *SnapshotExecutor) GetLastSnapshotTerm() int64 {
+	defer se.lock.Unlock()
+	se.lock.Lock()
+	return se.lastSnapshotTerm
+}
+
+//DoSnapshot 触发一次快照，距离上一次快照的日志数没有超过 SnapshotLogIndexMargin 时直接取消
 func (se *SnapshotExecutor) DoSnapshot(done Closure) {
+	se.lock.Lock()
+	if se.stopped {
+		se.lock.Unlock()
+		se.runClosure(done, entity.NewStatus(entity.EPERM, "Is stopped."))
+		return
+	}
+	if se.getDownloadingSnapshot() != nil {
+		se.lock.Unlock()
+		se.runClosure(done, entity.NewStatus(entity.EBUSY, "Is loading another snapshot."))
+		return
+	}
+	if se.savingSnapshot {
+		se.lock.Unlock()
+		se.runClosure(done, entity.NewStatus(entity.EBUSY, "Is saving another snapshot."))
+		return
+	}
+	lastAppliedIndex := se.fsmCaller.GetLastAppliedIndex()
+	if lastAppliedIndex == se.lastSnapshotIndex {
+		// 状态机没有新的数据，不需要再做快照
+		se.lock.Unlock()
+		se.runClosure(done, entity.StatusOK())
+		return
+	}
+	if distance := lastAppliedIndex - se.lastSnapshotIndex; distance < se.snapshotLogMargin {
+		se.lock.Unlock()
+		utils.RaftLog.Debug("Node %s snapshotLogIndexMargin=%d, distance=%d, so ignore this time of snapshot.",
+			se.nodeDesc(), se.snapshotLogMargin, distance)
+		se.runClosure(done, entity.NewStatus(entity.ECANCELED,
+			"The snapshot index distance since last snapshot is less than NodeOptions#SnapshotLogIndexMargin, canceled this task."))
+		return
+	}
+	writer := se.snapshotStorage.Create()
+	if writer == nil {
+		se.lock.Unlock()
+		se.runClosure(done, entity.NewStatus(entity.EIO, "Fail to create writer."))
+		se.reportError(entity.EIO, "Fail to create snapshot writer.")
+		return
+	}
+	se.savingSnapshot = true
+	se.runningJobs.Add(1)
+	se.lock.Unlock()
 
+	saveDone := &saveSnapshotDone{
+		executor: se,
+		writer:   writer,
+		done:     done,
+	}
+	if !se.fsmCaller.OnSnapshotSave(saveDone) {
+		saveDone.Run(entity.NewStatus(entity.EHostDown, "The raft node is down."))
+	}
 }
 
+//InstallSnapshot follower 处理 leader 的 InstallSnapshotRequest，下载快照之后交由状态机加载，加载完成之后回复 leader
 func (se *SnapshotExecutor) InstallSnapshot(req *raft.InstallSnapshotRequest, done *RpcRequestClosure) {
+	meta := req.GetMeta()
+	ds := NewDownloadingSnapshot(req, done)
+	if !se.registerDownloadingSnapshot(ds) {
+		utils.RaftLog.Warn("Fail to register downloading snapshot.")
+		return
+	}
+	se.lock.Lock()
+	copier := se.curCopier
+	se.lock.Unlock()
+	if copier == nil {
+		// 快照已经下载完成并开始加载，由加载结束时的 onSnapshotLoadDone 回复当前请求
+		return
+	}
+	copier.Join()
+	se.loadDownloadingSnapshot(ds, meta)
+}
+
+func (se *SnapshotExecutor) registerDownloadingSnapshot(ds *DownloadingSnapshot) bool {
+	defer se.lock.Unlock()
+	se.lock.Lock()
+	if se.stopped {
+		utils.RaftLog.Warn("Register DownloadingSnapshot failed: node is stopped.")
+		ds.RequestDone.Run(entity.NewStatus(entity.EHostDown, "Node is stopped."))
+		return false
+	}
+	if se.savingSnapshot {
+		utils.RaftLog.Warn("Register DownloadingSnapshot failed: is saving snapshot.")
+		ds.RequestDone.Run(entity.NewStatus(entity.EBUSY, "Node is saving snapshot."))
+		return false
+	}
+	if ds.Request.GetTerm() != se.term {
+		utils.RaftLog.Warn("Register DownloadingSnapshot failed: term mismatch, expect %d but %d.", se.term,
+			ds.Request.GetTerm())
+		se.sendInstallSnapshotResponse(ds.RequestDone, false)
+		return false
+	}
+	if ds.Request.GetMeta().GetLastIncludedIndex() <= se.lastSnapshotIndex {
+		utils.RaftLog.Warn("Register DownloadingSnapshot failed: snapshot is not newer, request lastIncludedIndex=%d, "+
+			"lastSnapshotIndex=%d.", ds.Request.GetMeta().GetLastIncludedIndex(), se.lastSnapshotIndex)
+		se.sendInstallSnapshotResponse(ds.RequestDone, true)
+		return false
+	}
+
+	m := se.getDownloadingSnapshot()
+	if m == nil {
+		se.downloadingSnapshot.Store(ds)
+		copier := se.snapshotStorage.StartToCopyFrom(ds.Request.GetUri(), se.copierOpts)
+		if copier == nil {
+			se.downloadingSnapshot.Store((*DownloadingSnapshot)(nil))
+			utils.RaftLog.Error("Register DownloadingSnapshot failed: fail to copy file from %s.", ds.Request.GetUri())
+			ds.RequestDone.Run(entity.NewStatus(entity.EINVAL, "Fail to copy from "+ds.Request.GetUri()))
+			return false
+		}
+		se.curCopier = copier
+		return true
+	}
 
+	downloadingIndex := m.Request.GetMeta().GetLastIncludedIndex()
+	requestIndex := ds.Request.GetMeta().GetLastIncludedIndex()
+	if downloadingIndex == requestIndex {
+		// leader 重试了同一个快照，替换掉旧的请求，旧的请求直接返回
+		m.RequestDone.Run(entity.NewStatus(entity.EINTR, "Interrupted by the retry InstallSnapshotRequest"))
+		se.downloadingSnapshot.Store(ds)
+		if se.loadingSnapshot {
+			// 快照已经在加载，copier 已经释放，不需要再下载，加载结束之后回复新的请求
+			utils.RaftLog.Info("Retried snapshot is under loading, lastIncludeIndex=%d.", requestIndex)
+			return false
+		}
+		return true
+	}
+	if downloadingIndex > requestIndex {
+		utils.RaftLog.Warn("Register DownloadingSnapshot failed: is installing a newer one, lastIncludeIndex=%d.",
+			downloadingIndex)
+		ds.RequestDone.Run(entity.NewStatus(entity.EINVAL, "A newer snapshot is under installing"))
+		return false
+	}
+	if se.loadingSnapshot {
+		utils.RaftLog.Warn("Register DownloadingSnapshot failed: is loading an older snapshot, lastIncludeIndex=%d.",
+			downloadingIndex)
+		ds.RequestDone.Run(entity.NewStatus(entity.EBUSY, "A former snapshot is under loading"))
+		return false
+	}
+	utils.RaftLog.Info("Interrupting downloading snapshot, lastIncludeIndex=%d, newer lastIncludeIndex=%d.",
+		downloadingIndex, requestIndex)
+	se.curCopier.Cancel()
+	ds.RequestDone.Run(entity.NewStatus(entity.EBUSY, "A former snapshot is under installing, trying to cancel"))
+	return false
 }
 
-func (se *SnapshotExecutor) stopDownloadingSnapshot(newTerm int64) {
+func (se *SnapshotExecutor) loadDownloadingSnapshot(ds *DownloadingSnapshot, meta *raft.SnapshotMeta) {
+	se.lock.Lock()
+	if ds != se.getDownloadingSnapshot() {
+		// 被新的请求替换掉了，由新的请求负责加载
+		se.lock.Unlock()
+		return
+	}
+	copier := se.curCopier
+	reader := copier.GetReader()
+	if !copier.Status().IsOK() || reader == nil {
+		st := copier.Status()
+		if st.IsOK() {
+			st = entity.NewStatus(entity.EIO, "Fail to open snapshot after copying")
+		}
+		if reader != nil {
+			reader.Close()
+		}
+		se.downloadingSnapshot.Store((*DownloadingSnapshot)(nil))
+		se.curCopier = nil
+		se.lock.Unlock()
+		utils.RaftLog.Warn("Fail to copy snapshot from %s : %s", ds.Request.GetUri(), st.GetMsg())
+		ds.RequestDone.Run(st)
+		return
+	}
+	se.curCopier = nil
+	se.loadingSnapshot = true
+	se.loadingSnapshotMeta = meta
+	se.runningJobs.Add(1)
+	se.lock.Unlock()
+
+	done := &loadSnapshotDone{
+		executor: se,
+		reader:   reader,
+	}
+	if !se.fsmCaller.OnSnapshotLoad(done) {
+		utils.RaftLog.Warn("Fail to call fsm OnSnapshotLoad.")
+		done.Run(entity.NewStatus(entity.EHostDown, "This raft node is down"))
+	}
+}
 
+//onSnapshotLoadDone 快照加载结束，成功时更新 LogManager 的快照信息以及节点的配置，并回复正在等待的 InstallSnapshotRequest
+func (se *SnapshotExecutor) onSnapshotLoadDone(st entity.Status) {
+	se.lock.Lock()
+	if !se.loadingSnapshot {
+		se.lock.Unlock()
+		utils.RaftLog.Error("Node %s is not loading any snapshot.", se.nodeDesc())
+		return
+	}
+	ds := se.getDownloadingSnapshot()
+	meta := se.loadingSnapshotMeta
+	if st.IsOK() {
+		se.lastSnapshotIndex = meta.GetLastIncludedIndex()
+		se.lastSnapshotTerm = meta.GetLastIncludedTerm()
+		se.lock.Unlock()
+		se.logMgn.SetSnapshot(meta)
+		if se.node != nil {
+			se.node.updateConfigurationAfterInstallingSnapshot()
+		}
+		se.lock.Lock()
+	} else {
+		utils.RaftLog.Error("Node %s fail to load snapshot, status=%s.", se.nodeDesc(), st.GetMsg())
+	}
+	if ds != nil {
+		if st.IsOK() {
+			se.sendInstallSnapshotResponse(ds.RequestDone, true)
+		} else {
+			ds.RequestDone.Run(st)
+		}
+	}
+	se.loadingSnapshot = false
+	se.downloadingSnapshot.Store((*DownloadingSnapshot)(nil))
+	se.lock.Unlock()
+	se.runningJobs.Done()
+}
+
+//stopDownloadingSnapshot 节点的 term 发生了变化，正在下载的快照已经过期，取消下载，已经开始加载的快照无法中断
+func (se *SnapshotExecutor) stopDownloadingSnapshot(newTerm int64) {
+	defer se.lock.Unlock()
+	se.lock.Lock()
+	if newTerm < se.term {
+		return
+	}
+	se.term = newTerm
+	if se.getDownloadingSnapshot() == nil || se.loadingSnapshot {
+		return
+	}
+	if se.curCopier != nil {
+		se.curCopier.Cancel()
+	}
 }
 
 func (se *SnapshotExecutor) IsInstallingSnapshot() bool {
-	return se.downloadingSnapshot.Load() != nil
+	return se.getDownloadingSnapshot() != nil
 }
 
 func (se *SnapshotExecutor) GetSnapshotStorage() SnapshotStorage {
 	return se.snapshotStorage
 }
+
+func (se *SnapshotExecutor) Shutdown() {
+	se.lock.Lock()
+	se.stopped = true
+	term := se.term
+	se.lock.Unlock()
+	se.stopDownloadingSnapshot(term)
+}
+
+func (se *SnapshotExecutor) Join() {
+	se.runningJobs.Wait()
+}
+
+func (se *SnapshotExecutor) getDownloadingSnapshot() *DownloadingSnapshot {
+	ds, _ := se.downloadingSnapshot.Load().(*DownloadingSnapshot)
+	return ds
+}
+
+func (se *SnapshotExecutor) sendInstallSnapshotResponse(done *RpcRequestClosure, success bool) {
+	done.SendProtoResponse(rpc.CoreInstallSnapshotRequest, &raft.InstallSnapshotResponse{
+		Term:    se.term,
+		Success: success,
+	})
+}
+
+func (se *SnapshotExecutor) runClosure(done Closure, st entity.Status) {
+	if done == nil {
+		return
+	}
+	polerpc.Go(context.Background(), func(ctx context.Context) {
+		done.Run(st)
+	})
+}
+
+func (se *SnapshotExecutor) reportError(code entity.RaftErrorCode, format string, args ...interface{}) {
+	st := entity.NewEmptyStatus()
+	st.SetError(code, format, args...)
+	se.fsmCaller.OnError(entity.RaftError{
+		ErrType: raft.ErrorType_ErrorTypeSnapshot,
+		Status:  st,
+	})
+}
+
+func (se *SnapshotExecutor) nodeDesc() string {
+	if se.node == nil {
+		return ""
+	}
+	return se.node.nodeID.GetDesc()
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/rpc"
+)
+
+const testGroupID = "test"
+
+//testRpcContext 收集服务端对请求的回复
+type testRpcContext struct {
+	respC chan *polerpc.ServerResponse
+}
+
+func newTestRpcContext() *testRpcContext {
+	return &testRpcContext{
+		respC: make(chan *polerpc.ServerResponse, 1),
+	}
+}
+
+func (ctx *testRpcContext) GetReq() *polerpc.ServerRequest {
+	return &polerpc.ServerRequest{}
+}
+
+func (ctx *testRpcContext) Send(resp *polerpc.ServerResponse) {
+	select {
+	case ctx.respC <- resp:
+	default:
+	}
+}
+
+func (ctx *testRpcContext) Complete() {
+}
+
+//loadOnlyFSMCaller 只实现 SnapshotExecutor 安装快照时用到的方法，加载快照时记录快照的 lastIncludedIndex
+type loadOnlyFSMCaller struct {
+	FSMCaller
+	loadedIndex int64
+}
+
+func (f *loadOnlyFSMCaller) OnSnapshotLoad(done LoadSnapshotClosure) bool {
+	go func() {
+		atomic.StoreInt64(&f.loadedIndex, done.Start().Load().GetLastIncludedIndex())
+		done.Run(entity.StatusOK())
+	}()
+	return true
+}
+
+func (f *loadOnlyFSMCaller) GetLastAppliedIndex() int64 {
+	return atomic.LoadInt64(&f.loadedIndex)
+}
+
+func (f *loadOnlyFSMCaller) OnError(err entity.RaftError) bool {
+	return true
+}
+
+func installTestSnapshot(se *SnapshotExecutor, index int64, uri string, ctx *testRpcContext) {
+	se.InstallSnapshot(&raft.InstallSnapshotRequest{
+		GroupID: testGroupID,
+		Term:    1,
+		Meta:    &raft.SnapshotMeta{LastIncludedIndex: index, LastIncludedTerm: 1},
+		Uri:     uri,
+	}, NewRpcRequestClosure(ctx))
+}
+
+func waitInstallResponse(t *testing.T, ctx *testRpcContext) (*raft.InstallSnapshotResponse, entity.Status) {
+	t.Helper()
+	select {
+	case resp := <-ctx.respC:
+		msg, st := rpc.GlobalProtoRegistry.DecodeResponse(rpc.CoreInstallSnapshotRequest, resp)
+		if msg == nil {
+			return nil, st
+		}
+		return msg.(*raft.InstallSnapshotResponse), st
+	case <-time.After(testWaitTimeout):
+		t.Fatal("no response for InstallSnapshotRequest")
+	}
+	return nil, entity.StatusOK()
+}
+
+func expectInstallCode(t *testing.T, what string, ctx *testRpcContext, code entity.RaftErrorCode) {
+	t.Helper()
+	if _, st := waitInstallResponse(t, ctx); st.GetCode() != code {
+		t.Fatalf("%s, status %d %s, expect %d", what, st.GetCode(), st.GetMsg(), code)
+	}
+}
+
+func expectInstallSuccess(t *testing.T, what string, ctx *testRpcContext) {
+	t.Helper()
+	resp, st := waitInstallResponse(t, ctx)
+	if !st.IsOK() || !resp.GetSuccess() {
+		t.Fatalf("%s, response %v, status %d %s", what, resp, st.GetCode(), st.GetMsg())
+	}
+}
+
+func readerIDOf(t *testing.T, uri string) int64 {
+	t.Helper()
+	readerID, err := strconv.ParseInt(uri[strings.LastIndex(uri, "/")+1:], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readerID
+}
+
+func TestSnapshotExecutorInstallSuperseded(t *testing.T) {
+	env := newCopierTestEnv(t)
+	oldURI := env.reader.GenerateURIForCopy()
+	// leader 上生成了一个更新的快照，旧的快照被 env.reader 引用，两个快照都可以下载
+	writer := env.leader.Create()
+	writer.SaveMeta(&raft.SnapshotMeta{LastIncludedIndex: 9, LastIncludedTerm: 1})
+	if err := writer.Close(false); err != nil {
+		t.Fatal(err)
+	}
+	newReader := env.leader.Open()
+	defer newReader.Close()
+	newURI := newReader.GenerateURIForCopy()
+
+	// 旧的快照一直下载失败，copier 在两次重试之间等待，直到被取消
+	oldReaderID := readerIDOf(t, oldURI)
+	env.server.setFail(func(req *raft.GetFileRequest) bool {
+		return req.GetReaderID() == oldReaderID
+	})
+	lm := newTestLogManager(t, NewMemoryLogStorage(), NewDefaultRaftOptions())
+	fsm := &loadOnlyFSMCaller{}
+	se := NewSnapshotExecutor()
+	if !se.Init(SnapshotExecutorOptions{
+		URI:                t.TempDir(),
+		FsmCaller:          fsm,
+		LogManager:         lm,
+		InitTerm:           1,
+		RaftClientOperator: env.opts.RaftClientOperator,
+		NodeOpts:           NewDefaultNodeOptions(),
+		RaftOpts:           env.opts.RaftOpts,
+	}) {
+		t.Fatal("fail to init snapshot executor")
+	}
+	t.Cleanup(func() {
+		se.Shutdown()
+		se.Join()
+	})
+
+	// 下载期间 InstallSnapshot 一直阻塞，在单独的协程中调用
+	first, retried := newTestRpcContext(), newTestRpcContext()
+	go installTestSnapshot(se, 7, oldURI, first)
+	waitUntil(t, "old snapshot to be downloading", func() bool {
+		return env.server.requestCount(raftSnapshotMetaFile) > 0
+	})
+
+	// leader 重试同一个快照，新的请求替换掉旧的请求，旧的请求收到 EINTR
+	go installTestSnapshot(se, 7, oldURI, retried)
+	expectInstallCode(t, "retried install request", first, entity.EINTR)
+	// 比正在下载的快照更旧的请求直接拒绝
+	older := newTestRpcContext()
+	installTestSnapshot(se, 5, oldURI, older)
+	expectInstallCode(t, "older install request", older, entity.EINVAL)
+
+	// 更新的快照取消正在进行的下载，本次请求返回 EBUSY，等待 leader 重试
+	newer := newTestRpcContext()
+	installTestSnapshot(se, 9, newURI, newer)
+	expectInstallCode(t, "newer install request", newer, entity.EBUSY)
+	expectInstallCode(t, "superseded install request", retried, entity.ECANCELED)
+	waitUntil(t, "superseded download to stop", func() bool {
+		return !se.IsInstallingSnapshot()
+	})
+	if se.GetLastSnapshotIndex() != 0 {
+		t.Fatalf("superseded snapshot is installed, last snapshot index %d", se.GetLastSnapshotIndex())
+	}
+
+	// leader 重试更新的快照，下载并加载成功
+	newer = newTestRpcContext()
+	installTestSnapshot(se, 9, newURI, newer)
+	expectInstallSuccess(t, "retried newer install request", newer)
+	if se.GetLastSnapshotIndex() != 9 || atomic.LoadInt64(&fsm.loadedIndex) != 9 {
+		t.Fatalf("last snapshot index %d, loaded index %d, expect 9", se.GetLastSnapshotIndex(),
+			atomic.LoadInt64(&fsm.loadedIndex))
+	}
+	if id := lm.GetLastLogID(false); id.GetIndex() != 9 {
+		t.Fatalf("last log index %d after installing snapshot, expect 9", id.GetIndex())
+	}
+	if reader := se.GetSnapshotStorage().Open(); reader == nil || !proto.Equal(reader.Load(),
+		&raft.SnapshotMeta{LastIncludedIndex: 9, LastIncludedTerm: 1}) {
+		t.Fatal("installed snapshot is not the newer one")
+	} else {
+		reader.Close()
+	}
+	// 已经安装过的快照不需要再次下载
+	stale := newTestRpcContext()
+	installTestSnapshot(se, 7, oldURI, stale)
+	expectInstallSuccess(t, "stale install request", stale)
+}
+
+//blockingLoadFSMCaller 加载快照时通知 loading，直到 release 关闭之后才完成加载
+type blockingLoadFSMCaller struct {
+	loadOnlyFSMCaller
+	loading chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingLoadFSMCaller) OnSnapshotLoad(done LoadSnapshotClosure) bool {
+	go func() {
+		close(f.loading)
+		<-f.release
+		atomic.StoreInt64(&f.loadedIndex, done.Start().Load().GetLastIncludedIndex())
+		done.Run(entity.StatusOK())
+	}()
+	return true
+}
+
+func TestSnapshotExecutorRetryDuringLoad(t *testing.T) {
+	env := newCopierTestEnv(t)
+	uri := env.reader.GenerateURIForCopy()
+	fsm := &blockingLoadFSMCaller{loading: make(chan struct{}), release: make(chan struct{})}
+	se := NewSnapshotExecutor()
+	if !se.Init(SnapshotExecutorOptions{
+		URI:                t.TempDir(),
+		FsmCaller:          fsm,
+		LogManager:         newTestLogManager(t, NewMemoryLogStorage(), NewDefaultRaftOptions()),
+		InitTerm:           1,
+		RaftClientOperator: env.opts.RaftClientOperator,
+		NodeOpts:           NewDefaultNodeOptions(),
+		RaftOpts:           env.opts.RaftOpts,
+	}) {
+		t.Fatal("fail to init snapshot executor")
+	}
+	t.Cleanup(func() {
+		se.Shutdown()
+		se.Join()
+	})
+	// 先于 Join 执行，测试失败时不会一直阻塞在加载中的快照上
+	t.Cleanup(func() {
+		select {
+		case <-fsm.release:
+		default:
+			close(fsm.release)
+		}
+	})
+
+	first := newTestRpcContext()
+	installTestSnapshot(se, 7, uri, first)
+	select {
+	case <-fsm.loading:
+	case <-time.After(testWaitTimeout):
+		t.Fatal("snapshot is not loaded")
+	}
+
+	// 加载期间 leader 重试同一个快照，copier 已经释放，重试的请求由正在进行的加载回复
+	retried := newTestRpcContext()
+	installTestSnapshot(se, 7, uri, retried)
+	expectInstallCode(t, "install request replaced during loading", first, entity.EINTR)
+	select {
+	case <-retried.respC:
+		t.Fatal("retried install request is replied before the snapshot is loaded")
+	default:
+	}
+	close(fsm.release)
+	expectInstallSuccess(t, "retried install request", retried)
+	if se.GetLastSnapshotIndex() != 7 || atomic.LoadInt64(&fsm.loadedIndex) != 7 {
+		t.Fatalf("last snapshot index %d, loaded index %d, expect 7", se.GetLastSnapshotIndex(),
+			atomic.LoadInt64(&fsm.loadedIndex))
+	}
+}
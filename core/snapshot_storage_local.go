@@ -0,0 +1,565 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/utils"
+)
+
+//localSnapshotMetaTable 快照的元数据表，记录快照的 SnapshotMeta 以及快照中每一个文件的 LocalFileMeta
+type localSnapshotMetaTable struct {
+	meta  *raft.SnapshotMeta
+	files map[string]*raft.LocalFileMeta
+}
+
+func newLocalSnapshotMetaTable() *localSnapshotMetaTable {
+	return &localSnapshotMetaTable{
+		files: make(map[string]*raft.LocalFileMeta),
+	}
+}
+
+func (t *localSnapshotMetaTable) addFile(fileName string, meta *raft.LocalFileMeta) bool {
+	if _, ok := t.files[fileName]; ok {
+		return false
+	}
+	t.files[fileName] = meta
+	return true
+}
+
+func (t *localSnapshotMetaTable) removeFile(fileName string) bool {
+	if _, ok := t.files[fileName]; !ok {
+		return false
+	}
+	delete(t.files, fileName)
+	return true
+}
+
+func (t *localSnapshotMetaTable) listFiles() []string {
+	names := make([]string, 0, len(t.files))
+	for name := range t.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t *localSnapshotMetaTable) getFileMeta(fileName string) *raft.LocalFileMeta {
+	return t.files[fileName]
+}
+
+func (t *localSnapshotMetaTable) hasMeta() bool {
+	return t.meta != nil
+}
+
+func (t *localSnapshotMetaTable) saveToBytes() ([]byte, error) {
+	pbMeta := &raft.LocalSnapshotPbMeta{
+		Meta:  t.meta,
+		Files: make([]*raft.LocalSnapshotPbMeta_File, 0, len(t.files)),
+	}
+	for _, name := range t.listFiles() {
+		pbMeta.Files = append(pbMeta.Files, &raft.LocalSnapshotPbMeta_File{
+			Name: name,
+			Meta: t.files[name],
+		})
+	}
+	return proto.Marshal(pbMeta)
+}
+
+func (t *localSnapshotMetaTable) loadFromBytes(b []byte) error {
+	pbMeta := &raft.LocalSnapshotPbMeta{}
+	if err := proto.Unmarshal(b, pbMeta); err != nil {
+		return err
+	}
+	t.meta = pbMeta.GetMeta()
+	t.files = make(map[string]*raft.LocalFileMeta)
+	for _, f := range pbMeta.GetFiles() {
+		t.files[f.GetName()] = f.GetMeta()
+	}
+	return nil
+}
+
+func (t *localSnapshotMetaTable) saveToFile(path string) error {
+	b, err := t.saveToBytes()
+	if err != nil {
+		return err
+	}
+	return utils.AtomicWriteFile(path, b, 0644)
+}
+
+func (t *localSnapshotMetaTable) loadFromFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return t.loadFromBytes(b)
+}
+
+//LocalSnapshotStorage 基于本地文件系统的快照存储，每一个快照对应 SnapshotURI 下的一个 snapshot_<index> 目录，
+//新的快照先写入 temp 目录，完成之后再 rename 为正式目录，只保留最新的一个快照
+type LocalSnapshotStorage struct {
+	lock                   sync.Mutex
+	path                   string
+	raftOpts               RaftOptions
+	lastSnapshotIndex      int64
+	refMap                 map[int64]int64
+	filterBeforeCopyRemote bool
+	addr                   entity.Endpoint
+	snapshotThrottle       SnapshotThrottle
+}
+
+func NewLocalSnapshotStorage(uri string, raftOpts RaftOptions) *LocalSnapshotStorage {
+	return &LocalSnapshotStorage{
+		path:     strings.TrimPrefix(uri, FileLogStorageURISchema),
+		raftOpts: raftOpts,
+		refMap:   make(map[int64]int64),
+	}
+}
+
+//Init 清理上一次遗留的 temp 目录以及过期的快照，只保留 index 最大的一个快照
+func (lss *LocalSnapshotStorage) Init() bool {
+	if err := os.MkdirAll(lss.path, 0755); err != nil {
+		utils.RaftLog.Error("fail to create snapshot dir %s : %s", lss.path, err)
+		return false
+	}
+	tempPath := filepath.Join(lss.path, raftSnapshotTempPath)
+	if err := os.RemoveAll(tempPath); err != nil {
+		utils.RaftLog.Error("fail to delete temp snapshot path %s : %s", tempPath, err)
+		return false
+	}
+	files, err := ioutil.ReadDir(lss.path)
+	if err != nil {
+		utils.RaftLog.Error("fail to list snapshot dir %s : %s", lss.path, err)
+		return false
+	}
+	indexes := make([]int64, 0)
+	for _, f := range files {
+		if !f.IsDir() || !strings.HasPrefix(f.Name(), raftSnapshotPrefix) {
+			continue
+		}
+		index, err := strconv.ParseInt(strings.TrimPrefix(f.Name(), raftSnapshotPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	if len(indexes) == 0 {
+		return true
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i] < indexes[j]
+	})
+	for _, index := range indexes[:len(indexes)-1] {
+		if !lss.destroySnapshot(lss.getSnapshotPath(index)) {
+			return false
+		}
+	}
+	lss.lastSnapshotIndex = indexes[len(indexes)-1]
+	lss.ref(lss.lastSnapshotIndex)
+	return true
+}
+
+func (lss *LocalSnapshotStorage) Shutdown() {
+}
+
+//SetServerAddr 设置本节点对外提供文件服务的地址，用于生成 remote:// 形式的快照 uri
+func (lss *LocalSnapshotStorage) SetServerAddr(addr entity.Endpoint) {
+	defer lss.lock.Unlock()
+	lss.lock.Lock()
+	lss.addr = addr
+}
+
+//SetSnapshotThrottle 设置快照传输的限流器，leader 提供文件下载以及 follower 下载快照时都会使用
+func (lss *LocalSnapshotStorage) SetSnapshotThrottle(throttle SnapshotThrottle) {
+	defer lss.lock.Unlock()
+	lss.lock.Lock()
+	lss.snapshotThrottle = throttle
+}
+
+func (lss *LocalSnapshotStorage) GetPath() string {
+	return lss.path
+}
+
+func (lss *LocalSnapshotStorage) getSnapshotPath(index int64) string {
+	return filepath.Join(lss.path, raftSnapshotPrefix+strconv.FormatInt(index, 10))
+}
+
+func (lss *LocalSnapshotStorage) ref(index int64) {
+	defer lss.lock.Unlock()
+	lss.lock.Lock()
+	lss.refMap[index]++
+}
+
+//unref 引用计数归零并且不再是最新快照时删除快照目录
+func (lss *LocalSnapshotStorage) unref(index int64) {
+	lss.lock.Lock()
+	lss.refMap[index]--
+	if lss.refMap[index] > 0 {
+		lss.lock.Unlock()
+		return
+	}
+	delete(lss.refMap, index)
+	lss.lock.Unlock()
+	lss.destroySnapshot(lss.getSnapshotPath(index))
+}
+
+func (lss *LocalSnapshotStorage) destroySnapshot(path string) bool {
+	utils.RaftLog.Info("Deleting snapshot %s.", path)
+	if err := os.RemoveAll(path); err != nil {
+		utils.RaftLog.Error("fail to destroy snapshot %s : %s", path, err)
+		return false
+	}
+	return true
+}
+
+func (lss *LocalSnapshotStorage) SetFilterBeforeCopyRemote() bool {
+	lss.filterBeforeCopyRemote = true
+	return true
+}
+
+//Create 在 temp 目录下创建一个新的快照，temp 目录中遗留的数据会被清空
+func (lss *LocalSnapshotStorage) Create() SnapshotWriter {
+	return lss.create(true)
+}
+
+func (lss *LocalSnapshotStorage) create(fromEmpty bool) SnapshotWriter {
+	tempPath := filepath.Join(lss.path, raftSnapshotTempPath)
+	if fromEmpty && !lss.destroySnapshot(tempPath) {
+		return nil
+	}
+	writer := newLocalSnapshotWriter(tempPath, lss, lss.raftOpts)
+	if !writer.init() {
+		utils.RaftLog.Error("Fail to init snapshot writer %s.", tempPath)
+		return nil
+	}
+	return writer
+}
+
+//Open 打开最新的快照，没有快照时返回 nil，使用完毕之后需要调用 SnapshotReader.Close
+func (lss *LocalSnapshotStorage) Open() SnapshotReader {
+	lss.lock.Lock()
+	if lss.lastSnapshotIndex == 0 {
+		lss.lock.Unlock()
+		utils.RaftLog.Warn("No data for snapshot reader %s.", lss.path)
+		return nil
+	}
+	lastSnapshotIndex := lss.lastSnapshotIndex
+	lss.refMap[lastSnapshotIndex]++
+	addr := lss.addr
+	throttle := lss.snapshotThrottle
+	lss.lock.Unlock()
+
+	reader := newLocalSnapshotReader(lss, lastSnapshotIndex, lss.getSnapshotPath(lastSnapshotIndex), addr, throttle)
+	if !reader.init() {
+		lss.unref(lastSnapshotIndex)
+		return nil
+	}
+	return reader
+}
+
+//CopyFrom 从 remote:// 形式的 uri 下载快照，阻塞直到下载完成，失败时返回 nil
+func (lss *LocalSnapshotStorage) CopyFrom(uri string, opts SnapshotCopierOptions) SnapshotReader {
+	copier := lss.StartToCopyFrom(uri, opts)
+	if copier == nil {
+		return nil
+	}
+	copier.Join()
+	if !copier.Status().IsOK() {
+		utils.RaftLog.Error("Fail to copy snapshot from %s : %s", uri, copier.Status().GetMsg())
+		return nil
+	}
+	return copier.GetReader()
+}
+
+//StartToCopyFrom 异步的从 remote:// 形式的 uri 下载快照，调用方通过 SnapshotCopier.Join 等待下载完成
+func (lss *LocalSnapshotStorage) StartToCopyFrom(uri string, opts SnapshotCopierOptions) SnapshotCopier {
+	lss.lock.Lock()
+	throttle := lss.snapshotThrottle
+	lss.lock.Unlock()
+	copier := newLocalSnapshotCopier(lss, lss.filterBeforeCopyRemote)
+	if !copier.init(uri, throttle, opts) {
+		utils.RaftLog.Error("Fail to init copier to %s.", uri)
+		return nil
+	}
+	copier.Start()
+	return copier
+}
+
+//close 完成一个快照的写入：落盘元数据，将 temp 目录 rename 为 snapshot_<index>，并删除旧的快照
+func (lss *LocalSnapshotStorage) close(writer *LocalSnapshotWriter, keepDataOnError bool) error {
+	err := func() error {
+		if !writer.Status().IsOK() {
+			return fmt.Errorf("snapshot writer status is not ok : %s", writer.Status().GetMsg())
+		}
+		if err := writer.sync(); err != nil {
+			return err
+		}
+		lss.lock.Lock()
+		oldIndex := lss.lastSnapshotIndex
+		lss.lock.Unlock()
+		newIndex := writer.getSnapshotIndex()
+		if oldIndex == newIndex {
+			return fmt.Errorf("snapshot %d already exists", newIndex)
+		}
+		newPath := lss.getSnapshotPath(newIndex)
+		if !lss.destroySnapshot(newPath) {
+			return fmt.Errorf("fail to delete stale snapshot %s", newPath)
+		}
+		// rename 之前快照中的文件以及删除旧目录的操作必须已经落盘，否则掉电之后 snapshot_<index> 中可能是不完整的数据
+		if err := utils.SyncTree(writer.GetPath()); err != nil {
+			return err
+		}
+		if err := utils.SyncDir(lss.path); err != nil {
+			return err
+		}
+		utils.RaftLog.Info("Renaming %s to %s.", writer.GetPath(), newPath)
+		if err := os.Rename(writer.GetPath(), newPath); err != nil {
+			return err
+		}
+		if err := utils.SyncDir(lss.path); err != nil {
+			return err
+		}
+		lss.ref(newIndex)
+		lss.lock.Lock()
+		lss.lastSnapshotIndex = newIndex
+		lss.lock.Unlock()
+		if oldIndex != 0 {
+			lss.unref(oldIndex)
+		}
+		return nil
+	}()
+	if err != nil {
+		utils.RaftLog.Error("Fail to close snapshot writer %s : %s", writer.GetPath(), err)
+		if !keepDataOnError {
+			lss.destroySnapshot(writer.GetPath())
+		}
+	}
+	return err
+}
+
+//LocalSnapshotWriter 写入本地快照，用户状态机将快照文件写入 GetPath 对应的目录之后调用 AddFile 登记文件
+type LocalSnapshotWriter struct {
+	lock      sync.Mutex
+	path      string
+	storage   *LocalSnapshotStorage
+	raftOpts  RaftOptions
+	metaTable *localSnapshotMetaTable
+	status    entity.Status
+}
+
+func newLocalSnapshotWriter(path string, storage *LocalSnapshotStorage, raftOpts RaftOptions) *LocalSnapshotWriter {
+	return &LocalSnapshotWriter{
+		path:      path,
+		storage:   storage,
+		raftOpts:  raftOpts,
+		metaTable: newLocalSnapshotMetaTable(),
+		status:    entity.NewEmptyStatus(),
+	}
+}
+
+func (lsw *LocalSnapshotWriter) init() bool {
+	if err := os.MkdirAll(lsw.path, 0755); err != nil {
+		utils.RaftLog.Error("Fail to create directory %s : %s", lsw.path, err)
+		lsw.status.SetError(entity.EIO, "Fail to create directory %s", lsw.path)
+		return false
+	}
+	metaPath := filepath.Join(lsw.path, raftSnapshotMetaFile)
+	if utils.FileExist(metaPath) {
+		if err := lsw.metaTable.loadFromFile(metaPath); err != nil {
+			utils.RaftLog.Error("Fail to load snapshot meta %s : %s", metaPath, err)
+			lsw.status.SetError(entity.EIO, "Fail to load snapshot meta %s", metaPath)
+			return false
+		}
+	}
+	return true
+}
+
+func (lsw *LocalSnapshotWriter) getSnapshotIndex() int64 {
+	defer lsw.lock.Unlock()
+	lsw.lock.Lock()
+	if !lsw.metaTable.hasMeta() {
+		return 0
+	}
+	return lsw.metaTable.meta.GetLastIncludedIndex()
+}
+
+func (lsw *LocalSnapshotWriter) sync() error {
+	defer lsw.lock.Unlock()
+	lsw.lock.Lock()
+	if !lsw.metaTable.hasMeta() {
+		return fmt.Errorf("snapshot meta is not set")
+	}
+	return lsw.metaTable.saveToFile(filepath.Join(lsw.path, raftSnapshotMetaFile))
+}
+
+func (lsw *LocalSnapshotWriter) GetPath() string {
+	return lsw.path
+}
+
+func (lsw *LocalSnapshotWriter) ListFiles() []string {
+	defer lsw.lock.Unlock()
+	lsw.lock.Lock()
+	return lsw.metaTable.listFiles()
+}
+
+func (lsw *LocalSnapshotWriter) GetFileMeta(fileName string) proto.Message {
+	defer lsw.lock.Unlock()
+	lsw.lock.Lock()
+	if meta := lsw.metaTable.getFileMeta(fileName); meta != nil {
+		return meta
+	}
+	return nil
+}
+
+func (lsw *LocalSnapshotWriter) Status() entity.Status {
+	return lsw.status
+}
+
+func (lsw *LocalSnapshotWriter) SaveMeta(meta *raft.SnapshotMeta) bool {
+	defer lsw.lock.Unlock()
+	lsw.lock.Lock()
+	lsw.metaTable.meta = proto.Clone(meta).(*raft.SnapshotMeta)
+	return true
+}
+
+//AddFile 登记快照中的文件，meta 为 nil 或者没有设置 checksum 时，根据文件内容计算 checksum
+func (lsw *LocalSnapshotWriter) AddFile(fileName string, meta proto.Message) bool {
+	fileMeta := &raft.LocalFileMeta{}
+	if meta != nil {
+		m, ok := meta.(*raft.LocalFileMeta)
+		if !ok {
+			utils.RaftLog.Error("Invalid file meta type %T for file %s", meta, fileName)
+			return false
+		}
+		fileMeta = proto.Clone(m).(*raft.LocalFileMeta)
+	}
+	if fileMeta.Checksum == "" {
+		checksum, err := utils.FileChecksum(filepath.Join(lsw.path, fileName))
+		if err != nil {
+			utils.RaftLog.Error("Fail to compute checksum of snapshot file %s : %s", fileName, err)
+			return false
+		}
+		fileMeta.Checksum = checksum
+	}
+	defer lsw.lock.Unlock()
+	lsw.lock.Lock()
+	return lsw.metaTable.addFile(fileName, fileMeta)
+}
+
+func (lsw *LocalSnapshotWriter) RemoveFile(fileName string) bool {
+	defer lsw.lock.Unlock()
+	lsw.lock.Lock()
+	return lsw.metaTable.removeFile(fileName)
+}
+
+func (lsw *LocalSnapshotWriter) Close(keepDataOnError bool) error {
+	return lsw.storage.close(lsw, keepDataOnError)
+}
+
+//LocalSnapshotReader 读取本地快照，持有快照的引用，Close 之前快照目录不会被删除
+type LocalSnapshotReader struct {
+	lock      sync.Mutex
+	path      string
+	index     int64
+	addr      entity.Endpoint
+	readerID  int64
+	throttle  SnapshotThrottle
+	storage   *LocalSnapshotStorage
+	metaTable *localSnapshotMetaTable
+	status    entity.Status
+	closeOnce sync.Once
+}
+
+func newLocalSnapshotReader(storage *LocalSnapshotStorage, index int64, path string, addr entity.Endpoint,
+	throttle SnapshotThrottle) *LocalSnapshotReader {
+	return &LocalSnapshotReader{
+		path:      path,
+		index:     index,
+		addr:      addr,
+		throttle:  throttle,
+		storage:   storage,
+		metaTable: newLocalSnapshotMetaTable(),
+		status:    entity.NewEmptyStatus(),
+	}
+}
+
+func (lsr *LocalSnapshotReader) init() bool {
+	if !utils.FileExist(lsr.path) {
+		utils.RaftLog.Error("No such snapshot path %s.", lsr.path)
+		lsr.status.SetError(entity.ENOENT, "No such snapshot path %s", lsr.path)
+		return false
+	}
+	metaPath := filepath.Join(lsr.path, raftSnapshotMetaFile)
+	if err := lsr.metaTable.loadFromFile(metaPath); err != nil {
+		utils.RaftLog.Error("Fail to load snapshot meta %s : %s", metaPath, err)
+		lsr.status.SetError(entity.EIO, "Fail to load snapshot meta %s", metaPath)
+		return false
+	}
+	return true
+}
+
+func (lsr *LocalSnapshotReader) GetPath() string {
+	return lsr.path
+}
+
+func (lsr *LocalSnapshotReader) ListFiles() []string {
+	return lsr.metaTable.listFiles()
+}
+
+func (lsr *LocalSnapshotReader) GetFileMeta(fileName string) proto.Message {
+	if meta := lsr.metaTable.getFileMeta(fileName); meta != nil {
+		return meta
+	}
+	return nil
+}
+
+func (lsr *LocalSnapshotReader) Status() entity.Status {
+	return lsr.status
+}
+
+func (lsr *LocalSnapshotReader) Load() *raft.SnapshotMeta {
+	if !lsr.metaTable.hasMeta() {
+		return nil
+	}
+	return proto.Clone(lsr.metaTable.meta).(*raft.SnapshotMeta)
+}
+
+//GenerateURIForCopy 将快照注册到 FileService 中，生成 remote://ip:port/readerID 形式的 uri 供 follower 下载
+func (lsr *LocalSnapshotReader) GenerateURIForCopy() string {
+	if lsr.addr.GetIP() == "" {
+		utils.RaftLog.Error("Address is not specified, snapshot %s can not be copied.", lsr.path)
+		return ""
+	}
+	defer lsr.lock.Unlock()
+	lsr.lock.Lock()
+	if lsr.readerID == 0 {
+		lsr.readerID = GetFileService().AddReader(NewSnapshotFileReader(lsr.path, lsr.metaTable, lsr.throttle))
+	}
+	return fmt.Sprintf("%s%s/%d", RemoteSnapshotURISchema, lsr.addr.GetDesc(), lsr.readerID)
+}
+
+func (lsr *LocalSnapshotReader) Close() {
+	lsr.closeOnce.Do(func() {
+		lsr.lock.Lock()
+		if lsr.readerID != 0 {
+			GetFileService().RemoveReader(lsr.readerID)
+			lsr.readerID = 0
+		}
+		lsr.lock.Unlock()
+		lsr.storage.unref(lsr.index)
+	})
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/utils"
+)
+
+//saveTestSnapshot 在 storage 中保存一个 lastIncludedIndex 为 index 的快照，files 为文件名到文件内容的映射
+func saveTestSnapshot(t *testing.T, storage *LocalSnapshotStorage, index int64, files map[string]string) {
+	t.Helper()
+	writer := storage.Create()
+	if writer == nil {
+		t.Fatal("fail to create snapshot writer")
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(writer.GetPath(), name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !writer.AddFile(name, nil) {
+			t.Fatalf("fail to add file %s", name)
+		}
+	}
+	peers := make([]string, 0, 3)
+	for _, peer := range newTestPeers(3) {
+		peers = append(peers, peer.GetDesc())
+	}
+	writer.SaveMeta(&raft.SnapshotMeta{
+		LastIncludedIndex: index,
+		LastIncludedTerm:  2,
+		Peers:             peers,
+	})
+	if err := writer.Close(false); err != nil {
+		t.Fatalf("fail to close snapshot writer : %s", err)
+	}
+}
+
+func snapshotExists(storage *LocalSnapshotStorage, index int64) bool {
+	return utils.FileExist(storage.getSnapshotPath(index))
+}
+
+func TestLocalSnapshotStorageRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewLocalSnapshotStorage(FileLogStorageURISchema+dir, NewDefaultRaftOptions())
+	if !storage.Init() {
+		t.Fatal("fail to init snapshot storage")
+	}
+	if storage.Open() != nil {
+		t.Fatal("empty snapshot storage should have no reader")
+	}
+	saveTestSnapshot(t, storage, 5, map[string]string{"data": "v5"})
+	saveTestSnapshot(t, storage, 9, map[string]string{"data": "v9", "index": "9"})
+	if snapshotExists(storage, 5) {
+		t.Fatal("older snapshot should be removed once a newer one is saved")
+	}
+
+	reader := storage.Open()
+	meta := reader.Load()
+	if meta.GetLastIncludedIndex() != 9 || meta.GetLastIncludedTerm() != 2 || len(meta.GetPeers()) != 3 {
+		t.Fatalf("snapshot meta : %v", meta)
+	}
+	if files := reader.ListFiles(); len(files) != 2 {
+		t.Fatalf("snapshot files : %v", files)
+	}
+	if fileMeta := reader.GetFileMeta("data").(*raft.LocalFileMeta); fileMeta.GetChecksum() == "" {
+		t.Fatal("checksum of snapshot file is not computed")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(reader.GetPath(), "data")); err != nil || string(data) != "v9" {
+		t.Fatalf("snapshot file data %q : %v", data, err)
+	}
+
+	// 被 reader 引用的快照在新的快照保存之后依旧保留，直到 reader 关闭
+	saveTestSnapshot(t, storage, 12, nil)
+	if !snapshotExists(storage, 9) {
+		t.Fatal("snapshot referenced by a reader is removed")
+	}
+	reader.Close()
+	if snapshotExists(storage, 9) {
+		t.Fatal("unreferenced snapshot is kept")
+	}
+
+	// 重启之后只保留最新的快照，残留的 temp 目录以及过期的快照都会被清理
+	if err := os.MkdirAll(storage.getSnapshotPath(3), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, raftSnapshotTempPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	storage = NewLocalSnapshotStorage(FileLogStorageURISchema+dir, NewDefaultRaftOptions())
+	if !storage.Init() {
+		t.Fatal("fail to reopen snapshot storage")
+	}
+	reader = storage.Open()
+	defer reader.Close()
+	if meta := reader.Load(); meta.GetLastIncludedIndex() != 12 {
+		t.Fatalf("reopened snapshot meta : %v", meta)
+	}
+	if snapshotExists(storage, 3) || utils.FileExist(filepath.Join(dir, raftSnapshotTempPath)) {
+		t.Fatal("stale snapshot or temp dir is kept after reopen")
+	}
+}
+
+func TestLocalSnapshotWriterFailure(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewLocalSnapshotStorage(dir, NewDefaultRaftOptions())
+	if !storage.Init() {
+		t.Fatal("fail to init snapshot storage")
+	}
+	// 没有设置元数据的快照不能生效，temp 目录被清理
+	writer := storage.Create()
+	if err := writer.Close(false); err == nil {
+		t.Fatal("snapshot without meta must fail to close")
+	}
+	if storage.Open() != nil || utils.FileExist(filepath.Join(dir, raftSnapshotTempPath)) {
+		t.Fatal("failed snapshot is visible")
+	}
+	// 登记不存在的文件失败
+	writer = storage.Create()
+	if writer.AddFile("missing", nil) {
+		t.Fatal("add a missing file to snapshot")
+	}
+}
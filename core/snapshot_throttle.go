@@ -0,0 +1,92 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrSnapshotThrottled = errors.New("read file throttled by throughput")
+
+//ThroughputSnapshotThrottle 按照吞吐量限制快照的传输速度，将一秒划分为 checkCycleSecs 个周期，每个周期最多允许
+//throttleThroughputBytes / checkCycleSecs 个字节，当前周期的额度用完之后返回 0，调用方需要在下一个周期重试
+type ThroughputSnapshotThrottle struct {
+	lock                      sync.Mutex
+	throttleThroughputBytes   int64
+	checkCycleSecs            int64
+	lastThroughputCheckTimeUs int64
+	currThroughputBytes       int64
+	baseAligningTimeUs        int64
+}
+
+func NewThroughputSnapshotThrottle(throttleThroughputBytes, checkCycleSecs int64) *ThroughputSnapshotThrottle {
+	if checkCycleSecs <= 0 {
+		checkCycleSecs = 1
+	}
+	t := &ThroughputSnapshotThrottle{
+		throttleThroughputBytes: throttleThroughputBytes,
+		checkCycleSecs:          checkCycleSecs,
+		baseAligningTimeUs:      1000 * 1000 / checkCycleSecs,
+	}
+	t.lastThroughputCheckTimeUs = t.calculateCheckTimeUs(monotonicUs())
+	return t
+}
+
+func (t *ThroughputSnapshotThrottle) calculateCheckTimeUs(currTimeUs int64) int64 {
+	return currTimeUs / t.baseAligningTimeUs * t.baseAligningTimeUs
+}
+
+//ThrottledByThroughput 返回本次允许传输的字节数，可能小于 bytes，为 0 时表示当前周期的额度已经用完
+func (t *ThroughputSnapshotThrottle) ThrottledByThroughput(bytes int64) int64 {
+	nowUs := monotonicUs()
+	limitPerCycle := t.throttleThroughputBytes / t.checkCycleSecs
+
+	defer t.lock.Unlock()
+	t.lock.Lock()
+	if t.currThroughputBytes+bytes <= limitPerCycle {
+		t.currThroughputBytes += bytes
+		return bytes
+	}
+	if nowUs-t.lastThroughputCheckTimeUs <= t.baseAligningTimeUs {
+		// 仍然在当前周期内，尽量用完当前周期剩余的额度
+		availableSize := limitPerCycle - t.currThroughputBytes
+		t.currThroughputBytes = limitPerCycle
+		return availableSize
+	}
+	// 进入了新的周期
+	availableSize := bytes
+	if availableSize > limitPerCycle {
+		availableSize = limitPerCycle
+	}
+	t.currThroughputBytes = availableSize
+	t.lastThroughputCheckTimeUs = t.calculateCheckTimeUs(nowUs)
+	return availableSize
+}
+
+//ReturnUnusedThroughput 额度是在之前的周期获取的时候不需要归还，新的周期已经重新计算了额度
+func (t *ThroughputSnapshotThrottle) ReturnUnusedThroughput(acquired, consumed, elapsedTimeUs int64) {
+	if acquired <= consumed {
+		return
+	}
+	nowUs := monotonicUs()
+
+	defer t.lock.Unlock()
+	t.lock.Lock()
+	if nowUs-elapsedTimeUs < t.lastThroughputCheckTimeUs {
+		return
+	}
+	t.currThroughputBytes -= acquired - consumed
+	if t.currThroughputBytes < 0 {
+		t.currThroughputBytes = 0
+	}
+}
+
+var monotonicStart = time.Now()
+
+func monotonicUs() int64 {
+	return int64(time.Since(monotonicStart) / time.Microsecond)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	raft "github.com/pole-group/lraft/proto"
+)
+
+//newAlignedThroughputThrottle 在周期的前半段创建限流器，保证紧接着的几次调用落在同一个周期内
+func newAlignedThroughputThrottle(throttleThroughputBytes, checkCycleSecs int64) *ThroughputSnapshotThrottle {
+	cycleUs := 1000 * 1000 / checkCycleSecs
+	for monotonicUs()%cycleUs > cycleUs/2 {
+		time.Sleep(time.Millisecond)
+	}
+	return NewThroughputSnapshotThrottle(throttleThroughputBytes, checkCycleSecs)
+}
+
+func TestThroughputSnapshotThrottle(t *testing.T) {
+	// 每秒 1000 字节，划分为 10 个周期，每个周期 100 字节
+	throttle := newAlignedThroughputThrottle(1000, 10)
+	for _, c := range []struct {
+		bytes, expect int64
+	}{
+		{60, 60},
+		// 超出的部分被截掉，只返回当前周期剩余的额度
+		{60, 40},
+		{10, 0},
+	} {
+		if n := throttle.ThrottledByThroughput(c.bytes); n != c.expect {
+			t.Fatalf("throttled %d bytes to %d, expect %d", c.bytes, n, c.expect)
+		}
+	}
+	// 进入新的周期之后额度恢复，单次最多返回一个周期的额度
+	time.Sleep(250 * time.Millisecond)
+	if n := throttle.ThrottledByThroughput(500); n != 100 {
+		t.Fatalf("throttled 500 bytes to %d in a new cycle, expect 100", n)
+	}
+}
+
+func TestThroughputSnapshotThrottleReturnUnused(t *testing.T) {
+	throttle := newAlignedThroughputThrottle(1000, 10)
+	if n := throttle.ThrottledByThroughput(100); n != 100 {
+		t.Fatalf("throttled 100 bytes to %d, expect 100", n)
+	}
+	// 只用到了 30 字节，剩余的 70 字节归还之后可以再次获取
+	throttle.ReturnUnusedThroughput(100, 30, 0)
+	if n := throttle.ThrottledByThroughput(100); n != 70 {
+		t.Fatalf("throttled 100 bytes to %d after returning 70, expect 70", n)
+	}
+	// 上一个周期获取的额度不能归还到当前周期
+	time.Sleep(250 * time.Millisecond)
+	if n := throttle.ThrottledByThroughput(100); n != 100 {
+		t.Fatalf("throttled 100 bytes to %d in a new cycle, expect 100", n)
+	}
+	throttle.ReturnUnusedThroughput(100, 0, int64(time.Second/time.Microsecond))
+	if n := throttle.ThrottledByThroughput(10); n != 0 {
+		t.Fatalf("throttled 10 bytes to %d, quota of the last cycle is returned", n)
+	}
+}
+
+//countingThrottle 不限流，只统计获取以及归还的额度
+type countingThrottle struct {
+	acquired int64
+	returned int64
+}
+
+func (c *countingThrottle) ThrottledByThroughput(bytes int64) int64 {
+	atomic.AddInt64(&c.acquired, bytes)
+	return bytes
+}
+
+func (c *countingThrottle) ReturnUnusedThroughput(acquired, consumed, elapsedTimeUs int64) {
+	atomic.AddInt64(&c.returned, acquired-consumed)
+}
+
+func TestSnapshotCopierChargesReceivedBytes(t *testing.T) {
+	env := newCopierTestEnv(t)
+	// 每个分块的第一次请求都失败，失败的请求不消耗额度
+	failed := make(map[int64]bool)
+	env.server.setFail(func(req *raft.GetFileRequest) bool {
+		if req.GetFilename() != "large" || failed[req.GetOffset()] {
+			return false
+		}
+		failed[req.GetOffset()] = true
+		return true
+	})
+	throttle := &countingThrottle{}
+	env.follower.SetSnapshotThrottle(throttle)
+	env.checkCopied(t, env.follower.CopyFrom(env.reader.GenerateURIForCopy(), env.opts))
+	charged := atomic.LoadInt64(&throttle.acquired) - atomic.LoadInt64(&throttle.returned)
+	if expect := int64(len(env.large) + len("small")); charged != expect {
+		t.Fatalf("charged %d bytes, expect %d", charged, expect)
+	}
+}
+
+func TestSnapshotCopierThrottled(t *testing.T) {
+	env := newCopierTestEnv(t)
+	var maxCount int64
+	env.server.setFail(func(req *raft.GetFileRequest) bool {
+		if req.GetFilename() != raftSnapshotMetaFile && req.GetCount() > atomic.LoadInt64(&maxCount) {
+			atomic.StoreInt64(&maxCount, req.GetCount())
+		}
+		return false
+	})
+	// follower 每秒最多下载 200K，每个周期 20K，100000 字节的 large 至少需要 5 个周期，跨过 4 个周期的边界
+	env.follower.SetSnapshotThrottle(newAlignedThroughputThrottle(200*1000, 10))
+	start := time.Now()
+	env.checkCopied(t, env.follower.CopyFrom(env.reader.GenerateURIForCopy(), env.opts))
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("copy 100000 bytes in %s, not throttled", elapsed)
+	}
+	if n := atomic.LoadInt64(&maxCount); n > 16*1024 {
+		t.Fatalf("request %d bytes at once, more than MaxByteCountPerRpc", n)
+	}
+}
+
+func TestSnapshotFileReaderThrottled(t *testing.T) {
+	env := newCopierTestEnv(t)
+	// leader 每秒最多读取 200K，超出额度的请求回复 EAGAIN，follower 等待之后重试，不计入失败次数
+	env.leader.SetSnapshotThrottle(newAlignedThroughputThrottle(200*1000, 10))
+	reader := env.leader.Open()
+	defer reader.Close()
+	start := time.Now()
+	env.checkCopied(t, env.follower.CopyFrom(reader.GenerateURIForCopy(), env.opts))
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("copy 100000 bytes in %s, not throttled", elapsed)
+	}
+	if n := env.server.requestCount("large"); n <= 7 {
+		t.Fatalf("requests for large file %d, expect some of them to be throttled", n)
+	}
+}
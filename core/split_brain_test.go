@@ -0,0 +1,163 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pole-group/lraft/rpc"
+)
+
+//campaign 不断的发起预投票，直到 node 成为 Leader
+func (c *testCluster) campaign(node *nodeImpl) {
+	c.t.Helper()
+	waitUntil(c.t, "campaign of "+node.serverID.GetDesc(), func() bool {
+		state, _, _ := c.status(node)
+		if state == StateLeader {
+			return true
+		}
+		if state == StateFollower {
+			c.preVote(node)
+		}
+		time.Sleep(testElectionTimeoutMs / 10 * time.Millisecond)
+		return false
+	})
+}
+
+//TestPreVoteDoesNotDisruptLeader 被隔离的 Follower 不停的发起预投票也不会提升自己的任期，网络恢复之后，
+//Leader 以及仍然和 Leader 保持联系的 Follower 都会拒绝它的预投票，不会打断当前的 Leader
+func TestPreVoteDoesNotDisruptLeader(t *testing.T) {
+	c := newTestCluster(t, 3, 1)
+	n1, n2, n3 := c.nodes[0], c.nodes[1], c.nodes[2]
+	c.electSelf(n1)
+	term := c.waitLeader(n1, n2, n3)
+	c.waitCommitted(c.apply(n1, 10), n1, n2, n3)
+
+	c.network.Isolate(n3.serverID.GetEndpoint())
+	for i := 0; i < 5; i++ {
+		c.preVote(n3)
+		time.Sleep(testElectionTimeoutMs / 5 * time.Millisecond)
+	}
+	if state, n3Term, _ := c.status(n3); state != StateFollower || n3Term != term {
+		t.Fatalf("isolated node %s is %s at term %d, expect follower at term %d", n3.serverID.GetDesc(),
+			state.GetName(), n3Term, term)
+	}
+
+	c.network.HealPartition()
+	// Leader 的租约由 StepDownJob 每隔 ElectionTimeoutMs/2 续约一次，等 n3 追上日志并且续约之后再发起预投票
+	c.waitCommitted(c.apply(n1, 1), n1, n2, n3)
+	time.Sleep(testElectionTimeoutMs / 2 * time.Millisecond)
+	c.preVote(n3)
+	time.Sleep(testElectionTimeoutMs / 2 * time.Millisecond)
+	if newTerm := c.waitLeader(n1, n2, n3); newTerm != term {
+		t.Fatalf("term is raised from %d to %d by pre vote", term, newTerm)
+	}
+	c.waitCommitted(c.apply(n1, 1), n1, n2, n3)
+}
+
+//TestMinorityLeaderStepsDown 处于少数派的 Leader 联系不上半数节点之后主动降级，多数派选举出新的 Leader，
+//网络恢复之后旧 Leader 跟随新 Leader，并且没有提交的日志被新 Leader 的日志覆盖
+func TestMinorityLeaderStepsDown(t *testing.T) {
+	c := newTestCluster(t, 3, 2)
+	n1, n2, n3 := c.nodes[0], c.nodes[1], c.nodes[2]
+	c.electSelf(n1)
+	term := c.waitLeader(n1, n2, n3)
+	committedIndex := c.apply(n1, 10)
+	c.waitCommitted(committedIndex, n1, n2, n3)
+
+	c.partition([]*nodeImpl{n1}, []*nodeImpl{n2, n3})
+	c.apply(n1, 5)
+	waitUntil(t, "minority leader steps down", func() bool {
+		state, _, _ := c.status(n1)
+		return state == StateFollower
+	})
+	if _, n1Term, _ := c.status(n1); n1Term != term {
+		t.Fatalf("minority node term %d, expect %d", n1Term, term)
+	}
+
+	c.campaign(n2)
+	newTerm := c.waitLeader(n2, n3)
+	if newTerm <= term {
+		t.Fatalf("new leader term %d, expect greater than %d", newTerm, term)
+	}
+	lastIndex := c.apply(n2, 3)
+	c.waitCommitted(lastIndex, n2, n3)
+	if n1.ballotBox.GetLastCommittedIndex() != committedIndex {
+		t.Fatalf("minority node committed %d, expect %d", n1.ballotBox.GetLastCommittedIndex(), committedIndex)
+	}
+
+	c.network.HealPartition()
+	if c.waitLeader(n2, n1, n3) != newTerm {
+		t.Fatal("leader changed after heal")
+	}
+	c.waitCommitted(lastIndex, n1)
+	c.checkLogs(lastIndex, n2, n1, n3)
+}
+
+//TestReadOnlySafeUnderSplitBrain ReadOnlySafe 模式下，少数派中的旧 Leader 不能确认自己仍然是 Leader，读请求必须失败；
+//多数派中的新 Leader 即使有一个节点联系不上，也能够完成读请求
+func TestReadOnlySafeUnderSplitBrain(t *testing.T) {
+	c := newTestCluster(t, 3, 3)
+	n1, n2, n3 := c.nodes[0], c.nodes[1], c.nodes[2]
+	c.electSelf(n1)
+	c.waitLeader(n1, n2, n3)
+	committedIndex := c.apply(n1, 10)
+	c.waitCommitted(committedIndex, n1, n2, n3)
+	if resp, st := c.readIndex(n1); !st.IsOK() || !resp.Success || resp.Index < committedIndex {
+		t.Fatalf("read index on leader : %v %d %s", resp, st.GetCode(), st.GetMsg())
+	}
+
+	c.partition([]*nodeImpl{n1}, []*nodeImpl{n2, n3})
+	if resp, st := c.readIndex(n1); st.IsOK() && resp.Success {
+		t.Fatalf("minority leader serves read index %d", resp.Index)
+	}
+
+	c.campaign(n2)
+	c.waitLeader(n2, n3)
+	// 新 Leader 在自己的任期内提交了日志之后才能处理读请求
+	lastIndex := c.apply(n2, 1)
+	c.waitCommitted(lastIndex, n2, n3)
+	for i := 0; i < 5; i++ {
+		resp, st := c.readIndex(n2)
+		if !st.IsOK() || !resp.Success || resp.Index < lastIndex {
+			t.Fatalf("read index on majority leader : %v %d %s", resp, st.GetCode(), st.GetMsg())
+		}
+	}
+	if resp, st := c.readIndex(n1); st.IsOK() && resp.Success {
+		t.Fatalf("stale leader serves read index %d", resp.Index)
+	}
+}
+
+//TestReplicationUnderMessageFaults 消息延迟、丢失、重复以及乱序的情况下，日志最终仍然在所有节点上一致
+func TestReplicationUnderMessageFaults(t *testing.T) {
+	c := newTestCluster(t, 3, 4)
+	n1, n2, n3 := c.nodes[0], c.nodes[1], c.nodes[2]
+	c.electSelf(n1)
+	c.waitLeader(n1, n2, n3)
+
+	c.network.SetDefaultFault(rpc.LinkFault{
+		Latency:       time.Millisecond,
+		Jitter:        5 * time.Millisecond,
+		DropRate:      0.1,
+		DuplicateRate: 0.1,
+		ReorderRate:   0.2,
+		ReorderDelay:  20 * time.Millisecond,
+	})
+	var lastIndex int64
+	// 消息的调度顺序会影响随机数的分配，持续写入直到每一种故障都出现过
+	waitUntil(t, "all kinds of faults are injected", func() bool {
+		lastIndex = c.apply(n1, 5)
+		time.Sleep(10 * time.Millisecond)
+		stats := c.network.Stats()
+		return stats.Dropped > 0 && stats.Duplicated > 0 && stats.Reordered > 0
+	})
+	c.waitCommitted(lastIndex, n1, n2, n3)
+
+	c.network.Heal()
+	lastIndex = c.apply(n1, 1)
+	c.waitCommitted(lastIndex, n1, n2, n3)
+	c.checkLogs(lastIndex, n1, n2, n3)
+}
@@ -38,7 +38,13 @@ const (
 	ErrAppendPendingTask     = "fail to appendingTask, pendingIndex=%d"
 )
 
+//Iterator 状态机通过 Iterator 遍历一批已经提交的日志，OnApply 返回之前需要把 HasNext 为 true 的日志全部消费掉
 type Iterator interface {
+	HasNext() bool
+
+	//Next 返回当前日志的数据并且推进到下一条日志
+	Next() []byte
+
 	GetData() []byte
 
 	GetIndex() int64
@@ -114,8 +120,12 @@ func (iti *IteratorImpl) Next() {
 	}()
 
 	iti.currEntry = nil
-	if iti.currentIndex <= iti.committedIndex && iti.currentIndex+1 <= iti.committedIndex {
-		iti.currentIndex++
+	if iti.currentIndex > iti.committedIndex {
+		return
+	}
+	// 最后一条日志之后 currentIndex 停在 committedIndex + 1，IsGood 返回 false
+	iti.currentIndex++
+	if iti.currentIndex <= iti.committedIndex {
 		iti.currEntry = iti.logManager.GetEntry(iti.currentIndex)
 		if iti.currEntry == nil {
 			iti.err = iti.GetOrCreateError()
@@ -127,7 +137,7 @@ func (iti *IteratorImpl) Next() {
 }
 
 func (iti *IteratorImpl) RunTenRestClosureWithError() {
-	for i := int64(math.Max(float64(iti.currentIndex), float64(iti.firstClosureIndex))); i < iti.committedIndex; i++ {
+	for i := int64(math.Max(float64(iti.currentIndex), float64(iti.firstClosureIndex))); i <= iti.committedIndex; i++ {
 		done := iti.closures[i-iti.firstClosureIndex]
 		if done != nil {
 			if _, err := utils.RequireNonNil(iti.err, "error"); err != nil {
@@ -172,7 +182,7 @@ func (iti *IteratorImpl) GetIndex() int64 {
 }
 
 func (iti *IteratorImpl) Done() Closure {
-	if iti.currentIndex < iti.firstClosureIndex {
+	if iti.currentIndex < iti.firstClosureIndex || iti.currentIndex-iti.firstClosureIndex >= int64(len(iti.closures)) {
 		return nil
 	}
 	return iti.closures[iti.currentIndex-iti.firstClosureIndex]
@@ -218,8 +228,11 @@ func (iw *IteratorWrapper) SetErrorAndRollback(nTail int64, st entity.Status) er
 }
 
 func (iw *IteratorWrapper) GetData() []byte {
-	entry := iw.impl.Entry()
-	return utils.IF(entry != nil, entry.Data, nil).([]byte)
+	// 遍历结束之后当前日志为空
+	if entry := iw.impl.Entry(); entry != nil {
+		return entry.Data
+	}
+	return nil
 }
 
 type LastAppliedLogIndexListener interface {
@@ -296,6 +309,8 @@ type FSMCaller interface {
 
 	GetLastAppliedIndex() int64
 
+	Shutdown()
+
 	Join()
 }
 
@@ -314,6 +329,8 @@ type FSMCallerImpl struct {
 	lastAppliedLogIndexListeners []LastAppliedLogIndexListener
 	applyTaskPool                sync.Pool
 	handler                      *applyTaskHandler
+	eventBus                     *utils.EventBus
+	ownEventBus                  bool
 	rwMutex                      sync.RWMutex
 	sliceRwMutex                 sync.RWMutex
 }
@@ -327,7 +344,15 @@ func (fci *FSMCallerImpl) Init(ctx context.Context, opt FSMCallerOptions) bool {
 	fci.error = entity.RaftError{
 		ErrType: raft.ErrorType_ErrorTypeNone,
 	}
-	fci.openHandler(ctx)
+	fci.eventBus = opt.EventBus
+	if fci.eventBus == nil {
+		fci.eventBus = utils.NewEventBus()
+		fci.ownEventBus = true
+	}
+	if err := fci.openHandler(); err != nil {
+		utils.RaftLog.Error("fail to open FSMCaller handler : %s", err)
+		return false
+	}
 
 	atomic.StoreInt64(&fci.lastAppliedIndex, opt.BootstrapID.GetIndex())
 	atomic.StoreInt64(&fci.lastAppliedTerm, opt.BootstrapID.GetTerm())
@@ -335,7 +360,7 @@ func (fci *FSMCallerImpl) Init(ctx context.Context, opt FSMCallerOptions) bool {
 	return true
 }
 
-func (fci *FSMCallerImpl) openHandler(ctx context.Context) {
+func (fci *FSMCallerImpl) openHandler() error {
 	fci.applyTaskPool = sync.Pool{New: func() interface{} {
 		return &ApplyTask{}
 	}}
@@ -344,29 +369,38 @@ func (fci *FSMCallerImpl) openHandler(ctx context.Context) {
 		fsmImpl:           fci,
 	}
 
-	subCtx, _ := context.WithCancel(ctx)
-	utils.CheckErr(utils.RegisterPublisherDefault(subCtx, &ApplyTask{}))
-	utils.CheckErr(utils.RegisterSubscriber(fci.handler))
+	if err := fci.eventBus.RegisterPublisherDefault(&ApplyTask{}); err != nil {
+		return err
+	}
+	return fci.eventBus.RegisterSubscriber(fci.handler)
 }
 
+//Shutdown 提交一个 TaskShutdown，之前提交的任务全部执行完之后才会调用 StateMachine.OnShutdown，之后不再接收新的任务，
+//通过 Join 等待结束
 func (fci *FSMCallerImpl) Shutdown() {
-	var unsafe1 = unsafe.Pointer(fci.shutdownLatch)
-	if !atomic.CompareAndSwapPointer(&unsafe1, nil, unsafe.Pointer(&sync.WaitGroup{})) {
+	latch := &sync.WaitGroup{}
+	latch.Add(1)
+	if !atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&fci.shutdownLatch)), nil,
+		unsafe.Pointer(latch)) {
 		return
 	}
 	utils.RaftLog.Info("Shutting down FSMCaller...")
-	fci.shutdownLatch.Add(1)
 	at := fci.applyTaskPool.Get().(*ApplyTask)
 	at.Reset()
 	at.TType = TaskShutdown
-	at.Latch = fci.shutdownLatch
-	utils.CheckErr(utils.PublishEvent(at))
-	fci.node = nil
-	if fci.fsm != nil {
-		fci.fsm.OnShutdown()
+	at.Latch = latch
+	if err := fci.eventBus.PublishEvent(at); err != nil {
+		// 处理协程已经不会再收到任务，直接在这里通知状态机，否则 Join 会一直等待
+		utils.RaftLog.Error("fail to publish shutdown task : %s", err)
+		fci.doShutdown()
+		latch.Done()
 	}
 }
 
+func (fci *FSMCallerImpl) getShutdownLatch() *sync.WaitGroup {
+	return (*sync.WaitGroup)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&fci.shutdownLatch))))
+}
+
 func (fci *FSMCallerImpl) AddLastAppliedLogIndexListener(listener LastAppliedLogIndexListener) {
 	defer fci.sliceRwMutex.Unlock()
 	fci.sliceRwMutex.Lock()
@@ -374,11 +408,11 @@ func (fci *FSMCallerImpl) AddLastAppliedLogIndexListener(listener LastAppliedLog
 }
 
 func (fci *FSMCallerImpl) enqueueTask(at *ApplyTask) bool {
-	if fci.shutdownLatch != nil {
-		// TODO warn log
+	if fci.getShutdownLatch() != nil {
+		utils.RaftLog.Warn("FSMCaller is stopped, can not apply new task.")
 		return false
 	}
-	isOk, err := utils.PublishEventNonBlock(at)
+	isOk, err := fci.eventBus.PublishEventNonBlock(at)
 	if err != nil {
 		fci.setError(entity.RaftError{
 			ErrType: raft.ErrorType_ErrorTypeStateMachine,
@@ -425,7 +459,9 @@ func (fci *FSMCallerImpl) TestFlush() {
 	at.Reset()
 	at.TType = TaskFlush
 	at.Latch = latch
-	fci.enqueueTask(at)
+	if !fci.enqueueTask(at) {
+		return
+	}
 	latch.Wait()
 }
 
@@ -499,14 +535,20 @@ func (fci *FSMCallerImpl) GetLastAppliedIndex() int64 {
 	return atomic.LoadInt64(&fci.lastAppliedIndex)
 }
 
+//Join 等待 TaskShutdown 执行完，之后取消订阅并且回调 FSMCallerOptions.AfterShutdown
 func (fci *FSMCallerImpl) Join() {
-	if fci.shutdownLatch != nil {
-		fci.shutdownLatch.Wait()
-		if fci.afterShutdown != nil {
-			fci.afterShutdown.Run(entity.StatusOK())
-			fci.afterShutdown = nil
-		}
-		fci.shutdownLatch = nil
+	latch := fci.getShutdownLatch()
+	if latch == nil {
+		return
+	}
+	latch.Wait()
+	fci.eventBus.DeregisterSubscriber(fci.handler)
+	if fci.ownEventBus {
+		fci.eventBus.Shutdown()
+	}
+	if fci.afterShutdown != nil {
+		fci.afterShutdown.Run(entity.StatusOK())
+		fci.afterShutdown = nil
 	}
 }
 
@@ -565,7 +607,9 @@ func (fci *FSMCallerImpl) runApplyTask(task *ApplyTask, maxCommittedIndex int64,
 			fci.currTask = TaskError
 			fci.doOnError(task.Done.(*OnErrorClosure))
 		case TaskShutdown:
+			fci.currTask = TaskShutdown
 			latch = task.Latch
+			fci.doShutdown()
 		case TaskFlush:
 			latch = task.Latch
 		}
@@ -585,13 +629,11 @@ func (fci *FSMCallerImpl) doCommitted(committedIndex int64) {
 		return
 	}
 	lastAppliedIndex := atomic.LoadInt64(&fci.lastAppliedIndex)
-	if lastAppliedIndex > committedIndex {
+	if lastAppliedIndex >= committedIndex {
 		return
 	}
 
-	closures := make([]Closure, 0)
-	taskClosures := make([]TaskClosure, 0)
-	firstClosureIndex := fci.closureQueue.PopClosureUntil(committedIndex, closures, taskClosures)
+	closures, taskClosures, firstClosureIndex := fci.closureQueue.PopClosureUntil(committedIndex)
 	fci.onTaskCommitted(taskClosures)
 
 	if err := utils.RequireTrue(firstClosureIndex >= 0, "Invalid firstClosureIndex"); err != nil {
@@ -611,6 +653,8 @@ func (fci *FSMCallerImpl) doCommitted(committedIndex int64) {
 		committedIndex:    committedIndex,
 		applyingIndex:     fci.applyingIndex,
 	}
+	// 定位到 lastAppliedIndex 之后的第一条日志
+	iterImpl.Next()
 
 	for iterImpl.IsGood() {
 		logEntry := iterImpl.Entry()
@@ -619,8 +663,9 @@ func (fci *FSMCallerImpl) doCommitted(committedIndex int64) {
 			fci.doApplyTask(iterImpl)
 		} else {
 			if lType == raft.EntryType_EntryTypeConfiguration {
-				if logEntry.OldPeers != nil && len(logEntry.OldPeers) != 0 {
-					fci.fsm.OnConfigurationCommitted(entity.NewConfiguration(logEntry.Peers, entity.EmptyPeers))
+				// 只有 Stable 的配置才会通知状态机，joint 阶段的配置只是中间状态
+				if len(logEntry.OldPeers) == 0 {
+					fci.fsm.OnConfigurationCommitted(entity.NewConfiguration(logEntry.Peers, logEntry.Learners))
 				}
 			}
 			if iterImpl.Done() != nil {
@@ -675,20 +720,19 @@ func (fci *FSMCallerImpl) doSnapshotSave(closure SaveSnapshotClosure) {
 		closure.Run(st)
 		return
 	}
-	confEntry.GetConf().GetPeers().Range(func(value interface{}) {
-		snapshotMeta.Peers = append(snapshotMeta.Peers, value.(*entity.PeerId).GetDesc())
-	})
-	confEntry.GetConf().GetLearners().Range(func(value interface{}) {
-		snapshotMeta.Peers = append(snapshotMeta.Peers, value.(*entity.PeerId).GetDesc())
-	})
-	oldConf := confEntry.GetOldConf()
-	if oldConf != nil {
-		oldConf.GetPeers().Range(func(value interface{}) {
-			snapshotMeta.Peers = append(snapshotMeta.Peers, value.(*entity.PeerId).GetDesc())
-		})
-		oldConf.GetLearners().Range(func(value interface{}) {
-			snapshotMeta.Peers = append(snapshotMeta.Peers, value.(*entity.PeerId).GetDesc())
-		})
+	for _, peer := range confEntry.GetConf().ListPeers() {
+		snapshotMeta.Peers = append(snapshotMeta.Peers, peer.GetDesc())
+	}
+	for _, learner := range confEntry.GetConf().ListLearners() {
+		snapshotMeta.Learners = append(snapshotMeta.Learners, learner.GetDesc())
+	}
+	if oldConf := confEntry.GetOldConf(); oldConf != nil {
+		for _, peer := range oldConf.ListPeers() {
+			snapshotMeta.OldPeers = append(snapshotMeta.OldPeers, peer.GetDesc())
+		}
+		for _, learner := range oldConf.ListLearners() {
+			snapshotMeta.OldLearners = append(snapshotMeta.OldLearners, learner.GetDesc())
+		}
 	}
 
 	writer := closure.Start(&snapshotMeta)
@@ -748,21 +792,17 @@ func (fci *FSMCallerImpl) doSnapshotLoad(closure LoadSnapshotClosure) {
 		return
 	}
 
-	if oldPeersCnt := len(snapshotMeta.GetOldPeers()); oldPeersCnt == 0 {
-		conf := &entity.Configuration{}
-		peers := make([]entity.PeerId, oldPeersCnt)
-		for i := 0; i < oldPeersCnt; i++ {
-			peer := entity.PeerId{}
-			if err := utils.RequireTrue(peer.Parse(snapshotMeta.Peers[i]), "Parse peer failed"); err != nil {
-				utils.RaftLog.Error("peer parse from snapshot meta failed : %s", err)
-				fci.setError(entity.RaftError{
-					ErrType: raft.ErrorType_ErrorTypeStateMachine,
-					Status:  entity.NewStatus(entity.EStateMachine, "StateMachine onSnapshotLoad failed, "+err.Error()),
-				})
-			}
-			peers[i] = peer
+	if len(snapshotMeta.GetOldPeers()) == 0 {
+		conf, err := parseConfiguration(snapshotMeta.GetPeers(), snapshotMeta.GetLearners())
+		if err != nil {
+			utils.RaftLog.Error("peer parse from snapshot meta failed : %s", err)
+			closure.Run(entity.NewStatus(entity.EStateMachine, "Fail to parse configuration from snapshot meta"))
+			fci.setError(entity.RaftError{
+				ErrType: raft.ErrorType_ErrorTypeStateMachine,
+				Status:  entity.NewStatus(entity.EStateMachine, "StateMachine onSnapshotLoad failed, "+err.Error()),
+			})
+			return
 		}
-		conf.AddPeers(peers)
 		fci.fsm.OnConfigurationCommitted(conf)
 	}
 	atomic.StoreInt64(&fci.lastAppliedIndex, snapshotMeta.LastIncludedIndex)
@@ -770,6 +810,14 @@ func (fci *FSMCallerImpl) doSnapshotLoad(closure LoadSnapshotClosure) {
 	closure.Run(entity.StatusOK())
 }
 
+//doShutdown 在执行任务的协程中调用，保证 OnShutdown 是状态机收到的最后一个回调
+func (fci *FSMCallerImpl) doShutdown() {
+	fci.node = nil
+	if fci.fsm != nil {
+		fci.fsm.OnShutdown()
+	}
+}
+
 func (fci *FSMCallerImpl) doLeaderStop(status entity.Status) {
 	fci.fsm.OnLeaderStop(status)
 }
@@ -4,9 +4,48 @@
 
 package core
 
-import "github.com/pole-group/lraft/entity"
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/golang/protobuf/proto"
+	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+	"github.com/pole-group/lraft/utils"
+)
+
+const (
+	FileLogStorageURISchema   = "file://"
+	MemoryLogStorageURISchema = "mem://"
+)
+
+//NewLogStorage 根据 NodeOptions.LogURI 创建对应的 LogStorage, mem:// 为纯内存存储, 不带 schema 的 uri 默认当作本地目录处理
+func NewLogStorage(uri string, raftOpts RaftOptions) (LogStorage, error) {
+	if uri == "" {
+		return nil, fmt.Errorf("log uri must not be empty")
+	}
+	if strings.HasPrefix(uri, MemoryLogStorageURISchema) {
+		return NewMemoryLogStorage(), nil
+	}
+	return NewFileLogStorage(strings.TrimPrefix(uri, FileLogStorageURISchema), raftOpts), nil
+}
+
+const (
+	raftMetaFile = "raft_meta"
+)
+
+//RaftMetaStorage 持久化节点的 term 以及 votedFor 信息，每次修改都会先写临时文件并 fsync，然后 rename 覆盖原文件，
+//文件内容为 checksum + StablePBMeta
 type RaftMetaStorage struct {
+	lock     sync.Mutex
 	node     *nodeImpl
 	term     int64
 	path     string
@@ -15,15 +54,173 @@ type RaftMetaStorage struct {
 	isInited bool
 }
 
-// setTermAndVotedFor 
-func (rms *RaftMetaStorage) setTermAndVotedFor(term int64, peer entity.PeerId) {
+func NewRaftMetaStorage(uri string, raftOpts RaftOptions) *RaftMetaStorage {
+	return &RaftMetaStorage{
+		path:     strings.TrimPrefix(uri, FileLogStorageURISchema),
+		voteFor:  entity.EmptyPeer,
+		raftOpts: raftOpts,
+	}
+}
+
+func (rms *RaftMetaStorage) init(node *nodeImpl) bool {
+	defer rms.lock.Unlock()
+	rms.lock.Lock()
 
+	if rms.isInited {
+		utils.RaftLog.Warn("Raft meta storage is already inited.")
+		return true
+	}
+	rms.node = node
+	if rms.path == "" {
+		utils.RaftLog.Error("raft meta uri must not be empty")
+		return false
+	}
+	if err := os.MkdirAll(rms.path, 0755); err != nil {
+		utils.RaftLog.Error("fail to create raft meta dir %s : %s", rms.path, err)
+		return false
+	}
+	if err := rms.load(); err != nil {
+		utils.RaftLog.Error("fail to load raft meta from %s : %s", rms.path, err)
+		return false
+	}
+	rms.isInited = true
+	return true
 }
 
-func (rms *RaftMetaStorage) reportIOError() {
+func (rms *RaftMetaStorage) load() error {
+	buf, err := ioutil.ReadFile(filepath.Join(rms.path, raftMetaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(buf) < checksumSize || binary.BigEndian.Uint64(buf[0:checksumSize]) != utils.Checksum(buf[checksumSize:]) {
+		return fmt.Errorf("raft meta checksum mismatch")
+	}
+	meta := &raft.StablePBMeta{}
+	if err := proto.Unmarshal(buf[checksumSize:], meta); err != nil {
+		return err
+	}
+	rms.term = meta.GetTerm()
+	rms.voteFor = entity.EmptyPeer
+	if meta.GetVotedFor() != "" {
+		peer := entity.PeerId{}
+		if !peer.Parse(meta.GetVotedFor()) {
+			return fmt.Errorf("fail to parse votedFor %s", meta.GetVotedFor())
+		}
+		rms.voteFor = peer
+	}
+	return nil
+}
+
+//save 将给定的 term 以及 votedFor 落盘，只有落盘成功之后调用方才可以修改内存中的值
+func (rms *RaftMetaStorage) save(term int64, voteFor entity.PeerId) bool {
+	votedFor := ""
+	if !voteFor.IsEmpty() {
+		votedFor = voteFor.GetDesc()
+	}
+	b, err := proto.Marshal(&raft.StablePBMeta{
+		Term:     term,
+		VotedFor: votedFor,
+	})
+	if err == nil {
+		buf := make([]byte, checksumSize+len(b))
+		binary.BigEndian.PutUint64(buf[0:checksumSize], utils.Checksum(b))
+		copy(buf[checksumSize:], b)
+		err = utils.AtomicWriteFile(filepath.Join(rms.path, raftMetaFile), buf, 0644)
+	}
+	if err != nil {
+		utils.RaftLog.Error("fail to save raft meta to %s : %s", rms.path, err)
+		rms.reportIOError()
+		return false
+	}
+	return true
+}
 
+func (rms *RaftMetaStorage) checkState() bool {
+	if !rms.isInited {
+		utils.RaftLog.Error("Raft meta storage is not initialized")
+		return false
+	}
+	return true
 }
 
-func (rms *RaftMetaStorage) save() {
+func (rms *RaftMetaStorage) getTerm() int64 {
+	defer rms.lock.Unlock()
+	rms.lock.Lock()
+	return rms.term
+}
+
+func (rms *RaftMetaStorage) getVotedFor() entity.PeerId {
+	defer rms.lock.Unlock()
+	rms.lock.Lock()
+	return rms.voteFor
+}
+
+func (rms *RaftMetaStorage) setTerm(term int64) bool {
+	defer rms.lock.Unlock()
+	rms.lock.Lock()
+	if !rms.checkState() {
+		return false
+	}
+	if !rms.save(term, rms.voteFor) {
+		return false
+	}
+	rms.term = term
+	return true
+}
+
+func (rms *RaftMetaStorage) setVotedFor(peer entity.PeerId) bool {
+	defer rms.lock.Unlock()
+	rms.lock.Lock()
+	if !rms.checkState() {
+		return false
+	}
+	if !rms.save(rms.term, peer) {
+		return false
+	}
+	rms.voteFor = peer
+	return true
+}
+
+//setTermAndVotedFor 同时修改 term 以及 votedFor，两者在一次写入中落盘
+func (rms *RaftMetaStorage) setTermAndVotedFor(term int64, peer entity.PeerId) bool {
+	defer rms.lock.Unlock()
+	rms.lock.Lock()
+	if !rms.checkState() {
+		return false
+	}
+	if !rms.save(term, peer) {
+		return false
+	}
+	rms.term = term
+	rms.voteFor = peer
+	return true
+}
+
+//reportIOError 调用方往往持有 node 的锁，而 onError 需要重新获取该锁，因此这里异步的通知 node
+func (rms *RaftMetaStorage) reportIOError() {
+	node := rms.node
+	if node == nil {
+		return
+	}
+	st := entity.NewEmptyStatus()
+	st.SetError(entity.EIO, "Fail to save raft meta, path=%s", rms.path)
+	polerpc.Go(context.Background(), func(ctx context.Context) {
+		node.onError(entity.RaftError{
+			ErrType: raft.ErrorType_ErrorTypeMeta,
+			Status:  st,
+		})
+	})
+}
 
+func (rms *RaftMetaStorage) shutdown() {
+	defer rms.lock.Unlock()
+	rms.lock.Lock()
+	if !rms.isInited {
+		return
+	}
+	rms.save(rms.term, rms.voteFor)
+	rms.isInited = false
 }
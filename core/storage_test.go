@@ -0,0 +1,193 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+)
+
+func openTestRaftMetaStorage(t *testing.T, dir string) *RaftMetaStorage {
+	t.Helper()
+	meta := NewRaftMetaStorage(FileLogStorageURISchema+dir, NewDefaultRaftOptions())
+	if !meta.init(nil) {
+		t.Fatalf("fail to init raft meta storage %s", dir)
+	}
+	return meta
+}
+
+func TestRaftMetaStorageRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	meta := openTestRaftMetaStorage(t, dir)
+	if meta.getTerm() != 0 || !meta.getVotedFor().IsEmpty() {
+		t.Fatalf("new raft meta storage, term %d, votedFor %s", meta.getTerm(), meta.getVotedFor().GetDesc())
+	}
+	peer := newTestPeers(1)[0]
+	if !meta.setTermAndVotedFor(5, peer) {
+		t.Fatal("fail to save term and votedFor")
+	}
+	meta.shutdown()
+
+	meta = openTestRaftMetaStorage(t, dir)
+	if meta.getTerm() != 5 || !meta.getVotedFor().Equal(peer) {
+		t.Fatalf("reopened raft meta storage, term %d, votedFor %s", meta.getTerm(), meta.getVotedFor().GetDesc())
+	}
+	// 进入新的任期之后清空投票，重新打开之后同样没有投票
+	if !meta.setTerm(6) || !meta.setVotedFor(entity.EmptyPeer) {
+		t.Fatal("fail to save term and votedFor")
+	}
+	meta.shutdown()
+
+	meta = openTestRaftMetaStorage(t, dir)
+	if meta.getTerm() != 6 || !meta.getVotedFor().IsEmpty() {
+		t.Fatalf("reopened raft meta storage, term %d, votedFor %s", meta.getTerm(), meta.getVotedFor().GetDesc())
+	}
+	meta.shutdown()
+	if meta.setTerm(7) {
+		t.Fatal("raft meta storage is writable after shutdown")
+	}
+}
+
+func TestRaftMetaStorageBadChecksum(t *testing.T) {
+	dir := t.TempDir()
+	meta := openTestRaftMetaStorage(t, dir)
+	if !meta.setTermAndVotedFor(3, newTestPeers(1)[0]) {
+		t.Fatal("fail to save term and votedFor")
+	}
+	meta.shutdown()
+
+	path := filepath.Join(dir, raftMetaFile)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// term 以及 votedFor 无法确认时不能启动，否则可能在同一个任期内投出两票
+	if NewRaftMetaStorage(dir, NewDefaultRaftOptions()).init(nil) {
+		t.Fatal("raft meta with a bad checksum must be rejected")
+	}
+	if err := ioutil.WriteFile(path, buf[:checksumSize-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if NewRaftMetaStorage(dir, NewDefaultRaftOptions()).init(nil) {
+		t.Fatal("truncated raft meta must be rejected")
+	}
+}
+
+//errorRecorder 记录 FSMCaller 收到的错误
+type errorRecorder struct {
+	FSMCaller
+	errs chan entity.RaftError
+}
+
+func (e *errorRecorder) OnError(err entity.RaftError) bool {
+	e.errs <- err
+	return true
+}
+
+func (e *errorRecorder) GetLastAppliedIndex() int64 {
+	return 0
+}
+
+func TestRaftMetaStorageIOErrorReachesNode(t *testing.T) {
+	dir := t.TempDir()
+	recorder := &errorRecorder{errs: make(chan entity.RaftError, 2)}
+	node := &nodeImpl{
+		lock:      &sync.RWMutex{},
+		state:     StateUninitialized,
+		fsmCaller: recorder,
+	}
+	meta := NewRaftMetaStorage(dir, NewDefaultRaftOptions())
+	if !meta.init(node) {
+		t.Fatal("fail to init raft meta storage")
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if meta.setTerm(100) {
+		t.Fatal("save raft meta to a removed dir should fail")
+	}
+	// 没有落盘的值不能被读到
+	if meta.setTermAndVotedFor(101, newTestPeers(1)[0]) {
+		t.Fatal("save raft meta to a removed dir should fail")
+	}
+	if meta.getTerm() != 0 || !meta.getVotedFor().IsEmpty() {
+		t.Fatalf("unsaved raft meta is kept, term %d, votedFor %s", meta.getTerm(), meta.getVotedFor().GetDesc())
+	}
+	// 写入失败通过 node.onError 通知状态机，节点不再参与选举以及日志复制
+	select {
+	case err := <-recorder.errs:
+		if err.ErrType != raft.ErrorType_ErrorTypeMeta || err.Status.GetCode() != entity.EIO {
+			t.Fatalf("reported error %v, status %d %s", err.ErrType, err.Status.GetCode(), err.Status.GetMsg())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("io error of raft meta is not reported to node")
+	}
+}
+
+func TestRaftMetaStorageIOErrorFailsPendingReads(t *testing.T) {
+	dir := t.TempDir()
+	recorder := &errorRecorder{errs: make(chan entity.RaftError, 1)}
+	node := &nodeImpl{
+		lock:      &sync.RWMutex{},
+		state:     StateUninitialized,
+		fsmCaller: recorder,
+	}
+	node.readOnlyOperator = &ReadOnlyOperator{
+		fsmCaller:           recorder,
+		node:                node,
+		pendingNotifyStatus: make(map[int64]*list.List),
+	}
+	meta := NewRaftMetaStorage(dir, NewDefaultRaftOptions())
+	if !meta.init(node) {
+		t.Fatal("fail to init raft meta storage")
+	}
+
+	codes := make(chan entity.RaftErrorCode, 2)
+	newRead := func() *ReadIndexClosure {
+		return NewReadIndexClosure(func(status entity.Status, index int64, reqCtx []byte) {
+			codes <- status.GetCode()
+		}, time.Minute)
+	}
+	// readIndex 已经确认，等待状态机 apply 到 10
+	req := &raft.ReadIndexRequest{GroupID: testGroupID}
+	pending := NewReadIndexResponseClosure([]*ReadIndexState{NewReadIndexState(nil, newRead(), time.Now())}, req)
+	pending.readIndexOperator = node.readOnlyOperator
+	pending.Resp = &raft.ReadIndexResponse{Index: 10, Success: true}
+	pending.Run(entity.StatusOK())
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if meta.setTerm(1) {
+		t.Fatal("save raft meta to a removed dir should fail")
+	}
+	// 等待中的读请求以元数据的错误结束，之后的读请求直接失败
+	expectEIO := func(what string) {
+		t.Helper()
+		select {
+		case code := <-codes:
+			if code != entity.EIO {
+				t.Fatalf("%s, status %d, expect %d", what, code, entity.EIO)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s is not failed", what)
+		}
+	}
+	expectEIO("pending read")
+	node.readOnlyOperator.addRequest(nil, newRead())
+	expectEIO("read after error")
+}
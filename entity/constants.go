@@ -25,6 +25,7 @@ const (
 	ETransferLeaderShip = RaftErrorCode(10013)
 	ELogDeleted         = RaftErrorCode(10014)
 	ENoMoreUserLog      = RaftErrorCode(10015)
+	ELeaderRemoved      = RaftErrorCode(10016)
 	ERequest            = RaftErrorCode(1000)
 	EStop               = RaftErrorCode(1001)
 	EAGAIN              = RaftErrorCode(1002)
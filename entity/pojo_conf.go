@@ -20,33 +20,40 @@ type Configuration struct {
 }
 
 func NewEmptyConfiguration() *Configuration {
-	return &Configuration{}
+	return &Configuration{
+		peers:    utils.NewSet(),
+		learners: utils.NewSet(),
+	}
 }
 
 func NewConfiguration(peers, learners []PeerId) *Configuration {
-	var _peers []PeerId
-	var _learners []PeerId
-
+	c := NewEmptyConfiguration()
 	for _, e := range peers {
-		_peers = append(_peers, e.Copy())
+		c.peers.Add(e.Copy())
 	}
-
 	for _, e := range learners {
-		_learners = append(_learners, e.Copy())
+		c.learners.Add(e.Copy())
 	}
+	return c
+}
 
-	return &Configuration{
-		peers:    utils.NewSetWithValues(_peers),
-		learners: utils.NewSetWithValues(_learners),
+func (c *Configuration) AddPeers(peers []PeerId) {
+	for _, e := range peers {
+		c.peers.Add(e)
 	}
 }
 
-func (c *Configuration) AddPeers(peers []PeerId) {
-	c.peers.AddAll(peers)
+func (c *Configuration) AddPeer(peer PeerId) bool {
+	if c.peers.Contain(peer) {
+		return false
+	}
+	c.peers.Add(peer)
+	return true
 }
 
 func (c *Configuration) SetPeers(peers []PeerId) {
-	c.peers = utils.NewSetWithValues(peers)
+	c.peers = utils.NewSet()
+	c.AddPeers(peers)
 }
 
 func (c *Configuration) GetPeers() *utils.Set {
@@ -58,13 +65,11 @@ func (c *Configuration) Contains(id PeerId) bool {
 }
 
 func (c *Configuration) ListPeers() []PeerId {
-	ids := make([]PeerId, 0)
-	c.peers.ToSlice(ids)
-	return ids
+	return toPeerSlice(c.peers)
 }
 
 func (c *Configuration) RemovePeer(peer *PeerId) {
-	c.peers.Remove(peer)
+	c.peers.Remove(*peer)
 }
 
 func (c *Configuration) GetLearners() *utils.Set {
@@ -72,21 +77,22 @@ func (c *Configuration) GetLearners() *utils.Set {
 }
 
 func (c *Configuration) SetLearners(learners []PeerId) {
-	c.learners = utils.NewSetWithValues(learners)
+	c.learners = utils.NewSet()
+	c.AddLearners(learners)
 }
 
 func (c *Configuration) AddLearners(learners []PeerId) {
-	c.learners.AddAll(learners)
+	for _, e := range learners {
+		c.learners.Add(e)
+	}
 }
 
 func (c *Configuration) ListLearners() []PeerId {
-	ids := make([]PeerId, 0)
-	c.learners.ToSlice(ids)
-	return ids
+	return toPeerSlice(c.learners)
 }
 
 func (c *Configuration) RemoveLearners(peer *PeerId) {
-	c.learners.Remove(peer)
+	c.learners.Remove(*peer)
 }
 
 func (c *Configuration) Copy() *Configuration {
@@ -94,8 +100,9 @@ func (c *Configuration) Copy() *Configuration {
 }
 
 func (c *Configuration) IsValid() bool {
-	intersection := utils.NewSetWithValues(c.peers)
-	intersection.RetainAll(c.learners)
+	intersection := utils.NewSet()
+	intersection.AddAllWithSet(c.peers)
+	intersection.RetainAllWithSet(c.learners)
 	return c.peers.Size() != 0 && intersection.IsEmpty()
 }
 
@@ -105,18 +112,50 @@ func (c *Configuration) Rest() {
 }
 
 func (c *Configuration) IsEmpty() bool {
-	return c.peers.Size() == 0
+	return c == nil || c.peers.Size() == 0
 }
 
 func (c *Configuration) Size() int {
 	return c.peers.Size()
 }
 
+//Equal 判断两个配置的 peers 以及 learners 是否完全一致
+func (c *Configuration) Equal(other *Configuration) bool {
+	if other == nil {
+		return c.IsEmpty() && len(c.ListLearners()) == 0
+	}
+	return setEqual(c.peers, other.peers) && setEqual(c.learners, other.learners)
+}
+
+//Diff 计算 included = c - rhs，excluded = rhs - c
 func (c *Configuration) Diff(rhs, included, excluded *Configuration) {
 	included.peers = utils.NewSet()
+	included.peers.AddAllWithSet(c.peers)
 	included.peers.RemoveAllWithSet(rhs.peers)
 	excluded.peers = utils.NewSet()
-	excluded.peers.RetainAllWithSet(rhs.peers)
+	excluded.peers.AddAllWithSet(rhs.peers)
+	excluded.peers.RemoveAllWithSet(c.peers)
+}
+
+func toPeerSlice(s *utils.Set) []PeerId {
+	ids := make([]PeerId, 0, s.Size())
+	s.Range(func(value interface{}) {
+		ids = append(ids, value.(PeerId))
+	})
+	return ids
+}
+
+func setEqual(a, b *utils.Set) bool {
+	if a.Size() != b.Size() {
+		return false
+	}
+	equal := true
+	a.Range(func(value interface{}) {
+		if !b.Contain(value) {
+			equal = false
+		}
+	})
+	return equal
 }
 
 type ConfigurationEntry struct {
@@ -165,17 +204,20 @@ func (ce *ConfigurationEntry) IsStable() bool {
 	return ce.oldConf.IsEmpty()
 }
 
+//IsValid 新旧配置各自的 peers 和 learners 不能有交集。Learner 被提升为 peer 时，joint 阶段它会同时出现在旧配置的 learners
+//以及新配置的 peers 中，因此不能合并新旧配置之后再检查
 func (ce *ConfigurationEntry) IsValid() bool {
 	if !ce.conf.IsValid() {
 		return false
 	}
-
-	intersection := ce.ListPeers()
-	intersection.RetainAllWithSet(ce.ListLearners())
-	if intersection.IsEmpty() {
+	if ce.oldConf.IsEmpty() || ce.oldConf.IsValid() {
 		return true
 	}
-	// TODO LOG
+	index := int64(0)
+	if ce.id != nil {
+		index = ce.id.GetIndex()
+	}
+	utils.RaftLog.Error("invalid conf entry %d, peers and learners have intersection", index)
 	return false
 }
 
@@ -184,65 +226,79 @@ func (ce *ConfigurationEntry) IsEmpty() bool {
 }
 
 func (ce *ConfigurationEntry) ContainPeer(p PeerId) bool {
-	return ce.conf.Contains(p) || ce.oldConf.Contains(p)
+	if ce.conf != nil && ce.conf.Contains(p) {
+		return true
+	}
+	return ce.oldConf != nil && ce.oldConf.Contains(p)
 }
 
 func (ce *ConfigurationEntry) ContainLearner(l PeerId) bool {
-	return ce.conf.GetLearners().Contain(l) || ce.oldConf.GetLearners().Contain(l)
+	if ce.conf != nil && ce.conf.GetLearners().Contain(l) {
+		return true
+	}
+	return ce.oldConf != nil && ce.oldConf.GetLearners().Contain(l)
 }
 
 func (ce *ConfigurationEntry) ListPeers() *utils.Set {
 	s := utils.NewSet()
-	s.AddAllWithSet(ce.conf.GetPeers())
-	s.AddAllWithSet(ce.conf.GetPeers())
+	if ce.conf != nil {
+		s.AddAllWithSet(ce.conf.GetPeers())
+	}
+	if ce.oldConf != nil {
+		s.AddAllWithSet(ce.oldConf.GetPeers())
+	}
 	return s
 }
 
 func (ce *ConfigurationEntry) ListLearners() *utils.Set {
 	s := utils.NewSet()
-	s.AddAllWithSet(ce.conf.GetLearners())
-	s.AddAllWithSet(ce.conf.GetLearners())
+	if ce.conf != nil {
+		s.AddAllWithSet(ce.conf.GetLearners())
+	}
+	if ce.oldConf != nil {
+		s.AddAllWithSet(ce.oldConf.GetLearners())
+	}
 	return s
 }
 
+//ConfigurationManager 按照日志 index 从小到大保存配置变更记录，snapshot 保存最近一次快照中的配置
 type ConfigurationManager struct {
-	configurations list.List
+	configurations *list.List
 	snapshot       *ConfigurationEntry
 }
 
+func NewConfigurationManager() *ConfigurationManager {
+	return &ConfigurationManager{
+		configurations: list.New(),
+		snapshot:       NewConfigurationEntry(NewEmptyLogID(), NewEmptyConfiguration(), NewEmptyConfiguration()),
+	}
+}
+
 func (cm *ConfigurationManager) Add(ce *ConfigurationEntry) bool {
 	if cm.configurations.Len() != 0 {
-		if cm.configurations.Front().Value.(*ConfigurationEntry).GetID().GetIndex() >= ce.GetID().GetIndex() {
-			// TODO Log
+		last := cm.configurations.Back().Value.(*ConfigurationEntry)
+		if last.GetID().GetIndex() >= ce.GetID().GetIndex() {
+			utils.RaftLog.Error("did you forget to call TruncateSuffix before the last log index goes back, last index %d, new index %d",
+				last.GetID().GetIndex(), ce.GetID().GetIndex())
 			return false
 		}
 	}
-	cm.configurations.PushFront(ce)
+	cm.configurations.PushBack(ce)
 	return true
 }
 
 func (cm *ConfigurationManager) TruncatePrefix(firstIndexKept int64) {
 	l := cm.configurations
-	for {
-		if l.Len() != 0 && l.Front().Value.(*ConfigurationEntry).GetID().GetIndex() < firstIndexKept {
-			l.Remove(l.Front())
-			continue
-		}
-		break
+	for l.Len() != 0 && l.Front().Value.(*ConfigurationEntry).GetID().GetIndex() < firstIndexKept {
+		l.Remove(l.Front())
 	}
-	cm.configurations = l
 }
 
 func (cm *ConfigurationManager) TruncateSuffix(lastIndexKept int64) {
 	l := cm.configurations
-	for {
-		if l.Len() != 0 && l.Front().Value.(*ConfigurationEntry).GetID().GetIndex() > lastIndexKept {
-			l.Remove(l.Back())
-			continue
-		}
-		break
+	for l.Len() != 0 && l.Back().Value.(*ConfigurationEntry).GetID().GetIndex() > lastIndexKept {
+		l.Remove(l.Back())
 	}
-	cm.configurations = l
 }
 
 func (cm *ConfigurationManager) GetSnapshot() *ConfigurationEntry {
@@ -257,29 +313,30 @@ func (cm *ConfigurationManager) GetLastConfiguration() *ConfigurationEntry {
 	if cm.configurations.Len() == 0 {
 		return cm.snapshot
 	}
-	return cm.configurations.Front().Value.(*ConfigurationEntry)
+	return cm.configurations.Back().Value.(*ConfigurationEntry)
 }
 
+//Get 获取 lastIncludedIndex 位置生效的配置，即 index 不大于 lastIncludedIndex 的最后一个配置
 func (cm *ConfigurationManager) Get(lastIncludedIndex int64) *ConfigurationEntry {
 	l := cm.configurations
 	if l.Len() == 0 {
-		utils.RequireTrue(lastIncludedIndex >= cm.snapshot.GetID().GetIndex(), "lastIncludedIndex %d is less than snapshot index %d", lastIncludedIndex, cm.snapshot.GetID().GetIndex())
+		if err := utils.RequireTrue(lastIncludedIndex >= cm.snapshot.GetID().GetIndex(),
+			"lastIncludedIndex %d is less than snapshot index %d", lastIncludedIndex, cm.snapshot.GetID().GetIndex()); err != nil {
+			utils.RaftLog.Error("%s", err)
+		}
+		return cm.snapshot
 	}
 
-	e := l.Front()
-
-	for e != nil && e.Next() != nil {
-		n := e.Next()
-
-		if n.Value.(*ConfigurationEntry).GetID().GetIndex() > lastIncludedIndex {
-			e = e.Prev()
+	var result *ConfigurationEntry
+	for e := l.Front(); e != nil; e = e.Next() {
+		ce := e.Value.(*ConfigurationEntry)
+		if ce.GetID().GetIndex() > lastIncludedIndex {
 			break
 		}
-		e = e.Next()
+		result = ce
 	}
-
-	if e != nil && e.Prev() != nil {
-		return e.Prev().Value.(*ConfigurationEntry)
+	if result == nil {
+		return cm.snapshot
 	}
-	return cm.snapshot
+	return result
 }
@@ -19,7 +19,7 @@ import (
 func NewErrorResponse(code RaftErrorCode, format string, args ...interface{}) *raft.ErrorResponse {
 	errResp := &raft.ErrorResponse{}
 	errResp.ErrorCode = int32(code)
-	errResp.ErrorMsg = fmt.Sprintf(format, args)
+	errResp.ErrorMsg = fmt.Sprintf(format, args...)
 	return errResp
 }
 
@@ -70,6 +70,9 @@ func (s Status) GetCode() RaftErrorCode {
 }
 
 func (s Status) SetMsg(msg string) {
+	if s.state == nil {
+		return
+	}
 	s.state.msg = msg
 }
 
@@ -80,12 +83,13 @@ func (s Status) GetMsg() string {
 	return s.state.msg
 }
 
+//SetError Status 以值的方式传递，因此这里直接修改共享的 State，调用方需要保证 Status 由 NewEmptyStatus 等方法创建
 func (s Status) SetError(code RaftErrorCode, format string, args ...interface{}) {
-	msg := utils.StringFormat(format, args)
-	s.state = &State{
-		code: code,
-		msg:  msg,
+	if s.state == nil {
+		return
 	}
+	s.state.code = code
+	s.state.msg = utils.StringFormat(format, args...)
 }
 
 func (s Status) Copy() Status {
@@ -174,10 +178,12 @@ func (b *Ballot) Init(conf, oldConf *Configuration) bool {
 
 	index := int64(0)
 
+	// 只有 peers 参与投票，Learner 不计入多数派
 	if conf != nil {
 		conf.GetPeers().Range(func(value interface{}) {
+			peer := value.(PeerId)
 			b.peers = append(b.peers, &UnFoundPeerId{
-				peerId: value.(*PeerId),
+				peerId: &peer,
 				found:  false,
 				index:  index,
 			})
@@ -185,13 +191,15 @@ func (b *Ballot) Init(conf, oldConf *Configuration) bool {
 		})
 	}
 	b.quorum = int64(len(b.peers)/2 + 1)
-	if oldConf == nil {
+	// 空的 oldConf 和没有 oldConf 一样，只需要 conf 的多数派
+	if oldConf.IsEmpty() {
 		return true
 	}
 	index = int64(0)
 	oldConf.GetPeers().Range(func(value interface{}) {
+		peer := value.(PeerId)
 		b.oldPeers = append(b.oldPeers, &UnFoundPeerId{
-			peerId: value.(*PeerId),
+			peerId: &peer,
 			found:  false,
 			index:  index,
 		})
@@ -201,16 +209,17 @@ func (b *Ballot) Init(conf, oldConf *Configuration) bool {
 	return true
 }
 
+//FindPeer 优先根据 hint 查找 peer，hint 不正确时再遍历 peers 查找
 func (b *Ballot) FindPeer(peer PeerId, peers []*UnFoundPeerId, hint int64) *UnFoundPeerId {
-	if hint < 0 || hint > int64(len(b.peers)) || b.peers[hint].peerId.Equal(peer) {
-		for _, ufp := range b.peers {
+	if hint < 0 || hint >= int64(len(peers)) || !peers[hint].peerId.Equal(peer) {
+		for _, ufp := range peers {
 			if ufp.peerId.Equal(peer) {
 				return ufp
 			}
 		}
 		return nil
 	}
-	return b.peers[hint]
+	return peers[hint]
 }
 
 func (b *Ballot) Grant(peer PeerId) PosHint {
@@ -379,10 +388,20 @@ func (le *LogEntry) Encode() []byte {
 	return b
 }
 
-func (le *LogEntry) Decode(b []byte) {
+func (le *LogEntry) Decode(b []byte) error {
 	pbL := &raft.PBLogEntry{}
-	err := proto.Unmarshal(b, pbL)
-	utils.CheckErr(err)
+	if err := proto.Unmarshal(b, pbL); err != nil {
+		return err
+	}
+	le.LogType = pbL.Type
+	le.LogID = NewLogID(pbL.Index, pbL.Term)
+	le.Peers = le.decodePeers(pbL.Peers)
+	le.OldPeers = le.decodePeers(pbL.OldPeers)
+	le.Learners = le.decodePeers(pbL.Learners)
+	le.OldLearners = le.decodePeers(pbL.OldLearners)
+	le.Data = pbL.Data
+	le.SetChecksum(pbL.Checksum)
+	return nil
 }
 
 func (le *LogEntry) encodePeers(peers []PeerId) [][]byte {
@@ -393,6 +412,20 @@ func (le *LogEntry) encodePeers(peers []PeerId) [][]byte {
 	return result
 }
 
+func (le *LogEntry) decodePeers(peers [][]byte) []PeerId {
+	if len(peers) == 0 {
+		return nil
+	}
+	result := make([]PeerId, 0, len(peers))
+	for _, b := range peers {
+		peer := PeerId{}
+		if peer.Decode(b) {
+			result = append(result, peer)
+		}
+	}
+	return result
+}
+
 func (le *LogEntry) checksumPeers(peers []PeerId, c uint64) uint64 {
 	if peers != nil && len(peers) != 0 {
 		for _, peer := range peers {
@@ -5,7 +5,6 @@
 package entity
 
 import (
-	"encoding/json"
 	"strconv"
 	"strings"
 
@@ -117,7 +116,7 @@ func (p PeerId) Copy() PeerId {
 	}
 }
 
-func (p PeerId) Parse(s string) bool {
+func (p *PeerId) Parse(s string) bool {
 	if s == "" {
 		return false
 	}
@@ -125,9 +124,17 @@ func (p PeerId) Parse(s string) bool {
 	if len(tmps) < 2 || len(tmps) > 4 {
 		return false
 	}
-	port := utils.ParseToInt64(tmps[1])
+	port, err := strconv.ParseInt(tmps[1], 10, 64)
+	if err != nil {
+		return false
+	}
 	p.endpoint = NewEndpoint(tmps[0], port)
+	p.idx = 0
+	p.priority = ElectionPriorityDisabled
+	p.checksum = 0
+	p.desc = ""
 	switch len(tmps) {
+	case 2:
 	case 3:
 		p.idx = utils.ParseToInt64(tmps[2])
 	case 4:
@@ -185,12 +192,9 @@ func (p PeerId) Equal(other PeerId) bool {
 }
 
 func (p PeerId) Encode() []byte {
-	b, err := json.Marshal(p)
-	utils.CheckErr(err)
-	return b
+	return []byte(p.GetDesc())
 }
 
-func (p PeerId) Decode(b []byte) {
-	err := json.Unmarshal(b, p)
-	utils.CheckErr(err)
+func (p *PeerId) Decode(b []byte) bool {
+	return p.Parse(string(b))
 }
@@ -7,8 +7,19 @@ package lraft
 import (
 	"github.com/pole-group/lraft/core"
 	"github.com/pole-group/lraft/entity"
+	"github.com/pole-group/lraft/utils"
 )
 
+//NewRaftNode 创建并且启动一个 raft 节点，参数不合法或者启动失败时返回 nil，具体的原因会打印在日志中
 func NewRaftNode(groupId string, serverId *entity.PeerId, opts *core.NodeOptions) core.Node {
-	return nil
+	if serverId == nil || opts == nil {
+		utils.RaftLog.Error("serverId and opts must not be nil.")
+		return nil
+	}
+	node, err := core.NewNode(groupId, *serverId, *opts)
+	if err != nil {
+		utils.RaftLog.Error("fail to create raft node %s-%s : %s", groupId, serverId.GetDesc(), err)
+		return nil
+	}
+	return node
 }
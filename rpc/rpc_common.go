@@ -6,13 +6,17 @@ package rpc
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/jjeffcaii/reactor-go/flux"
 	"github.com/jjeffcaii/reactor-go/mono"
 	pole_rpc "github.com/pole-group/pole-rpc"
 
+	"github.com/pole-group/lraft/entity"
 	raft "github.com/pole-group/lraft/proto"
 )
 
@@ -24,6 +28,7 @@ const (
 	CliGetLeaderRequest      string = "CliGetLeaderCommand"
 	CliGetPeersRequest       string = "CliGetPeersCommand"
 	CliRemoveLearnersRequest string = "CliRemoveLearnersCommand"
+	CliRemovePeerRequest     string = "CliRemovePeerCommand"
 	CliResetLearnersRequest  string = "CliResetLearnersCommand"
 	CliResetPeersRequest     string = "CliResetPeersCommand"
 	CliSnapshotRequest       string = "CliSnapshotCommand"
@@ -31,6 +36,7 @@ const (
 
 	// proto command
 	CoreAppendEntriesRequest   string = "CoreAppendEntriesCommand"
+	CoreBatchHeartbeatRequest  string = "CoreBatchHeartbeatCommand"
 	CoreGetFileRequest         string = "CoreGetFileCommand"
 	CoreInstallSnapshotRequest string = "CoreInstallSnapshotCommand"
 	CoreNodeRequest            string = "CoreNodeCommand"
@@ -39,13 +45,14 @@ const (
 	CoreRequestVoteRequest     string = "CoreRequestVoteCommand"
 	CoreTimeoutNowRequest      string = "CoreTimeoutNowCommand"
 
-	//
+	// 通用的错误响应
 	CommonRpcErrorCommand string = "CommonRpcErrorCommand"
 )
 
 var (
-	EmptyBytes     []byte = make([]byte, 0)
-	ServerNotFount        = errors.New("target server not found")
+	EmptyBytes        []byte = make([]byte, 0)
+	ServerNotFount           = errors.New("target server not found")
+	ErrUnknownCommand        = errors.New("unknown rpc command")
 )
 
 const RequestIDKey string = "RequestID"
@@ -89,83 +96,262 @@ func (c *RpcContext) Close() {
 
 var GlobalProtoRegistry *ProtobufMessageRegistry
 
+//MessageSupplier 创建一个空的 proto 消息，用于反序列化请求或者响应
+type MessageSupplier func() proto.Message
+
+//CommandDescriptor 一个命令对应的请求类型以及响应类型
+type CommandDescriptor struct {
+	Command  string
+	Request  MessageSupplier
+	Response MessageSupplier
+}
+
+//ProtobufMessageRegistry 命令到请求、响应类型的注册表，客户端根据命令解码响应，服务端根据命令解码请求
 type ProtobufMessageRegistry struct {
 	rwLock   sync.RWMutex
-	registry map[string]func() proto.Message
+	registry map[string]CommandDescriptor
+}
+
+//NewProtobufMessageRegistry 创建一个空的注册表
+func NewProtobufMessageRegistry() *ProtobufMessageRegistry {
+	return &ProtobufMessageRegistry{
+		rwLock:   sync.RWMutex{},
+		registry: make(map[string]CommandDescriptor),
+	}
 }
 
-func (pmr *ProtobufMessageRegistry) RegistryProtoMessageSupplier(key string, supplier func() proto.Message) bool {
+//RegisterCommand 注册命令的请求以及响应类型，同一个命令只能注册一次
+func (pmr *ProtobufMessageRegistry) RegisterCommand(command string, request, response MessageSupplier) bool {
+	if request == nil || response == nil {
+		return false
+	}
 	defer pmr.rwLock.Unlock()
 	pmr.rwLock.Lock()
-	if _, exist := pmr.registry[key]; !exist {
-		pmr.registry[key] = supplier
-		return true
+	if _, exist := pmr.registry[command]; exist {
+		return false
+	}
+	pmr.registry[command] = CommandDescriptor{
+		Command:  command,
+		Request:  request,
+		Response: response,
 	}
-	return false
+	return true
 }
 
-func (pmr *ProtobufMessageRegistry) FindProtoMessageSupplier(key string) func() proto.Message {
+//FindCommand 查找命令注册的请求以及响应类型
+func (pmr *ProtobufMessageRegistry) FindCommand(command string) (CommandDescriptor, bool) {
 	defer pmr.rwLock.RUnlock()
 	pmr.rwLock.RLock()
-	return pmr.registry[key]
+	descriptor, exist := pmr.registry[command]
+	return descriptor, exist
 }
 
-func init() {
-	GlobalProtoRegistry = &ProtobufMessageRegistry{
-		rwLock:   sync.RWMutex{},
-		registry: make(map[string]func() proto.Message),
+//Commands 所有已经注册的命令，按照字典序排列
+func (pmr *ProtobufMessageRegistry) Commands() []string {
+	defer pmr.rwLock.RUnlock()
+	pmr.rwLock.RLock()
+	commands := make([]string, 0, len(pmr.registry))
+	for command := range pmr.registry {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+//NewRequest 创建命令对应的空请求
+func (pmr *ProtobufMessageRegistry) NewRequest(command string) (proto.Message, error) {
+	descriptor, exist := pmr.FindCommand(command)
+	if !exist {
+		return nil, fmt.Errorf("%w : %s", ErrUnknownCommand, command)
+	}
+	return descriptor.Request(), nil
+}
+
+//NewResponse 创建命令对应的空响应
+func (pmr *ProtobufMessageRegistry) NewResponse(command string) (proto.Message, error) {
+	descriptor, exist := pmr.FindCommand(command)
+	if !exist {
+		return nil, fmt.Errorf("%w : %s", ErrUnknownCommand, command)
+	}
+	return descriptor.Response(), nil
+}
+
+//DecodeRequest 服务端根据请求的 FunName 将请求体解码为注册的请求类型
+func (pmr *ProtobufMessageRegistry) DecodeRequest(req *pole_rpc.ServerRequest) (proto.Message, error) {
+	msg, err := pmr.NewRequest(req.FunName)
+	if err != nil {
+		return nil, err
+	}
+	if req.Body == nil {
+		return nil, fmt.Errorf("command %s has empty request body", req.FunName)
 	}
+	if err := ptypes.UnmarshalAny(req.Body, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+//DecodeResponse 客户端根据发出请求时的命令将响应体解码为注册的响应类型。对端回复的是 ErrorResponse 时（传输层会把
+//FunName 改写为请求的 FunName，因此同时根据 Any 的类型判断），转换为对应的 entity.Status 返回给调用者；
+//但如果该命令本身注册的响应类型就是 ErrorResponse，解码出的消息也会一并返回
+func (pmr *ProtobufMessageRegistry) DecodeResponse(command string, resp *pole_rpc.ServerResponse) (proto.Message,
+	entity.Status) {
+	if resp == nil || resp.Body == nil {
+		return nil, entity.NewStatus(entity.EInternal, fmt.Sprintf("command %s has empty response body", command))
+	}
+	descriptor, exist := pmr.FindCommand(command)
+	if resp.FunName == CommonRpcErrorCommand || ptypes.Is(resp.Body, &raft.ErrorResponse{}) {
+		errResp := &raft.ErrorResponse{}
+		if err := ptypes.UnmarshalAny(resp.Body, errResp); err != nil {
+			return nil, entity.NewStatus(entity.EInternal, err.Error())
+		}
+		st := entity.NewStatus(entity.RaftErrorCode(errResp.ErrorCode), errResp.ErrorMsg)
+		if exist && st.IsOK() {
+			if _, ok := descriptor.Response().(*raft.ErrorResponse); ok {
+				return errResp, st
+			}
+		}
+		if st.IsOK() {
+			// 对端回复了 ErrorResponse 却没有携带错误码，不能当作成功处理
+			st = entity.NewStatus(entity.UNKNOWN, fmt.Sprintf("command %s receive error response without code", command))
+		}
+		return nil, st
+	}
+	if !exist {
+		return nil, entity.NewStatus(entity.EINVAL, fmt.Sprintf("%s : %s", ErrUnknownCommand, command))
+	}
+	msg := descriptor.Response()
+	if err := ptypes.UnmarshalAny(resp.Body, msg); err != nil {
+		return nil, entity.NewStatus(entity.EInternal, err.Error())
+	}
+	return msg, entity.StatusOK()
+}
+
+//NewErrorServerResponse 构造携带 ErrorResponse 的响应，对端通过 DecodeResponse 得到对应的 entity.Status
+func NewErrorServerResponse(code entity.RaftErrorCode, msg string) *pole_rpc.ServerResponse {
+	body, err := ptypes.MarshalAny(&raft.ErrorResponse{
+		ErrorCode: int32(code),
+		ErrorMsg:  msg,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return &pole_rpc.ServerResponse{
+		FunName: CommonRpcErrorCommand,
+		Body:    body,
+	}
+}
+
+func init() {
+	GlobalProtoRegistry = NewProtobufMessageRegistry()
 
 	// cli 模块
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CliAddLearnerRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CliAddLearnerRequest, func() proto.Message {
 		return &raft.AddLearnersRequest{}
+	}, func() proto.Message {
+		return &raft.LearnersOpResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CliAddPeerRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CliAddPeerRequest, func() proto.Message {
 		return &raft.AddPeerRequest{}
+	}, func() proto.Message {
+		return &raft.AddPeerResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CliChangePeersRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CliChangePeersRequest, func() proto.Message {
 		return &raft.ChangePeersRequest{}
+	}, func() proto.Message {
+		return &raft.ChangePeersResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CliGetLeaderRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CliGetLeaderRequest, func() proto.Message {
 		return &raft.GetLeaderRequest{}
+	}, func() proto.Message {
+		return &raft.GetLeaderResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CliGetPeersRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CliGetPeersRequest, func() proto.Message {
 		return &raft.GetPeersRequest{}
+	}, func() proto.Message {
+		return &raft.GetPeersResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CliRemoveLearnersRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CliRemoveLearnersRequest, func() proto.Message {
 		return &raft.RemoveLearnersRequest{}
+	}, func() proto.Message {
+		return &raft.LearnersOpResponse{}
+	})
+	GlobalProtoRegistry.RegisterCommand(CliRemovePeerRequest, func() proto.Message {
+		return &raft.RemovePeerRequest{}
+	}, func() proto.Message {
+		return &raft.RemovePeerResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CliResetLearnersRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CliResetLearnersRequest, func() proto.Message {
 		return &raft.ResetLearnersRequest{}
+	}, func() proto.Message {
+		return &raft.LearnersOpResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CliResetPeersRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CliResetPeersRequest, func() proto.Message {
 		return &raft.ResetPeerRequest{}
+	}, func() proto.Message {
+		return &raft.ErrorResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CliSnapshotRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CliSnapshotRequest, func() proto.Message {
 		return &raft.SnapshotRequest{}
+	}, func() proto.Message {
+		return &raft.ErrorResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CliTransferLeaderRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CliTransferLeaderRequest, func() proto.Message {
 		return &raft.TransferLeaderRequest{}
+	}, func() proto.Message {
+		return &raft.ErrorResponse{}
 	})
 
 	// proto 模块
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CoreAppendEntriesRequest, func() proto.Message {
-		return &raft.AddPeerResponse{}
+	GlobalProtoRegistry.RegisterCommand(CoreAppendEntriesRequest, func() proto.Message {
+		return &raft.AppendEntriesRequest{}
+	}, func() proto.Message {
+		return &raft.AppendEntriesResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CoreGetFileRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CoreBatchHeartbeatRequest, func() proto.Message {
+		return &raft.BatchHeartbeatRequest{}
+	}, func() proto.Message {
+		return &raft.BatchHeartbeatResponse{}
+	})
+	GlobalProtoRegistry.RegisterCommand(CoreGetFileRequest, func() proto.Message {
+		return &raft.GetFileRequest{}
+	}, func() proto.Message {
 		return &raft.GetFileResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CoreInstallSnapshotRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CoreInstallSnapshotRequest, func() proto.Message {
+		return &raft.InstallSnapshotRequest{}
+	}, func() proto.Message {
 		return &raft.InstallSnapshotResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CoreReadIndexRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CoreNodeRequest, func() proto.Message {
+		return &raft.PingRequest{}
+	}, func() proto.Message {
+		return &raft.ErrorResponse{}
+	})
+	GlobalProtoRegistry.RegisterCommand(CoreReadIndexRequest, func() proto.Message {
+		return &raft.ReadIndexRequest{}
+	}, func() proto.Message {
 		return &raft.ReadIndexResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CoreRequestVoteRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CoreRequestVoteRequest, func() proto.Message {
+		return &raft.RequestVoteRequest{}
+	}, func() proto.Message {
 		return &raft.RequestVoteResponse{}
 	})
-	GlobalProtoRegistry.RegistryProtoMessageSupplier(CoreTimeoutNowRequest, func() proto.Message {
+	GlobalProtoRegistry.RegisterCommand(CoreRequestPreVoteRequest, func() proto.Message {
+		return &raft.RequestVoteRequest{}
+	}, func() proto.Message {
+		return &raft.RequestVoteResponse{}
+	})
+	GlobalProtoRegistry.RegisterCommand(CoreTimeoutNowRequest, func() proto.Message {
+		return &raft.TimeoutNowRequest{}
+	}, func() proto.Message {
 		return &raft.TimeoutNowResponse{}
 	})
 
+	GlobalProtoRegistry.RegisterCommand(CommonRpcErrorCommand, func() proto.Message {
+		return &raft.ErrorResponse{}
+	}, func() proto.Message {
+		return &raft.ErrorResponse{}
+	})
 }
@@ -0,0 +1,262 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	pole_rpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+)
+
+var commandCases = []struct {
+	command  string
+	request  proto.Message
+	response proto.Message
+}{
+	{
+		CliAddLearnerRequest,
+		&raft.AddLearnersRequest{GroupID: "g", LeaderID: "127.0.0.1:8080", Learners: []string{"127.0.0.1:8081"}},
+		&raft.LearnersOpResponse{NewLearners: []string{"127.0.0.1:8081"}},
+	},
+	{
+		CliAddPeerRequest,
+		&raft.AddPeerRequest{GroupID: "g", PeerID: "127.0.0.1:8081"},
+		&raft.AddPeerResponse{NewPeers: []string{"127.0.0.1:8081"}},
+	},
+	{
+		CliChangePeersRequest,
+		&raft.ChangePeersRequest{GroupID: "g", NewPeers: []string{"127.0.0.1:8081"}},
+		&raft.ChangePeersResponse{NewPeers: []string{"127.0.0.1:8081"}},
+	},
+	{CliGetLeaderRequest, &raft.GetLeaderRequest{GroupID: "g"}, &raft.GetLeaderResponse{LeaderID: "127.0.0.1:8080"}},
+	{CliGetPeersRequest, &raft.GetPeersRequest{GroupID: "g"}, &raft.GetPeersResponse{Peers: []string{"127.0.0.1:8080"}}},
+	{
+		CliRemoveLearnersRequest,
+		&raft.RemoveLearnersRequest{GroupID: "g", Learners: []string{"127.0.0.1:8081"}},
+		&raft.LearnersOpResponse{OldLearners: []string{"127.0.0.1:8081"}},
+	},
+	{
+		CliRemovePeerRequest,
+		&raft.RemovePeerRequest{GroupID: "g", PeerID: "127.0.0.1:8081"},
+		&raft.RemovePeerResponse{OldPeers: []string{"127.0.0.1:8081"}},
+	},
+	{
+		CliResetLearnersRequest,
+		&raft.ResetLearnersRequest{GroupID: "g", Learners: []string{"127.0.0.1:8081"}},
+		&raft.LearnersOpResponse{NewLearners: []string{"127.0.0.1:8081"}},
+	},
+	{
+		CliResetPeersRequest,
+		&raft.ResetPeerRequest{GroupID: "g", NewPeers: []string{"127.0.0.1:8080"}},
+		&raft.ErrorResponse{},
+	},
+	{CliSnapshotRequest, &raft.SnapshotRequest{GroupID: "g"}, &raft.ErrorResponse{}},
+	{CliTransferLeaderRequest, &raft.TransferLeaderRequest{GroupID: "g", PeerID: "127.0.0.1:8081"}, &raft.ErrorResponse{}},
+	{
+		CoreAppendEntriesRequest,
+		&raft.AppendEntriesRequest{GroupID: "g", Term: 1, PrevLogIndex: 10},
+		&raft.AppendEntriesResponse{Term: 1, Success: true, LastLogIndex: 10},
+	},
+	{
+		CoreBatchHeartbeatRequest,
+		&raft.BatchHeartbeatRequest{Entries: []*raft.HeartbeatRequestEntry{{GroupID: "g", Term: 1, CommittedIndex: 10}}},
+		&raft.BatchHeartbeatResponse{Entries: []*raft.HeartbeatResponseEntry{{GroupID: "g", Term: 1, Success: true}}},
+	},
+	{
+		CoreGetFileRequest,
+		&raft.GetFileRequest{ReaderID: 1, Filename: "__raft_snapshot_meta", Count: 1024},
+		&raft.GetFileResponse{Eof: true, Data: []byte("meta")},
+	},
+	{
+		CoreInstallSnapshotRequest,
+		&raft.InstallSnapshotRequest{GroupID: "g", Term: 1, Uri: "remote://127.0.0.1:8080/1"},
+		&raft.InstallSnapshotResponse{Term: 1, Success: true},
+	},
+	{CoreNodeRequest, &raft.PingRequest{SendTimestamp: 1}, &raft.ErrorResponse{}},
+	{
+		CoreReadIndexRequest,
+		&raft.ReadIndexRequest{GroupID: "g", ServerID: "127.0.0.1:8080"},
+		&raft.ReadIndexResponse{Index: 10, Success: true},
+	},
+	{
+		CoreRequestPreVoteRequest,
+		&raft.RequestVoteRequest{GroupID: "g", Term: 2, PreVote: true},
+		&raft.RequestVoteResponse{Term: 1, Granted: true},
+	},
+	{
+		CoreRequestVoteRequest,
+		&raft.RequestVoteRequest{GroupID: "g", Term: 2},
+		&raft.RequestVoteResponse{Term: 2, Granted: true},
+	},
+	{
+		CoreTimeoutNowRequest,
+		&raft.TimeoutNowRequest{GroupID: "g", Term: 1},
+		&raft.TimeoutNowResponse{Term: 2, Success: true},
+	},
+	{CommonRpcErrorCommand, &raft.ErrorResponse{}, &raft.ErrorResponse{}},
+}
+
+func TestRegistryCoversEveryCommand(t *testing.T) {
+	commands := GlobalProtoRegistry.Commands()
+	if len(commands) != len(commandCases) {
+		t.Fatalf("registered commands %v, expect %d commands", commands, len(commandCases))
+	}
+	for _, tc := range commandCases {
+		t.Run(tc.command, func(t *testing.T) {
+			req, err := GlobalProtoRegistry.NewRequest(tc.command)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reflect.TypeOf(req) != reflect.TypeOf(tc.request) {
+				t.Fatalf("request type %T, expect %T", req, tc.request)
+			}
+			resp, err := GlobalProtoRegistry.NewResponse(tc.command)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reflect.TypeOf(resp) != reflect.TypeOf(tc.response) {
+				t.Fatalf("response type %T, expect %T", resp, tc.response)
+			}
+			another, _ := GlobalProtoRegistry.NewResponse(tc.command)
+			if resp == another {
+				t.Fatal("supplier must create a new message every time")
+			}
+		})
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	for _, tc := range commandCases {
+		t.Run(tc.command, func(t *testing.T) {
+			body, err := ptypes.MarshalAny(tc.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := GlobalProtoRegistry.DecodeRequest(&pole_rpc.ServerRequest{FunName: tc.command, Body: body})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(req, tc.request) {
+				t.Fatalf("decode request %v, expect %v", req, tc.request)
+			}
+		})
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	for _, tc := range commandCases {
+		t.Run(tc.command, func(t *testing.T) {
+			body, err := ptypes.MarshalAny(tc.response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, st := GlobalProtoRegistry.DecodeResponse(tc.command, &pole_rpc.ServerResponse{
+				FunName: tc.command,
+				Body:    body,
+			})
+			if !st.IsOK() {
+				t.Fatalf("decode response failed : %d %s", st.GetCode(), st.GetMsg())
+			}
+			if !proto.Equal(resp, tc.response) {
+				t.Fatalf("decode response %v, expect %v", resp, tc.response)
+			}
+		})
+	}
+}
+
+func TestDecodeErrorResponse(t *testing.T) {
+	for _, tc := range commandCases {
+		t.Run(tc.command, func(t *testing.T) {
+			errResp := NewErrorServerResponse(entity.EPERM, "Not leader")
+			if errResp.FunName != CommonRpcErrorCommand {
+				t.Fatalf("error response FunName %s", errResp.FunName)
+			}
+			resp, st := GlobalProtoRegistry.DecodeResponse(tc.command, errResp)
+			checkErrorStatus(t, resp, st, entity.EPERM, "Not leader")
+
+			// 传输层会把响应的 FunName 改写为请求的 FunName
+			errResp.FunName = tc.command
+			resp, st = GlobalProtoRegistry.DecodeResponse(tc.command, errResp)
+			checkErrorStatus(t, resp, st, entity.EPERM, "Not leader")
+		})
+	}
+}
+
+func checkErrorStatus(t *testing.T, resp proto.Message, st entity.Status, code entity.RaftErrorCode, msg string) {
+	t.Helper()
+	if resp != nil {
+		t.Fatalf("error reply must not be decoded as response : %v", resp)
+	}
+	if st.IsOK() || st.GetCode() != code || st.GetMsg() != msg {
+		t.Fatalf("status %d %s, expect %d %s", st.GetCode(), st.GetMsg(), code, msg)
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	const command = "CoreUnknownCommand"
+	if _, err := GlobalProtoRegistry.NewRequest(command); !errors.Is(err, ErrUnknownCommand) {
+		t.Fatalf("NewRequest error %v", err)
+	}
+	if _, err := GlobalProtoRegistry.NewResponse(command); !errors.Is(err, ErrUnknownCommand) {
+		t.Fatalf("NewResponse error %v", err)
+	}
+	body, _ := ptypes.MarshalAny(&raft.PingRequest{})
+	if _, err := GlobalProtoRegistry.DecodeRequest(&pole_rpc.ServerRequest{FunName: command, Body: body}); !errors.Is(err,
+		ErrUnknownCommand) {
+		t.Fatalf("DecodeRequest error %v", err)
+	}
+	resp, st := GlobalProtoRegistry.DecodeResponse(command, &pole_rpc.ServerResponse{FunName: command, Body: body})
+	if resp != nil || st.GetCode() != entity.EINVAL {
+		t.Fatalf("DecodeResponse %v %d %s", resp, st.GetCode(), st.GetMsg())
+	}
+	// 未注册的命令收到 ErrorResponse 时同样返回对端的错误信息
+	resp, st = GlobalProtoRegistry.DecodeResponse(command, NewErrorServerResponse(entity.ENOENT, "no such group"))
+	checkErrorStatus(t, resp, st, entity.ENOENT, "no such group")
+}
+
+func TestDecodeMismatchedBody(t *testing.T) {
+	body, _ := ptypes.MarshalAny(&raft.PingRequest{SendTimestamp: 1})
+	if _, err := GlobalProtoRegistry.DecodeRequest(&pole_rpc.ServerRequest{FunName: CoreRequestVoteRequest,
+		Body: body}); err == nil {
+		t.Fatal("PingRequest must not be decoded as RequestVoteRequest")
+	}
+	if _, err := GlobalProtoRegistry.DecodeRequest(&pole_rpc.ServerRequest{FunName: CoreRequestVoteRequest}); err == nil {
+		t.Fatal("empty body must be rejected")
+	}
+	resp, st := GlobalProtoRegistry.DecodeResponse(CoreRequestVoteRequest, &pole_rpc.ServerResponse{Body: body})
+	if resp != nil || st.GetCode() != entity.EInternal {
+		t.Fatalf("DecodeResponse %v %d %s", resp, st.GetCode(), st.GetMsg())
+	}
+	resp, st = GlobalProtoRegistry.DecodeResponse(CoreRequestVoteRequest, nil)
+	if resp != nil || st.GetCode() != entity.EInternal {
+		t.Fatalf("DecodeResponse %v %d %s", resp, st.GetCode(), st.GetMsg())
+	}
+}
+
+func TestRegisterCommand(t *testing.T) {
+	registry := NewProtobufMessageRegistry()
+	supplier := func() proto.Message {
+		return &raft.PingRequest{}
+	}
+	if registry.RegisterCommand("Ping", nil, supplier) || registry.RegisterCommand("Ping", supplier, nil) {
+		t.Fatal("nil supplier must be rejected")
+	}
+	if !registry.RegisterCommand("Ping", supplier, supplier) {
+		t.Fatal("register failed")
+	}
+	if registry.RegisterCommand("Ping", supplier, supplier) {
+		t.Fatal("duplicate register must be rejected")
+	}
+	if commands := registry.Commands(); len(commands) != 1 || commands[0] != "Ping" {
+		t.Fatalf("commands %v", commands)
+	}
+}
@@ -7,9 +7,15 @@ package rpc
 import (
 	"context"
 
+	"github.com/golang/protobuf/proto"
 	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
 )
 
+//RequestHandler 处理已经按照 GlobalProtoRegistry 中注册的请求类型解码好的请求
+type RequestHandler func(ctx context.Context, req proto.Message, rpcCtx polerpc.RpcServerContext)
+
 type RaftRPCServer struct {
 	IsReady chan struct{}
 	server  polerpc.TransportServer
@@ -38,3 +44,29 @@ func NewRaftRPCServer(label string, port int32, openTSL bool) (*RaftRPCServer, e
 func (rpcServer *RaftRPCServer) GetRealServer() polerpc.TransportServer {
 	return rpcServer.server
 }
+
+//RegisterRequestHandler 注册命令的处理函数，命令必须已经在 GlobalProtoRegistry 中注册过
+func (rpcServer *RaftRPCServer) RegisterRequestHandler(command string, handler RequestHandler) bool {
+	if _, exist := GlobalProtoRegistry.FindCommand(command); !exist {
+		return false
+	}
+	rpcServer.server.RegisterRequestHandler(command, func(ctx context.Context, rpcCtx polerpc.RpcServerContext) {
+		dispatchRequest(ctx, rpcCtx, handler)
+	})
+	return true
+}
+
+//Close 取消 RSocket 服务端的 context，停止接收新的请求
+func (rpcServer *RaftRPCServer) Close() {
+	rpcServer.cancelF()
+}
+
+//dispatchRequest 将请求体解码为注册的请求类型之后交给 handler，解码失败时直接回复 EINVAL 的 ErrorResponse
+func dispatchRequest(ctx context.Context, rpcCtx polerpc.RpcServerContext, handler RequestHandler) {
+	req, err := GlobalProtoRegistry.DecodeRequest(rpcCtx.GetReq())
+	if err != nil {
+		rpcCtx.Send(NewErrorServerResponse(entity.EINVAL, err.Error()))
+		return
+	}
+	handler(ctx, req, rpcCtx)
+}
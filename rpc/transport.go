@@ -0,0 +1,31 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+)
+
+//ClientTransport 节点向其他节点发送请求时依赖的传输层，RaftClient 基于 pole-rpc 的 RSocket 实现，
+//LoopbackClient 为进程内的实现
+type ClientTransport interface {
+	//SendRequest 发送请求并且等待对端的响应
+	SendRequest(endpoint entity.Endpoint, req *polerpc.ServerRequest) (*polerpc.ServerResponse, error)
+
+	//CheckConnection 检查到对端的连接是否可用
+	CheckConnection(endpoint entity.Endpoint) (bool, error)
+}
+
+//ServerTransport 节点接收其他节点请求时依赖的传输层，RaftRPCServer 基于 pole-rpc 的 RSocket 实现，
+//LoopbackServer 为进程内的实现
+type ServerTransport interface {
+	//RegisterRequestHandler 注册命令的处理函数，命令必须已经在 GlobalProtoRegistry 中注册过
+	RegisterRequestHandler(command string, handler RequestHandler) bool
+
+	//Close 关闭传输层，之后不再接收新的请求
+	Close()
+}
@@ -0,0 +1,319 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	"github.com/pole-group/lraft/utils"
+)
+
+var (
+	ErrPartitioned    = errors.New("peer is unreachable in current partition")
+	ErrMessageDropped = errors.New("message is dropped")
+)
+
+//LinkFault 一条单向链路上的故障设置，请求以及响应各自独立的计算延迟以及丢包
+type LinkFault struct {
+	//Latency 每条消息固定的延迟
+	Latency time.Duration
+	//Jitter 在 Latency 之上额外增加 [0, Jitter) 的随机延迟
+	Jitter time.Duration
+	//DropRate 消息被丢弃的概率，取值 [0, 1]
+	DropRate float64
+	//DuplicateRate 请求被重复投递的概率，重复请求的响应会被丢弃
+	DuplicateRate float64
+	//ReorderRate 消息被额外延迟 [0, ReorderDelay) 的概率，后发送的消息可能先于该消息到达
+	ReorderRate  float64
+	ReorderDelay time.Duration
+}
+
+//FaultStats 故障网络的统计信息
+type FaultStats struct {
+	Sent        int64
+	Delivered   int64
+	Dropped     int64
+	Duplicated  int64
+	Reordered   int64
+	Partitioned int64
+}
+
+type link struct {
+	from string
+	to   string
+}
+
+//FaultNetwork 在 LoopbackNetwork 之上增加网络分区、链路延迟、丢包、重复以及乱序，用于测试节点在各种网络故障下的表现，
+//所有的随机数都来自同一个种子，并且每条链路有独立的随机数序列，不同链路上消息发送的先后顺序不会影响各自的故障
+type FaultNetwork struct {
+	// stats 以及 inFlight 放在最前面，保证 32 位平台上原子操作的 64 位对齐
+	stats        FaultStats
+	inFlight     int64
+	network      *LoopbackNetwork
+	lock         sync.RWMutex
+	seed         int64
+	randoms      map[link]*rand.Rand
+	clock        utils.Clock
+	groups       map[string]int
+	isolated     map[string]bool
+	faults       map[link]LinkFault
+	defaultFault LinkFault
+}
+
+func NewFaultNetwork(seed int64) *FaultNetwork {
+	return &FaultNetwork{
+		network:  NewLoopbackNetwork(),
+		seed:     seed,
+		randoms:  make(map[link]*rand.Rand),
+		groups:   make(map[string]int),
+		isolated: make(map[string]bool),
+		faults:   make(map[link]LinkFault),
+	}
+}
+
+//SetClock 链路上的延迟改为在 clock 上等待，配合 utils.SimulationClock 使用时，消息只有在虚拟时间推进之后才会到达
+func (fn *FaultNetwork) SetClock(clock utils.Clock) {
+	defer fn.lock.Unlock()
+	fn.lock.Lock()
+	fn.clock = clock
+}
+
+//InFlight 正在投递或者处理中的消息数，不包括在虚拟时钟上等待延迟的消息，为 0 时说明网络上没有可以继续推进的消息
+func (fn *FaultNetwork) InFlight() int64 {
+	return atomic.LoadInt64(&fn.inFlight)
+}
+
+func (fn *FaultNetwork) NewServer(endpoint entity.Endpoint) (*LoopbackServer, error) {
+	return fn.network.NewServer(endpoint)
+}
+
+//NewClient 创建一个以 from 作为源地址的客户端，只有 from 和对端之间的链路可达时请求才会被投递
+func (fn *FaultNetwork) NewClient(from entity.Endpoint) *FaultClient {
+	return &FaultClient{
+		network: fn,
+		from:    endpointKey(from),
+		client:  fn.network.NewClient(),
+	}
+}
+
+//Partition 把节点划分为互相隔离的多个分组，只有同一个分组内的节点可以互相访问，没有出现在任何分组中的节点
+//被视为同一个分组
+func (fn *FaultNetwork) Partition(groups ...[]entity.Endpoint) {
+	defer fn.lock.Unlock()
+	fn.lock.Lock()
+	fn.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, endpoint := range group {
+			fn.groups[endpointKey(endpoint)] = i + 1
+		}
+	}
+}
+
+//Isolate 隔离单个节点，该节点无法访问其他任何节点，其他节点也无法访问该节点
+func (fn *FaultNetwork) Isolate(endpoint entity.Endpoint) {
+	defer fn.lock.Unlock()
+	fn.lock.Lock()
+	fn.isolated[endpointKey(endpoint)] = true
+}
+
+//HealPartition 恢复所有的网络分区以及被隔离的节点，链路上的故障设置保持不变
+func (fn *FaultNetwork) HealPartition() {
+	defer fn.lock.Unlock()
+	fn.lock.Lock()
+	fn.groups = make(map[string]int)
+	fn.isolated = make(map[string]bool)
+}
+
+//Heal 恢复整个网络，清除网络分区以及所有链路上的故障设置
+func (fn *FaultNetwork) Heal() {
+	defer fn.lock.Unlock()
+	fn.lock.Lock()
+	fn.groups = make(map[string]int)
+	fn.isolated = make(map[string]bool)
+	fn.faults = make(map[link]LinkFault)
+	fn.defaultFault = LinkFault{}
+}
+
+//SetLinkFault 设置 from 到 to 的单向链路的故障，优先级高于 SetDefaultFault
+func (fn *FaultNetwork) SetLinkFault(from, to entity.Endpoint, fault LinkFault) {
+	defer fn.lock.Unlock()
+	fn.lock.Lock()
+	fn.faults[link{from: endpointKey(from), to: endpointKey(to)}] = fault
+}
+
+func (fn *FaultNetwork) ClearLinkFault(from, to entity.Endpoint) {
+	defer fn.lock.Unlock()
+	fn.lock.Lock()
+	delete(fn.faults, link{from: endpointKey(from), to: endpointKey(to)})
+}
+
+//SetDefaultFault 设置所有没有单独设置故障的链路的故障
+func (fn *FaultNetwork) SetDefaultFault(fault LinkFault) {
+	defer fn.lock.Unlock()
+	fn.lock.Lock()
+	fn.defaultFault = fault
+}
+
+func (fn *FaultNetwork) Stats() FaultStats {
+	return FaultStats{
+		Sent:        atomic.LoadInt64(&fn.stats.Sent),
+		Delivered:   atomic.LoadInt64(&fn.stats.Delivered),
+		Dropped:     atomic.LoadInt64(&fn.stats.Dropped),
+		Duplicated:  atomic.LoadInt64(&fn.stats.Duplicated),
+		Reordered:   atomic.LoadInt64(&fn.stats.Reordered),
+		Partitioned: atomic.LoadInt64(&fn.stats.Partitioned),
+	}
+}
+
+func (fn *FaultNetwork) reachable(from, to string) bool {
+	defer fn.lock.RUnlock()
+	fn.lock.RLock()
+	if from == to {
+		return true
+	}
+	if fn.isolated[from] || fn.isolated[to] {
+		return false
+	}
+	return fn.groups[from] == fn.groups[to]
+}
+
+//deliveryPlan 一条消息在链路上的命运，在消息发送之前一次性决定
+type deliveryPlan struct {
+	delay     time.Duration
+	drop      bool
+	duplicate bool
+	reorder   bool
+}
+
+func (fn *FaultNetwork) plan(from, to string) deliveryPlan {
+	defer fn.lock.Unlock()
+	fn.lock.Lock()
+	l := link{from: from, to: to}
+	fault, exist := fn.faults[l]
+	if !exist {
+		fault = fn.defaultFault
+	}
+	random, exist := fn.randoms[l]
+	if !exist {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(from + "->" + to))
+		random = rand.New(rand.NewSource(fn.seed ^ int64(h.Sum64())))
+		fn.randoms[l] = random
+	}
+	p := deliveryPlan{delay: fault.Latency}
+	if fault.Jitter > 0 {
+		p.delay += time.Duration(random.Int63n(int64(fault.Jitter)))
+	}
+	p.drop = fault.DropRate > 0 && random.Float64() < fault.DropRate
+	p.duplicate = fault.DuplicateRate > 0 && random.Float64() < fault.DuplicateRate
+	if fault.ReorderRate > 0 && fault.ReorderDelay > 0 && random.Float64() < fault.ReorderRate {
+		p.reorder = true
+		p.delay += time.Duration(random.Int63n(int64(fault.ReorderDelay)))
+	}
+	return p
+}
+
+//sleep 消息在链路上停留 delay，设置了 clock 时在 clock 上等待，等待期间不计入 InFlight
+func (fn *FaultNetwork) sleep(delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	fn.lock.RLock()
+	clock := fn.clock
+	fn.lock.RUnlock()
+	if clock == nil {
+		time.Sleep(delay)
+		return
+	}
+	wakeup := make(chan struct{})
+	clock.AfterFunc(delay, func() {
+		// 在推进时间的协程中先计数，推进时间的一方返回时就能看到这条消息仍然在途
+		atomic.AddInt64(&fn.inFlight, 1)
+		close(wakeup)
+	})
+	atomic.AddInt64(&fn.inFlight, -1)
+	<-wakeup
+}
+
+//FaultClient FaultNetwork 中的 ClientTransport 实现，被丢弃的消息以及不可达的对端都会立即返回错误，而不是让调用方一直等待
+type FaultClient struct {
+	network *FaultNetwork
+	from    string
+	client  *LoopbackClient
+}
+
+func (fc *FaultClient) SendRequest(endpoint entity.Endpoint, req *polerpc.ServerRequest) (*polerpc.ServerResponse,
+	error) {
+	fn := fc.network
+	to := endpointKey(endpoint)
+	atomic.AddInt64(&fn.inFlight, 1)
+	defer atomic.AddInt64(&fn.inFlight, -1)
+	atomic.AddInt64(&fn.stats.Sent, 1)
+	if !fn.reachable(fc.from, to) {
+		atomic.AddInt64(&fn.stats.Partitioned, 1)
+		return nil, fmt.Errorf("%w : %s -> %s", ErrPartitioned, fc.from, to)
+	}
+
+	reqPlan := fn.plan(fc.from, to)
+	if reqPlan.reorder {
+		atomic.AddInt64(&fn.stats.Reordered, 1)
+	}
+	fn.sleep(reqPlan.delay)
+	// 消息在链路上的这段时间内网络可能已经被分区
+	if !fn.reachable(fc.from, to) {
+		atomic.AddInt64(&fn.stats.Partitioned, 1)
+		return nil, fmt.Errorf("%w : %s -> %s", ErrPartitioned, fc.from, to)
+	}
+	if reqPlan.drop {
+		atomic.AddInt64(&fn.stats.Dropped, 1)
+		return nil, fmt.Errorf("%w : request %s -> %s", ErrMessageDropped, fc.from, to)
+	}
+	if reqPlan.duplicate {
+		atomic.AddInt64(&fn.stats.Duplicated, 1)
+		atomic.AddInt64(&fn.inFlight, 1)
+		go func() {
+			defer atomic.AddInt64(&fn.inFlight, -1)
+			_, _ = fc.client.SendRequest(endpoint, req)
+		}()
+	}
+
+	resp, err := fc.client.SendRequest(endpoint, req)
+	if err != nil {
+		return nil, err
+	}
+
+	respPlan := fn.plan(to, fc.from)
+	if respPlan.reorder {
+		atomic.AddInt64(&fn.stats.Reordered, 1)
+	}
+	fn.sleep(respPlan.delay)
+	if !fn.reachable(to, fc.from) {
+		atomic.AddInt64(&fn.stats.Partitioned, 1)
+		return nil, fmt.Errorf("%w : %s -> %s", ErrPartitioned, to, fc.from)
+	}
+	if respPlan.drop {
+		atomic.AddInt64(&fn.stats.Dropped, 1)
+		return nil, fmt.Errorf("%w : response %s -> %s", ErrMessageDropped, to, fc.from)
+	}
+	atomic.AddInt64(&fn.stats.Delivered, 1)
+	return resp, nil
+}
+
+func (fc *FaultClient) CheckConnection(endpoint entity.Endpoint) (bool, error) {
+	to := endpointKey(endpoint)
+	if !fc.network.reachable(fc.from, to) {
+		return false, fmt.Errorf("%w : %s -> %s", ErrPartitioned, fc.from, to)
+	}
+	return fc.client.CheckConnection(endpoint)
+}
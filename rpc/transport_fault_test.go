@@ -0,0 +1,141 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	pole_rpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+)
+
+func newFaultCluster(t *testing.T, network *FaultNetwork, size int) ([]entity.Endpoint, *int64) {
+	received := new(int64)
+	endpoints := make([]entity.Endpoint, 0, size)
+	for i := 0; i < size; i++ {
+		endpoint := entity.NewEndpoint("127.0.0.1", int64(8081+i))
+		server, err := network.NewServer(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.RegisterRequestHandler(CoreRequestVoteRequest, func(ctx context.Context, req proto.Message,
+			rpcCtx pole_rpc.RpcServerContext) {
+			atomic.AddInt64(received, 1)
+			body, _ := ptypes.MarshalAny(&raft.RequestVoteResponse{Term: req.(*raft.RequestVoteRequest).Term})
+			rpcCtx.Send(&pole_rpc.ServerResponse{Body: body})
+		})
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, received
+}
+
+func checkSend(t *testing.T, client *FaultClient, endpoint entity.Endpoint, expect error) {
+	t.Helper()
+	_, err := client.SendRequest(endpoint, newVoteRequest(t, CoreRequestVoteRequest, 1))
+	if expect == nil && err != nil {
+		t.Fatalf("send to %s : %v", endpoint.GetDesc(), err)
+	}
+	if expect != nil && !errors.Is(err, expect) {
+		t.Fatalf("send to %s : %v, expect %v", endpoint.GetDesc(), err, expect)
+	}
+}
+
+func TestFaultNetworkPartition(t *testing.T) {
+	network := NewFaultNetwork(1)
+	endpoints, _ := newFaultCluster(t, network, 3)
+	a, b, c := endpoints[0], endpoints[1], endpoints[2]
+	clientA, clientC := network.NewClient(a), network.NewClient(c)
+
+	network.Partition([]entity.Endpoint{a, b}, []entity.Endpoint{c})
+	checkSend(t, clientA, b, nil)
+	checkSend(t, clientA, c, ErrPartitioned)
+	checkSend(t, clientC, a, ErrPartitioned)
+	checkSend(t, clientC, c, nil)
+	if ok, err := clientA.CheckConnection(c); ok || !errors.Is(err, ErrPartitioned) {
+		t.Fatalf("CheckConnection across partition %v %v", ok, err)
+	}
+
+	network.HealPartition()
+	network.Isolate(b)
+	checkSend(t, clientA, b, ErrPartitioned)
+	checkSend(t, clientA, c, nil)
+
+	network.HealPartition()
+	for _, endpoint := range endpoints {
+		checkSend(t, clientA, endpoint, nil)
+		checkSend(t, clientC, endpoint, nil)
+	}
+	if stats := network.Stats(); stats.Partitioned != 3 || stats.Delivered != stats.Sent-stats.Partitioned {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestFaultNetworkLinkFault(t *testing.T) {
+	network := NewFaultNetwork(1)
+	endpoints, received := newFaultCluster(t, network, 2)
+	a, b := endpoints[0], endpoints[1]
+	clientA, clientB := network.NewClient(a), network.NewClient(b)
+
+	// 链路是单向的，a -> b 的消息全部丢弃：a 的请求到不了 b，b 的请求可以被 a 处理，但是响应会被丢弃
+	network.SetLinkFault(a, b, LinkFault{DropRate: 1})
+	checkSend(t, clientA, b, ErrMessageDropped)
+	checkSend(t, clientB, a, ErrMessageDropped)
+	if atomic.LoadInt64(received) != 1 {
+		t.Fatalf("received %d requests, expect the request from b", atomic.LoadInt64(received))
+	}
+
+	network.SetLinkFault(a, b, LinkFault{Latency: 50 * time.Millisecond, DuplicateRate: 1})
+	network.SetLinkFault(b, a, LinkFault{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	checkSend(t, clientA, b, nil)
+	if cost := time.Since(start); cost < 100*time.Millisecond {
+		t.Fatalf("round trip cost %s, expect at least 100ms", cost)
+	}
+	waitReceived := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(received) != 3 && time.Now().Before(waitReceived) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt64(received) != 3 {
+		t.Fatalf("received %d requests, expect duplicated request", atomic.LoadInt64(received))
+	}
+
+	network.ClearLinkFault(a, b)
+	network.SetDefaultFault(LinkFault{ReorderRate: 1, ReorderDelay: time.Millisecond})
+	checkSend(t, clientA, b, nil)
+	stats := network.Stats()
+	if stats.Dropped != 2 || stats.Duplicated != 1 || stats.Reordered != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+
+	network.Heal()
+	start = time.Now()
+	checkSend(t, clientA, b, nil)
+	checkSend(t, clientB, a, nil)
+	if cost := time.Since(start); cost >= 50*time.Millisecond {
+		t.Fatalf("link fault is not cleared after heal, cost %s", cost)
+	}
+}
+
+func TestFaultNetworkSeed(t *testing.T) {
+	fault := LinkFault{Jitter: time.Second, DropRate: 0.5, DuplicateRate: 0.5, ReorderRate: 0.5,
+		ReorderDelay: time.Second}
+	networks := []*FaultNetwork{NewFaultNetwork(7), NewFaultNetwork(7)}
+	for _, network := range networks {
+		network.SetDefaultFault(fault)
+	}
+	for i := 0; i < 100; i++ {
+		if a, b := networks[0].plan("a", "b"), networks[1].plan("a", "b"); a != b {
+			t.Fatalf("plan %d is different with the same seed : %+v %+v", i, a, b)
+		}
+	}
+}
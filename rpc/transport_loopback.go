@@ -0,0 +1,192 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	polerpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+)
+
+var (
+	ErrAddressInUse   = errors.New("loopback address already in use")
+	ErrTransportClose = errors.New("transport is closed")
+)
+
+//LoopbackNetwork 进程内的网络，LoopbackServer 按照 entity.Endpoint 注册到网络中，LoopbackClient 根据 entity.Endpoint
+//找到对端直接投递请求，不需要真正的 socket，同一个测试进程中可以运行完整的集群
+type LoopbackNetwork struct {
+	lock    sync.RWMutex
+	servers map[string]*LoopbackServer
+}
+
+func NewLoopbackNetwork() *LoopbackNetwork {
+	return &LoopbackNetwork{
+		servers: make(map[string]*LoopbackServer),
+	}
+}
+
+//NewServer 在 endpoint 上创建一个 LoopbackServer，同一个 endpoint 在关闭之前只能被一个 LoopbackServer 占用
+func (ln *LoopbackNetwork) NewServer(endpoint entity.Endpoint) (*LoopbackServer, error) {
+	defer ln.lock.Unlock()
+	ln.lock.Lock()
+	key := endpointKey(endpoint)
+	if _, exist := ln.servers[key]; exist {
+		return nil, fmt.Errorf("%w : %s", ErrAddressInUse, key)
+	}
+	server := &LoopbackServer{
+		network:  ln,
+		endpoint: endpoint,
+		handlers: make(map[string]RequestHandler),
+		closeC:   make(chan struct{}),
+	}
+	ln.servers[key] = server
+	return server, nil
+}
+
+//NewClient 创建一个只能访问当前网络中 LoopbackServer 的客户端
+func (ln *LoopbackNetwork) NewClient() *LoopbackClient {
+	return &LoopbackClient{
+		network: ln,
+	}
+}
+
+func (ln *LoopbackNetwork) findServer(endpoint entity.Endpoint) (*LoopbackServer, bool) {
+	defer ln.lock.RUnlock()
+	ln.lock.RLock()
+	server, exist := ln.servers[endpointKey(endpoint)]
+	return server, exist
+}
+
+func (ln *LoopbackNetwork) removeServer(server *LoopbackServer) {
+	defer ln.lock.Unlock()
+	ln.lock.Lock()
+	key := endpointKey(server.endpoint)
+	if ln.servers[key] == server {
+		delete(ln.servers, key)
+	}
+}
+
+func endpointKey(endpoint entity.Endpoint) string {
+	return fmt.Sprintf("%s:%d", endpoint.GetIP(), endpoint.GetPort())
+}
+
+//LoopbackServer 进程内的 ServerTransport 实现
+type LoopbackServer struct {
+	network   *LoopbackNetwork
+	endpoint  entity.Endpoint
+	lock      sync.RWMutex
+	handlers  map[string]RequestHandler
+	closeOnce sync.Once
+	closeC    chan struct{}
+}
+
+func (ls *LoopbackServer) RegisterRequestHandler(command string, handler RequestHandler) bool {
+	if _, exist := GlobalProtoRegistry.FindCommand(command); !exist {
+		return false
+	}
+	defer ls.lock.Unlock()
+	ls.lock.Lock()
+	ls.handlers[command] = handler
+	return true
+}
+
+//Close 从网络中摘除当前节点，还在等待响应的请求会收到 ErrTransportClose
+func (ls *LoopbackServer) Close() {
+	ls.closeOnce.Do(func() {
+		ls.network.removeServer(ls)
+		close(ls.closeC)
+	})
+}
+
+func (ls *LoopbackServer) findHandler(command string) (RequestHandler, bool) {
+	defer ls.lock.RUnlock()
+	ls.lock.RLock()
+	handler, exist := ls.handlers[command]
+	return handler, exist
+}
+
+//LoopbackClient 进程内的 ClientTransport 实现，请求以及响应都会经过一次序列化，节点之间不会共享同一个消息对象
+type LoopbackClient struct {
+	network *LoopbackNetwork
+}
+
+func (lc *LoopbackClient) SendRequest(endpoint entity.Endpoint, req *polerpc.ServerRequest) (*polerpc.ServerResponse,
+	error) {
+	server, exist := lc.network.findServer(endpoint)
+	if !exist {
+		return nil, fmt.Errorf("%w : %s", ServerNotFount, endpointKey(endpoint))
+	}
+	handler, exist := server.findHandler(req.FunName)
+	if !exist {
+		return nil, fmt.Errorf("%w : %s", ErrUnknownCommand, req.FunName)
+	}
+	copyReq := &polerpc.ServerRequest{}
+	if err := cloneMessage(req, copyReq); err != nil {
+		return nil, err
+	}
+
+	rpcCtx := &loopbackRpcContext{
+		req:   copyReq,
+		respC: make(chan *polerpc.ServerResponse, 1),
+	}
+	polerpc.Go(context.Background(), func(ctx context.Context) {
+		dispatchRequest(ctx, rpcCtx, handler)
+	})
+
+	select {
+	case resp := <-rpcCtx.respC:
+		return resp, nil
+	case <-server.closeC:
+		return nil, fmt.Errorf("%w : %s", ErrTransportClose, endpointKey(endpoint))
+	}
+}
+
+func (lc *LoopbackClient) CheckConnection(endpoint entity.Endpoint) (bool, error) {
+	if _, exist := lc.network.findServer(endpoint); !exist {
+		return false, fmt.Errorf("%w : %s", ServerNotFount, endpointKey(endpoint))
+	}
+	return true, nil
+}
+
+//loopbackRpcContext 和 RSocket 的实现保持一致，响应的 FunName 以及 RequestId 会被改写为请求的值，并且只有第一次回复有效
+type loopbackRpcContext struct {
+	req      *polerpc.ServerRequest
+	respC    chan *polerpc.ServerResponse
+	sendOnce sync.Once
+}
+
+func (rpcCtx *loopbackRpcContext) GetReq() *polerpc.ServerRequest {
+	return rpcCtx.req
+}
+
+func (rpcCtx *loopbackRpcContext) Send(resp *polerpc.ServerResponse) {
+	rpcCtx.sendOnce.Do(func() {
+		copyResp := &polerpc.ServerResponse{}
+		if err := cloneMessage(resp, copyResp); err != nil {
+			copyResp = NewErrorServerResponse(entity.EInternal, err.Error())
+		}
+		copyResp.FunName = rpcCtx.req.FunName
+		copyResp.RequestId = rpcCtx.req.RequestId
+		rpcCtx.respC <- copyResp
+	})
+}
+
+func (rpcCtx *loopbackRpcContext) Complete() {
+}
+
+func cloneMessage(src, dst proto.Message) error {
+	body, err := proto.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(body, dst)
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	pole_rpc "github.com/pole-group/pole-rpc"
+
+	"github.com/pole-group/lraft/entity"
+	raft "github.com/pole-group/lraft/proto"
+)
+
+func newVoteRequest(t *testing.T, command string, term int64) *pole_rpc.ServerRequest {
+	body, err := ptypes.MarshalAny(&raft.RequestVoteRequest{GroupID: "g", Term: term})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pole_rpc.ServerRequest{FunName: command, Body: body, RequestId: "1"}
+}
+
+func TestLoopbackRequestResponse(t *testing.T) {
+	network := NewLoopbackNetwork()
+	endpoint := entity.NewEndpoint("127.0.0.1", 8080)
+	server, err := network.NewServer(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := network.NewServer(endpoint); !errors.Is(err, ErrAddressInUse) {
+		t.Fatalf("NewServer on used endpoint : %v", err)
+	}
+	if server.RegisterRequestHandler("CoreUnknownCommand", nil) {
+		t.Fatal("unknown command must not be registered")
+	}
+	server.RegisterRequestHandler(CoreRequestVoteRequest, func(ctx context.Context, req proto.Message,
+		rpcCtx pole_rpc.RpcServerContext) {
+		voteReq := req.(*raft.RequestVoteRequest)
+		body, _ := ptypes.MarshalAny(&raft.RequestVoteResponse{Term: voteReq.Term, Granted: true})
+		// 异步回复，并且只有第一次回复有效
+		go func() {
+			rpcCtx.Send(&pole_rpc.ServerResponse{Body: body})
+			rpcCtx.Send(NewErrorServerResponse(entity.EINTR, "ignored"))
+		}()
+	})
+
+	client := network.NewClient()
+	if ok, err := client.CheckConnection(endpoint); !ok || err != nil {
+		t.Fatalf("CheckConnection %v %v", ok, err)
+	}
+	resp, err := client.SendRequest(endpoint, newVoteRequest(t, CoreRequestVoteRequest, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.FunName != CoreRequestVoteRequest || resp.RequestId != "1" {
+		t.Fatalf("response FunName %s RequestId %s", resp.FunName, resp.RequestId)
+	}
+	msg, st := GlobalProtoRegistry.DecodeResponse(CoreRequestVoteRequest, resp)
+	if !st.IsOK() {
+		t.Fatal(st.GetMsg())
+	}
+	if voteResp := msg.(*raft.RequestVoteResponse); voteResp.Term != 3 || !voteResp.Granted {
+		t.Fatalf("response %v", voteResp)
+	}
+
+	// 没有注册处理函数的命令
+	if _, err := client.SendRequest(endpoint, newVoteRequest(t, CoreRequestPreVoteRequest, 3)); !errors.Is(err,
+		ErrUnknownCommand) {
+		t.Fatalf("SendRequest unregistered command : %v", err)
+	}
+	// 请求体和命令不匹配时服务端回复 EINVAL
+	body, _ := ptypes.MarshalAny(&raft.PingRequest{})
+	resp, err = client.SendRequest(endpoint, &pole_rpc.ServerRequest{FunName: CoreRequestVoteRequest, Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, st := GlobalProtoRegistry.DecodeResponse(CoreRequestVoteRequest, resp); st.GetCode() != entity.EINVAL {
+		t.Fatalf("status %d %s", st.GetCode(), st.GetMsg())
+	}
+}
+
+func TestLoopbackClose(t *testing.T) {
+	network := NewLoopbackNetwork()
+	endpoint := entity.NewEndpoint("127.0.0.1", 8080)
+	server, _ := network.NewServer(endpoint)
+	received := make(chan struct{})
+	server.RegisterRequestHandler(CoreRequestVoteRequest, func(ctx context.Context, req proto.Message,
+		rpcCtx pole_rpc.RpcServerContext) {
+		// 不回复，模拟对端在处理请求的过程中宕机
+		close(received)
+	})
+
+	client := network.NewClient()
+	errC := make(chan error, 1)
+	go func() {
+		_, err := client.SendRequest(endpoint, newVoteRequest(t, CoreRequestVoteRequest, 1))
+		errC <- err
+	}()
+	<-received
+	server.Close()
+	select {
+	case err := <-errC:
+		if !errors.Is(err, ErrTransportClose) {
+			t.Fatalf("pending request error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending request is not released after close")
+	}
+
+	if ok, _ := client.CheckConnection(endpoint); ok {
+		t.Fatal("closed server is still reachable")
+	}
+	if _, err := client.SendRequest(endpoint, newVoteRequest(t, CoreRequestVoteRequest, 1)); !errors.Is(err,
+		ServerNotFount) {
+		t.Fatalf("SendRequest to closed server : %v", err)
+	}
+	// 关闭之后地址可以被重新使用
+	if _, err := network.NewServer(endpoint); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//Timer Clock 调度的一次性任务
+type Timer interface {
+	//Stop 取消还没有执行的任务，任务已经执行或者已经被取消时返回 false
+	Stop() bool
+}
+
+//Clock 节点读取时间、调度定时任务以及生成随机超时时间的来源。SystemClock 使用系统时间；SimulationClock 使用虚拟时间，
+//时间只有在模拟器推进时才会流逝，并且所有的随机数都来自同一个种子，多节点的测试失败之后可以通过种子完整的重放
+type Clock interface {
+	//NowMs 当前时间的毫秒数
+	NowMs() int64
+
+	//AfterFunc delay 之后执行一次 task
+	AfterFunc(delay time.Duration, task func()) Timer
+
+	//Int63n 返回 [0, n) 之间的随机数
+	Int63n(n int64) int64
+}
+
+var SystemClock Clock = systemClock{}
+
+type systemClock struct {
+}
+
+func (systemClock) NowMs() int64 {
+	return GetCurrentTimeMs()
+}
+
+func (systemClock) AfterFunc(delay time.Duration, task func()) Timer {
+	return time.AfterFunc(delay, task)
+}
+
+func (systemClock) Int63n(n int64) int64 {
+	return rand.Int63n(n)
+}
+
+//simulationEpoch 虚拟时间的起点，避免从 0 开始时和各处 "时间戳为 0 表示没有发生过" 的约定冲突
+var simulationEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+//SimulationClock 虚拟时钟，只有调用 Step、Advance 时时间才会前进，到期的任务按照到期时间以及调度的先后顺序，
+//在推进时间的协程中依次执行
+type SimulationClock struct {
+	lock   sync.Mutex
+	now    time.Duration
+	seq    int64
+	timers simulationTimers
+	random *rand.Rand
+}
+
+func NewSimulationClock(seed int64) *SimulationClock {
+	return &SimulationClock{
+		random: rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (sc *SimulationClock) NowMs() int64 {
+	defer sc.lock.Unlock()
+	sc.lock.Lock()
+	return simulationEpoch.Add(sc.now).UnixNano() / int64(time.Millisecond)
+}
+
+//Elapsed 从虚拟时钟创建到现在经过的虚拟时间
+func (sc *SimulationClock) Elapsed() time.Duration {
+	defer sc.lock.Unlock()
+	sc.lock.Lock()
+	return sc.now
+}
+
+func (sc *SimulationClock) AfterFunc(delay time.Duration, task func()) Timer {
+	defer sc.lock.Unlock()
+	sc.lock.Lock()
+	if delay < 0 {
+		delay = 0
+	}
+	sc.seq++
+	t := &simulationTimer{
+		clock:    sc,
+		deadline: sc.now + delay,
+		seq:      sc.seq,
+		task:     task,
+	}
+	heap.Push(&sc.timers, t)
+	return t
+}
+
+func (sc *SimulationClock) Int63n(n int64) int64 {
+	defer sc.lock.Unlock()
+	sc.lock.Lock()
+	return sc.random.Int63n(n)
+}
+
+//Pending 还没有执行的任务数
+func (sc *SimulationClock) Pending() int {
+	defer sc.lock.Unlock()
+	sc.lock.Lock()
+	return sc.timers.Len()
+}
+
+//NextDeadline 下一个任务的到期时间，没有任务时返回 false
+func (sc *SimulationClock) NextDeadline() (time.Duration, bool) {
+	defer sc.lock.Unlock()
+	sc.lock.Lock()
+	if sc.timers.Len() == 0 {
+		return 0, false
+	}
+	return sc.timers[0].deadline, true
+}
+
+//Step 把时间推进到下一个任务的到期时间并且执行该任务，没有任务时返回 false
+func (sc *SimulationClock) Step() bool {
+	sc.lock.Lock()
+	if sc.timers.Len() == 0 {
+		sc.lock.Unlock()
+		return false
+	}
+	t := heap.Pop(&sc.timers).(*simulationTimer)
+	if t.deadline > sc.now {
+		sc.now = t.deadline
+	}
+	sc.lock.Unlock()
+	t.task()
+	return true
+}
+
+//Advance 把时间推进 d，期间到期的任务都会被执行，包括执行过程中新调度的任务
+func (sc *SimulationClock) Advance(d time.Duration) {
+	sc.lock.Lock()
+	target := sc.now + d
+	sc.lock.Unlock()
+	for {
+		if deadline, ok := sc.NextDeadline(); !ok || deadline > target {
+			break
+		}
+		sc.Step()
+	}
+	sc.lock.Lock()
+	if target > sc.now {
+		sc.now = target
+	}
+	sc.lock.Unlock()
+}
+
+type simulationTimer struct {
+	clock    *SimulationClock
+	deadline time.Duration
+	seq      int64
+	task     func()
+	index    int
+}
+
+func (t *simulationTimer) Stop() bool {
+	defer t.clock.lock.Unlock()
+	t.clock.lock.Lock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.clock.timers, t.index)
+	return true
+}
+
+//simulationTimers 以到期时间为序的小顶堆，到期时间相同的任务按照调度的先后顺序执行
+type simulationTimers []*simulationTimer
+
+func (st simulationTimers) Len() int {
+	return len(st)
+}
+
+func (st simulationTimers) Less(i, j int) bool {
+	if st[i].deadline != st[j].deadline {
+		return st[i].deadline < st[j].deadline
+	}
+	return st[i].seq < st[j].seq
+}
+
+func (st simulationTimers) Swap(i, j int) {
+	st[i], st[j] = st[j], st[i]
+	st[i].index = i
+	st[j].index = j
+}
+
+func (st *simulationTimers) Push(x interface{}) {
+	t := x.(*simulationTimer)
+	t.index = len(*st)
+	*st = append(*st, t)
+}
+
+func (st *simulationTimers) Pop() interface{} {
+	old := *st
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*st = old[:n-1]
+	return t
+}
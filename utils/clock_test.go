@@ -0,0 +1,50 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSimulationClock(t *testing.T) {
+	clock := NewSimulationClock(1)
+	start := clock.NowMs()
+	fired := make([]string, 0)
+	record := func(name string) func() {
+		return func() {
+			fired = append(fired, name)
+		}
+	}
+	clock.AfterFunc(20*time.Millisecond, record("b"))
+	clock.AfterFunc(10*time.Millisecond, func() {
+		fired = append(fired, "a")
+		// 执行过程中调度的任务只要在推进的范围之内也会被执行
+		clock.AfterFunc(5*time.Millisecond, record("a1"))
+	})
+	clock.AfterFunc(20*time.Millisecond, record("c"))
+	canceled := clock.AfterFunc(15*time.Millisecond, record("canceled"))
+	if !canceled.Stop() || canceled.Stop() {
+		t.Fatal("timer can only be stopped once")
+	}
+
+	clock.Advance(18 * time.Millisecond)
+	if !reflect.DeepEqual(fired, []string{"a", "a1"}) || clock.NowMs()-start != 18 {
+		t.Fatalf("fired %v at %dms", fired, clock.NowMs()-start)
+	}
+	for clock.Step() {
+	}
+	if !reflect.DeepEqual(fired, []string{"a", "a1", "b", "c"}) || clock.Elapsed() != 20*time.Millisecond {
+		t.Fatalf("fired %v at %s", fired, clock.Elapsed())
+	}
+
+	other := NewSimulationClock(1)
+	for i := 0; i < 100; i++ {
+		if a, b := clock.Int63n(1000), other.Int63n(1000); a != b {
+			t.Fatalf("random %d is different with the same seed : %d %d", i, a, b)
+		}
+	}
+}
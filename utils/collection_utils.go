@@ -16,7 +16,7 @@ var (
 )
 
 const (
-	IndexOutOfBoundErrMsg = "index out of bound, index=%d, offset=%d, pos=%s"
+	IndexOutOfBoundErrMsg = "index out of bound, index=%d, offset=%d, pos=%d"
 )
 
 type ConcurrentSlice struct {
@@ -195,19 +195,15 @@ func (s *Set) Contain(value interface{}) bool {
 }
 
 func (s *Set) RetainAll(arr ...interface{}) {
-	for _, e := range arr {
-		if !s.Contain(e) {
-			delete(s.container, e)
-		}
-	}
+	s.RetainAllWithSet(NewSetWithValues(arr...))
 }
 
 func (s *Set) RetainAllWithSet(set *Set) {
-	set.Range(func(value interface{}) {
-		if !s.Contain(value) {
-			delete(s.container, value)
+	for v := range s.container {
+		if !set.Contain(v) {
+			delete(s.container, v)
 		}
-	})
+	}
 }
 
 func (s *Set) RemoveAll(arr []interface{}) {
@@ -222,10 +218,12 @@ func (s *Set) RemoveAllWithSet(set *Set) {
 	})
 }
 
-func (s *Set) ToSlice(arr ...interface{}) {
-	for v, _ := range s.container {
+func (s *Set) ToSlice() []interface{} {
+	arr := make([]interface{}, 0, len(s.container))
+	for v := range s.container {
 		arr = append(arr, v)
 	}
+	return arr
 }
 
 func (s *Set) IsEmpty() bool {
@@ -384,14 +382,18 @@ func (sl *SegmentList) RemoveFromFirst(toIndex int32) {
 	toSegIndex := alignedIndex / SegmentSize
 	toIndexInSeg := alignedIndex % SegmentSize
 	if toSegIndex > 0 {
-		sl.segments = sl.segments[toIndexInSeg-1:]
-		sl.size = toSegIndex*SegmentSize - sl.firstOffset
+		for _, seg := range sl.segments[:toSegIndex] {
+			seg.recycle()
+		}
+		sl.segments = sl.segments[toSegIndex:]
+		sl.size -= toSegIndex*SegmentSize - sl.firstOffset
 	}
 	firstSeg := sl.GetFirst()
 	if firstSeg != nil {
 		sl.size -= firstSeg.RemoveFromFirst(toIndexInSeg)
 		sl.firstOffset = firstSeg.offset
 		if firstSeg.IsEmpty() {
+			sl.segments = sl.segments[1:]
 			firstSeg.recycle()
 			sl.firstOffset = 0
 		}
@@ -422,6 +424,8 @@ func (sl *SegmentList) Clear() {
 	for _, seg := range sl.segments {
 		seg.recycle()
 	}
+	sl.segments = nil
+	sl.firstOffset = 0
 	sl.size = 0
 }
 
@@ -514,7 +518,7 @@ func (s *Segment) RemoveFromLastWhen(predicate func(v interface{}) bool) int32 {
 
 func (s *Segment) RemoveFromFirst(toIndex int32) int32 {
 	removed := int32(0)
-	for i := s.offset; i < int32(math.Max(float64(toIndex), float64(s.pos))); i++ {
+	for i := s.offset; i < int32(math.Min(float64(toIndex), float64(s.pos))); i++ {
 		s.elements[i] = nil
 		removed++
 	}
@@ -536,7 +540,7 @@ func (s *Segment) Size() int32 {
 
 func ArrayCopy(src []interface{}, srcPos int32, target []interface{}, targetPos int32, length int32) {
 	ti := targetPos
-	for i := srcPos; i < length; i++ {
+	for i := srcPos; i < srcPos+length; i++ {
 		target[ti] = src[i]
 		ti++
 	}
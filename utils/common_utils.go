@@ -113,20 +113,20 @@ func RequireNonNil(e interface{}, msg string) (interface{}, error) {
 
 func RequireTrue(expression bool, format string, args ...interface{}) error {
 	if !expression {
-		return errors.Errorf(format, args)
+		return errors.Errorf(format, args...)
 	}
 	return nil
 }
 
 func RequireFalse(expression bool, format string, args ...interface{}) {
 	if expression {
-		panic(errors.Errorf(format, args))
+		panic(errors.Errorf(format, args...))
 	}
 }
 
 func StringFormat(format string, args ...interface{}) string {
 	buf := bytes.NewBuffer([]byte{})
-	_, err := fmt.Fprintf(buf, format, args)
+	_, err := fmt.Fprintf(buf, format, args...)
 	CheckErr(err)
 	return string(buf.Bytes())
 }
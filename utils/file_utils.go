@@ -0,0 +1,87 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"fmt"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const tempFileSuffix = ".tmp"
+
+//AtomicWriteFile 先写临时文件并 fsync，再 rename 覆盖目标文件，最后 fsync 目录，保证目标文件要么是旧内容要么是新内容
+func AtomicWriteFile(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + tempFileSuffix
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(path))
+}
+
+//SyncDir 对目录做 fsync，确保目录下文件的创建、删除以及 rename 操作落盘
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+//SyncTree 对目录本身以及目录下的所有文件、子目录做 fsync，确保整个目录的内容都已经落盘
+func SyncTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return f.Sync()
+	})
+}
+
+//FileExist 判断文件或者目录是否存在
+func FileExist(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+//FileChecksum 计算文件内容的 crc64 校验和，以十六进制字符串的形式返回
+func FileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := crc64.New(Crc64Table)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x", h.Sum64()), nil
+}
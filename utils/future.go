@@ -9,7 +9,6 @@ import (
 	"sync/atomic"
 
 	"github.com/jjeffcaii/reactor-go/mono"
-	polerpc "github.com/pole-group/pole-rpc"
 )
 
 var DefaultScheduler *RoutinePool = NewRoutinePool(16, 128)
@@ -49,7 +48,8 @@ func (rp *RoutinePool) init() {
 	workers := make([]worker, rp.size, rp.size)
 	for i := int32(0); i < rp.size; i++ {
 		workers[i] = worker{owner: rp}
-		polerpc.GoEmpty(workers[i].run)
+		// worker 常驻直到协程池关闭，不能占用 polerpc 调度器中数量固定的协程，否则后创建的协程池永远得不到执行
+		go workers[i].run()
 	}
 }
 
@@ -0,0 +1,295 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+//Operation 客户端的一次操作，Call 以及 Return 为发起调用以及收到结果的时间，结果未知的操作（比如超时的写请求）
+//Return 设置为 math.MaxInt64，表示它可能在发起之后的任何时刻生效，也可能从来没有生效
+type Operation struct {
+	ClientID int
+	Input    interface{}
+	Call     int64
+	Output   interface{}
+	Return   int64
+}
+
+//Model 被检查对象的顺序规格，检查器会尝试为历史中的操作找到一个满足实时顺序并且符合 Model 的执行顺序
+type Model struct {
+	//Partition 把历史拆分为互不影响的多个部分分别检查，比如 KV 按照 key 拆分，为空时整个历史一起检查
+	Partition func(history []Operation) [][]Operation
+	//Init 初始状态
+	Init func() interface{}
+	//Step 在 state 上执行 input 并且得到 output 是否合法，合法时返回执行之后的状态，不能修改 state 本身
+	Step func(state, input, output interface{}) (bool, interface{})
+	//Equal 两个状态是否相同，为空时使用 ==
+	Equal func(state1, state2 interface{}) bool
+	//DescribeOperation 输出操作的描述，用于打印不满足线性一致的历史
+	DescribeOperation func(input, output interface{}) string
+}
+
+//CheckOperations 检查 history 是否满足线性一致性，实现参考 Porcupine：在按照时间排序的调用、返回事件上做深度优先搜索，
+//并且缓存已经搜索过的 (已经线性化的操作集合, 状态)，避免重复搜索
+func CheckOperations(model Model, history []Operation) bool {
+	partitions := [][]Operation{history}
+	if model.Partition != nil {
+		partitions = model.Partition(history)
+	}
+	for _, partition := range partitions {
+		if !checkPartition(model, partition) {
+			return false
+		}
+	}
+	return true
+}
+
+//DescribeOperations 按照调用时间输出 history，方便定位不满足线性一致的操作
+func DescribeOperations(model Model, history []Operation) []string {
+	sorted := make([]Operation, len(history))
+	copy(sorted, history)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Call < sorted[j].Call
+	})
+	result := make([]string, 0, len(sorted))
+	for _, op := range sorted {
+		desc := fmt.Sprintf("%v -> %v", op.Input, op.Output)
+		if model.DescribeOperation != nil {
+			desc = model.DescribeOperation(op.Input, op.Output)
+		}
+		ret := "?"
+		if op.Return != math.MaxInt64 {
+			ret = fmt.Sprintf("%d", op.Return)
+		}
+		result = append(result, fmt.Sprintf("client %d [%d, %s] %s", op.ClientID, op.Call, ret, desc))
+	}
+	return result
+}
+
+type historyEntry struct {
+	id     int
+	isCall bool
+	time   int64
+	value  interface{}
+	match  *historyEntry
+	prev   *historyEntry
+	next   *historyEntry
+}
+
+//makeEntries 把操作拆分为调用以及返回两个事件并且按照时间排序，时间相同时调用排在返回之前，也就是认为两个操作是并发的
+func makeEntries(history []Operation) *historyEntry {
+	entries := make([]*historyEntry, 0, len(history)*2)
+	for i, op := range history {
+		call := &historyEntry{id: i, isCall: true, time: op.Call, value: op.Input}
+		ret := &historyEntry{id: i, time: op.Return, value: op.Output}
+		call.match = ret
+		entries = append(entries, call, ret)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].time != entries[j].time {
+			return entries[i].time < entries[j].time
+		}
+		return entries[i].isCall && !entries[j].isCall
+	})
+	head := &historyEntry{id: -1}
+	prev := head
+	for _, entry := range entries {
+		prev.next = entry
+		entry.prev = prev
+		prev = entry
+	}
+	return head
+}
+
+//lift 线性化一个操作之后，把它的调用以及返回事件从链表中摘除
+func (e *historyEntry) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	match := e.match
+	match.prev.next = match.next
+	if match.next != nil {
+		match.next.prev = match.prev
+	}
+}
+
+//unlift 回溯时把操作的调用以及返回事件重新放回链表中原来的位置
+func (e *historyEntry) unlift() {
+	match := e.match
+	match.prev.next = match
+	if match.next != nil {
+		match.next.prev = match
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+type bitset []uint64
+
+func newBitset(size int) bitset {
+	return make(bitset, (size+63)/64)
+}
+
+func (b bitset) set(pos int) {
+	b[pos/64] |= 1 << uint(pos%64)
+}
+
+func (b bitset) clear(pos int) {
+	b[pos/64] &^= 1 << uint(pos%64)
+}
+
+func (b bitset) clone() bitset {
+	c := make(bitset, len(b))
+	copy(c, b)
+	return c
+}
+
+func (b bitset) equals(other bitset) bool {
+	for i := range b {
+		if b[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(len(b))
+	for _, v := range b {
+		h = h*31 + v
+	}
+	return h
+}
+
+type linearizedState struct {
+	linearized bitset
+	state      interface{}
+}
+
+type callFrame struct {
+	entry *historyEntry
+	state interface{}
+}
+
+func checkPartition(model Model, history []Operation) bool {
+	equal := model.Equal
+	if equal == nil {
+		equal = func(a, b interface{}) bool {
+			return a == b
+		}
+	}
+	head := makeEntries(history)
+	linearized := newBitset(len(history))
+	cache := make(map[uint64][]linearizedState)
+	calls := make([]callFrame, 0, len(history))
+	state := model.Init()
+
+	seen := func(s linearizedState) bool {
+		for _, cached := range cache[s.linearized.hash()] {
+			if cached.linearized.equals(s.linearized) && equal(cached.state, s.state) {
+				return true
+			}
+		}
+		return false
+	}
+
+	entry := head.next
+	for head.next != nil {
+		if entry.isCall {
+			ok, newState := model.Step(state, entry.value, entry.match.value)
+			if ok {
+				newLinearized := linearized.clone()
+				newLinearized.set(entry.id)
+				candidate := linearizedState{linearized: newLinearized, state: newState}
+				if !seen(candidate) {
+					hash := newLinearized.hash()
+					cache[hash] = append(cache[hash], candidate)
+					calls = append(calls, callFrame{entry: entry, state: state})
+					state = newState
+					linearized.set(entry.id)
+					entry.lift()
+					entry = head.next
+					continue
+				}
+			}
+			entry = entry.next
+			continue
+		}
+		// 遇到了一个还没有线性化的操作的返回事件，说明当前的选择走不通，需要回溯
+		if len(calls) == 0 {
+			return false
+		}
+		top := calls[len(calls)-1]
+		calls = calls[:len(calls)-1]
+		entry = top.entry
+		state = top.state
+		linearized.clear(entry.id)
+		entry.unlift()
+		entry = entry.next
+	}
+	return true
+}
+
+//KvOpType KV 寄存器模型的操作类型
+type KvOpType int8
+
+const (
+	KvGet KvOpType = iota
+	KvPut
+)
+
+//KvInput KV 寄存器模型的操作，Get 时 Value 为空
+type KvInput struct {
+	Op    KvOpType
+	Key   string
+	Value string
+}
+
+//KvOutput Get 读到的值，Put 的输出为空
+type KvOutput struct {
+	Value string
+}
+
+//KvModel 每个 key 都是一个独立的寄存器，Get 必须读到最近一次生效的 Put 写入的值，没有写入过时为空字符串
+var KvModel = Model{
+	Partition: func(history []Operation) [][]Operation {
+		byKey := make(map[string][]Operation)
+		keys := make([]string, 0)
+		for _, op := range history {
+			key := op.Input.(KvInput).Key
+			if _, exist := byKey[key]; !exist {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], op)
+		}
+		sort.Strings(keys)
+		partitions := make([][]Operation, 0, len(keys))
+		for _, key := range keys {
+			partitions = append(partitions, byKey[key])
+		}
+		return partitions
+	},
+	Init: func() interface{} {
+		return ""
+	},
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		in := input.(KvInput)
+		if in.Op == KvPut {
+			return true, in.Value
+		}
+		out, ok := output.(KvOutput)
+		return ok && out.Value == state.(string), state
+	},
+	DescribeOperation: func(input, output interface{}) string {
+		in := input.(KvInput)
+		if in.Op == KvPut {
+			return fmt.Sprintf("put(%s, %s)", in.Key, in.Value)
+		}
+		out, _ := output.(KvOutput)
+		return fmt.Sprintf("get(%s) -> %s", in.Key, out.Value)
+	},
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"math"
+	"testing"
+)
+
+func put(client int, key, value string, call, ret int64) Operation {
+	return Operation{ClientID: client, Input: KvInput{Op: KvPut, Key: key, Value: value}, Call: call, Return: ret}
+}
+
+func get(client int, key, value string, call, ret int64) Operation {
+	return Operation{ClientID: client, Input: KvInput{Op: KvGet, Key: key}, Output: KvOutput{Value: value},
+		Call: call, Return: ret}
+}
+
+func TestCheckKvOperations(t *testing.T) {
+	cases := []struct {
+		name         string
+		history      []Operation
+		linearizable bool
+	}{
+		{
+			name:         "sequential",
+			history:      []Operation{put(0, "x", "1", 0, 10), get(1, "x", "1", 20, 30), get(1, "y", "", 40, 50)},
+			linearizable: true,
+		},
+		{
+			name:         "stale read after put returns",
+			history:      []Operation{put(0, "x", "1", 0, 10), get(1, "x", "", 20, 30)},
+			linearizable: false,
+		},
+		{
+			name: "concurrent read may see either value",
+			history: []Operation{put(0, "x", "1", 0, 10), put(1, "x", "2", 5, 50), get(2, "x", "1", 20, 30),
+				get(2, "x", "2", 40, 60)},
+			linearizable: true,
+		},
+		{
+			name: "value goes back in time",
+			history: []Operation{put(0, "x", "1", 0, 10), put(1, "x", "2", 5, 50), get(2, "x", "2", 20, 30),
+				get(2, "x", "1", 40, 60)},
+			linearizable: false,
+		},
+		{
+			name: "put with unknown outcome",
+			history: []Operation{put(0, "x", "1", 0, 10), put(1, "x", "2", 15, math.MaxInt64),
+				get(2, "x", "1", 20, 30), get(2, "x", "2", 40, 60)},
+			linearizable: true,
+		},
+		{
+			name: "keys are checked independently",
+			history: []Operation{put(0, "x", "1", 0, 10), put(0, "y", "1", 20, 30), get(1, "y", "1", 40, 50),
+				get(1, "x", "", 60, 70)},
+			linearizable: false,
+		},
+	}
+	for _, c := range cases {
+		if result := CheckOperations(KvModel, c.history); result != c.linearizable {
+			t.Fatalf("%s : linearizable=%v, expect %v\n%v", c.name, result, c.linearizable,
+				DescribeOperations(KvModel, c.history))
+		}
+	}
+}
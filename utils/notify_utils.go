@@ -5,113 +5,119 @@
 package utils
 
 import (
-	"context"
 	"errors"
 	"fmt"
-	"math"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
 var (
 	ErrorEventNotRegister = errors.New("the event was not registered")
 	ErrorEventRegister    = errors.New("register event publisher failed")
 	ErrorAddSubscriber    = errors.New("add subscriber failed")
-	publisherCenter       *PublisherCenter
-	publisherOnce         sync.Once
+	ErrorPublisherClosed  = errors.New("the event publisher was closed")
 
 	defaultFastRingBufferSize = GetInt64FromEnvOptional("github.com/pole-group/lraft.notify.fast-event-buffer.size", 16384)
 )
 
-type PublisherCenter struct {
-	Publishers    sync.Map
-	hasSubscriber bool
-	// just for test
-	onExpire func(event Event)
+//EventBus 类似 disruptor 的事件总线，由使用者（一般是一个 raft 节点）独占，不同实例之间的事件互不可见。每个 topic
+//对应一个 Publisher，每个订阅者拥有自己的有界环形队列以及处理协程：同一个订阅者按照发布的顺序处理事件，
+//某一个订阅者处理得慢只会让发布者阻塞，不会影响其他订阅者的处理顺序
+type EventBus struct {
+	lock       sync.RWMutex
+	publishers map[string]*Publisher
+	isShutdown bool
+	// 所有订阅者的处理协程，Shutdown 时等待它们处理完队列中剩余的事件
+	subscriberWait sync.WaitGroup
 }
 
-func InitPublisherCenter() {
-	publisherOnce.Do(func() {
-		publisherCenter = &PublisherCenter{
-			Publishers:    sync.Map{},
-			hasSubscriber: false,
-		}
-	})
+func NewEventBus() *EventBus {
+	return &EventBus{
+		publishers: make(map[string]*Publisher),
+	}
 }
 
-func RegisterPublisherDefault(ctx context.Context, event Event) error {
-	return RegisterPublisher(ctx, event, defaultFastRingBufferSize)
+func (eb *EventBus) RegisterPublisherDefault(event Event) error {
+	return eb.RegisterPublisher(event, defaultFastRingBufferSize)
 }
 
-func RegisterPublisher(ctx context.Context, event Event, ringBufferSize int64) error {
+//RegisterPublisher 为 event 的 topic 创建 Publisher，ringBufferSize 是每一个订阅者的队列长度，重复注册时保留之前的 Publisher
+func (eb *EventBus) RegisterPublisher(event Event, ringBufferSize int64) error {
 	if ringBufferSize <= 32 {
 		ringBufferSize = 128
 	}
 	topic := event.Name()
-
-	publisherCenter.Publishers.LoadOrStore(topic, &Publisher{
-		queue:        make(chan eventHolder, ringBufferSize),
-		topic:        topic,
-		subscribers:  &sync.Map{},
-		lastSequence: -1,
-		ctx:          ctx,
-	})
-
-	p, ok := publisherCenter.Publishers.Load(topic)
-
-	if ok {
-		publisher := p.(*Publisher)
-		publisher.start()
-
-		return nil
+	defer eb.lock.Unlock()
+	eb.lock.Lock()
+	if eb.isShutdown {
+		return ErrorEventRegister
+	}
+	if _, exist := eb.publishers[topic]; !exist {
+		eb.publishers[topic] = &Publisher{
+			topic:          topic,
+			ringBufferSize: ringBufferSize,
+			subscriberWait: &eb.subscriberWait,
+		}
 	}
-	return ErrorEventRegister
+	return nil
+}
 
+func (eb *EventBus) findPublisher(topic string) (*Publisher, bool) {
+	defer eb.lock.RUnlock()
+	eb.lock.RLock()
+	p, exist := eb.publishers[topic]
+	return p, exist
 }
 
-func PublishEvent(event ...Event) error {
-	if p, ok := publisherCenter.Publishers.Load(event[0].Name()); ok {
-		p.(*Publisher).PublishEvent(event...)
-		return nil
+//PublishEvent 发布一批相同 topic 的事件，订阅者的队列已满时阻塞等待，EventBus 已经关闭时返回 ErrorPublisherClosed
+func (eb *EventBus) PublishEvent(events ...Event) error {
+	if p, ok := eb.findPublisher(events[0].Name()); ok {
+		return p.PublishEvent(events...)
 	}
 	return ErrorEventNotRegister
 }
 
-func PublishEventNonBlock(event ...Event) (bool, error) {
-	if p, ok := publisherCenter.Publishers.Load(event[0].Name()); ok {
-		return p.(*Publisher).PublishEventNonBlock(event...), nil
+//PublishEventNonBlock 任何一个订阅者的队列放不下这一批事件时直接返回 false，这一批事件不会投递给任何订阅者
+func (eb *EventBus) PublishEventNonBlock(events ...Event) (bool, error) {
+	if p, ok := eb.findPublisher(events[0].Name()); ok {
+		return p.PublishEventNonBlock(events...)
 	}
 	return false, ErrorEventNotRegister
 }
 
-func RegisterSubscriber(s Subscriber) error {
+func (eb *EventBus) RegisterSubscriber(s Subscriber) error {
 	topic := s.SubscribeType()
-	if v, ok := publisherCenter.Publishers.Load(topic.Name()); ok {
-		p := v.(*Publisher)
-		(*p).AddSubscriber(s)
+	if p, ok := eb.findPublisher(topic.Name()); ok {
+		if !p.AddSubscriber(s) {
+			return ErrorAddSubscriber
+		}
 		return nil
 	}
-	return fmt.Errorf("this topic [%s] no publisher", topic)
+	return fmt.Errorf("this topic [%s] no publisher", topic.Name())
 }
 
-func DeregisterSubscriber(s Subscriber) {
+//DeregisterSubscriber 订阅者不再接收新的事件，已经在队列中的事件仍然会被处理，可以在订阅者自己的 OnEvent 中调用
+func (eb *EventBus) DeregisterSubscriber(s Subscriber) {
 	topic := s.SubscribeType()
-	if v, ok := publisherCenter.Publishers.Load(topic); ok {
-		p := v.(*Publisher)
-		(*p).RemoveSubscriber(s)
+	if p, ok := eb.findPublisher(topic.Name()); ok {
+		p.RemoveSubscriber(s)
 	}
 }
 
-func Shutdown() {
-	publisherCenter.Publishers.Range(func(key, value interface{}) bool {
-		p := key.(*Publisher)
-		(*p).shutdown()
-		return true
-	})
-}
-
-func TestRegisterOnExpire(f func(event Event)) {
-	publisherCenter.onExpire = f
+//Shutdown 关闭所有的 Publisher，等待每一个订阅者处理完队列中剩余的事件之后返回，不能在订阅者的 OnEvent 中调用
+func (eb *EventBus) Shutdown() {
+	eb.lock.Lock()
+	if eb.isShutdown {
+		eb.lock.Unlock()
+		eb.subscriberWait.Wait()
+		return
+	}
+	eb.isShutdown = true
+	for _, p := range eb.publishers {
+		p.shutdown()
+	}
+	eb.lock.Unlock()
+	eb.subscriberWait.Wait()
 }
 
 // Event interface
@@ -122,10 +128,6 @@ type Event interface {
 	Sequence() int64
 }
 
-type eventHolder struct {
-	events []Event
-}
-
 type Subscriber interface {
 	OnEvent(event Event, endOfBatch bool)
 
@@ -135,118 +137,147 @@ type Subscriber interface {
 }
 
 type Publisher struct {
-	queue        chan eventHolder
-	topic        string
-	subscribers  *sync.Map
-	init         sync.Once
-	canOpen      bool
-	isClosed     bool
-	lastSequence int64
-	ctx          context.Context
+	// 发布事件时持有锁，保证所有订阅者看到的事件顺序一致
+	publishLock    sync.Mutex
+	topic          string
+	ringBufferSize int64
+	subscribers    sync.Map // <Subscriber, *subscriberRing>
+	isClosed       int32
+	subscriberWait *sync.WaitGroup
 }
 
-func (p *Publisher) start() {
-	p.init.Do(func() {
-		go p.openHandler()
+//PublishEvent 关闭之后事件不会投递给任何订阅者，需要返回错误让调用方自己处理这一批事件
+func (p *Publisher) PublishEvent(events ...Event) error {
+	defer p.publishLock.Unlock()
+	p.publishLock.Lock()
+	if atomic.LoadInt32(&p.isClosed) == 1 {
+		return ErrorPublisherClosed
+	}
+	p.subscribers.Range(func(key, value interface{}) bool {
+		value.(*subscriberRing).offer(events)
+		return true
 	})
+	return nil
 }
 
-func (p *Publisher) PublishEvent(event ...Event) {
-	if !p.isClosed {
-		return
+func (p *Publisher) PublishEventNonBlock(events ...Event) (bool, error) {
+	defer p.publishLock.Unlock()
+	p.publishLock.Lock()
+	if atomic.LoadInt32(&p.isClosed) == 1 {
+		return false, ErrorPublisherClosed
 	}
-	p.queue <- eventHolder{
-		events: event,
+	// 只有持有锁的发布者会向队列中写入，检查完剩余容量之后的写入一定不会阻塞
+	hasCapacity := true
+	p.subscribers.Range(func(key, value interface{}) bool {
+		ring := value.(*subscriberRing)
+		hasCapacity = cap(ring.queue)-len(ring.queue) >= len(events)
+		return hasCapacity
+	})
+	if !hasCapacity {
+		return false, nil
 	}
+	p.subscribers.Range(func(key, value interface{}) bool {
+		value.(*subscriberRing).offer(events)
+		return true
+	})
+	return true, nil
 }
 
-func (p *Publisher) PublishEventNonBlock(events ...Event) bool {
-	if !p.isClosed {
+func (p *Publisher) AddSubscriber(s Subscriber) bool {
+	if atomic.LoadInt32(&p.isClosed) == 1 {
 		return false
 	}
-	select {
-	case p.queue <- eventHolder{
-		events: events,
-	}:
+	ring := &subscriberRing{
+		subscriber:   s,
+		queue:        make(chan Event, p.ringBufferSize),
+		done:         make(chan struct{}),
+		lastSequence: -1,
+	}
+	if _, exist := p.subscribers.LoadOrStore(s, ring); exist {
 		return true
-	default:
+	}
+	p.subscriberWait.Add(1)
+	go ring.run(p.subscriberWait)
+	// shutdown 遍历订阅者时可能还没有看到刚加入的订阅者，这里需要自己停止
+	if atomic.LoadInt32(&p.isClosed) == 1 {
+		p.RemoveSubscriber(s)
 		return false
 	}
+	return true
 }
 
-func (p *Publisher) AddSubscriber(s Subscriber) {
-	p.subscribers.Store(s, member)
-	p.canOpen = true
-}
-
+//RemoveSubscriber 不需要获取 publishLock，发布者因为该订阅者的队列已满而阻塞时，订阅者在 OnEvent 中取消订阅也不会死锁
 func (p *Publisher) RemoveSubscriber(s Subscriber) {
-	p.subscribers.Delete(s)
+	if v, exist := p.subscribers.Load(s); exist {
+		p.subscribers.Delete(s)
+		v.(*subscriberRing).stop()
+	}
 }
 
 func (p *Publisher) shutdown() {
-	if p.isClosed {
+	if !atomic.CompareAndSwapInt32(&p.isClosed, 0, 1) {
 		return
 	}
-	p.isClosed = true
-	close(p.queue)
-	p.subscribers = nil
+	p.subscribers.Range(func(key, value interface{}) bool {
+		p.RemoveSubscriber(key.(Subscriber))
+		return true
+	})
 }
 
-func (p *Publisher) openHandler() {
-
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Printf("dispose fast event has error : %s\n", err)
-		}
-	}()
+//subscriberRing 一个订阅者独占的有界队列
+type subscriberRing struct {
+	subscriber   Subscriber
+	queue        chan Event
+	done         chan struct{}
+	stopOnce     sync.Once
+	lastSequence int64
+}
 
-	for {
-		if p.canOpen {
-			break
+func (sr *subscriberRing) offer(events []Event) {
+	for _, e := range events {
+		select {
+		case sr.queue <- e:
+		case <-sr.done:
+			return
 		}
-		time.Sleep(time.Duration(100) * time.Millisecond)
 	}
+}
 
+func (sr *subscriberRing) stop() {
+	sr.stopOnce.Do(func() {
+		close(sr.done)
+	})
+}
+
+func (sr *subscriberRing) run(wait *sync.WaitGroup) {
+	defer wait.Done()
 	for {
 		select {
-		case e := <-p.queue:
-			fmt.Printf("handler receive fast event : %s\n", e)
-			p.notifySubscriber(e)
-		case <-p.ctx.Done():
-			p.shutdown()
+		case e := <-sr.queue:
+			// 和 disruptor 的语义保持一致，只有当队列中暂时没有更多的事件时才认为是一个批次的结束
+			sr.notify(e, len(sr.queue) == 0)
+		case <-sr.done:
+			// 取消订阅之前已经进入队列的事件仍然需要处理
+			for len(sr.queue) > 0 {
+				sr.notify(<-sr.queue, len(sr.queue) == 0)
+			}
 			return
 		}
 	}
 }
 
-func (p *Publisher) notifySubscriber(events eventHolder) {
-	currentSequence := p.lastSequence
-	es := events.events
-	s := len(es) - 1
-	for i, e := range es {
-		currentSequence = e.Sequence()
-		p.subscribers.Range(func(key, value interface{}) bool {
-
-			defer func() {
-				if err := recover(); err != nil {
-					fmt.Printf("notify subscriber has error : %s \n", err)
-				}
-			}()
-
-			subscriber := key.(Subscriber)
-
-			if subscriber.IgnoreExpireEvent() && currentSequence < p.lastSequence {
-				// just for test
-				if publisherCenter.onExpire != nil {
-					publisherCenter.onExpire(e)
-				}
-				return true
-			}
-
-			subscriber.OnEvent(e, i == s)
-			return true
-		})
+func (sr *subscriberRing) notify(e Event, endOfBatch bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			RaftLog.Error("notify subscriber has error : %s", err)
+		}
+	}()
+	sequence := e.Sequence()
+	if sr.subscriber.IgnoreExpireEvent() && sequence < sr.lastSequence {
+		return
 	}
-
-	p.lastSequence = int64(math.Max(float64(currentSequence), float64(p.lastSequence)))
+	if sequence > sr.lastSequence {
+		sr.lastSequence = sequence
+	}
+	sr.subscriber.OnEvent(e, endOfBatch)
 }
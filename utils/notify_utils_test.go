@@ -0,0 +1,182 @@
+// Copyright (c) 2020, pole-group. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	seq int64
+}
+
+func (e *testEvent) Name() string {
+	return "testEvent"
+}
+
+func (e *testEvent) Sequence() int64 {
+	return e.seq
+}
+
+//recordSubscriber 记录收到的事件，block 不为空时每处理一个事件之前都会先通知 entered 再等待 block
+type recordSubscriber struct {
+	lock     sync.Mutex
+	received []int64
+	batches  int
+	entered  chan struct{}
+	block    chan struct{}
+	onEvent  func(e Event)
+}
+
+func (s *recordSubscriber) OnEvent(event Event, endOfBatch bool) {
+	if s.block != nil {
+		select {
+		case s.entered <- struct{}{}:
+		default:
+		}
+		<-s.block
+	}
+	if s.onEvent != nil {
+		s.onEvent(event)
+	}
+	defer s.lock.Unlock()
+	s.lock.Lock()
+	s.received = append(s.received, event.Sequence())
+	if endOfBatch {
+		s.batches++
+	}
+}
+
+func (s *recordSubscriber) IgnoreExpireEvent() bool {
+	return false
+}
+
+func (s *recordSubscriber) SubscribeType() Event {
+	return &testEvent{}
+}
+
+func (s *recordSubscriber) events() []int64 {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+	return append([]int64(nil), s.received...)
+}
+
+func newTestEventBus(t *testing.T, ringBufferSize int64, subscribers ...Subscriber) *EventBus {
+	bus := NewEventBus()
+	if err := bus.RegisterPublisher(&testEvent{}, ringBufferSize); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range subscribers {
+		if err := bus.RegisterSubscriber(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bus
+}
+
+func TestEventBusIsolation(t *testing.T) {
+	a, b := &recordSubscriber{}, &recordSubscriber{}
+	busA, busB := newTestEventBus(t, 128, a), newTestEventBus(t, 128, b)
+	for i := int64(0); i < 10; i++ {
+		if err := busA.PublishEvent(&testEvent{seq: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	busB.PublishEvent(&testEvent{seq: 100})
+	busA.Shutdown()
+	busB.Shutdown()
+	if !reflect.DeepEqual(a.events(), []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) || !reflect.DeepEqual(b.events(), []int64{100}) {
+		t.Fatalf("events leak between buses, a=%v, b=%v", a.events(), b.events())
+	}
+	if _, err := NewEventBus().PublishEventNonBlock(&testEvent{}); err != ErrorEventNotRegister {
+		t.Fatalf("publish to a topic without publisher : %v", err)
+	}
+}
+
+func TestEventBusOrderingAndShutdown(t *testing.T) {
+	fast, slow := &recordSubscriber{}, &recordSubscriber{onEvent: func(e Event) {
+		if e.Sequence()%100 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}}
+	bus := newTestEventBus(t, 64, fast, slow)
+
+	const publishers, perPublisher = 4, 250
+	wg := sync.WaitGroup{}
+	for p := 0; p < publishers; p++ {
+		p := p
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perPublisher; i++ {
+				bus.PublishEvent(&testEvent{seq: int64(p*perPublisher + i)})
+			}
+		}()
+	}
+	wg.Wait()
+	// Shutdown 返回时队列中剩余的事件已经全部处理完
+	bus.Shutdown()
+	if len(fast.events()) != publishers*perPublisher {
+		t.Fatalf("received %d events, expect %d", len(fast.events()), publishers*perPublisher)
+	}
+	if !reflect.DeepEqual(fast.events(), slow.events()) {
+		t.Fatal("subscribers observe different orders")
+	}
+	if fast.batches == 0 {
+		t.Fatal("endOfBatch is never set")
+	}
+
+	if err := bus.PublishEvent(&testEvent{seq: -1}); err != ErrorPublisherClosed {
+		t.Fatalf("publish after shutdown : %v", err)
+	}
+	if ok, err := bus.PublishEventNonBlock(&testEvent{seq: -1}); ok || err != ErrorPublisherClosed {
+		t.Fatalf("publish after shutdown : %v %v", ok, err)
+	}
+	if err := bus.RegisterSubscriber(&recordSubscriber{}); err == nil {
+		t.Fatal("subscribe after shutdown")
+	}
+}
+
+func TestEventBusBoundedRing(t *testing.T) {
+	blocked := &recordSubscriber{entered: make(chan struct{}, 1), block: make(chan struct{})}
+	bus := newTestEventBus(t, 64, blocked)
+
+	// 订阅者正在处理第一个事件，队列中最多再放 64 个事件
+	bus.PublishEvent(&testEvent{seq: 0})
+	<-blocked.entered
+	for i := int64(1); i <= 64; i++ {
+		if ok, err := bus.PublishEventNonBlock(&testEvent{seq: i}); !ok || err != nil {
+			t.Fatalf("publish %d : %v %v", i, ok, err)
+		}
+	}
+	if ok, _ := bus.PublishEventNonBlock(&testEvent{seq: 65}); ok {
+		t.Fatal("ring is full, publish should fail")
+	}
+
+	// 发布者阻塞在已满的队列上时，订阅者在 OnEvent 中取消订阅不会死锁
+	blocked.onEvent = func(e Event) {
+		if e.Sequence() == 0 {
+			bus.DeregisterSubscriber(blocked)
+		}
+	}
+	published := make(chan struct{})
+	go func() {
+		bus.PublishEvent(&testEvent{seq: 65})
+		close(published)
+	}()
+	close(blocked.block)
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher is blocked after the subscriber is removed")
+	}
+	bus.Shutdown()
+	if events := blocked.events(); len(events) < 65 || events[64] != 64 {
+		t.Fatalf("events in the ring before deregister must be handled, received %d", len(events))
+	}
+}
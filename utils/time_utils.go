@@ -17,7 +17,7 @@ var currentTimeNs int64
 
 func init() {
 	polerpc.DoTickerSchedule(context.Background(), func() {
-		atomic.StoreInt64(&currentTimeMs, time.Now().Unix() * 1000)
+		atomic.StoreInt64(&currentTimeMs, time.Now().UnixNano()/int64(time.Millisecond))
 		atomic.StoreInt64(&currentTimeNs, time.Now().UnixNano())
 	}, time.Duration(100)*time.Millisecond)
 }